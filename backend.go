@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Backend stores backup files. Names are relative to the configured
+// destination.
+type Backend interface {
+	// Check verifies the destination is reachable, creating it if needed.
+	Check(ctx context.Context) error
+	// Write stores r under name and returns the checksum of the stored bytes
+	// using the configured algorithm, or "" when verify_mode local leaves
+	// hashing to the caller.
+	Write(ctx context.Context, name string, r io.Reader) (checksum string, err error)
+	Exists(ctx context.Context, name string) (bool, error)
+	// List returns the names of all files starting with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+	Remove(ctx context.Context, names ...string) error
+	Rename(ctx context.Context, tmp, final string) error
+	// Describe renders an operation for dry-run output.
+	Describe(op string, names ...string) string
+}
+
+// remote returns the backend selected by the config, defaulting to ssh.
+func (cfg *Config) remote() Backend {
+	if cfg.backend == nil {
+		if cfg.Backend == "command" {
+			cfg.backend = &commandBackend{cfg: cfg}
+		} else {
+			cfg.backend = &sshBackend{cfg: cfg}
+		}
+	}
+	return cfg.backend
+}
+
+// sshBackend runs shell commands against remote_dest on remote_host, or
+// locally when no host is configured.
+type sshBackend struct {
+	cfg *Config
+}
+
+func (b *sshBackend) path(name string) string {
+	return shellEscape(filepath.Join(b.cfg.RemoteDest, name))
+}
+
+func (b *sshBackend) command(op string, names ...string) string {
+	switch op {
+	case "check":
+		dest := shellEscape(b.cfg.RemoteDest)
+		if b.cfg.RemoteDirMode != 0 {
+			// -m only applies to remote_dest itself, not parents it creates.
+			return fmt.Sprintf("test -d %s || mkdir -p -m %s %s", dest, b.cfg.RemoteDirMode, dest)
+		}
+		return fmt.Sprintf("test -d %s || mkdir -p %s", dest, dest)
+	case "write":
+		if b.cfg.verifyMode() == "local" {
+			return fmt.Sprintf("cat > %s", b.path(names[0]))
+		}
+		// Use tee to write file and compute checksum in parallel during transfer
+		return fmt.Sprintf("tee %s | %s", b.path(names[0]), b.cfg.checksum().command)
+	case "exists":
+		return fmt.Sprintf("if test -f %s; then echo exists; else echo missing; fi", b.path(names[0]))
+	case "list":
+		return fmt.Sprintf("cd %s && ls -1", shellEscape(b.cfg.RemoteDest))
+	case "remove":
+		var paths []string
+		for _, name := range names {
+			paths = append(paths, b.path(name))
+		}
+		return fmt.Sprintf("rm -f %s", strings.Join(paths, " "))
+	case "rename":
+		return fmt.Sprintf("mv %s %s", b.path(names[0]), b.path(names[1]))
+	}
+	panic("unknown backend operation: " + op)
+}
+
+func (b *sshBackend) Describe(op string, names ...string) string {
+	return describeRemoteCommand(b.cfg, b.command(op, names...))
+}
+
+func (b *sshBackend) Check(ctx context.Context) error {
+	cfg := b.cfg
+	err := runRemoteOp(ctx, cfg, b.command("check"), func(cmd *exec.Cmd) error {
+		return cmd.Run()
+	})
+	if err != nil {
+		if cfg.RemoteHost == "" {
+			return fmt.Errorf("failed to access local destination %s: %w (check the path and permissions)", cfg.RemoteDest, err)
+		}
+		return fmt.Errorf("failed to access remote host %s: %w (check SSH connectivity and permissions)", cfg.RemoteHost, err)
+	}
+
+	if verbose {
+		if cfg.RemoteHost == "" {
+			fmt.Printf("→ Local destination %s is accessible\n", cfg.RemoteDest)
+		} else {
+			fmt.Printf("→ Remote host %s is accessible\n", cfg.RemoteHost)
+		}
+	}
+
+	return nil
+}
+
+func (b *sshBackend) Write(ctx context.Context, name string, r io.Reader) (string, error) {
+	cmd := remoteCommand(ctx, b.cfg, b.command("write", name))
+	cmd.Stdin = r
+	cmd.Stderr = os.Stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("ssh start failed: %w", err)
+	}
+
+	output, err := io.ReadAll(stdout)
+	if err != nil {
+		_ = cmd.Wait()
+		return "", fmt.Errorf("failed to read remote checksum: %w", err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return "", fmt.Errorf("ssh failed: %w", err)
+	}
+	if b.cfg.verifyMode() == "local" {
+		return "", nil
+	}
+
+	fields := strings.Fields(strings.TrimSpace(string(output)))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("unable to parse remote checksum output: %q", string(output))
+	}
+
+	return fields[0], nil
+}
+
+func (b *sshBackend) Exists(ctx context.Context, name string) (bool, error) {
+	var output []byte
+	err := runRemoteOp(ctx, b.cfg, b.command("exists", name), func(cmd *exec.Cmd) (err error) {
+		output, err = cmd.Output()
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(output)) == "exists", nil
+}
+
+func (b *sshBackend) List(ctx context.Context, prefix string) ([]string, error) {
+	var output []byte
+	err := runRemoteOp(ctx, b.cfg, b.command("list"), func(cmd *exec.Cmd) (err error) {
+		output, err = cmd.Output()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && strings.HasPrefix(line, prefix) {
+			names = append(names, line)
+		}
+	}
+
+	return names, nil
+}
+
+func (b *sshBackend) Remove(ctx context.Context, names ...string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	return runRemoteOp(ctx, b.cfg, b.command("remove", names...), func(cmd *exec.Cmd) error {
+		return cmd.Run()
+	})
+}
+
+func (b *sshBackend) Rename(ctx context.Context, tmp, final string) error {
+	return runRemoteOp(ctx, b.cfg, b.command("rename", tmp, final), func(cmd *exec.Cmd) error {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	})
+}
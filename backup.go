@@ -0,0 +1,628 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// errSkipped marks volumes not started because -fail-fast stopped the run.
+var errSkipped = errors.New("skipped after an earlier failure")
+
+// runBackups backs up every volume using up to cfg.Parallelism workers and
+// returns the outcome of each, in the order of cfg.Volumes.
+func runBackups(ctx context.Context, cfg *Config, currentTime time.Time) []volumeResult {
+	results := make([]volumeResult, len(cfg.Volumes))
+
+	// Resolve the backend up front so workers don't race to initialise it.
+	cfg.remote()
+
+	var mu sync.Mutex
+	done := 0
+	halted := false
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range cfg.Parallelism {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				vol := &cfg.Volumes[i]
+				// Once interrupted, the remaining volumes aren't started.
+				if err := ctx.Err(); err != nil {
+					results[i] = volumeResult{name: vol.Name, err: err, finished: time.Now()}
+					continue
+				}
+
+				mu.Lock()
+				skip := halted
+				if !skip {
+					sdStatus(fmt.Sprintf("Processing volume %s (%d/%d done, %d%%)", vol.Name, done, len(cfg.Volumes), done*100/len(cfg.Volumes)))
+				}
+				mu.Unlock()
+				// With -fail-fast nothing new starts after a failure.
+				if skip {
+					results[i] = volumeResult{name: vol.Name, err: errSkipped, finished: time.Now()}
+					continue
+				}
+
+				start := time.Now()
+				res, err := backupVolume(ctx, cfg, vol, currentTime)
+				if err != nil {
+					errLog.Printf("Error backing up %s: %v", vol.Name, err)
+					notifyFailure(cfg, vol.Name, "backup", err)
+				}
+				res.name, res.err = vol.Name, err
+				res.duration, res.finished = time.Since(start), time.Now()
+				results[i] = res
+
+				mu.Lock()
+				done++
+				if err != nil && failFast {
+					halted = true
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := range cfg.Volumes {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if cfg.MetricsFile != "" {
+		if err := writeMetrics(cfg.MetricsFile, results); err != nil {
+			errLog.Printf("Error writing metrics: %v", err)
+		}
+	}
+
+	if names := failedVolumes(results); len(names) > 0 {
+		sdStatus(fmt.Sprintf("Backup failed for: %s", strings.Join(names, ", ")))
+	} else {
+		sdStatus(fmt.Sprintf("Backed up %d volume(s)", len(cfg.Volumes)))
+	}
+
+	return results
+}
+
+// failedVolumes returns the names of the volumes in results that failed.
+func failedVolumes(results []volumeResult) []string {
+	var names []string
+	for _, r := range results {
+		if r.err != nil {
+			names = append(names, r.name)
+		}
+	}
+	return names
+}
+
+// failureExitCode picks the exit code for a run in which some volumes failed:
+// exitPartial if any others were backed up, exitFailed if none were.
+func failureExitCode(results []volumeResult) int {
+	for _, r := range results {
+		if r.err == nil {
+			return exitPartial
+		}
+	}
+	return exitFailed
+}
+
+// printReport prints a table of what each volume did in the run, with
+// totals, when there is more than one volume.
+func printReport(results []volumeResult) {
+	if quiet || len(results) < 2 {
+		return
+	}
+
+	var sent int64
+	var took time.Duration
+	counts := map[string]int{}
+	var statuses []string
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VOLUME\tKIND\tSENT\tDURATION\tCHECKSUM\tSTATUS")
+	for _, r := range results {
+		status := r.status()
+		word, _, _ := strings.Cut(status, " ")
+		if counts[word] == 0 {
+			statuses = append(statuses, word)
+		}
+		counts[word]++
+		sent += r.bytesSent
+		took += r.duration
+
+		kind, checksum := r.kind, r.checksum
+		if kind == "" {
+			kind = "-"
+		}
+		if checksum == "" {
+			checksum = "-"
+		} else if len(checksum) > 12 {
+			checksum = checksum[:12]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.name, kind, formatBytes(r.bytesSent), formatDuration(r.duration), checksum, status)
+	}
+
+	var summary []string
+	for _, word := range statuses {
+		summary = append(summary, fmt.Sprintf("%d %s", counts[word], word))
+	}
+	fmt.Fprintf(w, "TOTAL\t\t%s\t%s\t\t%s\n", formatBytes(sent), formatDuration(took), strings.Join(summary, ", "))
+	w.Flush()
+}
+
+func backupVolume(ctx context.Context, cfg *Config, vol *Volume, currentTime time.Time) (res volumeResult, err error) {
+	cfg = cfg.forVolume(vol)
+	// Names below are written in the configured timezone.
+	currentTime = currentTime.In(snapshotLocation)
+
+	if verbose {
+		fmt.Printf(color.YellowString("Processing volume: %s (src: %s, snapdir: %s)\n"), vol.Name, vol.Src, vol.SnapDir)
+	}
+
+	oldSnap, dupErr := latestSnapshot(vol.SnapDir, cfg.snapshotPrefix())
+	if dupErr != nil {
+		if strictSnaps {
+			return res, failedAt("snapshot", fmt.Errorf("%w in %s", dupErr, vol.SnapDir))
+		}
+		if !quiet {
+			fmt.Println(color.YellowString("⚠️ %v in %s; the wrong one may be used as a parent", dupErr, vol.SnapDir))
+		}
+	}
+
+	if oldSnap != "" && verbose {
+		fmt.Printf("→ Found previous snapshot: %s\n", oldSnap)
+	}
+
+	// With retry_from_snapshot a snapshot whose send failed is sent again
+	// rather than replaced. It keeps its name, so needsFullBackup decides the
+	// same kind against the same parent.
+	retrying := cfg.RetryFromSnapshot && !snapshotOnly && oldSnap != "" && failedSend(vol.SnapDir) == filepath.Base(oldSnap)
+	if retrying && verbose {
+		fmt.Printf("→ Sending %s again after it failed last run\n", filepath.Base(oldSnap))
+	}
+	reuseSnap := sendOnly || retrying
+
+	// min_interval paces snapshots, which a send-only or retrying run
+	// doesn't take.
+	if vol.MinInterval > 0 && oldSnap != "" && !force && !reuseSnap {
+		if ts, err := extractSnapshotTimestamp(oldSnap); err == nil && currentTime.Sub(ts) < vol.MinInterval {
+			if verbose {
+				fmt.Printf("→ Skipping %s: last snapshot is %s old, min_interval is %s\n", vol.Name, currentTime.Sub(ts).Round(time.Second), vol.MinInterval)
+			}
+			return res, nil
+		}
+	}
+
+	// post_backup runs whatever happens, even after a failed pre_backup, so
+	// anything it locked is released. The run's context may be cancelled.
+	defer func() {
+		status := "success"
+		if err != nil {
+			status = "failure"
+		}
+		if hookErr := runHooks(context.Background(), "post_backup", vol.PostBackup, vol, status); hookErr != nil {
+			if err == nil {
+				err = failedAt("post_backup", hookErr)
+			} else {
+				errLog.Printf("Error running post_backup for %s: %v", vol.Name, hookErr)
+			}
+		}
+	}()
+	if err := runHooks(ctx, "pre_backup", vol.PreBackup, vol, ""); err != nil {
+		return res, failedAt("pre_backup", err)
+	}
+
+	if !reuseSnap {
+		if next := nextSnapshotTime(oldSnap, currentTime); !next.Equal(currentTime) {
+			if verbose {
+				fmt.Printf("→ Naming the new snapshot %s to follow %s\n", next.Format(snapshotTimestampFormat), filepath.Base(oldSnap))
+			}
+			currentTime = next
+		}
+	}
+
+	if snapshotOnly {
+		res.kind = "snapshot"
+		return res, snapshotVolume(ctx, cfg, vol, currentTime)
+	}
+
+	if reuseSnap {
+		if oldSnap == "" {
+			return res, failedAt("snapshot", fmt.Errorf("no snapshot in %s to send", vol.SnapDir))
+		}
+		// The backup is named after the snapshot so later runs can match
+		// them up again.
+		ts, err := extractSnapshotTimestamp(oldSnap)
+		if err != nil {
+			return res, failedAt("snapshot", err)
+		}
+		currentTime = ts
+	}
+
+	if cfg.Mode == "replicate" {
+		return replicateVolume(ctx, cfg, vol, oldSnap, currentTime, reuseSnap)
+	}
+
+	finished, err := finishPendingBackup(ctx, cfg, vol, oldSnap)
+	if err != nil {
+		return res, failedAt("resume", fmt.Errorf("finishing pending upload: %w", err))
+	}
+	if finished {
+		// The interrupted run never got as far as pruning.
+		pruneLocalSnapshots(ctx, vol.SnapDir, cfg.snapshotPrefix(), cfg.LocalRetention, oldSnap)
+	}
+
+	// Listed once, after any pending upload is in place, so every decision
+	// below sees the same remote. Failing to list falls back to a full.
+	backups, listErr := listRemoteBackups(ctx, cfg, vol)
+	if listErr != nil {
+		errLog.Printf("Error retrieving remote backups: %v", listErr)
+	}
+
+	// Only the snapshot behind the latest remote backup can be diffed against;
+	// anything else produces a stream the remote chain can't apply.
+	parent := incrementalParent(cfg, vol, backups)
+	mirrors := newMirrorUploads(ctx, cfg, vol)
+	if reuseSnap && parent != "" && parent == oldSnap {
+		if verbose {
+			fmt.Printf("→ %s is already on the remote, nothing to send\n", filepath.Base(oldSnap))
+		}
+		clearFailedSend(vol.SnapDir)
+		return res, nil
+	}
+	if verbose && oldSnap != "" && parent != oldSnap {
+		if parent == "" {
+			fmt.Printf("→ No local snapshot matches the latest remote backup\n")
+		} else {
+			fmt.Printf("→ Using %s as the incremental parent\n", parent)
+		}
+	}
+
+	fullSnapshot := false
+	if force {
+		fullSnapshot = true
+		if verbose {
+			fmt.Printf("→ Forcing full backup for %s\n", vol.Name)
+		}
+	} else if listErr != nil || needsFullBackup(cfg, vol, backups, parent, currentTime) {
+		fullSnapshot = true
+		if verbose {
+			fmt.Printf("→ Doing full backup for %s\n", vol.Name)
+		}
+	} else if verbose {
+		fmt.Printf("→ Doing incremental backup for %s\n", vol.Name)
+	}
+
+	// The listing may be stale, and an incremental is useless without the
+	// backup it was diffed against, so make sure that one is really there.
+	if !fullSnapshot {
+		parentFile := backups[len(backups)-1].Name
+		if !remoteBackupExists(ctx, cfg, parentFile) {
+			if !cfg.fallbackToFull() {
+				return res, failedAt("parent", fmt.Errorf("parent backup %s is missing from the remote (fallback_to_full is off)", parentFile))
+			}
+			fullSnapshot = true
+			parent = ""
+			if verbose {
+				fmt.Printf("→ Parent backup %s is missing from the remote, doing full backup for %s\n", parentFile, vol.Name)
+			}
+		}
+	}
+
+	suffix := "inc"
+	if fullSnapshot {
+		suffix = "full"
+	}
+	outfile := fmt.Sprintf("%s-%s.%s%s", vol.Name, currentTime.Format(snapshotTimestampFormat), suffix, remoteFileSuffix(cfg))
+
+	if remoteBackupExists(ctx, cfg, outfile) {
+		if !quiet {
+			color.Red("⚠️ Backup file %s already exists on remote, skipping volume %s\n", outfile, vol.Name)
+		}
+
+		if verbose || dryRun {
+			fmt.Print("\n\n")
+		}
+		return res, nil
+	}
+
+	// Checked against the live subvolume so a failure leaves no snapshot behind.
+	if fullSnapshot && !dryRun {
+		if err := checkRemoteSpace(ctx, cfg, vol.Src); err != nil {
+			return res, failedAt("space", err)
+		}
+	}
+
+	newSnap := oldSnap
+	if !reuseSnap {
+		newSnap, err = takeSnapshot(ctx, cfg, vol, currentTime)
+		if err != nil {
+			return res, failedAt("snapshot", err)
+		}
+	}
+
+	if dryRun {
+		reportTransferEstimate(ctx, vol, newSnap, parent, fullSnapshot)
+	}
+	var clones []string
+	if !fullSnapshot {
+		skipMirrorsWithoutParent(mirrors, parent)
+		if cfg.CloneSources {
+			clones = mirrorCloneSources(mirrors, cloneSources(backups, listSnapshots(vol.SnapDir, cfg.snapshotPrefix()), parent))
+			if verbose && len(clones) > 0 {
+				fmt.Printf("→ Offering %d earlier snapshot(s) as clone sources\n", len(clones))
+			}
+		}
+	}
+
+	// Streams can't resume mid-transfer, so a failed send starts over.
+	var checksum, tmpFile string
+	var size int64
+	noChanges := false
+	err = withRetry(ctx, cfg.Retries, cfg.RetryBackoff, func() (err error) {
+		tmpFile = newTmpName(outfile)
+		checksum, size, err = sendSnapshot(ctx, cfg, vol.Name, newSnap, parent, clones, outfile, tmpFile, fullSnapshot, mirrors)
+		if errors.Is(err, errNoChanges) {
+			noChanges = true
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		discardFailedSnapshot(cfg, vol, newSnap)
+		return res, failedAt("send", fmt.Errorf("sending snapshot: %w", err))
+	}
+	if noChanges {
+		// sendSnapshot already removed the upload; drop the snapshot so the
+		// next run diffs against the same parent.
+		if verbose {
+			fmt.Printf("→ No changes in %s since %s, skipping upload\n", vol.Name, filepath.Base(parent))
+		}
+		if !sendOnly {
+			deleteOldSnapshot(ctx, newSnap)
+		}
+		return res, nil
+	}
+	if fullSnapshot && cfg.SkipIdentical && !dryRun {
+		if latest := latestRemoteFull(backups); latest != nil && sameAsRemoteBackup(ctx, cfg, latest.Name, checksum) {
+			discardUpload(ctx, cfg, mirrors, tmpFile)
+			if !quiet {
+				fmt.Println(color.YellowString("%s is identical to existing full %s, skipped", outfile, latest.Name))
+			}
+			if !sendOnly {
+				deleteOldSnapshot(ctx, newSnap)
+			}
+			return res, nil
+		}
+	}
+
+	if err := moveTmpFile(ctx, cfg, tmpFile, outfile, checksum); err != nil {
+		// Once the sidecar is written the next run can finish the upload,
+		// and diffs against this snapshot when it has.
+		if !mayBeOnRemote(context.Background(), cfg, outfile) {
+			discardFailedSnapshot(cfg, vol, newSnap)
+		}
+		return res, failedAt("finalize", fmt.Errorf("finalizing remote file: %w", err))
+	}
+	clearFailedSend(vol.SnapDir)
+	res.kind, res.checksum, res.bytesSent = suffix, checksum, size
+	if !fullSnapshot {
+		if ts, err := extractSnapshotTimestamp(parent); err == nil {
+			res.sinceParent = currentTime.Sub(ts)
+			if verbose {
+				fmt.Printf("→ %s: %s changed in %s\n", vol.Name, formatBytes(size), formatDuration(res.sinceParent))
+			}
+		}
+	}
+
+	if verbose && checksum != "" {
+		fmt.Printf("→ %s: %s\n", strings.ToUpper(cfg.checksum().name), checksum)
+	}
+
+	if cfg.MaintainLatest {
+		if err := writeLatest(ctx, cfg, vol, outfile); err != nil {
+			errLog.Printf("Error updating latest pointer for %s: %v", vol.Name, err)
+		}
+	}
+
+	// The checksum only shows the upload matches what was sent. A stream
+	// that doesn't parse is kept, as it may still be partly recoverable, but
+	// marked in its manifest.
+	var suspect string
+	if cfg.VerifyReceive {
+		if err := verifyReceive(ctx, cfg, outfile); err != nil {
+			suspect = fmt.Sprintf("btrfs receive --dump failed: %v", err)
+			errLog.Printf("⚠️ Backup %s is suspect, kept for inspection: %s", outfile, suspect)
+		}
+	}
+
+	manifest := backupManifest{
+		Volume:            vol.Name,
+		Kind:              suffix,
+		Timestamp:         currentTime.Format(snapshotTimestampFormat),
+		Size:              size,
+		Checksum:          checksum,
+		ChecksumAlgorithm: cfg.checksum().name,
+		Version:           version,
+		Suspect:           suspect,
+	}
+	if !fullSnapshot {
+		if ts, err := extractSnapshotTimestamp(parent); err == nil {
+			manifest.Parent = ts.Format(snapshotTimestampFormat)
+		}
+		manifest.SinceParent = int64(res.sinceParent.Seconds())
+	}
+	// The backup itself is already in place, so a missing manifest isn't fatal.
+	manifestErr := writeManifest(ctx, cfg, outfile, manifest)
+	if manifestErr != nil {
+		errLog.Printf("Error writing manifest for %s: %v", outfile, manifestErr)
+	}
+	if err := chmodRemoteFiles(ctx, cfg, backupFiles(cfg, outfile, checksum != "", manifestErr == nil)...); err != nil {
+		errLog.Printf("Error setting permissions on %s: %v", outfile, err)
+	}
+
+	newBackup := &remoteBackup{
+		Name:      outfile,
+		Timestamp: currentTime,
+		Kind:      suffix,
+		Size:      size,
+	}
+	// The primary copy is complete, so a failed mirror is reported once the
+	// rest of the backup has run.
+	mirrorErr := finishMirrors(ctx, vol, mirrors, tmpFile, outfile, checksum, manifest, newBackup)
+
+	// Without a listing there's no telling what is safe to delete.
+	if listErr == nil {
+		if err := cleanupOldBackups(ctx, cfg, vol, backups, newBackup); err != nil {
+			errLog.Printf("Error cleaning up old backups: %v", err)
+		}
+	}
+
+	// After an incremental its parent is kept as well; a full is a new base
+	// that nothing older is needed for.
+	needed := []string{newSnap}
+	if !fullSnapshot && parent != "" {
+		needed = append(needed, parent)
+	}
+	pruneLocalSnapshots(ctx, vol.SnapDir, cfg.snapshotPrefix(), cfg.LocalRetention, needed...)
+
+	if verbose {
+		fmt.Printf(color.GreenString("Finished processing: %s"), vol.Name)
+	}
+
+	if verbose || dryRun {
+		fmt.Print("\n\n")
+	}
+
+	if mirrorErr != nil {
+		return res, failedAt("mirror", mirrorErr)
+	}
+	return res, nil
+}
+
+// takeSnapshot creates a new read-only snapshot of vol.
+func takeSnapshot(ctx context.Context, cfg *Config, vol *Volume, currentTime time.Time) (string, error) {
+	if err := ensureSnapDir(cfg, vol); err != nil {
+		return "", fmt.Errorf("creating snapdir: %w", err)
+	}
+	snap, err := createSnapshot(ctx, vol.Src, vol.SnapDir, cfg.snapshotPrefix(), currentTime)
+	if err != nil {
+		// An interrupted create can leave a partial snapshot behind; the
+		// run's context is already cancelled so clean up without it.
+		if _, statErr := os.Stat(snap); statErr == nil && !dryRun {
+			deleteOldSnapshot(context.Background(), snap)
+		}
+		return "", fmt.Errorf("creating snapshot: %w", err)
+	}
+	return snap, nil
+}
+
+// ensureSnapDir creates vol's snapdir if it's missing and create_snapdir is
+// on. Only root can read it, as the snapshots may hold files the source has
+// since locked down.
+func ensureSnapDir(cfg *Config, vol *Volume) error {
+	if _, err := os.Stat(vol.SnapDir); !os.IsNotExist(err) || !cfg.createSnapdir() {
+		return nil
+	}
+	if verbose {
+		fmt.Printf("→ Creating snapdir %s\n", vol.SnapDir)
+	}
+	if dryRun {
+		return nil
+	}
+	return os.MkdirAll(vol.SnapDir, 0o700)
+}
+
+// discardFailedSnapshot deletes a snapshot of vol that never reached the
+// remote. Nothing there was diffed against it, so it can't be a parent and
+// would only pile up in snapdir. keep_failed_snapshots leaves it for
+// debugging, and retry_from_snapshot leaves it for the next run to send.
+func discardFailedSnapshot(cfg *Config, vol *Volume, snap string) {
+	if sendOnly || dryRun {
+		return
+	}
+	if cfg.RetryFromSnapshot {
+		if err := recordFailedSend(vol.SnapDir, snap); err != nil {
+			errLog.Printf("Error recording failed send of %s: %v", snap, err)
+		}
+		return
+	}
+	if cfg.KeepFailedSnapshots {
+		return
+	}
+	if verbose {
+		fmt.Printf("→ Removing snapshot %s, which wasn't backed up\n", filepath.Base(snap))
+	}
+	// The run's context may be what stopped the send.
+	deleteOldSnapshot(context.Background(), snap)
+}
+
+// mayBeOnRemote reports whether outfile, or a verified upload of it the next
+// run could finish, might be on the remote. Not being able to tell counts.
+func mayBeOnRemote(ctx context.Context, cfg *Config, outfile string) bool {
+	for _, name := range []string{outfile, cfg.checksum().sidecar(outfile)} {
+		if exists, err := cfg.remote().Exists(ctx, name); err != nil || exists {
+			return true
+		}
+	}
+	return false
+}
+
+// reportTransferEstimate prints roughly how much a dry run would have sent.
+// Without the new snapshot, which a dry run never takes, a full is sized from
+// the source and an incremental can't be estimated.
+func reportTransferEstimate(ctx context.Context, vol *Volume, snap, parent string, full bool) {
+	if full {
+		parent = ""
+	}
+
+	// Older btrfs-progs lack --no-data, which leaves the source size for a full.
+	err := errors.New("the snapshot hasn't been taken yet")
+	var estimate int64
+	if _, statErr := os.Stat(snap); statErr == nil {
+		estimate, err = estimateSendSize(ctx, snap, parent)
+	}
+	if err != nil && full {
+		estimate, err = estimateSubvolumeSize(ctx, vol.Src)
+	}
+	if err != nil {
+		fmt.Printf("→ Unable to estimate transfer size: %v\n", err)
+		return
+	}
+	fmt.Printf("→ Estimated transfer: %s (before compression)\n", formatBytes(estimate))
+}
+
+// snapshotVolume takes a snapshot for a later --send-only run without
+// touching the remote. Not knowing which snapshot the next send will diff
+// against, it only prunes when local_retention says how many to keep.
+func snapshotVolume(ctx context.Context, cfg *Config, vol *Volume, currentTime time.Time) error {
+	snap, err := takeSnapshot(ctx, cfg, vol, currentTime)
+	if err != nil {
+		return failedAt("snapshot", err)
+	}
+	if verbose {
+		fmt.Printf("→ Created snapshot %s\n", snap)
+	}
+
+	if cfg.LocalRetention > 0 {
+		pruneLocalSnapshots(ctx, vol.SnapDir, cfg.snapshotPrefix(), cfg.LocalRetention, snap)
+	}
+
+	if verbose {
+		fmt.Printf(color.GreenString("Finished processing: %s"), vol.Name)
+		fmt.Print("\n\n")
+	}
+	return nil
+}
@@ -0,0 +1,785 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunBackupsCollectsFailures(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+	t.Setenv("BTRFS_FAIL_SNAPSHOT_SRC", "/@broken")
+
+	snapRoot := t.TempDir()
+	cfg := &Config{
+		RemoteHost:  "remote",
+		RemoteDest:  remoteDir,
+		Backend:     "ssh",
+		Parallelism: 2,
+		Volumes: []Volume{
+			{Name: "root", Src: "/@", SnapDir: filepath.Join(snapRoot, "root")},
+			{Name: "broken", Src: "/@broken", SnapDir: filepath.Join(snapRoot, "broken")},
+			{Name: "home", Src: "/@home", SnapDir: filepath.Join(snapRoot, "home")},
+		},
+	}
+
+	currentTime := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	failed := failedVolumes(runBackups(context.Background(), cfg, currentTime))
+
+	if len(failed) != 1 || failed[0] != "broken" {
+		t.Fatalf("expected only broken to fail, got %v", failed)
+	}
+
+	for _, name := range []string{"root", "home"} {
+		outfile := filepath.Join(remoteDir, name+"-2024-01-01_10-00-00.full.btrfs")
+		if _, err := os.Stat(outfile); err != nil {
+			t.Fatalf("expected backup for %s despite the failure: %v", name, err)
+		}
+	}
+}
+
+func TestRunBackupsFailFast(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+	t.Setenv("BTRFS_FAIL_SNAPSHOT_SRC", "/@broken")
+	failFast = true
+	t.Cleanup(func() { failFast = false })
+
+	snapRoot := t.TempDir()
+	cfg := &Config{
+		RemoteHost:  "remote",
+		RemoteDest:  remoteDir,
+		Backend:     "ssh",
+		Parallelism: 1,
+		Volumes: []Volume{
+			{Name: "root", Src: "/@", SnapDir: filepath.Join(snapRoot, "root")},
+			{Name: "broken", Src: "/@broken", SnapDir: filepath.Join(snapRoot, "broken")},
+			{Name: "home", Src: "/@home", SnapDir: filepath.Join(snapRoot, "home")},
+		},
+	}
+
+	currentTime := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	failed := failedVolumes(runBackups(context.Background(), cfg, currentTime))
+
+	if !slices.Equal(failed, []string{"broken", "home"}) {
+		t.Fatalf("expected broken to fail and home to be skipped, got %v", failed)
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, "root-2024-01-01_10-00-00.full.btrfs")); err != nil {
+		t.Fatalf("expected root to be backed up before the failure: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, "home-2024-01-01_10-00-00.full.btrfs")); !os.IsNotExist(err) {
+		t.Fatalf("expected home not to be backed up, stat err: %v", err)
+	}
+}
+
+func TestFailureExitCode(t *testing.T) {
+	failed := volumeResult{name: "root", err: failedAt("send", errors.New("boom"))}
+	skipped := volumeResult{name: "var", err: errSkipped}
+
+	if got := failureExitCode([]volumeResult{failed, skipped}); got != exitFailed {
+		t.Errorf("expected %d when no volume was backed up, got %d", exitFailed, got)
+	}
+	if got := failureExitCode([]volumeResult{failed, {name: "home", kind: "inc"}}); got != exitPartial {
+		t.Errorf("expected %d when another volume was backed up, got %d", exitPartial, got)
+	}
+}
+
+func TestPrintReport(t *testing.T) {
+	results := []volumeResult{
+		{name: "root", kind: "full", checksum: "0123456789abcdef0123", bytesSent: 1500, duration: 3 * time.Second},
+		{name: "home", duration: time.Second},
+		{name: "db", err: failedAt("send", errors.New("boom")), duration: 2 * time.Second},
+	}
+
+	got := captureStdout(t, func() { printReport(results) })
+	want := `VOLUME  KIND  SENT    DURATION  CHECKSUM      STATUS
+root    full  1.5 KB  3s        0123456789ab  ok
+home    -     0 B     1s        -             skipped
+db      -     0 B     2s        -             failed at send
+TOTAL         1.5 KB  6s                      1 ok, 1 skipped, 1 failed
+`
+	if got != want {
+		t.Errorf("unexpected report:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+
+	if got := captureStdout(t, func() { printReport(results[:1]) }); got != "" {
+		t.Errorf("expected no report for a single volume, got:\n%s", got)
+	}
+}
+
+func TestBackupVolumeWritesManifest(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	snapDir := t.TempDir()
+	vol := &Volume{Name: "root", Src: "/@", SnapDir: snapDir}
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Backend:    "ssh",
+		Volumes:    []Volume{*vol},
+	}
+
+	currentTime := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	if _, err := backupVolume(context.Background(), cfg, vol, currentTime); err != nil {
+		t.Fatalf("backupVolume: %v", err)
+	}
+
+	outfile := "root-2024-01-01_10-00-00.full.btrfs"
+	payload, err := os.ReadFile(filepath.Join(remoteDir, outfile))
+	if err != nil {
+		t.Fatalf("reading backup: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(remoteDir, outfile+".json"))
+	if err != nil {
+		t.Fatalf("reading manifest: %v", err)
+	}
+	var got backupManifest
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("parsing manifest: %v", err)
+	}
+
+	want := backupManifest{
+		Volume:            "root",
+		Kind:              "full",
+		Timestamp:         "2024-01-01_10-00-00",
+		Size:              int64(len(payload)),
+		Checksum:          fmt.Sprintf("%x", sha256.Sum256(payload)),
+		ChecksumAlgorithm: "sha256",
+		Version:           version,
+	}
+	if got != want {
+		t.Fatalf("unexpected manifest:\nwant %+v\ngot  %+v", want, got)
+	}
+}
+
+func TestBackupVolumeVerifyReceive(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+	btrfsLog := filepath.Join(t.TempDir(), "btrfs.log")
+	t.Setenv("BTRFS_LOG", btrfsLog)
+
+	snapDir := t.TempDir()
+	vol := &Volume{Name: "root", Src: "/@", SnapDir: snapDir}
+	cfg := &Config{
+		RemoteHost:    "remote",
+		RemoteDest:    remoteDir,
+		Backend:       "ssh",
+		VerifyReceive: true,
+		Volumes:       []Volume{*vol},
+	}
+
+	manifest := func(outfile string) backupManifest {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(remoteDir, outfile+".json"))
+		if err != nil {
+			t.Fatalf("reading manifest: %v", err)
+		}
+		var m backupManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatalf("parsing manifest: %v", err)
+		}
+		return m
+	}
+
+	if _, err := backupVolume(context.Background(), cfg, vol, time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("backupVolume: %v", err)
+	}
+	if m := manifest("root-2024-01-01_10-00-00.full.btrfs"); m.Suspect != "" {
+		t.Errorf("expected a stream that parses not to be suspect, got %q", m.Suspect)
+	}
+	if data, _ := os.ReadFile(btrfsLog); !strings.Contains(string(data), "receive --dump") {
+		t.Fatalf("expected the backup to be checked with btrfs receive --dump, got:\n%s", data)
+	}
+
+	// A stream that doesn't parse is kept, but marked.
+	t.Setenv("BTRFS_FAIL_DUMP", "1")
+	if _, err := backupVolume(context.Background(), cfg, vol, time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("backupVolume: %v", err)
+	}
+	outfile := "root-2024-01-02_10-00-00.inc.btrfs"
+	if _, err := os.Stat(filepath.Join(remoteDir, outfile)); err != nil {
+		t.Fatalf("expected the suspect backup to be kept: %v", err)
+	}
+	if m := manifest(outfile); !strings.Contains(m.Suspect, "unexpected command 0") {
+		t.Errorf("expected the manifest to say why the backup is suspect, got %q", m.Suspect)
+	}
+}
+
+func TestBackupVolumeKeepsIncrementalParent(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	snapDir := t.TempDir()
+	parent := filepath.Join(snapDir, "btrfs-backup-2024-01-01_10-00-00")
+	stale := filepath.Join(snapDir, "btrfs-backup-2023-12-31_10-00-00")
+	for _, dir := range []string{stale, parent} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatalf("creating snapshot: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(remoteDir, "root-2024-01-01_10-00-00.full.btrfs"), []byte("full"), 0o644); err != nil {
+		t.Fatalf("creating remote full: %v", err)
+	}
+
+	vol := &Volume{Name: "root", Src: "/@", SnapDir: snapDir}
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Backend:    "ssh",
+		Volumes:    []Volume{*vol},
+	}
+
+	currentTime := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	if _, err := backupVolume(context.Background(), cfg, vol, currentTime); err != nil {
+		t.Fatalf("backupVolume: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(remoteDir, "root-2024-01-02_10-00-00.inc.btrfs")); err != nil {
+		t.Fatalf("expected an incremental backup: %v", err)
+	}
+	if _, err := os.Stat(parent); err != nil {
+		t.Fatalf("expected the incremental parent to survive: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(snapDir, "btrfs-backup-2024-01-02_10-00-00")); err != nil {
+		t.Fatalf("expected the new snapshot to exist: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("expected the stale snapshot to be deleted, stat err: %v", err)
+	}
+}
+
+func TestBackupVolumeSameSecondSnapshot(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	snapDir := t.TempDir()
+	vol := &Volume{Name: "root", Src: "/@", SnapDir: snapDir}
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Backend:    "ssh",
+		Volumes:    []Volume{*vol},
+	}
+
+	currentTime := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	for _, offset := range []time.Duration{0, 500 * time.Millisecond} {
+		if _, err := backupVolume(context.Background(), cfg, vol, currentTime.Add(offset)); err != nil {
+			t.Fatalf("backupVolume: %v", err)
+		}
+	}
+
+	want := filepath.Join(snapDir, "btrfs-backup-2024-01-01_10-00-01")
+	if latest, _ := latestSnapshot(snapDir, "btrfs-backup-"); latest != want {
+		t.Fatalf("expected the second snapshot %s to be the latest, got %s", want, latest)
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, "root-2024-01-01_10-00-01.inc.btrfs")); err != nil {
+		t.Fatalf("expected the second backup to follow the first: %v", err)
+	}
+}
+
+func TestBackupVolumeRespectsMinInterval(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	snapDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(snapDir, "btrfs-backup-2024-01-01_10-00-00"), 0o755); err != nil {
+		t.Fatalf("creating snapshot: %v", err)
+	}
+
+	vol := &Volume{Name: "root", Src: "/@", SnapDir: snapDir, MinInterval: time.Hour}
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Backend:    "ssh",
+		Volumes:    []Volume{*vol},
+	}
+
+	currentTime := time.Date(2024, 1, 1, 10, 5, 0, 0, time.UTC)
+	outfile := filepath.Join(remoteDir, "root-2024-01-01_10-05-00.full.btrfs")
+
+	if _, err := backupVolume(context.Background(), cfg, vol, currentTime); err != nil {
+		t.Fatalf("backupVolume: %v", err)
+	}
+	if _, err := os.Stat(outfile); !os.IsNotExist(err) {
+		t.Fatalf("expected the volume to be skipped, stat err: %v", err)
+	}
+
+	force = true
+	t.Cleanup(func() { force = false })
+
+	if _, err := backupVolume(context.Background(), cfg, vol, currentTime); err != nil {
+		t.Fatalf("backupVolume forced: %v", err)
+	}
+	if _, err := os.Stat(outfile); err != nil {
+		t.Fatalf("expected -f to bypass min_interval: %v", err)
+	}
+}
+
+func TestBackupVolumeCreatesSnapDir(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	snapDir := filepath.Join(t.TempDir(), "snapshots", "root")
+	vol := &Volume{Name: "root", Src: "/@", SnapDir: snapDir}
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Backend:    "ssh",
+		Volumes:    []Volume{*vol},
+	}
+	currentTime := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	dryRun = true
+	_, err := backupVolume(context.Background(), cfg, vol, currentTime)
+	dryRun = false
+	if err != nil {
+		t.Fatalf("backupVolume dry run: %v", err)
+	}
+	if _, err := os.Stat(snapDir); !os.IsNotExist(err) {
+		t.Fatalf("expected a dry run not to create the snapdir, got %v", err)
+	}
+
+	disabled := false
+	cfg.CreateSnapdir = &disabled
+	if err := ensureSnapDir(cfg, vol); err != nil {
+		t.Fatalf("ensureSnapDir: %v", err)
+	}
+	if _, err := os.Stat(snapDir); !os.IsNotExist(err) {
+		t.Fatalf("expected create_snapdir: false to leave the snapdir missing, got %v", err)
+	}
+
+	cfg.CreateSnapdir = nil
+	if _, err := backupVolume(context.Background(), cfg, vol, currentTime); err != nil {
+		t.Fatalf("backupVolume: %v", err)
+	}
+	info, err := os.Stat(snapDir)
+	if err != nil {
+		t.Fatalf("expected the snapdir to be created: %v", err)
+	}
+	if info.Mode().Perm() != 0o700 {
+		t.Errorf("expected the snapdir to be private, got %v", info.Mode().Perm())
+	}
+	if snaps := listSnapshots(snapDir, cfg.snapshotPrefix()); len(snaps) != 1 {
+		t.Errorf("expected the snapshot in the new snapdir, got %v", snaps)
+	}
+}
+
+func TestBackupVolumeStrictSnapshots(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	snapDir := t.TempDir()
+	for _, name := range []string{"btrfs-backup-2024-01-01_10-00-00", "btrfs-backup-2024-01-01_10-00-00-old"} {
+		if err := os.Mkdir(filepath.Join(snapDir, name), 0o755); err != nil {
+			t.Fatalf("creating snapshot: %v", err)
+		}
+	}
+	vol := &Volume{Name: "root", Src: "/@", SnapDir: snapDir}
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Backend:    "ssh",
+		Volumes:    []Volume{*vol},
+	}
+
+	strictSnaps = true
+	t.Cleanup(func() { strictSnaps = false })
+
+	_, err := backupVolume(context.Background(), cfg, vol, time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC))
+	if err == nil || !strings.Contains(err.Error(), "share timestamp 2024-01-01_10-00-00") {
+		t.Fatalf("expected the duplicate snapshots to fail the volume, got %v", err)
+	}
+	if entries, _ := os.ReadDir(remoteDir); len(entries) != 0 {
+		t.Fatalf("expected nothing sent, found %d entries", len(entries))
+	}
+}
+
+func TestSnapshotOnlyThenSendOnly(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	snapDir := t.TempDir()
+	vol := &Volume{Name: "root", Src: "/@", SnapDir: snapDir}
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Backend:    "ssh",
+		Volumes:    []Volume{*vol},
+	}
+
+	snapshotOnly = true
+	t.Cleanup(func() { snapshotOnly = false })
+
+	for _, currentTime := range []time.Time{
+		time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC),
+		time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC),
+	} {
+		if _, err := backupVolume(context.Background(), cfg, vol, currentTime); err != nil {
+			t.Fatalf("backupVolume snapshot-only: %v", err)
+		}
+	}
+	if snaps := listSnapshots(snapDir, cfg.snapshotPrefix()); len(snaps) != 2 {
+		t.Fatalf("expected both snapshots kept without local_retention, got %v", snaps)
+	}
+	if entries, _ := os.ReadDir(remoteDir); len(entries) != 0 {
+		t.Fatalf("expected nothing on the remote, found %d entries", len(entries))
+	}
+
+	snapshotOnly = false
+	sendOnly = true
+	t.Cleanup(func() { sendOnly = false })
+
+	// The run's time is ignored; the backup takes the snapshot's.
+	later := time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC)
+	if _, err := backupVolume(context.Background(), cfg, vol, later); err != nil {
+		t.Fatalf("backupVolume send-only: %v", err)
+	}
+	outfile := filepath.Join(remoteDir, "root-2024-01-01_11-00-00.full.btrfs")
+	if _, err := os.Stat(outfile); err != nil {
+		t.Fatalf("expected the latest snapshot to be sent: %v", err)
+	}
+	if snaps := listSnapshots(snapDir, cfg.snapshotPrefix()); len(snaps) != 1 {
+		t.Fatalf("expected only the sent snapshot to be kept, got %v", snaps)
+	}
+
+	// Sending again finds the snapshot already on the remote.
+	if _, err := backupVolume(context.Background(), cfg, vol, later); err != nil {
+		t.Fatalf("backupVolume send-only again: %v", err)
+	}
+	matches, _ := filepath.Glob(filepath.Join(remoteDir, "root-*.btrfs"))
+	if len(matches) != 1 {
+		t.Fatalf("expected a single backup, got %v", matches)
+	}
+}
+
+func TestRunBackupsStopsWhenInterrupted(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	snapRoot := t.TempDir()
+	cfg := &Config{
+		RemoteHost:  "remote",
+		RemoteDest:  remoteDir,
+		Backend:     "ssh",
+		Parallelism: 1,
+		Volumes: []Volume{
+			{Name: "root", Src: "/@", SnapDir: filepath.Join(snapRoot, "root")},
+			{Name: "home", Src: "/@home", SnapDir: filepath.Join(snapRoot, "home")},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	failed := failedVolumes(runBackups(ctx, cfg, time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)))
+	if len(failed) != 2 {
+		t.Fatalf("expected both volumes to be reported, got %v", failed)
+	}
+
+	entries, err := os.ReadDir(remoteDir)
+	if err != nil {
+		t.Fatalf("reading remote dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected nothing on the remote, got %d entries", len(entries))
+	}
+}
+
+func TestReportTransferEstimate(t *testing.T) {
+	setupTestEnv(t)
+
+	tempDir := t.TempDir()
+	src := filepath.Join(tempDir, "src")
+	if err := os.Mkdir(src, 0o755); err != nil {
+		t.Fatalf("creating source: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "data"), make([]byte, 3000), 0o644); err != nil {
+		t.Fatalf("writing source file: %v", err)
+	}
+	vol := &Volume{Name: "root", Src: src}
+
+	// The stub sends a file's contents, so this stands in for a snapshot.
+	snap := filepath.Join(tempDir, "btrfs-backup-2024-01-01_10-00-00")
+	stream := append(buildSendStream(0, sendCmdSnapshot), buildUpdateExtent(2_000_000)...)
+	if err := os.WriteFile(snap, stream, 0o644); err != nil {
+		t.Fatalf("writing snapshot stream: %v", err)
+	}
+	missing := filepath.Join(tempDir, "btrfs-backup-2024-01-02_10-00-00")
+
+	tests := []struct {
+		name   string
+		snap   string
+		full   bool
+		noData bool
+		want   string
+	}{
+		{"existing snapshot", snap, false, false, "Estimated transfer: 2.0 MB"},
+		{"full before snapshot", missing, true, false, "Estimated transfer: "},
+		{"full without --no-data", snap, true, true, "Estimated transfer: "},
+		{"incremental before snapshot", missing, false, false, "Unable to estimate"},
+	}
+
+	for _, tt := range tests {
+		if tt.noData {
+			t.Setenv("BTRFS_FAIL_NO_DATA", "1")
+		}
+		out := captureStdout(t, func() {
+			reportTransferEstimate(context.Background(), vol, tt.snap, "/snaps/parent", tt.full)
+		})
+		if !strings.Contains(out, tt.want) {
+			t.Errorf("%s: expected %q in output, got %q", tt.name, tt.want, out)
+		}
+		if tt.noData && strings.Contains(out, "2.0 MB") {
+			t.Errorf("%s: expected the source size, got %q", tt.name, out)
+		}
+	}
+}
+
+func TestBackupVolumeMissingParent(t *testing.T) {
+	fallback := false
+	tests := []struct {
+		name     string
+		fallback *bool
+		want     string
+		wantErr  bool
+	}{
+		{name: "promotes to full", want: "root-2024-01-02_10-00-00.full.btrfs"},
+		{name: "fails", fallback: &fallback, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, remoteDir := setupTestEnv(t)
+
+			snapDir := t.TempDir()
+			if err := os.Mkdir(filepath.Join(snapDir, "btrfs-backup-2024-01-01_10-00-00"), 0o755); err != nil {
+				t.Fatalf("creating snapshot: %v", err)
+			}
+			// Listed by ls but not a file, as if deleted after the listing.
+			parentFile := filepath.Join(remoteDir, "root-2024-01-01_10-00-00.full.btrfs")
+			if err := os.Symlink(filepath.Join(remoteDir, "gone"), parentFile); err != nil {
+				t.Fatalf("creating dangling parent: %v", err)
+			}
+
+			vol := &Volume{Name: "root", Src: "/@", SnapDir: snapDir}
+			cfg := &Config{
+				RemoteHost:     "remote",
+				RemoteDest:     remoteDir,
+				Backend:        "ssh",
+				FallbackToFull: tt.fallback,
+				Volumes:        []Volume{*vol},
+			}
+
+			currentTime := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+			_, err := backupVolume(context.Background(), cfg, vol, currentTime)
+			if tt.wantErr {
+				var se *stageError
+				if !errors.As(err, &se) || se.stage != "parent" {
+					t.Fatalf("expected a parent stage error, got %v", err)
+				}
+				if _, err := os.Stat(filepath.Join(remoteDir, "root-2024-01-02_10-00-00.inc.btrfs")); !os.IsNotExist(err) {
+					t.Fatalf("expected no incremental to be uploaded, stat err: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("backupVolume: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(remoteDir, tt.want)); err != nil {
+				t.Fatalf("expected %s: %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestBackupVolumeSkipIdentical(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	snapDir := t.TempDir()
+	// The stub streams a snapshot's path, so an existing full holding that
+	// path hashes the same as the one about to be sent.
+	existing := "root-2024-01-01_10-00-00.full.btrfs"
+	writeRemoteBackup(t, remoteDir, existing, filepath.Join(snapDir, "btrfs-backup-2024-01-02_10-00-00"), true)
+
+	vol := &Volume{Name: "root", Src: "/@", SnapDir: snapDir}
+	cfg := &Config{
+		RemoteHost:    "remote",
+		RemoteDest:    remoteDir,
+		Backend:       "ssh",
+		SkipIdentical: true,
+		Volumes:       []Volume{*vol},
+	}
+
+	force = true
+	t.Cleanup(func() { force = false })
+
+	var err error
+	out := captureStdout(t, func() {
+		_, err = backupVolume(context.Background(), cfg, vol, time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC))
+	})
+	if err != nil {
+		t.Fatalf("backupVolume: %v", err)
+	}
+	if !strings.Contains(out, "identical to existing full "+existing) {
+		t.Errorf("expected the skip to be reported, got %q", out)
+	}
+	assertNames(t, remoteListing(t, cfg, vol), []string{existing})
+	if tmps, _ := filepath.Glob(filepath.Join(remoteDir, "*.tmp")); len(tmps) != 0 {
+		t.Fatalf("expected the upload to be removed, found %v", tmps)
+	}
+
+	// A different stream is kept.
+	if _, err := backupVolume(context.Background(), cfg, vol, time.Date(2024, 1, 3, 10, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("backupVolume: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, "root-2024-01-03_10-00-00.full.btrfs")); err != nil {
+		t.Fatalf("expected a differing full to be kept: %v", err)
+	}
+}
+
+func TestBackupVolumeRemoteFileMode(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+	sshLog := filepath.Join(t.TempDir(), "ssh.log")
+	t.Setenv("SSH_LOG", sshLog)
+
+	snapDir := t.TempDir()
+	vol := &Volume{Name: "root", Src: "/@", SnapDir: snapDir}
+	dest := filepath.Join(remoteDir, "backups")
+	cfg := &Config{
+		RemoteHost:     "remote",
+		RemoteDest:     dest,
+		Backend:        "ssh",
+		RemoteFileMode: 0o600,
+		RemoteDirMode:  0o700,
+		Volumes:        []Volume{*vol},
+	}
+
+	if err := checkRemoteAccess(context.Background(), cfg); err != nil {
+		t.Fatalf("checkRemoteAccess: %v", err)
+	}
+	if _, err := backupVolume(context.Background(), cfg, vol, time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("backupVolume: %v", err)
+	}
+
+	outfile := "root-2024-01-01_10-00-00.full.btrfs"
+	data, err := os.ReadFile(sshLog)
+	if err != nil {
+		t.Fatalf("reading ssh log: %v", err)
+	}
+	for _, want := range []string{
+		"mkdir -p -m 0700 " + shellEscape(dest),
+		fmt.Sprintf("chmod 0600 %s %s %s",
+			shellEscape(filepath.Join(dest, outfile)),
+			shellEscape(filepath.Join(dest, outfile+".sha256")),
+			shellEscape(filepath.Join(dest, outfile+".json")),
+		),
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("expected %q to reach the remote, got:\n%s", want, data)
+		}
+	}
+
+	for name, want := range map[string]os.FileMode{dest: 0o700, filepath.Join(dest, outfile): 0o600} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("stat %s: %v", name, err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("expected %s to have mode %o, got %o", name, want, info.Mode().Perm())
+		}
+	}
+}
+
+func TestBackupVolumeRemovesSnapshotAfterFailedSend(t *testing.T) {
+	tests := []struct {
+		name string
+		keep bool
+		want int
+	}{
+		{name: "removed", want: 1},
+		{name: "kept with keep_failed_snapshots", keep: true, want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, remoteDir := setupTestEnv(t)
+
+			// The parent of the failed incremental must survive it.
+			snapDir := t.TempDir()
+			parent := filepath.Join(snapDir, "btrfs-backup-2024-01-01_10-00-00")
+			if err := os.Mkdir(parent, 0o755); err != nil {
+				t.Fatalf("creating snapshot: %v", err)
+			}
+			writeRemoteBackup(t, remoteDir, "root-2024-01-01_10-00-00.full.btrfs", parent, true)
+
+			vol := &Volume{Name: "root", Src: "/@", SnapDir: snapDir}
+			cfg := &Config{
+				RemoteHost:          "remote",
+				RemoteDest:          remoteDir,
+				Backend:             "ssh",
+				KeepFailedSnapshots: tt.keep,
+				Volumes:             []Volume{*vol},
+			}
+
+			t.Setenv("BTRFS_FAIL_SEND", "1")
+			_, err := backupVolume(context.Background(), cfg, vol, time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC))
+			var se *stageError
+			if !errors.As(err, &se) || se.stage != "send" {
+				t.Fatalf("expected a send stage error, got %v", err)
+			}
+
+			snaps := listSnapshots(snapDir, cfg.snapshotPrefix())
+			if len(snaps) != tt.want || snaps[0] != parent {
+				t.Fatalf("expected %d snapshot(s) starting with the parent, got %v", tt.want, snaps)
+			}
+		})
+	}
+}
+
+func TestBackupVolumeRetryFromSnapshot(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	snapDir := t.TempDir()
+	parent := filepath.Join(snapDir, "btrfs-backup-2024-01-01_10-00-00")
+	if err := os.Mkdir(parent, 0o755); err != nil {
+		t.Fatalf("creating snapshot: %v", err)
+	}
+	writeRemoteBackup(t, remoteDir, "root-2024-01-01_10-00-00.full.btrfs", parent, true)
+
+	vol := &Volume{Name: "root", Src: "/@", SnapDir: snapDir, MinInterval: time.Hour}
+	cfg := &Config{
+		RemoteHost:        "remote",
+		RemoteDest:        remoteDir,
+		Backend:           "ssh",
+		RetryFromSnapshot: true,
+		Volumes:           []Volume{*vol},
+	}
+
+	t.Setenv("BTRFS_FAIL_SEND", "1")
+	if _, err := backupVolume(context.Background(), cfg, vol, time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)); err == nil {
+		t.Fatal("expected the send to fail")
+	}
+	failed := filepath.Join(snapDir, "btrfs-backup-2024-01-02_10-00-00")
+	if got := failedSend(snapDir); got != filepath.Base(failed) {
+		t.Fatalf("expected the failed snapshot to be recorded, got %q", got)
+	}
+
+	// Inside min_interval, but the failed snapshot still has to go out.
+	t.Setenv("BTRFS_FAIL_SEND", "0")
+	res, err := backupVolume(context.Background(), cfg, vol, time.Date(2024, 1, 2, 10, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("backupVolume retry: %v", err)
+	}
+	if res.kind != "inc" {
+		t.Errorf("expected the retry to stay incremental, got %q", res.kind)
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, "root-2024-01-02_10-00-00.inc.btrfs")); err != nil {
+		t.Fatalf("expected the failed snapshot to be sent: %v", err)
+	}
+	if snaps := listSnapshots(snapDir, cfg.snapshotPrefix()); len(snaps) != 2 || snaps[1] != failed {
+		t.Fatalf("expected no new snapshot to be taken, got %v", snaps)
+	}
+	if got := failedSend(snapDir); got != "" {
+		t.Fatalf("expected the record to be cleared, got %q", got)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/sha256"
+	"hash"
+
+	"github.com/zeebo/blake3"
+)
+
+// checksumAlgorithm is a hash computed over the stream as it is sent and
+// recomputed on the remote to verify it.
+type checksumAlgorithm struct {
+	name string
+	// command prints "<hex>  <file>" like sha256sum.
+	command string
+	newHash func() hash.Hash
+}
+
+var checksumAlgorithms = []checksumAlgorithm{
+	{name: "sha256", command: "sha256sum", newHash: sha256.New},
+	{name: "blake3", command: "b3sum", newHash: func() hash.Hash { return blake3.New() }},
+}
+
+func lookupChecksumAlgorithm(name string) (checksumAlgorithm, bool) {
+	for _, a := range checksumAlgorithms {
+		if a.name == name {
+			return a, true
+		}
+	}
+	return checksumAlgorithm{}, false
+}
+
+// checksum returns the configured algorithm, defaulting to sha256.
+func (cfg *Config) checksum() checksumAlgorithm {
+	if a, ok := lookupChecksumAlgorithm(cfg.ChecksumAlgorithm); ok {
+		return a
+	}
+	return checksumAlgorithms[0]
+}
+
+// verifyMode returns where uploads are hashed: both ends, only the remote, or
+// only locally with the stored file checked afterwards. It defaults to both.
+func (cfg *Config) verifyMode() string {
+	if cfg.VerifyMode == "" {
+		return "both"
+	}
+	return cfg.VerifyMode
+}
+
+// sidecar returns the name of the file holding name's checksum.
+func (a checksumAlgorithm) sidecar(name string) string {
+	return name + "." + a.name
+}
+
+// sidecars returns every possible checksum file for name, so cleanup catches
+// backups made before the algorithm was changed.
+func sidecars(name string) []string {
+	var names []string
+	for _, a := range checksumAlgorithms {
+		names = append(names, a.sidecar(name))
+	}
+	return names
+}
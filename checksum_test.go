@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zeebo/blake3"
+)
+
+func TestChecksumAlgorithmSelection(t *testing.T) {
+	tests := []struct {
+		configured string
+		name       string
+		// Hash of the empty input.
+		empty string
+	}{
+		{"", "sha256", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"sha256", "sha256", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"blake3", "blake3", "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+	}
+
+	for _, tt := range tests {
+		cfg := &Config{ChecksumAlgorithm: tt.configured}
+		algorithm := cfg.checksum()
+		if algorithm.name != tt.name {
+			t.Errorf("%q: expected %s, got %s", tt.configured, tt.name, algorithm.name)
+		}
+		if got := fmt.Sprintf("%x", algorithm.newHash().Sum(nil)); got != tt.empty {
+			t.Errorf("%q: unexpected empty hash %s", tt.configured, got)
+		}
+		if got, want := algorithm.sidecar("a.btrfs"), "a.btrfs."+tt.name; got != want {
+			t.Errorf("%q: expected sidecar %s, got %s", tt.configured, want, got)
+		}
+	}
+}
+
+func TestReadRemoteChecksumFallsBackToOtherAlgorithm(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	cfg := &Config{
+		RemoteHost:        "remote",
+		RemoteDest:        remoteDir,
+		ChecksumAlgorithm: "blake3",
+	}
+
+	// A backup made before switching to blake3 only has a sha256 sidecar.
+	outfile := "root-2024-05-12_11-30-45.full.btrfs"
+	if err := os.WriteFile(filepath.Join(remoteDir, outfile+".sha256"), []byte("abc123  "+outfile+"\n"), 0o644); err != nil {
+		t.Fatalf("writing sidecar: %v", err)
+	}
+
+	checksum, algorithm, err := readRemoteChecksum(context.Background(), cfg, outfile)
+	if err != nil {
+		t.Fatalf("readRemoteChecksum: %v", err)
+	}
+	if checksum != "abc123" || algorithm.name != "sha256" {
+		t.Fatalf("expected sha256 checksum abc123, got %s %q", algorithm.name, checksum)
+	}
+}
+
+func TestMoveTmpFileWritesConfiguredSidecar(t *testing.T) {
+	binDir, remoteDir := setupTestEnv(t)
+
+	// Stand in for b3sum on the remote, printing the hash Go computes. It
+	// drains its input so tee never sees a closed pipe.
+	hasher := blake3.New()
+	hasher.Write([]byte("content"))
+	checksum := fmt.Sprintf("%x", hasher.Sum(nil))
+	writeExecutable(t, binDir, "b3sum", fmt.Sprintf("#!/bin/sh\ncat \"${1:--}\" > /dev/null\nprintf '%%s  %%s\\n' %s \"${1:--}\"\n", checksum))
+
+	cfg := &Config{
+		RemoteHost:        "remote",
+		RemoteDest:        remoteDir,
+		ChecksumAlgorithm: "blake3",
+	}
+
+	outfile := "volume-full.btrfs"
+	if err := os.WriteFile(filepath.Join(remoteDir, outfile+".tmp"), []byte("content"), 0o644); err != nil {
+		t.Fatalf("writing tmp file: %v", err)
+	}
+
+	if err := moveTmpFile(context.Background(), cfg, outfile+".tmp", outfile, checksum); err != nil {
+		t.Fatalf("moveTmpFile: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(remoteDir, outfile+".blake3"))
+	if err != nil {
+		t.Fatalf("reading blake3 sidecar: %v", err)
+	}
+	if want := checksum + "  " + outfile + "\n"; string(data) != want {
+		t.Fatalf("unexpected sidecar contents: %q", string(data))
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, outfile+".sha256")); !os.IsNotExist(err) {
+		t.Fatalf("expected no sha256 sidecar, stat err: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// commandBackend pipes each file into a user command, which stores it
+// wherever it likes. The command can't be asked what it holds, so nothing is
+// ever listed, found or removed: every backup is a full, and pruning is the
+// command's business.
+type commandBackend struct {
+	cfg *Config
+}
+
+// command returns the command for name, with %s replaced by the final name,
+// already quoted. Uploads are named after their final file, as the command
+// gets no rename.
+func (b *commandBackend) command(name string) string {
+	return strings.ReplaceAll(b.cfg.Command, "%s", shellEscape(tmpTarget(name)))
+}
+
+func (b *commandBackend) Describe(op string, names ...string) string {
+	if op == "write" {
+		return fmt.Sprintf("sh -c %s", shellEscape(b.command(names[0])))
+	}
+	return fmt.Sprintf("nothing to %s with backend command", op)
+}
+
+func (b *commandBackend) Check(ctx context.Context) error {
+	if verbose {
+		fmt.Printf("→ Piping backups into %s\n", b.cfg.Command)
+	}
+	return nil
+}
+
+// Write runs the command with r on stdin and returns the checksum of what it
+// read. Its exit status is the only word on whether the file was stored.
+func (b *commandBackend) Write(ctx context.Context, name string, r io.Reader) (string, error) {
+	hasher := b.cfg.checksum().newHash()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", b.command(name))
+	cmd.Env = append(os.Environ(), "BTRFS_BACKUP_FILE="+tmpTarget(name))
+	cmd.Stdin = io.TeeReader(r, hasher)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("command failed: %w", err)
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func (b *commandBackend) Exists(ctx context.Context, name string) (bool, error) {
+	return false, nil
+}
+
+func (b *commandBackend) List(ctx context.Context, prefix string) ([]string, error) {
+	return nil, nil
+}
+
+func (b *commandBackend) Remove(ctx context.Context, names ...string) error {
+	return nil
+}
+
+func (b *commandBackend) Rename(ctx context.Context, tmp, final string) error {
+	return nil
+}
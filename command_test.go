@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommandBackendSend(t *testing.T) {
+	_, archiveDir := setupTestEnv(t)
+
+	sshLog := filepath.Join(t.TempDir(), "ssh.log")
+	t.Setenv("SSH_LOG", sshLog)
+
+	cfg := &Config{
+		Backend: "command",
+		Command: "cat > " + archiveDir + "/%s",
+	}
+	vol := &Volume{Name: "root"}
+	ctx := context.Background()
+
+	newSnap := filepath.Join(t.TempDir(), "snap")
+	payload := []byte("piped snapshot data")
+	if err := os.WriteFile(newSnap, payload, 0o644); err != nil {
+		t.Fatalf("writing new snapshot: %v", err)
+	}
+
+	outfile := "root-2024-01-02_10-00-00.full.btrfs"
+	tmpFile := newTmpName(outfile)
+	checksum, _, err := sendSnapshot(ctx, cfg, "root", newSnap, "", nil, outfile, tmpFile, true, nil)
+	if err != nil {
+		t.Fatalf("sendSnapshot: %v", err)
+	}
+	if want := fmt.Sprintf("%x", sha256.Sum256(payload)); checksum != want {
+		t.Fatalf("unexpected checksum: want %s, got %s", want, checksum)
+	}
+	if err := moveTmpFile(ctx, cfg, tmpFile, outfile, checksum); err != nil {
+		t.Fatalf("moveTmpFile: %v", err)
+	}
+
+	// The command gets the final names, as nothing renames its uploads.
+	data, err := os.ReadFile(filepath.Join(archiveDir, outfile))
+	if err != nil {
+		t.Fatalf("reading piped backup: %v", err)
+	}
+	if string(data) != string(payload) {
+		t.Fatalf("piped backup mismatch: want %q, got %q", payload, data)
+	}
+	sidecar, err := os.ReadFile(filepath.Join(archiveDir, outfile+".sha256"))
+	if err != nil {
+		t.Fatalf("reading piped sidecar: %v", err)
+	}
+	if want := checksum + "  " + outfile + "\n"; string(sidecar) != want {
+		t.Fatalf("expected sidecar %q, got %q", want, sidecar)
+	}
+
+	// Nothing can be listed back, so the next backup is a full too.
+	backups, err := listRemoteBackups(ctx, cfg, vol)
+	if err != nil {
+		t.Fatalf("listRemoteBackups: %v", err)
+	}
+	if len(backups) != 0 {
+		t.Fatalf("expected no backups listed, got %v", backupNames(backups))
+	}
+
+	if _, err := os.Stat(sshLog); !os.IsNotExist(err) {
+		t.Fatalf("expected ssh not to be invoked, stat err: %v", err)
+	}
+}
+
+func TestCommandBackendFailure(t *testing.T) {
+	setupTestEnv(t)
+
+	cfg := &Config{
+		Backend: "command",
+		Command: "cat >/dev/null; exit 3",
+	}
+
+	newSnap := filepath.Join(t.TempDir(), "snap")
+	if err := os.WriteFile(newSnap, []byte("data"), 0o644); err != nil {
+		t.Fatalf("writing new snapshot: %v", err)
+	}
+
+	outfile := "root-2024-01-02_10-00-00.full.btrfs"
+	_, _, err := sendSnapshot(context.Background(), cfg, "root", newSnap, "", nil, outfile, newTmpName(outfile), true, nil)
+	if err == nil || !strings.Contains(err.Error(), "command failed: exit status 3") {
+		t.Fatalf("expected the command's exit status to fail the send, got %v", err)
+	}
+}
+
+func TestCommandBackendDescribe(t *testing.T) {
+	b := &commandBackend{cfg: &Config{Command: "rclone rcat remote:btrfs/%s"}}
+
+	got := b.Describe("write", "root-2024-01-02_10-00-00.full.btrfs.0123abcd.tmp")
+	want := `sh -c 'rclone rcat remote:btrfs/'\''root-2024-01-02_10-00-00.full.btrfs'\'''`
+	if got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
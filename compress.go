@@ -0,0 +1,67 @@
+package main
+
+import "fmt"
+
+// compressionSuffix returns the file suffix added for the given compression.
+func compressionSuffix(compression string) string {
+	switch compression {
+	case "zstd":
+		return ".zst"
+	case "gzip":
+		return ".gz"
+	}
+	return ""
+}
+
+// compressArgs returns the command compressing the send stream, or nil when
+// compression is disabled.
+func compressArgs(cfg *Config) []string {
+	var args []string
+	switch cfg.Compression {
+	case "zstd":
+		args = []string{"zstd", "-q", "-c"}
+	case "gzip":
+		args = []string{"gzip", "-c"}
+	default:
+		return nil
+	}
+	if cfg.CompressionLevel > 0 {
+		args = append(args, fmt.Sprintf("-%d", cfg.CompressionLevel))
+	}
+	return args
+}
+
+// decompressArgs returns the command reversing the compression recorded in
+// a backup's file name, or nil when it isn't compressed.
+func decompressArgs(name string) []string {
+	enc, _ := parseBackupEncoding(name)
+	switch enc.Compression {
+	case "zstd":
+		return []string{"zstd", "-d", "-q", "-c"}
+	case "gzip":
+		return []string{"gzip", "-d", "-c"}
+	}
+	return nil
+}
+
+func validateCompression(cfg *Config) error {
+	maxLevel := 0
+	switch cfg.Compression {
+	case "none":
+	case "zstd":
+		maxLevel = 19
+	case "gzip":
+		maxLevel = 9
+	default:
+		return fmt.Errorf("unknown compression %q (expected none, zstd or gzip)", cfg.Compression)
+	}
+
+	if cfg.CompressionLevel < 0 || cfg.CompressionLevel > maxLevel {
+		if maxLevel == 0 {
+			return fmt.Errorf("compression_level requires compression to be set")
+		}
+		return fmt.Errorf("compression_level %d out of range for %s (1-%d)", cfg.CompressionLevel, cfg.Compression, maxLevel)
+	}
+
+	return nil
+}
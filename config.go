@@ -1,41 +1,825 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Volume struct {
-	Name    string `yaml:"name"`
-	Src     string `yaml:"src"`
-	SnapDir string `yaml:"snapdir"`
+	Name              string        `yaml:"name"`
+	Src               string        `yaml:"src"`
+	SnapDir           string        `yaml:"snapdir"`
+	MaxAgeDays        int           `yaml:"max_age_days"`
+	MaxIncrementals   int           `yaml:"max_incrementals"`
+	MinInterval       time.Duration `yaml:"min_interval"`
+	EncryptionKey     string        `yaml:"encryption_key"`
+	EncryptionKeyFile string        `yaml:"encryption_key_file"`
+	EncryptionKeyEnv  string        `yaml:"encryption_key_env"`
+	EncryptionKeys    []string      `yaml:"encryption_keys"`
+	PreBackup         []string      `yaml:"pre_backup"`
+	PostBackup        []string      `yaml:"post_backup"`
+	Enabled           *bool         `yaml:"enabled"`
+	Tags              []string      `yaml:"tags"`
+}
+
+type Retention struct {
+	KeepDaily   int `yaml:"keep_daily"`
+	KeepWeekly  int `yaml:"keep_weekly"`
+	KeepMonthly int `yaml:"keep_monthly"`
+}
+
+type S3Config struct {
+	Bucket     string `yaml:"bucket"`
+	Endpoint   string `yaml:"endpoint"`
+	Region     string `yaml:"region"`
+	Prefix     string `yaml:"prefix"`
+	AccessKey  string `yaml:"access_key"`
+	SecretKey  string `yaml:"secret_key"`
+	PartSizeMB int    `yaml:"part_size_mb"`
+}
+
+// Mirror is an extra ssh destination sent a copy of every backup. Unset
+// fields aren't inherited; ssh_options and the other ssh settings are.
+type Mirror struct {
+	RemoteHost string `yaml:"remote_host"`
+	RemotePort int    `yaml:"remote_port"`
+	RemoteDest string `yaml:"remote_dest"`
+	SSHKey     string `yaml:"ssh_key"`
+}
+
+type NotifyConfig struct {
+	WebhookURL      string `yaml:"webhook_url"`
+	NotifyOnSuccess bool   `yaml:"notify_on_success"`
 }
 
 type Config struct {
-	SSHKey          string   `yaml:"ssh_key"`
-	RemoteHost      string   `yaml:"remote_host"`
-	RemoteDest      string   `yaml:"remote_dest"`
-	MaxAgeDays      int      `yaml:"max_age_days"`
-	MaxIncrementals int      `yaml:"max_incrementals"`
-	EncryptionKey   string   `yaml:"encryption_key"`
-	Volumes         []Volume `yaml:"volumes"`
+	SSHKey              string        `yaml:"ssh_key"`
+	SSHOptions          []string      `yaml:"ssh_options"`
+	SSHMultiplex        bool          `yaml:"ssh_multiplex"`
+	SSHControlDir       string        `yaml:"ssh_control_dir"`
+	RemoteHost          string        `yaml:"remote_host"`
+	RemotePort          int           `yaml:"remote_port"`
+	RemoteDest          string        `yaml:"remote_dest"`
+	Mirrors             []Mirror      `yaml:"mirrors"`
+	MaxAgeDays          int           `yaml:"max_age_days"`
+	MaxIncrementals     int           `yaml:"max_incrementals"`
+	FullOnWeekday       string        `yaml:"full_on_weekday"`
+	MinInterval         time.Duration `yaml:"min_interval"`
+	PreBackup           []string      `yaml:"pre_backup"`
+	PostBackup          []string      `yaml:"post_backup"`
+	EncryptionKey       string        `yaml:"encryption_key"`
+	EncryptionKeyFile   string        `yaml:"encryption_key_file"`
+	EncryptionKeyEnv    string        `yaml:"encryption_key_env"`
+	EncryptionKeys      []string      `yaml:"encryption_keys"`
+	EncryptionBackend   string        `yaml:"encryption_backend"`
+	ChecksumAlgorithm   string        `yaml:"checksum_algorithm"`
+	VerifyMode          string        `yaml:"verify_mode"`
+	VerifyReceive       bool          `yaml:"verify_receive"`
+	Compression         string        `yaml:"compression"`
+	CompressionLevel    int           `yaml:"compression_level"`
+	Transport           string        `yaml:"transport"`
+	BtrfsBin            string        `yaml:"btrfs_bin"`
+	SSHBin              string        `yaml:"ssh_bin"`
+	AgeBin              string        `yaml:"age_bin"`
+	BWLimit             ByteSize      `yaml:"bwlimit"`
+	MinFreeBytes        ByteSize      `yaml:"min_free_bytes"`
+	MinChangeBytes      ByteSize      `yaml:"min_change_bytes"`
+	MaxTotalBytes       ByteSize      `yaml:"max_total_bytes"`
+	StaleTmpAge         time.Duration `yaml:"stale_tmp_age"`
+	Retries             int           `yaml:"retries"`
+	RetryBackoff        time.Duration `yaml:"retry_backoff"`
+	RunTimeout          time.Duration `yaml:"run_timeout"`
+	OpTimeout           time.Duration `yaml:"op_timeout"`
+	Parallelism         int           `yaml:"parallelism"`
+	Backend             string        `yaml:"backend"`
+	Command             string        `yaml:"command"`
+	Mode                string        `yaml:"mode"`
+	S3                  *S3Config     `yaml:"s3"`
+	KeepFulls           int           `yaml:"keep_fulls"`
+	MaintainLatest      bool          `yaml:"maintain_latest"`
+	FallbackToFull      *bool         `yaml:"fallback_to_full"`
+	RemoteLock          bool          `yaml:"remote_lock"`
+	RemoteFileMode      FileMode      `yaml:"remote_file_mode"`
+	RemoteDirMode       FileMode      `yaml:"remote_dir_mode"`
+	SkipIdentical       bool          `yaml:"skip_identical"`
+	Retention           *Retention    `yaml:"retention"`
+	Notify              *NotifyConfig `yaml:"notify"`
+	HealthcheckURL      string        `yaml:"healthcheck_url"`
+	MetricsFile         string        `yaml:"metrics_file"`
+	LogFile             string        `yaml:"log_file"`
+	LockFile            string        `yaml:"lock_file"`
+	SnapshotPrefix      string        `yaml:"snapshot_prefix"`
+	Timezone            string        `yaml:"timezone"`
+	LocalRetention      int           `yaml:"local_retention"`
+	CloneSources        bool          `yaml:"clone_sources"`
+	KeepFailedSnapshots bool          `yaml:"keep_failed_snapshots"`
+	CreateSnapdir       *bool         `yaml:"create_snapdir"`
+	RetryFromSnapshot   bool          `yaml:"retry_from_snapshot"`
+	Volumes             []Volume      `yaml:"volumes"`
+
+	backend Backend
 }
 
+// unknownFieldRegexp matches yaml's complaint about a key with no field.
+var unknownFieldRegexp = regexp.MustCompile(`field (\S+) not found in type \S+`)
+
+// checkConfig loads the config at path as a run would, for -config-check.
+// Unlike a run it also rejects keys that aren't settings, which are usually
+// typos.
+func checkConfig(path string) error {
+	_, loadErr := loadConfig(path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return loadErr
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var typeErr *yaml.TypeError
+	if err := dec.Decode(&Config{}); errors.As(err, &typeErr) {
+		var unknown []string
+		for _, e := range typeErr.Errors {
+			if unknownFieldRegexp.MatchString(e) {
+				unknown = append(unknown, unknownFieldRegexp.ReplaceAllString(e, "unknown setting $1"))
+			}
+		}
+		if len(unknown) > 0 {
+			return errors.Join(loadErr, fmt.Errorf("unknown settings:\n  - %s", strings.Join(unknown, "\n  - ")))
+		}
+	} else if err != nil && !errors.Is(err, io.EOF) && loadErr == nil {
+		return err
+	}
+	return loadErr
+}
+
+// loadConfig reads, defaults and validates the config at path.
+//
+// JSON configs go through the yaml decoder too rather than encoding/json:
+// JSON is YAML, so the same yaml keys apply, with no json tags, and durations,
+// sizes and modes parse the same way. A .json file must also parse as JSON, so
+// YAML-only syntax such as comments is rejected there. The yaml decoder is
+// stricter than encoding/json about duplicate keys, which it rejects. Any
+// other file is read as YAML, JSON content included.
 func loadConfig(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		var v any
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("parsing %s as JSON: %w", path, err)
+		}
+	}
+
 	var cfg Config
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
-	if cfg.MaxAgeDays == 0 {
-		cfg.MaxAgeDays = 7
+	if err := cfg.expandEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.resolveEncryptionKeys(); err != nil {
+		return nil, err
+	}
+	cfg.applyDefaults()
+	for i := range cfg.Volumes {
+		if cfg.Volumes[i].MaxAgeDays == 0 {
+			cfg.Volumes[i].MaxAgeDays = cfg.MaxAgeDays
+		}
+		if cfg.Volumes[i].MaxIncrementals == 0 {
+			cfg.Volumes[i].MaxIncrementals = cfg.MaxIncrementals
+		}
+		if cfg.Volumes[i].MinInterval == 0 {
+			cfg.Volumes[i].MinInterval = cfg.MinInterval
+		}
+		// An empty list in the volume turns the global hooks off.
+		if cfg.Volumes[i].PreBackup == nil {
+			cfg.Volumes[i].PreBackup = cfg.PreBackup
+		}
+		if cfg.Volumes[i].PostBackup == nil {
+			cfg.Volumes[i].PostBackup = cfg.PostBackup
+		}
+		cfg.Volumes[i].EncryptionKey = strings.TrimSpace(cfg.Volumes[i].EncryptionKey)
+		cfg.Volumes[i].EncryptionKeys = trimAll(cfg.Volumes[i].EncryptionKeys)
 	}
 	cfg.EncryptionKey = strings.TrimSpace(cfg.EncryptionKey)
+	cfg.EncryptionKeys = trimAll(cfg.EncryptionKeys)
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Backend == "s3" {
+		backend, err := newS3Backend(cfg.S3)
+		if err != nil {
+			return nil, err
+		}
+		backend.checksum = cfg.checksum()
+		cfg.backend = backend
+	}
 	return &cfg, nil
 }
+
+// applyDefaults fills in the global settings left unset. Volumes inherit
+// from these in loadConfig.
+func (cfg *Config) applyDefaults() {
+	if cfg.MaxAgeDays == 0 {
+		cfg.MaxAgeDays = 7
+	}
+	if cfg.Parallelism == 0 {
+		cfg.Parallelism = 1
+	}
+	if cfg.RetryBackoff == 0 {
+		cfg.RetryBackoff = 5 * time.Second
+	}
+	if cfg.EncryptionBackend == "" {
+		cfg.EncryptionBackend = "age"
+	}
+	if cfg.KeepFulls == 0 {
+		cfg.KeepFulls = 1
+	}
+	if cfg.Timezone == "" {
+		cfg.Timezone = "UTC"
+	}
+	if cfg.StaleTmpAge == 0 {
+		cfg.StaleTmpAge = 24 * time.Hour
+	}
+	if cfg.SnapshotPrefix == "" {
+		cfg.SnapshotPrefix = defaultSnapshotPrefix
+	}
+	if cfg.LockFile == "" {
+		cfg.LockFile = defaultLockFile
+	}
+	if cfg.ChecksumAlgorithm == "" {
+		cfg.ChecksumAlgorithm = "sha256"
+	}
+	if cfg.VerifyMode == "" {
+		cfg.VerifyMode = "both"
+	}
+	if cfg.Compression == "" {
+		cfg.Compression = "none"
+	}
+	if cfg.Transport == "" {
+		cfg.Transport = "ssh"
+	}
+	if cfg.Backend == "" {
+		cfg.Backend = "ssh"
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = "archive"
+	}
+	if cfg.BtrfsBin == "" {
+		cfg.BtrfsBin = "btrfs"
+	}
+	if cfg.SSHBin == "" {
+		cfg.SSHBin = "ssh"
+	}
+	if cfg.AgeBin == "" {
+		cfg.AgeBin = "age"
+	}
+	if cfg.FallbackToFull == nil {
+		fallback := true
+		cfg.FallbackToFull = &fallback
+	}
+	if cfg.CreateSnapdir == nil {
+		create := true
+		cfg.CreateSnapdir = &create
+	}
+	for i := range cfg.Volumes {
+		if cfg.Volumes[i].Enabled == nil {
+			enabled := true
+			cfg.Volumes[i].Enabled = &enabled
+		}
+	}
+}
+
+// snapshotPrefix returns the name prefix of local snapshots made by this tool.
+func (cfg *Config) snapshotPrefix() string {
+	if cfg.SnapshotPrefix == "" {
+		return defaultSnapshotPrefix
+	}
+	return cfg.SnapshotPrefix
+}
+
+// redacted returns a copy of cfg that is safe to print, with encryption keys
+// and credentials replaced and only the host of the webhook URL kept.
+func (cfg *Config) redacted() *Config {
+	redact := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return "<redacted>"
+	}
+	redactAll := func(ss []string) []string {
+		var out []string
+		for _, s := range ss {
+			out = append(out, redact(s))
+		}
+		return out
+	}
+
+	c := *cfg
+	c.backend = nil
+	c.EncryptionKey = redact(c.EncryptionKey)
+	c.EncryptionKeys = redactAll(c.EncryptionKeys)
+	if c.S3 != nil {
+		s3 := *c.S3
+		s3.AccessKey = redact(s3.AccessKey)
+		s3.SecretKey = redact(s3.SecretKey)
+		c.S3 = &s3
+	}
+	// Webhook and healthcheck URLs often carry a token in the path or query.
+	redactURL := func(s string) string {
+		if u, err := url.Parse(s); err == nil && u.Host != "" {
+			return u.Scheme + "://" + u.Host + "/<redacted>"
+		}
+		return redact(s)
+	}
+	if c.Notify != nil {
+		n := *c.Notify
+		n.WebhookURL = redactURL(n.WebhookURL)
+		c.Notify = &n
+	}
+	c.HealthcheckURL = redactURL(c.HealthcheckURL)
+	// Volumes show the keys they end up encrypting with, inherited or not.
+	c.Volumes = slices.Clone(c.Volumes)
+	for i := range c.Volumes {
+		effective := cfg.forVolume(&c.Volumes[i])
+		c.Volumes[i].EncryptionKey = redact(effective.EncryptionKey)
+		c.Volumes[i].EncryptionKeys = redactAll(effective.EncryptionKeys)
+	}
+	return &c
+}
+
+// location returns the zone named by timezone, UTC when it is unset or
+// unknown (which validate reports).
+func (cfg *Config) location() *time.Location {
+	loc, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// parseWeekday parses a day name such as "Sunday" or "sun", in any case.
+func parseWeekday(name string) (time.Weekday, bool) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(name, d.String()) || strings.EqualFold(name, d.String()[:3]) {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// fallbackToFull reports whether an incremental whose parent is missing from
+// the remote is sent as a full instead. Unset means yes.
+func (cfg *Config) fallbackToFull() bool {
+	return cfg.FallbackToFull == nil || *cfg.FallbackToFull
+}
+
+func (cfg *Config) createSnapdir() bool {
+	return cfg.CreateSnapdir == nil || *cfg.CreateSnapdir
+}
+
+// selectVolumes narrows Volumes down to the named ones, keeping config order.
+func (cfg *Config) selectVolumes(names []string) error {
+	var missing []string
+	for _, name := range names {
+		if findVolume(cfg, name) == nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("volume(s) not found in config: %s", strings.Join(missing, ", "))
+	}
+
+	cfg.Volumes = slices.DeleteFunc(cfg.Volumes, func(vol Volume) bool {
+		return !slices.Contains(names, vol.Name)
+	})
+	return nil
+}
+
+// selectTags narrows cfg.Volumes to those with any of tags. A tag no volume
+// has isn't an error, it just matches nothing.
+func (cfg *Config) selectTags(tags []string) {
+	cfg.Volumes = slices.DeleteFunc(cfg.Volumes, func(vol Volume) bool {
+		return !slices.ContainsFunc(vol.Tags, func(tag string) bool {
+			return slices.Contains(tags, tag)
+		})
+	})
+}
+
+// skipDisabledVolumes leaves out volumes paused with enabled: false.
+func (cfg *Config) skipDisabledVolumes() {
+	cfg.Volumes = slices.DeleteFunc(cfg.Volumes, func(vol Volume) bool {
+		if vol.enabled() {
+			return false
+		}
+		if verbose {
+			fmt.Printf("→ Skipping %s, it's disabled\n", vol.Name)
+		}
+		return true
+	})
+}
+
+// enabled reports whether vol is backed up. Unset means yes.
+func (vol *Volume) enabled() bool {
+	return vol.Enabled == nil || *vol.Enabled
+}
+
+// overrideDestination points the primary destination at host and dest from
+// -remote-host and -remote-dest, where they're set, and checks the result.
+// Mirrors keep their own destinations. A new host doesn't inherit
+// remote_port; it can carry its own as host:port.
+func (cfg *Config) overrideDestination(host, dest string) error {
+	if host == "" && dest == "" {
+		return nil
+	}
+	if cfg.Backend != "ssh" {
+		return fmt.Errorf("-remote-host and -remote-dest don't apply to backend %s", cfg.Backend)
+	}
+	if host != "" {
+		cfg.RemoteHost = host
+		cfg.RemotePort = 0
+	}
+	if dest != "" {
+		cfg.RemoteDest = dest
+	}
+	cfg.backend = nil
+	return cfg.validate()
+}
+
+// forVolume returns the config to use for vol, with its overrides of
+// global settings applied.
+func (cfg *Config) forVolume(vol *Volume) *Config {
+	if vol.EncryptionKey == "" && len(vol.EncryptionKeys) == 0 {
+		return cfg
+	}
+	c := *cfg
+	c.EncryptionKey = vol.EncryptionKey
+	c.EncryptionKeys = vol.EncryptionKeys
+	return &c
+}
+
+func trimAll(values []string) []string {
+	var trimmed []string
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			trimmed = append(trimmed, v)
+		}
+	}
+	return trimmed
+}
+
+// validate checks the config once defaults are applied and reports every
+// problem at once rather than stopping at the first.
+func (cfg *Config) validate() error {
+	var problems []string
+	addf := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// Mirrors are checked like the primary destination, with their fields
+	// prefixed by mirrors[i].
+	checkDestination := func(prefix, host string, port int, dest string) {
+		if host != "" {
+			if _, _, hostPort, err := splitRemoteHost(host); err != nil {
+				addf("%sremote_host: %v", prefix, err)
+			} else if hostPort != 0 && port != 0 && hostPort != port {
+				addf("%sremote_host port %d conflicts with remote_port %d", prefix, hostPort, port)
+			}
+		}
+		if dest == "" {
+			addf("%sremote_dest is required", prefix)
+		} else if host == "" && !filepath.IsAbs(dest) {
+			addf("%sremote_dest must be an absolute path when remote_host is empty (local destination)", prefix)
+		}
+	}
+
+	switch cfg.Backend {
+	case "ssh":
+		checkDestination("", cfg.RemoteHost, cfg.RemotePort, cfg.RemoteDest)
+		for i, m := range cfg.Mirrors {
+			checkDestination(fmt.Sprintf("mirrors[%d].", i), m.RemoteHost, m.RemotePort, m.RemoteDest)
+		}
+		if len(cfg.Mirrors) > 0 && cfg.Transport == "rsync" {
+			addf("mirrors are not supported with transport rsync")
+		}
+	case "s3":
+		if len(cfg.Mirrors) > 0 {
+			addf("mirrors are not supported with backend s3")
+		}
+		if cfg.S3 == nil {
+			addf("backend s3 requires an s3 block")
+		}
+		if cfg.Transport == "rsync" {
+			addf("transport rsync is not supported with backend s3")
+		}
+		if cfg.RemoteLock {
+			addf("remote_lock is not supported with backend s3")
+		}
+		if cfg.SkipIdentical {
+			addf("skip_identical is not supported with backend s3")
+		}
+		if cfg.MaxTotalBytes != 0 {
+			addf("max_total_bytes is not supported with backend s3")
+		}
+		if cfg.VerifyReceive {
+			addf("verify_receive is not supported with backend s3")
+		}
+		if cfg.RemoteFileMode != 0 || cfg.RemoteDirMode != 0 {
+			addf("remote_file_mode and remote_dir_mode are not supported with backend s3")
+		}
+	case "command":
+		if cfg.Command == "" {
+			addf("backend command requires command")
+		}
+		if len(cfg.Mirrors) > 0 {
+			addf("mirrors are not supported with backend command")
+		}
+		if cfg.Transport == "rsync" {
+			addf("transport rsync is not supported with backend command")
+		}
+		if cfg.RemoteLock {
+			addf("remote_lock is not supported with backend command")
+		}
+		if cfg.SkipIdentical {
+			addf("skip_identical is not supported with backend command")
+		}
+		if cfg.MaxTotalBytes != 0 {
+			addf("max_total_bytes is not supported with backend command")
+		}
+		if cfg.VerifyReceive {
+			addf("verify_receive is not supported with backend command")
+		}
+		if cfg.RemoteFileMode != 0 || cfg.RemoteDirMode != 0 {
+			addf("remote_file_mode and remote_dir_mode are not supported with backend command")
+		}
+	default:
+		addf("unknown backend %q (expected ssh, s3 or command)", cfg.Backend)
+	}
+
+	switch cfg.Mode {
+	case "archive":
+	case "replicate":
+		// The stream goes straight into btrfs receive, which can only
+		// take it as btrfs send wrote it.
+		if cfg.Backend != "ssh" {
+			addf("mode replicate requires backend ssh")
+		}
+		if cfg.Transport == "rsync" {
+			addf("mode replicate is not supported with transport rsync")
+		}
+		if cfg.Compression != "none" {
+			addf("compression is not supported with mode replicate")
+		}
+		if cfg.encrypted() {
+			addf("encryption is not supported with mode replicate")
+		}
+		if len(cfg.Mirrors) > 0 {
+			addf("mirrors are not supported with mode replicate")
+		}
+		if cfg.SkipIdentical {
+			addf("skip_identical is not supported with mode replicate")
+		}
+		if cfg.MaxTotalBytes != 0 {
+			addf("max_total_bytes is not supported with mode replicate")
+		}
+		if cfg.VerifyReceive {
+			addf("verify_receive is not supported with mode replicate")
+		}
+	default:
+		addf("unknown mode %q (expected archive or replicate)", cfg.Mode)
+	}
+
+	switch cfg.Transport {
+	case "ssh", "rsync":
+	default:
+		addf("unknown transport %q (expected ssh or rsync)", cfg.Transport)
+	}
+
+	switch cfg.EncryptionBackend {
+	case "age", "gpg":
+	default:
+		addf("unknown encryption_backend %q (expected age or gpg)", cfg.EncryptionBackend)
+	}
+
+	if _, ok := lookupChecksumAlgorithm(cfg.ChecksumAlgorithm); !ok {
+		addf("unknown checksum_algorithm %q (expected sha256 or blake3)", cfg.ChecksumAlgorithm)
+	}
+	if cfg.VerifyReceive && cfg.encrypted() {
+		addf("verify_receive is not supported with encryption (the remote can't decrypt)")
+	}
+	switch cfg.VerifyMode {
+	case "both", "remote":
+	case "local":
+		// The stored file is hashed afterwards with a remote shell command.
+		if cfg.Backend != "ssh" {
+			addf("verify_mode local is not supported with backend %s", cfg.Backend)
+		}
+	default:
+		addf("unknown verify_mode %q (expected both, remote or local)", cfg.VerifyMode)
+	}
+
+	if err := validateCompression(cfg); err != nil {
+		addf("%v", err)
+	}
+
+	if cfg.Notify != nil {
+		if u, err := url.Parse(cfg.Notify.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			addf("notify webhook_url must be an http(s) URL")
+		}
+	}
+	if cfg.HealthcheckURL != "" {
+		if u, err := url.Parse(cfg.HealthcheckURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			addf("healthcheck_url must be an http(s) URL")
+		}
+	}
+
+	if cfg.RemotePort < 0 || cfg.RemotePort > 65535 {
+		addf("remote_port %d out of range", cfg.RemotePort)
+	}
+	if cfg.MaxAgeDays < 0 {
+		addf("max_age_days must not be negative")
+	}
+	if cfg.MaxIncrementals < 0 {
+		addf("max_incrementals must not be negative")
+	}
+	if cfg.FullOnWeekday != "" {
+		if _, ok := parseWeekday(cfg.FullOnWeekday); !ok {
+			addf("unknown full_on_weekday %q (expected a day such as Sunday)", cfg.FullOnWeekday)
+		}
+	}
+	if cfg.MinInterval < 0 {
+		addf("min_interval must not be negative")
+	}
+	if cfg.MinChangeBytes < 0 {
+		addf("min_change_bytes must not be negative")
+	}
+	if cfg.MaxTotalBytes < 0 {
+		addf("max_total_bytes must not be negative")
+	}
+	if cfg.KeepFulls < 0 {
+		addf("keep_fulls must not be negative")
+	}
+	if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+		addf("unknown timezone %q", cfg.Timezone)
+	}
+	if cfg.LocalRetention < 0 {
+		addf("local_retention must not be negative")
+	}
+	if cfg.Retries < 0 {
+		addf("retries must not be negative")
+	}
+	if cfg.StaleTmpAge > 0 && cfg.StaleTmpAge < time.Minute {
+		// find ages files in whole minutes, so less would match every upload.
+		addf("stale_tmp_age must be at least 1m")
+	}
+	if cfg.RunTimeout < 0 {
+		addf("run_timeout must not be negative")
+	}
+	if cfg.OpTimeout < 0 {
+		addf("op_timeout must not be negative")
+	}
+	if cfg.Parallelism < 0 {
+		addf("parallelism must not be negative")
+	}
+
+	seen := map[string]bool{}
+	for i, vol := range cfg.Volumes {
+		label := vol.Name
+		if label == "" {
+			label = fmt.Sprintf("#%d", i+1)
+			addf("volume %s: name is required", label)
+		} else if seen[vol.Name] {
+			addf("volume %s: duplicate name", label)
+		}
+		seen[vol.Name] = true
+
+		if vol.Src == "" {
+			addf("volume %s: src is required", label)
+		}
+		if vol.SnapDir == "" {
+			addf("volume %s: snapdir is required", label)
+		}
+		if vol.MaxAgeDays < 0 {
+			addf("volume %s: max_age_days must not be negative", label)
+		}
+		if vol.MinInterval < 0 {
+			addf("volume %s: min_interval must not be negative", label)
+		}
+		if vol.MaxIncrementals < 0 {
+			addf("volume %s: max_incrementals must not be negative", label)
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid config:\n  - %s", strings.Join(problems, "\n  - "))
+}
+
+// expandEnv substitutes $VAR and ${VAR} in path-like fields. HOSTNAME falls
+// back to the system hostname since shells rarely export it. Undefined
+// variables expand to empty, or are an error with --strict-env.
+func (cfg *Config) expandEnv() error {
+	var missing []string
+	mapping := func(name string) string {
+		if value, ok := os.LookupEnv(name); ok {
+			return value
+		}
+		if name == "HOSTNAME" {
+			if host, err := os.Hostname(); err == nil {
+				return host
+			}
+		}
+		if !slices.Contains(missing, name) {
+			missing = append(missing, name)
+		}
+		return ""
+	}
+
+	fields := []*string{&cfg.RemoteHost, &cfg.RemoteDest, &cfg.SSHKey, &cfg.EncryptionKeyFile}
+	for i := range cfg.Volumes {
+		fields = append(fields, &cfg.Volumes[i].Src, &cfg.Volumes[i].SnapDir, &cfg.Volumes[i].EncryptionKeyFile)
+	}
+	for i := range cfg.Mirrors {
+		fields = append(fields, &cfg.Mirrors[i].RemoteHost, &cfg.Mirrors[i].RemoteDest, &cfg.Mirrors[i].SSHKey)
+	}
+	for _, field := range fields {
+		*field = os.Expand(*field, mapping)
+	}
+
+	if strictEnv && len(missing) > 0 {
+		return fmt.Errorf("undefined environment variables in config: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// resolveEncryptionKeys reads encryption_key_file and encryption_key_env into
+// encryption_key, globally and per volume, so the key needn't sit in the
+// config. Only one of the three may be set in one place; a volume setting any
+// of them still replaces the global key.
+func (cfg *Config) resolveEncryptionKeys() error {
+	key, err := resolveEncryptionKey("", cfg.EncryptionKey, cfg.EncryptionKeyFile, cfg.EncryptionKeyEnv)
+	if err != nil {
+		return err
+	}
+	cfg.EncryptionKey = key
+
+	for i := range cfg.Volumes {
+		vol := &cfg.Volumes[i]
+		key, err := resolveEncryptionKey(fmt.Sprintf("volume %s: ", vol.Name), vol.EncryptionKey, vol.EncryptionKeyFile, vol.EncryptionKeyEnv)
+		if err != nil {
+			return err
+		}
+		vol.EncryptionKey = key
+	}
+	return nil
+}
+
+func resolveEncryptionKey(where, inline, file, env string) (string, error) {
+	set := 0
+	for _, source := range []string{inline, file, env} {
+		if source != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return "", fmt.Errorf("%sonly one of encryption_key, encryption_key_file and encryption_key_env may be set", where)
+	}
+
+	switch {
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("%sreading encryption_key_file: %w", where, err)
+		}
+		key := strings.TrimSpace(string(data))
+		if key == "" {
+			return "", fmt.Errorf("%sencryption_key_file %s is empty", where, file)
+		}
+		return key, nil
+	case env != "":
+		key := strings.TrimSpace(os.Getenv(env))
+		if key == "" {
+			return "", fmt.Errorf("%sencryption_key_env %s is not set", where, env)
+		}
+		return key, nil
+	}
+	return inline, nil
+}
@@ -3,7 +3,13 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -136,6 +142,84 @@ volumes:
 	}
 }
 
+func TestLoadConfigEncryptionKeySources(t *testing.T) {
+	tempDir := t.TempDir()
+	keyFile := filepath.Join(tempDir, "recipient")
+	if err := os.WriteFile(keyFile, []byte("age1fromfile\n"), 0o600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+	t.Setenv("TEST_RECIPIENT", " age1fromenv ")
+
+	base := "remote_dest: /data/backups\n"
+	volumes := "volumes:\n  - name: root\n    src: /@\n    snapdir: /.snapshots\n"
+
+	tests := []struct {
+		name    string
+		content string
+		global  string
+		volume  string
+		wantErr string
+	}{
+		{
+			name:    "file",
+			content: base + "encryption_key_file: " + keyFile + "\n" + volumes,
+			global:  "age1fromfile",
+		},
+		{
+			name:    "env",
+			content: base + "encryption_key_env: TEST_RECIPIENT\n" + volumes,
+			global:  "age1fromenv",
+		},
+		{
+			name:    "volume overrides global",
+			content: base + "encryption_key: age1inline\n" + volumes + "    encryption_key_env: TEST_RECIPIENT\n",
+			global:  "age1inline",
+			volume:  "age1fromenv",
+		},
+		{
+			name:    "ambiguous",
+			content: base + "encryption_key: age1inline\nencryption_key_file: " + keyFile + "\n" + volumes,
+			wantErr: "only one of encryption_key, encryption_key_file and encryption_key_env",
+		},
+		{
+			name:    "unset env",
+			content: base + volumes + "    encryption_key_env: TEST_UNSET_RECIPIENT\n",
+			wantErr: "volume root: encryption_key_env TEST_UNSET_RECIPIENT is not set",
+		},
+		{
+			name:    "missing file",
+			content: base + "encryption_key_file: " + filepath.Join(tempDir, "missing") + "\n" + volumes,
+			wantErr: "reading encryption_key_file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configPath, []byte(tt.content), 0o644); err != nil {
+				t.Fatalf("failed to write config file: %v", err)
+			}
+
+			cfg, err := loadConfig(configPath)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error mentioning %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig failed: %v", err)
+			}
+			if cfg.EncryptionKey != tt.global {
+				t.Errorf("expected global key %q, got %q", tt.global, cfg.EncryptionKey)
+			}
+			if got := cfg.forVolume(&cfg.Volumes[0]).EncryptionKey; tt.volume != "" && got != tt.volume {
+				t.Errorf("expected volume key %q, got %q", tt.volume, got)
+			}
+		})
+	}
+}
+
 func TestLoadConfigMissingFile(t *testing.T) {
 	_, err := loadConfig("/nonexistent/config.yaml")
 	if err == nil {
@@ -218,3 +302,822 @@ volumes:
 		t.Errorf("expected empty EncryptionKey, got '%s'", cfg.EncryptionKey)
 	}
 }
+
+func TestLoadConfigPerVolumeRetention(t *testing.T) {
+	tempDir := t.TempDir()
+	configPath := filepath.Join(tempDir, "config.yaml")
+
+	configContent := `remote_host: backup@example.com
+remote_dest: /data/backups
+max_age_days: 14
+max_incrementals: 5
+
+volumes:
+  - name: db
+    src: /@db
+    snapdir: /.snapshots/db
+    max_age_days: 7
+  - name: media
+    src: /@media
+    snapdir: /.snapshots/media
+    max_age_days: 90
+    max_incrementals: 60
+  - name: home
+    src: /@home
+    snapdir: /.snapshots/home
+`
+
+	if err := os.WriteFile(configPath, []byte(configContent), 0o644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+
+	tests := []struct {
+		name                string
+		wantMaxAgeDays      int
+		wantMaxIncrementals int
+	}{
+		{"db", 7, 5},
+		{"media", 90, 60},
+		{"home", 14, 5},
+	}
+
+	for i, tt := range tests {
+		vol := cfg.Volumes[i]
+		if vol.Name != tt.name {
+			t.Fatalf("expected volume[%d].Name %q, got %q", i, tt.name, vol.Name)
+		}
+		if vol.MaxAgeDays != tt.wantMaxAgeDays {
+			t.Errorf("volume %s: expected MaxAgeDays %d, got %d", vol.Name, tt.wantMaxAgeDays, vol.MaxAgeDays)
+		}
+		if vol.MaxIncrementals != tt.wantMaxIncrementals {
+			t.Errorf("volume %s: expected MaxIncrementals %d, got %d", vol.Name, tt.wantMaxIncrementals, vol.MaxIncrementals)
+		}
+	}
+}
+
+func TestLoadConfigPerVolumeHooks(t *testing.T) {
+	tempDir := t.TempDir()
+	configPath := filepath.Join(tempDir, "config.yaml")
+
+	configContent := `remote_host: backup@example.com
+remote_dest: /data/backups
+pre_backup:
+  - sync
+post_backup:
+  - echo done
+
+volumes:
+  - name: db
+    src: /@db
+    snapdir: /.snapshots/db
+    pre_backup:
+      - psql -c 'CHECKPOINT'
+  - name: media
+    src: /@media
+    snapdir: /.snapshots/media
+    post_backup: []
+`
+
+	if err := os.WriteFile(configPath, []byte(configContent), 0o644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+
+	db, media := cfg.Volumes[0], cfg.Volumes[1]
+	if !slices.Equal(db.PreBackup, []string{"psql -c 'CHECKPOINT'"}) || !slices.Equal(db.PostBackup, []string{"echo done"}) {
+		t.Errorf("db: unexpected hooks %q, %q", db.PreBackup, db.PostBackup)
+	}
+	if !slices.Equal(media.PreBackup, []string{"sync"}) || len(media.PostBackup) != 0 {
+		t.Errorf("media: unexpected hooks %q, %q", media.PreBackup, media.PostBackup)
+	}
+}
+
+func TestLoadConfigS3Backend(t *testing.T) {
+	tempDir := t.TempDir()
+	configPath := filepath.Join(tempDir, "config.yaml")
+
+	configContent := `backend: s3
+s3:
+  bucket: backups
+  endpoint: https://minio.example.com
+  access_key: AKID
+  secret_key: secret
+
+volumes:
+  - name: root
+    src: /@
+    snapdir: /.snapshots
+`
+
+	if err := os.WriteFile(configPath, []byte(configContent), 0o644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+
+	b, ok := cfg.remote().(*s3Backend)
+	if !ok {
+		t.Fatalf("expected s3 backend, got %T", cfg.remote())
+	}
+	if b.region != "us-east-1" {
+		t.Errorf("expected default region us-east-1, got %q", b.region)
+	}
+}
+
+func TestLoadConfigS3BackendRequiresBlock(t *testing.T) {
+	tempDir := t.TempDir()
+	configPath := filepath.Join(tempDir, "config.yaml")
+
+	configContent := `backend: s3
+
+volumes:
+  - name: root
+    src: /@
+    snapdir: /.snapshots
+`
+
+	if err := os.WriteFile(configPath, []byte(configContent), 0o644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	if _, err := loadConfig(configPath); err == nil {
+		t.Fatal("expected error for backend s3 without an s3 block")
+	}
+}
+
+func TestLoadConfigCompression(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"default", "", false},
+		{"zstd with level", "compression: zstd\ncompression_level: 19\n", false},
+		{"gzip level too high", "compression: gzip\ncompression_level: 10\n", true},
+		{"level without compression", "compression_level: 3\n", true},
+		{"unknown", "compression: lz4\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			content := tt.content + "remote_dest: /backups\nvolumes:\n  - name: root\n    src: /@\n    snapdir: /.snapshots\n"
+			if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+				t.Fatalf("failed to write config file: %v", err)
+			}
+
+			cfg, err := loadConfig(configPath)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig failed: %v", err)
+			}
+			if tt.content == "" && cfg.Compression != "none" {
+				t.Errorf("expected default compression none, got %q", cfg.Compression)
+			}
+		})
+	}
+}
+
+func TestLoadConfigBWLimit(t *testing.T) {
+	tests := []struct {
+		value string
+		want  ByteSize
+	}{
+		{"10M", 10 * 1024 * 1024},
+		{"2048", 2048},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			content := "bwlimit: " + tt.value + "\nremote_dest: /backups\nvolumes:\n  - name: root\n    src: /@\n    snapdir: /.snapshots\n"
+			if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+				t.Fatalf("failed to write config file: %v", err)
+			}
+
+			cfg, err := loadConfig(configPath)
+			if err != nil {
+				t.Fatalf("loadConfig failed: %v", err)
+			}
+			if cfg.BWLimit != tt.want {
+				t.Errorf("expected BWLimit %d, got %d", tt.want, cfg.BWLimit)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRetries(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := "retries: 3\nretry_backoff: 10s\nremote_dest: /backups\nvolumes:\n  - name: root\n    src: /@\n    snapdir: /.snapshots\n"
+	if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if cfg.Retries != 3 || cfg.RetryBackoff != 10*time.Second {
+		t.Errorf("expected 3 retries every 10s, got %d every %s", cfg.Retries, cfg.RetryBackoff)
+	}
+}
+
+func TestLoadConfigFileModes(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := "remote_file_mode: 0600\nremote_dir_mode: \"0o750\"\nremote_dest: /backups\nvolumes:\n  - name: root\n    src: /@\n    snapdir: /.snapshots\n"
+	if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if cfg.RemoteFileMode != 0o600 || cfg.RemoteDirMode != 0o750 {
+		t.Errorf("expected modes 0600 and 0750, got %s and %s", cfg.RemoteFileMode, cfg.RemoteDirMode)
+	}
+
+	content = "remote_file_mode: 0999\nremote_dest: /backups\n"
+	if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	if _, err := loadConfig(configPath); err == nil || !strings.Contains(err.Error(), "invalid file mode") {
+		t.Fatalf("expected an invalid file mode error, got %v", err)
+	}
+}
+
+func TestLoadConfigVolumeEnabled(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := "remote_dest: /backups\nvolumes:\n  - name: root\n    src: /@\n    snapdir: /.snapshots\n  - name: home\n    src: /@home\n    snapdir: /.snapshots\n    enabled: false\n"
+	if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if !cfg.Volumes[0].enabled() || cfg.Volumes[0].Enabled == nil {
+		t.Errorf("expected root to default to enabled, got %v", cfg.Volumes[0].Enabled)
+	}
+	if cfg.Volumes[1].enabled() {
+		t.Error("expected home to be disabled")
+	}
+}
+
+func TestValidateNegativeMaxTotalBytes(t *testing.T) {
+	// The size parser already refuses "-1", but a config built in code isn't
+	// parsed.
+	cfg := &Config{RemoteDest: "/backups", MaxTotalBytes: -1}
+	cfg.applyDefaults()
+
+	err := cfg.validate()
+	if err == nil || !strings.Contains(err.Error(), "max_total_bytes must not be negative") {
+		t.Fatalf("expected a negative max_total_bytes to be rejected, got %v", err)
+	}
+}
+
+func TestOverrideDestination(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := "remote_host: backup.example.com\nremote_port: 2222\nremote_dest: /backups\nmirrors:\n  - remote_host: mirror\n    remote_dest: /mirror\n"
+	if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if err := cfg.overrideDestination("", "/scratch"); err != nil {
+		t.Fatalf("overriding remote_dest: %v", err)
+	}
+	if cfg.RemoteHost != "backup.example.com" || cfg.RemotePort != 2222 || cfg.RemoteDest != "/scratch" {
+		t.Errorf("expected only remote_dest replaced, got %s:%d %s", cfg.RemoteHost, cfg.RemotePort, cfg.RemoteDest)
+	}
+
+	if err := cfg.overrideDestination("scratch.example.com:2200", ""); err != nil {
+		t.Fatalf("overriding remote_host: %v", err)
+	}
+	if cfg.RemoteHost != "scratch.example.com:2200" || cfg.RemotePort != 0 {
+		t.Errorf("expected the new host without the old port, got %s:%d", cfg.RemoteHost, cfg.RemotePort)
+	}
+	if cfg.Mirrors[0].RemoteHost != "mirror" || cfg.Mirrors[0].RemoteDest != "/mirror" {
+		t.Errorf("expected mirrors left alone, got %+v", cfg.Mirrors[0])
+	}
+
+	if err := cfg.overrideDestination("[::1", ""); err == nil || !strings.Contains(err.Error(), "remote_host") {
+		t.Errorf("expected the override to be validated, got %v", err)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	write := func(t *testing.T, content string) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write config file: %v", err)
+		}
+		return path
+	}
+
+	valid := "remote_dest: /backups\nvolumes:\n  - name: root\n    src: /@\n    snapdir: /.snapshots\n"
+	if err := checkConfig(write(t, valid)); err != nil {
+		t.Fatalf("expected a valid config, got %v", err)
+	}
+
+	// A run ignores keys it doesn't know; the check doesn't.
+	typos := "remote_dest: /backups\nmax_age_dyas: 3\nvolumes:\n  - name: root\n    src: /@\n    snapdr: /.snapshots\n"
+	err := checkConfig(write(t, typos))
+	if err == nil {
+		t.Fatal("expected unknown settings to be reported")
+	}
+	for _, want := range []string{"line 2: unknown setting max_age_dyas", "line 6: unknown setting snapdr", "volume root: snapdir is required"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+
+	if err := checkConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("expected an error for a missing config")
+	}
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "config.yaml")
+	jsonPath := filepath.Join(dir, "config.json")
+
+	yamlContent := `remote_host: backup@example.com
+remote_dest: /backups
+min_interval: 1h
+bwlimit: 10M
+remote_file_mode: 0600
+retention:
+  keep_daily: 7
+volumes:
+  - name: root
+    src: /@
+    snapdir: /.snapshots
+    tags: [nightly]
+    enabled: false
+`
+	// As a provisioning template would write it, tabs and all.
+	jsonContent := `{
+	"remote_host": "backup@example.com",
+	"remote_dest": "/backups",
+	"min_interval": "1h",
+	"bwlimit": "10M",
+	"remote_file_mode": "0600",
+	"retention": {"keep_daily": 7},
+	"volumes": [
+		{"name": "root", "src": "/@", "snapdir": "/.snapshots", "tags": ["nightly"], "enabled": false}
+	]
+}
+`
+	if err := os.WriteFile(yamlPath, []byte(yamlContent), 0o644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	if err := os.WriteFile(jsonPath, []byte(jsonContent), 0o644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	fromYAML, err := loadConfig(yamlPath)
+	if err != nil {
+		t.Fatalf("loadConfig YAML: %v", err)
+	}
+	fromJSON, err := loadConfig(jsonPath)
+	if err != nil {
+		t.Fatalf("loadConfig JSON: %v", err)
+	}
+	if !reflect.DeepEqual(fromYAML, fromJSON) {
+		t.Fatalf("expected the same config from both:\nYAML: %+v\nJSON: %+v", fromYAML, fromJSON)
+	}
+	if err := checkConfig(jsonPath); err != nil {
+		t.Fatalf("checkConfig JSON: %v", err)
+	}
+}
+
+func TestLoadConfigJSONSyntax(t *testing.T) {
+	volumes := `"volumes": [{"name": "root", "src": "/@", "snapdir": "/.snapshots"}]`
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		wantErr string
+	}{
+		{"tabs between tokens", "config.json", "{\t\"remote_dest\":\t\"/backups\",\t" + volumes + "}", ""},
+		{"duplicate keys", "config.json", `{"remote_dest": "/backups", "remote_dest": "/other", ` + volumes + "}", `"remote_dest" already defined`},
+		{"comment", "config.json", "# generated\n{\"remote_dest\": \"/backups\", " + volumes + "}", "as JSON"},
+		{"YAML in a .json file", "config.json", "remote_dest: /backups\nvolumes: []\n", "as JSON"},
+		{"trailing comma", "config.json", `{"remote_dest": "/backups", ` + volumes + ",}", "as JSON"},
+		{"JSON in a .yaml file", "config.yaml", "# generated\n{\"remote_dest\": \"/backups\", " + volumes + "}", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatalf("failed to write config file: %v", err)
+			}
+
+			cfg, err := loadConfig(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("loadConfig: %v", err)
+				}
+				if cfg.RemoteDest != "/backups" {
+					t.Fatalf("expected remote_dest /backups, got %q", cfg.RemoteDest)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigExpandsEnv(t *testing.T) {
+	t.Setenv("BACKUP_ROOT", "/data/backups")
+	t.Setenv("BACKUP_HOST", "backup.example.com")
+	t.Setenv("HOSTNAME", "laptop")
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := `ssh_key: ${HOME}/.ssh/id_ed25519
+remote_host: backup@$BACKUP_HOST
+remote_dest: $BACKUP_ROOT/$HOSTNAME
+volumes:
+  - name: root
+    src: /@
+    snapdir: $SNAP_BASE/.snapshots
+`
+	if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+
+	if want := os.Getenv("HOME") + "/.ssh/id_ed25519"; cfg.SSHKey != want {
+		t.Errorf("expected SSHKey %q, got %q", want, cfg.SSHKey)
+	}
+	if cfg.RemoteHost != "backup@backup.example.com" {
+		t.Errorf("expected expanded RemoteHost, got %q", cfg.RemoteHost)
+	}
+	if cfg.RemoteDest != "/data/backups/laptop" {
+		t.Errorf("expected expanded RemoteDest, got %q", cfg.RemoteDest)
+	}
+	if cfg.Volumes[0].SnapDir != "/.snapshots" {
+		t.Errorf("expected undefined variable to expand to empty, got %q", cfg.Volumes[0].SnapDir)
+	}
+
+	strictEnv = true
+	t.Cleanup(func() { strictEnv = false })
+	if _, err := loadConfig(configPath); err == nil || !strings.Contains(err.Error(), "SNAP_BASE") {
+		t.Fatalf("expected strict mode to reject SNAP_BASE, got %v", err)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			name:    "missing remote_dest",
+			content: "remote_host: backup@example.com\n",
+			want:    []string{"remote_dest is required"},
+		},
+		{
+			name:    "relative local destination",
+			content: "remote_dest: backups\n",
+			want:    []string{"remote_dest must be an absolute path"},
+		},
+		{
+			name: "volume problems",
+			content: `remote_dest: /backups
+volumes:
+  - name: root
+    src: /@
+    snapdir: /.snapshots
+  - name: root
+    src: /@root2
+    snapdir: /.snapshots2
+  - src: /@nameless
+    snapdir: /.snapshots3
+  - name: home
+    max_age_days: -1
+    max_incrementals: -2
+`,
+			want: []string{
+				"volume root: duplicate name",
+				"volume #3: name is required",
+				"volume home: src is required",
+				"volume home: snapdir is required",
+				"volume home: max_age_days must not be negative",
+				"volume home: max_incrementals must not be negative",
+			},
+		},
+		{
+			name:    "negative policy",
+			content: "remote_dest: /backups\nmax_age_days: -3\nmax_incrementals: -1\n",
+			want:    []string{"max_age_days must not be negative", "max_incrementals must not be negative"},
+		},
+		{
+			name:    "unknown checksum",
+			content: "remote_dest: /backups\nchecksum_algorithm: md5\n",
+			want:    []string{`unknown checksum_algorithm "md5"`},
+		},
+		{
+			name:    "bad webhook",
+			content: "remote_dest: /backups\nnotify:\n  webhook_url: hooks.example.com\n",
+			want:    []string{"notify webhook_url must be an http(s) URL"},
+		},
+		{
+			name:    "bad healthcheck",
+			content: "remote_dest: /backups\nhealthcheck_url: hc-ping.com/abc\n",
+			want:    []string{"healthcheck_url must be an http(s) URL"},
+		},
+		{
+			name:    "unknown timezone",
+			content: "remote_dest: /backups\ntimezone: Mars/Olympus_Mons\n",
+			want:    []string{`unknown timezone "Mars/Olympus_Mons"`},
+		},
+		{
+			name:    "negative timeouts",
+			content: "remote_dest: /backups\nrun_timeout: -1h\nop_timeout: -1m\n",
+			want: []string{
+				"run_timeout must not be negative",
+				"op_timeout must not be negative",
+			},
+		},
+		{
+			name:    "sub-minute stale_tmp_age",
+			content: "remote_dest: /backups\nstale_tmp_age: 30s\n",
+			want:    []string{"stale_tmp_age must be at least 1m"},
+		},
+		{
+			name:    "replicate problems",
+			content: "remote_dest: /backups\nmode: replicate\ncompression: zstd\nencryption_key: age1example\nmirrors:\n  - remote_dest: /mirror\n",
+			want: []string{
+				"compression is not supported with mode replicate",
+				"encryption is not supported with mode replicate",
+				"mirrors are not supported with mode replicate",
+			},
+		},
+		{
+			name:    "unknown mode",
+			content: "remote_dest: /backups\nmode: mirror\n",
+			want:    []string{`unknown mode "mirror" (expected archive or replicate)`},
+		},
+		{
+			name:    "unknown full_on_weekday",
+			content: "remote_dest: /backups\nfull_on_weekday: Sundy\n",
+			want:    []string{`unknown full_on_weekday "Sundy" (expected a day such as Sunday)`},
+		},
+		{
+			name:    "negative max_total_bytes",
+			content: "remote_dest: /backups\nmax_total_bytes: -1\n",
+			want:    []string{`invalid size "-1"`},
+		},
+		{
+			name:    "max_total_bytes with replicate",
+			content: "remote_dest: /backups\nmode: replicate\nmax_total_bytes: 500G\n",
+			want:    []string{"max_total_bytes is not supported with mode replicate"},
+		},
+		{
+			name:    "verify_receive with encryption",
+			content: "remote_dest: /backups\nverify_receive: true\nvolumes:\n  - name: root\n    src: /@\n    snapdir: /.snapshots\n    encryption_key: age1example\n",
+			want:    []string{"verify_receive is not supported with encryption (the remote can't decrypt)"},
+		},
+		{
+			name:    "backend command problems",
+			content: "backend: command\ntransport: rsync\nverify_mode: local\nskip_identical: true\n",
+			want: []string{
+				"backend command requires command",
+				"transport rsync is not supported with backend command",
+				"skip_identical is not supported with backend command",
+				"verify_mode local is not supported with backend command",
+			},
+		},
+		{
+			name:    "mirror problems",
+			content: "remote_dest: /backups\ntransport: rsync\nmirrors:\n  - remote_host: backup@example.com\n  - remote_dest: backups\n",
+			want: []string{
+				"mirrors[0].remote_dest is required",
+				"mirrors[1].remote_dest must be an absolute path",
+				"mirrors are not supported with transport rsync",
+			},
+		},
+		{
+			name:    "unknown verify mode",
+			content: "remote_dest: /backups\nverify_mode: neither\n",
+			want:    []string{`unknown verify_mode "neither"`},
+		},
+		{
+			name:    "remote lock on s3",
+			content: "backend: s3\nremote_lock: true\ns3:\n  bucket: backups\n",
+			want:    []string{"remote_lock is not supported with backend s3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configPath, []byte(tt.content), 0o644); err != nil {
+				t.Fatalf("failed to write config file: %v", err)
+			}
+
+			_, err := loadConfig(configPath)
+			if err == nil {
+				t.Fatal("expected validation error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected error to mention %q, got:\n%v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := `remote_dest: /backups
+encryption_key: age1global
+s3:
+  bucket: backups
+  access_key: AKID
+  secret_key: hunter2
+notify:
+  webhook_url: https://hooks.example.com/T123/token?key=abc
+healthcheck_url: https://hc-ping.com/0b1e5ec2
+volumes:
+  - name: root
+    src: /@
+    snapdir: /.snapshots
+  - name: home
+    src: /@home
+    snapdir: /home/.snapshots
+    encryption_keys: [age1home]
+`
+	if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+
+	out, err := yaml.Marshal(cfg.redacted())
+	if err != nil {
+		t.Fatalf("marshalling: %v", err)
+	}
+	for _, secret := range []string{"age1global", "age1home", "AKID", "hunter2", "T123", "key=abc", "0b1e5ec2"} {
+		if strings.Contains(string(out), secret) {
+			t.Errorf("expected %q to be redacted, got:\n%s", secret, out)
+		}
+	}
+	for _, want := range []string{
+		"max_age_days: 7",
+		"webhook_url: https://hooks.example.com/<redacted>",
+		"healthcheck_url: https://hc-ping.com/<redacted>",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+
+	var shown Config
+	if err := yaml.Unmarshal(out, &shown); err != nil {
+		t.Fatalf("unmarshalling: %v", err)
+	}
+	if shown.Volumes[0].EncryptionKey != "<redacted>" {
+		t.Errorf("expected root to show the inherited key, got %+v", shown.Volumes[0])
+	}
+	if cfg.EncryptionKey != "age1global" || cfg.S3.SecretKey != "hunter2" || cfg.Volumes[1].EncryptionKeys[0] != "age1home" {
+		t.Errorf("expected the original config to be left alone")
+	}
+}
+
+func TestLoadConfigEncryptionKeys(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := `remote_dest: /backups
+encryption_key: age1laptop
+encryption_keys:
+  - " age1recovery "
+volumes:
+  - name: root
+    src: /@
+    snapdir: /.snapshots
+  - name: tenant
+    src: /@tenant
+    snapdir: /.snapshots-tenant
+    encryption_keys: [age1tenant, age1tenantrecovery]
+`
+	if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+
+	if got := strings.Join(cfg.forVolume(&cfg.Volumes[0]).recipients(), ","); got != "age1laptop,age1recovery" {
+		t.Errorf("unexpected root recipients %q", got)
+	}
+	if got := strings.Join(cfg.forVolume(&cfg.Volumes[1]).recipients(), ","); got != "age1tenant,age1tenantrecovery" {
+		t.Errorf("unexpected tenant recipients %q", got)
+	}
+}
+
+func TestSelectTags(t *testing.T) {
+	volumes := []Volume{
+		{Name: "root", Tags: []string{"nightly"}},
+		{Name: "home", Tags: []string{"hourly", "nightly"}},
+		{Name: "media", Tags: []string{"weekly"}},
+		{Name: "var"},
+	}
+
+	tests := []struct {
+		tags     []string
+		expected []string
+	}{
+		{[]string{"nightly"}, []string{"root", "home"}},
+		{[]string{"hourly", "weekly"}, []string{"home", "media"}},
+		{[]string{"unknown"}, nil},
+	}
+	for _, tt := range tests {
+		cfg := &Config{Volumes: slices.Clone(volumes)}
+		cfg.selectTags(tt.tags)
+
+		var names []string
+		for _, vol := range cfg.Volumes {
+			names = append(names, vol.Name)
+		}
+		if !slices.Equal(names, tt.expected) {
+			t.Errorf("tags %v: expected %v, got %v", tt.tags, tt.expected, names)
+		}
+	}
+}
+
+func TestSkipDisabledVolumes(t *testing.T) {
+	disabled := false
+	cfg := &Config{Volumes: []Volume{{Name: "root"}, {Name: "home", Enabled: &disabled}, {Name: "var"}}}
+
+	// Composes with -volume, which narrows the volumes first.
+	if err := cfg.selectVolumes([]string{"home", "var"}); err != nil {
+		t.Fatalf("selectVolumes: %v", err)
+	}
+
+	verbose = true
+	t.Cleanup(func() { verbose = false })
+	output := captureStdout(t, cfg.skipDisabledVolumes)
+
+	if len(cfg.Volumes) != 1 || cfg.Volumes[0].Name != "var" {
+		t.Fatalf("expected only var to be backed up, got %+v", cfg.Volumes)
+	}
+	if !strings.Contains(output, "Skipping home, it's disabled") {
+		t.Fatalf("expected a note about the disabled volume, got %q", output)
+	}
+}
+
+func TestSelectVolumes(t *testing.T) {
+	cfg := &Config{Volumes: []Volume{{Name: "root"}, {Name: "home"}, {Name: "var"}}}
+
+	if err := cfg.selectVolumes([]string{"var", "root"}); err != nil {
+		t.Fatalf("selectVolumes: %v", err)
+	}
+	if len(cfg.Volumes) != 2 || cfg.Volumes[0].Name != "root" || cfg.Volumes[1].Name != "var" {
+		t.Fatalf("expected root and var in config order, got %+v", cfg.Volumes)
+	}
+
+	err := cfg.selectVolumes([]string{"root", "missing"})
+	if err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("expected error naming the missing volume, got %v", err)
+	}
+	if len(cfg.Volumes) != 2 {
+		t.Fatalf("expected volumes untouched after an error, got %+v", cfg.Volumes)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// minBtrfsProgs is the oldest btrfs-progs release the tool is used with.
+var minBtrfsProgs = [2]int{5, 0}
+
+var btrfsProgsVersionRegexp = regexp.MustCompile(`v(\d+)\.(\d+)`)
+
+// doctorProbe is written to remote_dest to check it is writable. The .tmp
+// suffix means the stale temp file cleanup removes it if the check dies.
+const doctorProbe = "btrfs-backup-doctor.tmp"
+
+// runDoctor checks everything a backup depends on, printing a line per check,
+// and fails if any of them do.
+func runDoctor(ctx context.Context, cfg *Config, args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	failed := 0
+	report := func(name, detail string, err error) {
+		if err != nil {
+			failed++
+			fmt.Printf("%s %s: %v\n", color.RedString("✗"), name, err)
+			return
+		}
+		fmt.Printf("%s %s: %s\n", color.GreenString("✓"), name, detail)
+	}
+
+	version, err := checkBtrfsProgs(ctx)
+	report("btrfs-progs", version, err)
+
+	if cfg.Backend == "ssh" && cfg.RemoteHost != "" {
+		path, err := exec.LookPath(sshBin)
+		report("ssh", path, err)
+	}
+
+	encrypted := false
+	for i := range cfg.Volumes {
+		if len(cfg.forVolume(&cfg.Volumes[i]).recipients()) > 0 {
+			encrypted = true
+		}
+	}
+	if encrypted {
+		bin := ageBin
+		if cfg.EncryptionBackend == "gpg" {
+			bin = "gpg"
+		}
+		path, err := exec.LookPath(bin)
+		report(cfg.EncryptionBackend, path, err)
+	}
+
+	destination := cfg.RemoteDest
+	switch {
+	case cfg.Backend == "s3":
+		destination = "s3://" + cfg.S3.Bucket + "/" + cfg.S3.Prefix
+	case cfg.Backend == "command":
+		destination = cfg.Command
+	case cfg.RemoteHost != "":
+		destination = remoteTarget(cfg, cfg.RemoteDest)
+	}
+	if err := checkRemoteAccess(ctx, cfg); err != nil {
+		report("remote access", "", err)
+	} else {
+		report("remote access", destination, nil)
+		// A probe piped into the command would be archived like a backup.
+		if cfg.Backend != "command" {
+			report("remote writable", destination, checkRemoteWritable(ctx, cfg))
+		}
+	}
+
+	for i := range cfg.Volumes {
+		vol := &cfg.Volumes[i]
+		report("volume "+vol.Name, vol.Src+" is a subvolume", checkBtrfsAccess(ctx, vol))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	return nil
+}
+
+// checkBtrfsProgs returns the installed btrfs-progs version, or an error when
+// it is missing or older than minBtrfsProgs.
+func checkBtrfsProgs(ctx context.Context) (string, error) {
+	output, err := exec.CommandContext(ctx, btrfsBin, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s --version failed: %w", btrfsBin, err)
+	}
+
+	version := strings.TrimSpace(string(output))
+	match := btrfsProgsVersionRegexp.FindStringSubmatch(version)
+	if match == nil {
+		return "", fmt.Errorf("unable to parse version from %q", version)
+	}
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	if major < minBtrfsProgs[0] || major == minBtrfsProgs[0] && minor < minBtrfsProgs[1] {
+		return "", fmt.Errorf("%s is older than v%d.%d", version, minBtrfsProgs[0], minBtrfsProgs[1])
+	}
+
+	return version, nil
+}
+
+// checkRemoteWritable writes and removes a small file in remote_dest.
+func checkRemoteWritable(ctx context.Context, cfg *Config) error {
+	remote := cfg.remote()
+	if _, err := remote.Write(ctx, doctorProbe, strings.NewReader("btrfs-backup doctor\n")); err != nil {
+		return fmt.Errorf("writing %s: %w", doctorProbe, err)
+	}
+	if err := remote.Remove(ctx, doctorProbe); err != nil {
+		return fmt.Errorf("removing %s: %w", doctorProbe, err)
+	}
+	return nil
+}
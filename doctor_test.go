@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRunDoctor(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Backend:    "ssh",
+		Volumes:    []Volume{{Name: "root", Src: "/@"}},
+	}
+
+	out := captureStdout(t, func() {
+		if err := runDoctor(context.Background(), cfg, nil); err != nil {
+			t.Errorf("runDoctor: %v", err)
+		}
+	})
+	for _, want := range []string{"btrfs-progs: btrfs-progs v6.6.3", "remote writable: remote:" + remoteDir, "volume root"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+	if _, err := os.Stat(remoteDir + "/" + doctorProbe); !os.IsNotExist(err) {
+		t.Fatalf("expected the probe file to be removed, stat err: %v", err)
+	}
+}
+
+func TestRunDoctorReportsFailures(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+	t.Setenv("BTRFS_VERSION", "v4.19")
+	t.Setenv("BTRFS_FAIL_LIST", "1")
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Backend:    "ssh",
+		Volumes:    []Volume{{Name: "root", Src: "/@"}},
+	}
+
+	var err error
+	out := captureStdout(t, func() {
+		err = runDoctor(context.Background(), cfg, nil)
+	})
+	if err == nil || !strings.Contains(err.Error(), "2 check(s) failed") {
+		t.Fatalf("expected two failed checks, got %v", err)
+	}
+	for _, want := range []string{"older than v5.0", "volume root: error accessing"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runDownload fetches backups as they are stored, without decrypting or
+// receiving them, for archiving elsewhere.
+func runDownload(ctx context.Context, cfg *Config, args []string) error {
+	var volumeName, at, out string
+	var withIncrementals bool
+
+	fs := flag.NewFlagSet("download", flag.ContinueOnError)
+	fs.StringVar(&volumeName, "volume", "", "Name of the volume to download")
+	fs.StringVar(&at, "at", "", "Download the full that the backup taken at this timestamp builds on (default: latest)")
+	fs.StringVar(&out, "out", ".", "Directory to write the backups to")
+	fs.BoolVar(&withIncrementals, "with-incrementals", false, "Also download the incrementals up to --at")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if volumeName == "" {
+		return errors.New("download requires --volume")
+	}
+
+	if cfg.Backend == "s3" {
+		return errors.New("download is not supported with backend s3")
+	}
+
+	vol := findVolume(cfg, volumeName)
+	if vol == nil {
+		return fmt.Errorf("volume %q not found in config", volumeName)
+	}
+
+	target, err := parseAt(at)
+	if err != nil {
+		return err
+	}
+
+	backups, err := listRemoteBackups(ctx, cfg, vol)
+	if err != nil {
+		return err
+	}
+
+	chain, err := restoreChain(backups, target)
+	if err != nil {
+		return err
+	}
+	if !withIncrementals {
+		chain = chain[:1]
+	}
+
+	if !dryRun {
+		if err := os.MkdirAll(out, 0o755); err != nil {
+			return err
+		}
+	}
+
+	for _, b := range chain {
+		if err := downloadBackup(ctx, cfg, b.Name, out); err != nil {
+			return err
+		}
+	}
+
+	if verbose {
+		fmt.Printf("→ Downloaded %d backup(s) of %s into %s\n", len(chain), vol.Name, out)
+	}
+
+	return nil
+}
+
+// downloadBackup copies name from the remote into dir along with its checksum
+// sidecar, checking the bytes against the sidecar on the way. Nothing is left
+// under name unless it matches.
+func downloadBackup(ctx context.Context, cfg *Config, name, dir string) error {
+	path := filepath.Join(dir, name)
+	catRemoteCmd := fmt.Sprintf("cat %s", shellEscape(filepath.Join(cfg.RemoteDest, name)))
+
+	if verbose {
+		fmt.Printf("→ Downloading %s into %s\n", name, dir)
+	}
+
+	if dryRun {
+		if veryVerbose {
+			fmt.Printf("[DRY-RUN] %s > %s\n", describeRemoteCommand(cfg, catRemoteCmd), path)
+		}
+		return nil
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+
+	expected, algorithm, err := readRemoteChecksum(ctx, cfg, name)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	h := algorithm.newHash()
+	catCmd := remoteCommand(ctx, cfg, catRemoteCmd)
+	catCmd.Stdout = io.MultiWriter(f, h)
+	catCmd.Stderr = os.Stderr
+	err = catCmd.Run()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("downloading %s: %w", name, err)
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(actual, expected) {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("checksum mismatch for %s: expected=%s downloaded=%s", name, expected, actual)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	sidecar := fmt.Sprintf("%s  %s\n", expected, name)
+	if err := os.WriteFile(filepath.Join(dir, algorithm.sidecar(name)), []byte(sidecar), 0o644); err != nil {
+		return err
+	}
+
+	if verbose {
+		fmt.Printf("→ Verified %s\n", name)
+	}
+
+	return nil
+}
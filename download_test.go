@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunDownload(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	writeRemoteBackup(t, remoteDir, "home-2024-05-10_10-00-00.full.btrfs", "full;", true)
+	writeRemoteBackup(t, remoteDir, "home-2024-05-11_10-00-00.inc.btrfs", "inc1;", true)
+	writeRemoteBackup(t, remoteDir, "home-2024-05-12_10-00-00.inc.btrfs", "inc2;", true)
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Volumes:    []Volume{{Name: "home"}},
+	}
+
+	t.Run("full only", func(t *testing.T) {
+		out := t.TempDir()
+		if err := runDownload(context.Background(), cfg, []string{"--volume", "home", "--out", out}); err != nil {
+			t.Fatalf("runDownload: %v", err)
+		}
+		assertDir(t, out, []string{
+			"home-2024-05-10_10-00-00.full.btrfs",
+			"home-2024-05-10_10-00-00.full.btrfs.sha256",
+		})
+	})
+
+	t.Run("with incrementals", func(t *testing.T) {
+		out := t.TempDir()
+		args := []string{"--volume", "home", "--at", "2024-05-11_10-00-00", "--with-incrementals", "--out", out}
+		if err := runDownload(context.Background(), cfg, args); err != nil {
+			t.Fatalf("runDownload: %v", err)
+		}
+		assertDir(t, out, []string{
+			"home-2024-05-10_10-00-00.full.btrfs",
+			"home-2024-05-10_10-00-00.full.btrfs.sha256",
+			"home-2024-05-11_10-00-00.inc.btrfs",
+			"home-2024-05-11_10-00-00.inc.btrfs.sha256",
+		})
+
+		data, err := os.ReadFile(filepath.Join(out, "home-2024-05-11_10-00-00.inc.btrfs"))
+		if err != nil {
+			t.Fatalf("reading download: %v", err)
+		}
+		if string(data) != "inc1;" {
+			t.Fatalf("expected the backup as stored, got %q", string(data))
+		}
+	})
+}
+
+func TestRunDownloadChecksumMismatch(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	name := "home-2024-05-10_10-00-00.full.btrfs"
+	writeRemoteBackup(t, remoteDir, name, "full;", true)
+	if err := os.WriteFile(filepath.Join(remoteDir, name), []byte("corrupt"), 0o644); err != nil {
+		t.Fatalf("corrupting backup: %v", err)
+	}
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Volumes:    []Volume{{Name: "home"}},
+	}
+
+	out := t.TempDir()
+	err := runDownload(context.Background(), cfg, []string{"--volume", "home", "--out", out})
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch error, got %v", err)
+	}
+	assertDir(t, out, nil)
+}
+
+// assertDir checks dir holds exactly the files in expected.
+func assertDir(t *testing.T, dir string, expected []string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("reading %s: %v", dir, err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if strings.Join(names, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected %v in %s, got %v", expected, dir, names)
+	}
+}
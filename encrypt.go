@@ -0,0 +1,69 @@
+package main
+
+import "slices"
+
+// recipients returns every key backups are encrypted to, from both the
+// scalar encryption_key and the encryption_keys list.
+func (cfg *Config) recipients() []string {
+	var keys []string
+	if cfg.EncryptionKey != "" {
+		keys = append(keys, cfg.EncryptionKey)
+	}
+	return append(keys, cfg.EncryptionKeys...)
+}
+
+// encrypted reports whether any backups are encrypted, globally or by a
+// volume's own keys.
+func (cfg *Config) encrypted() bool {
+	return len(cfg.recipients()) > 0 || slices.ContainsFunc(cfg.Volumes, func(v Volume) bool {
+		return v.EncryptionKey != "" || len(v.EncryptionKeys) > 0
+	})
+}
+
+// encryptionSuffix returns the file suffix added by encryption, if enabled.
+func encryptionSuffix(cfg *Config) string {
+	if len(cfg.recipients()) == 0 {
+		return ""
+	}
+	if cfg.EncryptionBackend == "gpg" {
+		return ".gpg"
+	}
+	return ".age"
+}
+
+// encryptArgs returns the command encrypting the send stream, or nil when
+// encryption is disabled. Any one recipient's identity can decrypt.
+func encryptArgs(cfg *Config) []string {
+	keys := cfg.recipients()
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if cfg.EncryptionBackend == "gpg" {
+		args := []string{"gpg", "--batch", "--encrypt"}
+		for _, key := range keys {
+			args = append(args, "--recipient", key)
+		}
+		return args
+	}
+
+	args := []string{ageBin}
+	for _, key := range keys {
+		args = append(args, "-r", key)
+	}
+	return args
+}
+
+// decryptArgs returns the command decrypting a backup, chosen by its file
+// name, or nil when it isn't encrypted. gpg finds its key in the keyring;
+// age needs the identity file.
+func decryptArgs(name, identity string) []string {
+	enc, _ := parseBackupEncoding(name)
+	switch enc.Encryption {
+	case "age":
+		return []string{ageBin, "-d", "-i", identity}
+	case "gpg":
+		return []string{"gpg", "--batch", "--decrypt"}
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// exampleComments documents every config field for -print-example-config,
+// keyed by its YAML path with list indices left out.
+var exampleComments = map[string]string{
+	"ssh_key":                     "Private key for ssh; empty uses ssh's own defaults",
+	"ssh_options":                 "Extra ssh options; entries starting with - are raw flags",
+	"ssh_multiplex":               "Reuse one ssh connection for the whole run",
+	"ssh_control_dir":             "Where the multiplexing control socket lives; empty uses $TMPDIR",
+	"remote_host":                 "user@host[:port]; empty writes to a local remote_dest",
+	"remote_port":                 "ssh port when sshd listens elsewhere; 0 uses ssh's default",
+	"remote_dest":                 "Directory backups are written to",
+	"mirrors":                     "Extra ssh destinations sent a copy of every backup",
+	"mirrors.remote_host":         "Mirror host, as remote_host",
+	"mirrors.remote_port":         "Mirror ssh port, as remote_port",
+	"mirrors.remote_dest":         "Mirror directory, as remote_dest",
+	"mirrors.ssh_key":             "Mirror key; the primary's isn't reused",
+	"max_age_days":                "Force a full backup after this many days",
+	"max_incrementals":            "Force a full backup after this many incrementals; 0 for no limit",
+	"full_on_weekday":             "Force a full backup on the first run on this day, e.g. Sunday; empty for none",
+	"min_interval":                "Skip a volume whose last snapshot is newer than this (-f ignores)",
+	"pre_backup":                  "Shell commands run before each volume's backup",
+	"post_backup":                 "Shell commands run after each volume's backup, even a failed one",
+	"encryption_key":              "Encrypt backups to this recipient (recommended)",
+	"encryption_key_file":         "Read encryption_key from this file instead",
+	"encryption_key_env":          "Read encryption_key from this environment variable instead",
+	"encryption_keys":             "Extra recipients; any one identity can decrypt",
+	"encryption_backend":          "age or gpg",
+	"checksum_algorithm":          "sha256 or blake3 (needs b3sum on the remote)",
+	"verify_mode":                 "both hashes on each end; remote trusts the remote's hash; local hashes here and checks the stored file after",
+	"verify_receive":              "Have the remote parse each new backup with btrfs receive --dump; not with encryption",
+	"compression":                 "none, zstd or gzip; applied before encryption",
+	"compression_level":           "0 uses the compressor's default",
+	"transport":                   "ssh streams straight to the remote; rsync stages in $TMPDIR so transfers resume",
+	"btrfs_bin":                   "btrfs command, looked up on $PATH unless absolute",
+	"ssh_bin":                     "ssh command, looked up on $PATH unless absolute",
+	"age_bin":                     "age command, looked up on $PATH unless absolute",
+	"bwlimit":                     "Transfer cap in bytes/sec (K/M/G suffixes); 0 for none",
+	"min_free_bytes":              "Space to leave free on the destination after a full",
+	"min_change_bytes":            "Drop incrementals smaller than this (empty ones always are)",
+	"max_total_bytes":             "Evict the oldest chains to keep each volume's backups under this; 0 for no cap",
+	"stale_tmp_age":               "Remove abandoned .tmp uploads older than this at startup",
+	"retries":                     "Retry failed remote operations and sends this many times",
+	"retry_backoff":               "Initial delay between retries, doubled each time",
+	"run_timeout":                 "Give up on the whole run after this long (-timeout)",
+	"op_timeout":                  "Kill a single remote listing, check, rename or delete after this long",
+	"parallelism":                 "Volumes backed up at once (progress display needs 1)",
+	"backend":                     "ssh uses remote_host/remote_dest; s3 uploads to a bucket; command pipes each file into command",
+	"command":                     "Shell command each file is piped into with backend command; %s is replaced by its quoted name",
+	"mode":                        "archive stores send streams as files; replicate receives them into subvolumes on the remote",
+	"s3":                          "S3-compatible bucket used with backend: s3",
+	"s3.bucket":                   "Bucket name",
+	"s3.endpoint":                 "Endpoint URL; AWS, MinIO, B2, R2, ...",
+	"s3.region":                   "Region used for signing",
+	"s3.prefix":                   "Key prefix inside the bucket",
+	"s3.access_key":               "Defaults to $AWS_ACCESS_KEY_ID",
+	"s3.secret_key":               "Defaults to $AWS_SECRET_ACCESS_KEY",
+	"s3.part_size_mb":             "Multipart upload chunk size",
+	"keep_fulls":                  "Newest full chains always kept",
+	"maintain_latest":             "Keep <volume>-latest on the remote naming the newest backup",
+	"remote_file_mode":            "Octal mode for backups and their sidecars, e.g. 0600; unset leaves the remote umask",
+	"remote_dir_mode":             "Octal mode for remote_dest when it has to be created, e.g. 0700",
+	"remote_lock":                 "Hold a flock on remote_dest/.lock during the run, for hosts sharing remote_dest",
+	"skip_identical":              "Drop a full whose checksum matches the latest full on the remote",
+	"fallback_to_full":            "Send a full when an incremental's parent is missing from the remote; false fails instead",
+	"retention":                   "Grandfather-father-son retention of full chains; otherwise keep_fulls applies",
+	"retention.keep_daily":        "Days with a full chain kept",
+	"retention.keep_weekly":       "Weeks with a full chain kept",
+	"retention.keep_monthly":      "Months with a full chain kept",
+	"notify":                      "Webhook POSTed a JSON body when a backup fails",
+	"notify.webhook_url":          "http(s) URL to POST to",
+	"notify.notify_on_success":    "Also POST a summary after a clean run",
+	"healthcheck_url":             "Dead man's switch pinged at <url>/start, then <url> or <url>/fail",
+	"metrics_file":                "node_exporter textfile collector output, rewritten after each run",
+	"log_file":                    "Also append output here; reopened on SIGHUP (-log-file overrides)",
+	"lock_file":                   "Prevents overlapping runs (-lock-file overrides)",
+	"snapshot_prefix":             "Local snapshot names; others in snapdir are ignored",
+	"timezone":                    "Zone for snapshot and backup names: UTC, Local or an IANA name",
+	"local_retention":             "Local snapshots to keep; 0 keeps just the ones still needed",
+	"clone_sources":               "Let incrementals clone from earlier retained snapshots in the chain (btrfs send -c)",
+	"keep_failed_snapshots":       "Keep a new snapshot whose send failed instead of deleting it, for debugging",
+	"create_snapdir":              "Create a missing snapdir (mode 0700) before the first snapshot",
+	"retry_from_snapshot":         "Keep a snapshot whose send failed and send it again next run instead of taking a new one",
+	"volumes":                     "Subvolumes to back up",
+	"volumes.name":                "Unique name, used in backup file names",
+	"volumes.src":                 "Source subvolume",
+	"volumes.snapdir":             "Where local snapshots are kept",
+	"volumes.max_age_days":        "0 uses the global max_age_days",
+	"volumes.max_incrementals":    "0 uses the global max_incrementals",
+	"volumes.min_interval":        "0 uses the global min_interval",
+	"volumes.encryption_key":      "Replaces the global recipients for this volume",
+	"volumes.encryption_key_file": "Read the volume's encryption_key from this file instead",
+	"volumes.encryption_key_env":  "Read the volume's encryption_key from this environment variable instead",
+	"volumes.encryption_keys":     "Replaces the global extra recipients for this volume",
+	"volumes.pre_backup":          "Replaces the global pre_backup; [] turns it off",
+	"volumes.post_backup":         "Replaces the global post_backup; [] turns it off",
+	"volumes.tags":                "Labels for picking volumes with -tag",
+	"volumes.enabled":             "false pauses the volume without removing it from the config",
+}
+
+// exampleSamples are shown commented out in place of fields whose unset
+// value means something different from any value written out, or that only
+// make sense filled in.
+var exampleSamples = map[string]any{
+	"ssh_key":     "/root/.ssh/id_ed25519",
+	"ssh_options": []string{"ServerAliveInterval=30"},
+	"mirrors": []Mirror{{
+		RemoteHost: "backup@offsite.example.com",
+		RemoteDest: "/srv/backups/myhost",
+	}},
+	"pre_backup":          []string{"sync"},
+	"post_backup":         []string{`logger "btrfs-backup $BTRFS_BACKUP_VOLUME: $BTRFS_BACKUP_STATUS"`},
+	"encryption_key":      "age1...",
+	"encryption_key_file": "/etc/btrfs-backup/recipient",
+	"encryption_key_env":  "BTRFS_BACKUP_RECIPIENT",
+	"encryption_keys":     []string{"age1offlinerecoverykey..."},
+	"s3": &S3Config{
+		Bucket:     "my-backups",
+		Endpoint:   "https://s3.eu-west-1.amazonaws.com",
+		Region:     "eu-west-1",
+		Prefix:     "myhost",
+		PartSizeMB: 64,
+	},
+	"retention": &Retention{KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 6},
+	"notify": &NotifyConfig{
+		WebhookURL: "https://hooks.example.com/btrfs-backup",
+	},
+	"remote_file_mode":            FileMode(0o600),
+	"remote_dir_mode":             FileMode(0o700),
+	"healthcheck_url":             "https://hc-ping.com/your-uuid",
+	"metrics_file":                "/var/lib/node_exporter/textfile_collector/btrfs_backup.prom",
+	"log_file":                    "/var/log/btrfs-backup.log",
+	"volumes.encryption_key":      "age1...",
+	"volumes.encryption_key_file": "/etc/btrfs-backup/root-recipient",
+	"volumes.encryption_key_env":  "BTRFS_BACKUP_ROOT_RECIPIENT",
+	"volumes.encryption_keys":     []string{"age1..."},
+	"volumes.pre_backup":          []string{"psql -c 'CHECKPOINT'"},
+	"volumes.post_backup":         []string{},
+	"volumes.tags":                []string{"nightly"},
+}
+
+// exampleConfig renders a commented config with every field of Config at its
+// default. It walks the structs, so a new field shows up without being added
+// here, and TestExampleConfig fails until it has a comment.
+func exampleConfig() string {
+	cfg := Config{
+		RemoteHost: "backup@backup.example.com",
+		RemoteDest: "/srv/backups/myhost",
+		Volumes: []Volume{
+			{Name: "root", Src: "/", SnapDir: "/.snapshots/btrfs-backup"},
+		},
+	}
+	cfg.applyDefaults()
+
+	var b strings.Builder
+	b.WriteString("# btrfs-backup config with every setting at its default. Commented-out\n")
+	b.WriteString("# settings are optional; uncomment and adjust them to use them.\n")
+	writeExampleFields(&b, reflect.ValueOf(cfg), "", "", "")
+	return b.String()
+}
+
+// writeExampleFields writes the fields of struct v, one per line. The first
+// line starts with first and the rest with rest, which differ for the first
+// field of a list item.
+func writeExampleFields(b *strings.Builder, v reflect.Value, path, first, rest string) {
+	lead := first
+	t := v.Type()
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if !f.IsExported() || name == "" {
+			continue
+		}
+		key := path + name
+		value := v.Field(i)
+
+		fieldLead := lead
+		if sample, ok := exampleSamples[key]; ok {
+			fieldLead = rest + "# " + strings.TrimPrefix(lead, rest)
+			value = reflect.ValueOf(sample)
+		}
+		writeExampleField(b, value, key, name, fieldLead, strings.Repeat(" ", len(lead))+strings.TrimPrefix(fieldLead, lead))
+		lead = rest
+	}
+}
+
+func writeExampleField(b *strings.Builder, v reflect.Value, key, name, lead, rest string) {
+	comment := "  # " + exampleComments[key]
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+
+	switch {
+	case v.Kind() == reflect.Struct && v.Type() != reflect.TypeFor[time.Duration]():
+		b.WriteString(lead + name + ":" + comment + "\n")
+		writeExampleFields(b, v, key+".", rest+"  ", rest+"  ")
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		b.WriteString(lead + name + ":" + comment + "\n")
+		for j := range v.Len() {
+			writeExampleFields(b, v.Index(j), key+".", rest+"  - ", rest+"    ")
+		}
+	case v.Kind() == reflect.Slice && v.Len() > 0:
+		b.WriteString(lead + name + ":" + comment + "\n")
+		for j := range v.Len() {
+			b.WriteString(rest + "  - " + exampleScalar(v.Index(j)) + "\n")
+		}
+	default:
+		b.WriteString(lead + name + ": " + exampleScalar(v) + comment + "\n")
+	}
+}
+
+// exampleScalar renders a single value as YAML.
+func exampleScalar(v reflect.Value) string {
+	if d, ok := v.Interface().(time.Duration); ok {
+		return d.String()
+	}
+	out, err := yaml.Marshal(v.Interface())
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExampleConfigCommentsEveryField(t *testing.T) {
+	var walk func(typ reflect.Type, path string)
+	walk = func(typ reflect.Type, path string) {
+		for i := range typ.NumField() {
+			f := typ.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if name == "" {
+				continue
+			}
+			key := path + name
+			if _, ok := exampleComments[key]; !ok {
+				t.Errorf("no example comment for %s", key)
+			}
+
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer || ft.Kind() == reflect.Slice {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				walk(ft, key+".")
+			}
+		}
+	}
+	walk(reflect.TypeFor[Config](), "")
+}
+
+func TestExampleConfigLoads(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(exampleConfig()), 0o644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed on the example: %v", err)
+	}
+
+	want := Config{}
+	want.applyDefaults()
+	if cfg.MaxAgeDays != want.MaxAgeDays || cfg.LockFile != want.LockFile || cfg.StaleTmpAge != want.StaleTmpAge {
+		t.Errorf("expected the example to keep the defaults, got %+v", cfg)
+	}
+	if cfg.PreBackup != nil || cfg.Volumes[0].PostBackup != nil {
+		t.Errorf("expected hooks to be left unset, got %q and %q", cfg.PreBackup, cfg.Volumes[0].PostBackup)
+	}
+}
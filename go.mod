@@ -2,10 +2,14 @@ module github.com/RichGuk/btrfs-backup
 
 go 1.25.1
 
-require gopkg.in/yaml.v3 v3.0.1
+require (
+	github.com/fatih/color v1.18.0
+	github.com/zeebo/blake3 v0.2.4
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
-	github.com/fatih/color v1.18.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	golang.org/x/sys v0.25.0 // indirect
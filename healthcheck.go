@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// healthcheckTimeout is short so a slow monitoring service can't hold up a
+// run; a missed ping only means a late alert.
+const healthcheckTimeout = 5 * time.Second
+
+// pingHealthcheck tells a dead man's switch service such as healthchecks.io
+// that the run has reached event: "start", "success" or "fail". Success pings
+// the URL itself, the others <url>/<event>, with message as the body. Like
+// notifications it is best-effort.
+func pingHealthcheck(cfg *Config, event, message string) {
+	if cfg.HealthcheckURL == "" {
+		return
+	}
+
+	pingURL := strings.TrimSuffix(cfg.HealthcheckURL, "/")
+	if event != "success" {
+		pingURL += "/" + event
+	}
+
+	if dryRun {
+		if veryVerbose {
+			fmt.Printf("[DRY-RUN] POST %s\n", pingURL)
+		}
+		return
+	}
+
+	// Not tied to the run's context: an interrupted run should still report.
+	ctx, cancel := context.WithTimeout(context.Background(), healthcheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pingURL, strings.NewReader(message))
+	if err != nil {
+		errLog.Printf("Error pinging healthcheck: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		errLog.Printf("Error pinging healthcheck: %v", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		errLog.Printf("Error pinging healthcheck: %s returned %s", event, resp.Status)
+		return
+	}
+
+	if verbose {
+		fmt.Printf("→ Pinged healthcheck (%s)\n", event)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestPingHealthcheck(t *testing.T) {
+	var mu sync.Mutex
+	var pings []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		pings = append(pings, r.URL.Path+" "+string(body))
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := &Config{HealthcheckURL: srv.URL + "/abc/"}
+	pingHealthcheck(cfg, "start", "")
+	pingHealthcheck(cfg, "fail", "Backup failed for: root")
+	pingHealthcheck(cfg, "success", "")
+
+	want := []string{"/abc/start ", "/abc/fail Backup failed for: root", "/abc "}
+	if !slices.Equal(pings, want) {
+		t.Fatalf("expected pings %q, got %q", want, pings)
+	}
+}
+
+func TestPingHealthcheckIsBestEffort(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(srv.Close)
+
+	// Neither an error status nor an unreachable service may panic or block.
+	pingHealthcheck(&Config{HealthcheckURL: srv.URL}, "start", "")
+	pingHealthcheck(&Config{HealthcheckURL: "http://127.0.0.1:1"}, "fail", "")
+	pingHealthcheck(&Config{}, "success", "")
+}
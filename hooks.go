@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// runHooks runs each command through sh -c in order, stopping at the first
+// that exits non-zero. The volume is described in the environment, along with
+// the outcome of the backup when status is set.
+func runHooks(ctx context.Context, stage string, commands []string, vol *Volume, status string) error {
+	env := append(os.Environ(),
+		"BTRFS_BACKUP_VOLUME="+vol.Name,
+		"BTRFS_BACKUP_SRC="+vol.Src,
+		"BTRFS_BACKUP_SNAPDIR="+vol.SnapDir,
+	)
+	if status != "" {
+		env = append(env, "BTRFS_BACKUP_STATUS="+status)
+	}
+
+	for _, command := range commands {
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Env = env
+
+		if dryRun {
+			if veryVerbose {
+				fmt.Printf("[DRY-RUN] %s: sh -c %s\n", stage, shellEscape(command))
+			}
+			continue
+		}
+
+		if verbose {
+			fmt.Printf("→ Running %s hook: %s\n", stage, command)
+		}
+		output, err := cmd.CombinedOutput()
+		if verbose {
+			for line := range strings.Lines(string(output)) {
+				fmt.Printf("→ %s: %s", stage, line)
+				if !strings.HasSuffix(line, "\n") {
+					fmt.Println()
+				}
+			}
+		}
+		if err != nil {
+			if msg := strings.TrimSpace(string(output)); msg != "" && !verbose {
+				return fmt.Errorf("%s hook %q failed: %w: %s", stage, command, err, msg)
+			}
+			return fmt.Errorf("%s hook %q failed: %w", stage, command, err)
+		}
+	}
+
+	return nil
+}
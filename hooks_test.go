@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunHooksPassesVolumeEnvironment(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "marker")
+	vol := &Volume{Name: "db", Src: "/@db", SnapDir: "/snaps/db"}
+
+	commands := []string{
+		`printf '%s %s %s %s\n' "$BTRFS_BACKUP_VOLUME" "$BTRFS_BACKUP_SRC" "$BTRFS_BACKUP_SNAPDIR" "$BTRFS_BACKUP_STATUS" > ` + marker,
+	}
+	if err := runHooks(context.Background(), "post_backup", commands, vol, "success"); err != nil {
+		t.Fatalf("runHooks: %v", err)
+	}
+
+	data, err := os.ReadFile(marker)
+	if err != nil {
+		t.Fatalf("reading marker: %v", err)
+	}
+	if want := "db /@db /snaps/db success\n"; string(data) != want {
+		t.Fatalf("expected %q, got %q", want, string(data))
+	}
+}
+
+func TestRunHooksStopsAtFirstFailure(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "marker")
+	vol := &Volume{Name: "db"}
+
+	err := runHooks(context.Background(), "pre_backup", []string{"echo locked >&2; exit 3", "touch " + marker}, vol, "")
+	if err == nil {
+		t.Fatal("expected hook failure")
+	}
+	if _, statErr := os.Stat(marker); !os.IsNotExist(statErr) {
+		t.Fatalf("expected later hooks not to run, stat err: %v", statErr)
+	}
+}
+
+func TestBackupVolumeSkipsOnPreBackupFailure(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	marker := filepath.Join(t.TempDir(), "marker")
+	snapDir := t.TempDir()
+	vol := &Volume{
+		Name:       "db",
+		Src:        "/@db",
+		SnapDir:    snapDir,
+		PreBackup:  []string{"exit 1"},
+		PostBackup: []string{`echo "$BTRFS_BACKUP_STATUS" > ` + marker},
+	}
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Backend:    "ssh",
+		Volumes:    []Volume{*vol},
+	}
+
+	currentTime := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	if _, err := backupVolume(context.Background(), cfg, vol, currentTime); err == nil {
+		t.Fatal("expected pre_backup failure to fail the volume")
+	}
+
+	if snaps := listSnapshots(snapDir, cfg.snapshotPrefix()); len(snaps) != 0 {
+		t.Fatalf("expected no snapshot, got %v", snaps)
+	}
+	data, err := os.ReadFile(marker)
+	if err != nil {
+		t.Fatalf("expected post_backup to run: %v", err)
+	}
+	if string(data) != "failure\n" {
+		t.Fatalf("expected failure status, got %q", string(data))
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// latestName is the remote file naming the newest backup of vol, kept with
+// maintain_latest so restore tooling doesn't have to list and sort. A plain
+// file rather than a symlink works on every backend.
+func latestName(vol *Volume) string {
+	return vol.Name + "-latest"
+}
+
+// writeLatest points vol's latest file at outfile. It is written under a
+// temporary name and renamed so readers never see it half written.
+func writeLatest(ctx context.Context, cfg *Config, vol *Volume, outfile string) error {
+	remote := cfg.remote()
+	name := latestName(vol)
+	tmpFile := newTmpName(name)
+
+	if dryRun {
+		if veryVerbose {
+			fmt.Printf("[DRY-RUN] %s\n", remote.Describe("write", name))
+		}
+		return nil
+	}
+
+	err := withRetry(ctx, cfg.Retries, cfg.RetryBackoff, func() error {
+		if _, err := remote.Write(ctx, tmpFile, strings.NewReader(outfile+"\n")); err != nil {
+			return err
+		}
+		return remote.Rename(ctx, tmpFile, name)
+	})
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+
+	if verbose {
+		fmt.Printf("→ Pointed %s at %s\n", name, outfile)
+	}
+
+	return nil
+}
+
+// repointLatest moves vol's latest file to the newest of backups not being
+// deleted, when deleted includes the one it names. It is removed if nothing
+// is left to point at.
+func repointLatest(ctx context.Context, cfg *Config, vol *Volume, backups, deleted []remoteBackup) error {
+	if len(backups) == 0 {
+		return nil
+	}
+
+	gone := map[string]bool{}
+	for _, b := range deleted {
+		gone[b.Name] = true
+	}
+	if !gone[backups[len(backups)-1].Name] {
+		return nil
+	}
+
+	for i := len(backups) - 1; i >= 0; i-- {
+		if !gone[backups[i].Name] {
+			return writeLatest(ctx, cfg, vol, backups[i].Name)
+		}
+	}
+
+	remote := cfg.remote()
+	if dryRun {
+		if veryVerbose {
+			fmt.Printf("[DRY-RUN] %s\n", remote.Describe("remove", latestName(vol)))
+		}
+		return nil
+	}
+	return withRetry(ctx, cfg.Retries, cfg.RetryBackoff, func() error {
+		return remote.Remove(ctx, latestName(vol))
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupVolumeMaintainsLatest(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	snapDir := t.TempDir()
+	vol := &Volume{Name: "root", Src: "/@", SnapDir: snapDir}
+	cfg := &Config{
+		RemoteHost:     "remote",
+		RemoteDest:     remoteDir,
+		Backend:        "ssh",
+		MaintainLatest: true,
+		Volumes:        []Volume{*vol},
+	}
+
+	runs := []struct {
+		time time.Time
+		want string
+	}{
+		{time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC), "root-2024-01-01_10-00-00.full.btrfs\n"},
+		{time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC), "root-2024-01-02_10-00-00.inc.btrfs\n"},
+	}
+	for _, run := range runs {
+		if _, err := backupVolume(context.Background(), cfg, vol, run.time); err != nil {
+			t.Fatalf("backupVolume: %v", err)
+		}
+		got, err := os.ReadFile(filepath.Join(remoteDir, "root-latest"))
+		if err != nil {
+			t.Fatalf("reading latest pointer: %v", err)
+		}
+		if string(got) != run.want {
+			t.Errorf("expected latest to name %q, got %q", run.want, got)
+		}
+	}
+
+	if backups := remoteListing(t, cfg, vol); len(backups) != 2 {
+		t.Errorf("expected the pointer to be left out of the listing, got %+v", backups)
+	}
+}
+
+func TestRepointLatest(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	vol := &Volume{Name: "root"}
+	cfg := &Config{RemoteDest: remoteDir, Backend: "ssh"}
+	backups := []remoteBackup{
+		{Name: "root-2024-01-01_10-00-00.full.btrfs"},
+		{Name: "root-2024-01-02_10-00-00.inc.btrfs"},
+		{Name: "root-2024-01-03_10-00-00.inc.btrfs"},
+	}
+	pointer := filepath.Join(remoteDir, "root-latest")
+
+	tests := []struct {
+		name    string
+		deleted []remoteBackup
+		want    string
+	}{
+		{"target kept", backups[:1], "unchanged\n"},
+		{"target deleted", backups[2:], backups[1].Name + "\n"},
+		{"everything deleted", backups, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(pointer, []byte("unchanged\n"), 0o644); err != nil {
+				t.Fatalf("writing pointer: %v", err)
+			}
+
+			if err := repointLatest(context.Background(), cfg, vol, backups, tt.deleted); err != nil {
+				t.Fatalf("repointLatest: %v", err)
+			}
+
+			got, err := os.ReadFile(pointer)
+			if tt.want == "" {
+				if !os.IsNotExist(err) {
+					t.Fatalf("expected the pointer to be removed, got %q (%v)", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("reading pointer: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+func runList(ctx context.Context, cfg *Config, args []string) error {
+	var volumeName, since, until string
+	var asJSON bool
+
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	fs.StringVar(&volumeName, "volume", "", "Name of the volume to list")
+	fs.BoolVar(&asJSON, "json", false, "Print backups as JSON")
+	fs.StringVar(&since, "since", "", "Only list backups taken at or after this time (RFC3339 or "+snapshotTimestampFormat+")")
+	fs.StringVar(&until, "until", "", "Only list backups taken before this time (RFC3339 or "+snapshotTimestampFormat+")")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	window, err := parseTimeWindow(since, until)
+	if err != nil {
+		return err
+	}
+
+	if volumeName == "" {
+		return errors.New("list requires --volume")
+	}
+
+	vol := findVolume(cfg, volumeName)
+	if vol == nil {
+		return fmt.Errorf("volume %q not found in config", volumeName)
+	}
+
+	backups, err := listRemoteBackups(ctx, cfg, vol)
+	if err != nil {
+		return err
+	}
+	backups = filterBackups(backups, window)
+
+	// Sizes and times come from stat on the remote, which object storage
+	// doesn't have.
+	if cfg.Backend != "s3" {
+		if err := fillRemoteBackupStats(ctx, cfg, backups); err != nil {
+			return err
+		}
+	}
+
+	if asJSON {
+		if backups == nil {
+			backups = []remoteBackup{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(backups)
+	}
+
+	if len(backups) == 0 {
+		fmt.Printf("No backups found for %s\n", vol.Name)
+		return nil
+	}
+
+	for _, b := range backups {
+		indent := ""
+		if b.Kind == "inc" {
+			indent = "  └ "
+		}
+		var warning string
+		if suspiciousModTime(b) {
+			warning = color.YellowString("  ⚠️ written %s, before its timestamp; renamed?", b.ModTime.In(b.Timestamp.Location()).Format("2006-01-02 15:04:05"))
+		}
+		fmt.Printf(
+			"%s%s  %s  %s  %s%s\n",
+			indent,
+			b.Name,
+			b.Kind,
+			b.Timestamp.Format("2006-01-02 15:04:05"),
+			formatBytes(b.Size),
+			warning,
+		)
+	}
+
+	return nil
+}
+
+// modTimeSlack is how far a backup's mtime may fall before the timestamp in
+// its name, allowing for the clocks of the two machines disagreeing.
+const modTimeSlack = time.Hour
+
+// suspiciousModTime reports whether b was written before the snapshot its
+// name says it holds was taken, which suggests it was renamed. The name stays
+// what the chain is built from either way.
+func suspiciousModTime(b remoteBackup) bool {
+	return !b.ModTime.IsZero() && b.ModTime.Before(b.Timestamp.Add(-modTimeSlack))
+}
+
+// fillRemoteBackupStats stats every backup on the remote in a single call and
+// records the sizes and modification times on the given slice.
+func fillRemoteBackupStats(ctx context.Context, cfg *Config, backups []remoteBackup) error {
+	if len(backups) == 0 {
+		return nil
+	}
+
+	var names []string
+	for _, b := range backups {
+		names = append(names, shellEscape(b.Name))
+	}
+
+	remoteCmd := fmt.Sprintf("cd %s && stat -c '%%s %%Y %%n' -- %s", shellEscape(cfg.RemoteDest), strings.Join(names, " "))
+	var output []byte
+	err := runRemoteOp(ctx, cfg, remoteCmd, func(cmd *exec.Cmd) (err error) {
+		output, err = cmd.Output()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("stat of remote backups failed: %w", err)
+	}
+
+	stats := map[string]remoteBackup{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		mtime, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		stats[fields[2]] = remoteBackup{Size: size, ModTime: time.Unix(mtime, 0)}
+	}
+
+	for i := range backups {
+		backups[i].Size = stats[backups[i].Name].Size
+		backups[i].ModTime = stats[backups[i].Name].ModTime
+	}
+
+	return nil
+}
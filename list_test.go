@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunListJSON(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	writeRemoteBackup(t, remoteDir, "root-2024-05-11_10-00-00.inc.btrfs", "inc", true)
+	writeRemoteBackup(t, remoteDir, "root-2024-05-10_10-00-00.full.btrfs", "full-data", true)
+	mtime := time.Date(2024, 5, 10, 10, 5, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(remoteDir, "root-2024-05-10_10-00-00.full.btrfs"), mtime, mtime); err != nil {
+		t.Fatalf("setting mtime: %v", err)
+	}
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Volumes:    []Volume{{Name: "root"}},
+	}
+
+	var runErr error
+	out := captureStdout(t, func() {
+		runErr = runList(context.Background(), cfg, []string{"--volume", "root", "--json"})
+	})
+	if runErr != nil {
+		t.Fatalf("runList: %v", runErr)
+	}
+
+	var backups []remoteBackup
+	if err := json.Unmarshal([]byte(out), &backups); err != nil {
+		t.Fatalf("decoding JSON output %q: %v", out, err)
+	}
+
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups, got %d", len(backups))
+	}
+	if backups[0].Kind != "full" || backups[0].Size != int64(len("full-data")) {
+		t.Errorf("unexpected first backup: %+v", backups[0])
+	}
+	if backups[1].Kind != "inc" || backups[1].Size != int64(len("inc")) {
+		t.Errorf("unexpected second backup: %+v", backups[1])
+	}
+	if !backups[0].ModTime.Equal(mtime) {
+		t.Errorf("expected mtime %s, got %s", mtime, backups[0].ModTime)
+	}
+}
+
+func TestRunListRenamedBackup(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	name := "root-2024-05-10_10-00-00.full.btrfs"
+	writeRemoteBackup(t, remoteDir, name, "full", true)
+	// Written a day before the snapshot its name claims.
+	written := time.Date(2024, 5, 9, 10, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(remoteDir, name), written, written); err != nil {
+		t.Fatalf("setting mtime: %v", err)
+	}
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Volumes:    []Volume{{Name: "root"}},
+	}
+
+	var runErr error
+	out := captureStdout(t, func() {
+		runErr = runList(context.Background(), cfg, []string{"--volume", "root"})
+	})
+	if runErr != nil {
+		t.Fatalf("runList: %v", runErr)
+	}
+	if !strings.Contains(out, "written 2024-05-09 10:00:00, before its timestamp") {
+		t.Fatalf("expected a warning about the mtime, got %q", out)
+	}
+}
+
+func TestRunListText(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	writeRemoteBackup(t, remoteDir, "root-2024-05-10_10-00-00.full.btrfs", "full", true)
+	writeRemoteBackup(t, remoteDir, "root-2024-05-11_10-00-00.inc.btrfs", "inc", true)
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Volumes:    []Volume{{Name: "root"}},
+	}
+
+	var runErr error
+	out := captureStdout(t, func() {
+		runErr = runList(context.Background(), cfg, []string{"--volume", "root"})
+	})
+	if runErr != nil {
+		t.Fatalf("runList: %v", runErr)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", out)
+	}
+	if !strings.HasPrefix(lines[0], "root-2024-05-10_10-00-00.full.btrfs") {
+		t.Errorf("expected full first, got %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "  └ root-2024-05-11_10-00-00.inc.btrfs") {
+		t.Errorf("expected incremental grouped under full, got %q", lines[1])
+	}
+}
+
+func TestRunListEmpty(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Volumes:    []Volume{{Name: "root"}},
+	}
+
+	var runErr error
+	out := captureStdout(t, func() {
+		runErr = runList(context.Background(), cfg, []string{"--volume", "root", "--json"})
+	})
+	if runErr != nil {
+		t.Fatalf("runList: %v", runErr)
+	}
+	if strings.TrimSpace(out) != "[]" {
+		t.Fatalf("expected empty JSON array, got %q", out)
+	}
+
+	out = captureStdout(t, func() {
+		runErr = runList(context.Background(), cfg, []string{"--volume", "root"})
+	})
+	if runErr != nil {
+		t.Fatalf("runList: %v", runErr)
+	}
+	if !strings.Contains(out, "No backups found for root") {
+		t.Fatalf("expected empty message, got %q", out)
+	}
+}
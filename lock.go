@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const defaultLockFile = "/var/run/btrfs-backup.lock"
+
+// lockPollInterval is how often a contended lock is retried while waiting.
+var lockPollInterval = 500 * time.Millisecond
+
+var errLockHeld = errors.New("another instance of btrfs-backup is already running")
+
+// acquireLock takes an exclusive flock on path, waiting up to wait for another
+// instance to release it. The lock is held until the returned file is closed.
+//
+// The holder's PID is written into the file for anyone debugging a stuck run,
+// and named when the lock is held. Only the flock does the excluding: it goes
+// away with the process that held it, so the file never needs cleaning up, and
+// a held lock is never removed even if its recorded PID is dead, as a new
+// holder records its own only after locking. The error says so instead.
+func acquireLock(ctx context.Context, path string, wait time.Duration) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		f, err := tryLock(path)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, errLockHeld) {
+			return nil, err
+		}
+
+		if !time.Now().Before(deadline) {
+			if pid := lockHolder(path); pid > 0 && processAlive(pid) {
+				err = fmt.Errorf("%w (pid %d)", errLockHeld, pid)
+			} else if pid > 0 {
+				err = fmt.Errorf("%w (held by an unknown process; recorded pid %d is not running)", errLockHeld, pid)
+			}
+			if wait > 0 {
+				return nil, fmt.Errorf("%w (gave up after %s)", err, wait)
+			}
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(min(lockPollInterval, time.Until(deadline))):
+		}
+	}
+}
+
+// tryLock makes one attempt at the flock on path and records our PID in it,
+// returning errLockHeld if someone else has it.
+func tryLock(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errLockHeld
+		}
+		return nil, err
+	}
+
+	// The file may have been deleted between opening and locking, in which
+	// case we hold the lock on a file nobody else will look at.
+	if held, err := f.Stat(); err == nil {
+		if current, err := os.Stat(path); err != nil || !os.SameFile(held, current) {
+			f.Close()
+			return tryLock(path)
+		}
+	}
+
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// lockHolder returns the PID recorded in the lock file at path, or 0 if there
+// isn't one yet.
+func lockHolder(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// processAlive reports whether pid is a running process. EPERM means it
+// exists but belongs to another user.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// remoteLockFile is flocked in remote_dest with remote_lock, so hosts
+// sharing a destination take turns.
+const remoteLockFile = ".lock"
+
+var errRemoteLockHeld = errors.New("remote_dest is locked by another run")
+
+// remoteLock is an flock held by a command left running on the remote. The
+// command exits, dropping the lock, once its stdin closes, which also happens
+// if this process dies without releasing it.
+type remoteLock struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+// acquireRemoteLock takes the flock on remote_dest/.lock without waiting.
+func acquireRemoteLock(ctx context.Context, cfg *Config) (*remoteLock, error) {
+	path := filepath.Join(cfg.RemoteDest, remoteLockFile)
+	cmd := remoteCommand(ctx, cfg, fmt.Sprintf("flock -n %s -c 'echo locked; cat >/dev/null'", shellEscape(path)))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("ssh start failed: %w", err)
+	}
+	line, _ := bufio.NewReader(stdout).ReadString('\n')
+	if strings.TrimSpace(line) == "locked" {
+		if verbose {
+			fmt.Printf("→ Holding remote lock %s\n", remoteTarget(cfg, path))
+		}
+		return &remoteLock{cmd: cmd, stdin: stdin}, nil
+	}
+
+	stdin.Close()
+	err = cmd.Wait()
+	// flock -n exits 1 when someone else has the lock.
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return nil, errRemoteLockHeld
+	}
+	if err == nil {
+		err = errors.New("lock command exited early")
+	}
+	return nil, fmt.Errorf("taking remote lock %s: %w: %s", path, err, strings.TrimSpace(stderr.String()))
+}
+
+// release drops the remote lock and waits for the command holding it.
+func (l *remoteLock) release() {
+	l.stdin.Close()
+	_ = l.cmd.Wait()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireLockContended(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "btrfs-backup.lock")
+
+	held, err := acquireLock(context.Background(), path, 0)
+	if err != nil {
+		t.Fatalf("acquireLock: %v", err)
+	}
+	defer held.Close()
+
+	if _, err := acquireLock(context.Background(), path, 0); !errors.Is(err, errLockHeld) {
+		t.Fatalf("expected errLockHeld without waiting, got %v", err)
+	}
+
+	start := time.Now()
+	if _, err := acquireLock(context.Background(), path, 100*time.Millisecond); !errors.Is(err, errLockHeld) {
+		t.Fatalf("expected errLockHeld after waiting, got %v", err)
+	}
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Fatalf("expected to wait for the timeout, waited %s", waited)
+	}
+}
+
+func TestAcquireLockWaitsForRelease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "btrfs-backup.lock")
+	lockPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { lockPollInterval = 500 * time.Millisecond })
+
+	held, err := acquireLock(context.Background(), path, 0)
+	if err != nil {
+		t.Fatalf("acquireLock: %v", err)
+	}
+	time.AfterFunc(50*time.Millisecond, func() { held.Close() })
+
+	f, err := acquireLock(context.Background(), path, 5*time.Second)
+	if err != nil {
+		t.Fatalf("expected lock once released, got %v", err)
+	}
+	f.Close()
+}
+
+func TestAcquireLockRecordsPID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "btrfs-backup.lock")
+
+	held, err := acquireLock(context.Background(), path, 0)
+	if err != nil {
+		t.Fatalf("acquireLock: %v", err)
+	}
+	defer held.Close()
+
+	if pid := lockHolder(path); pid != os.Getpid() {
+		t.Fatalf("expected our pid %d in the lock file, got %d", os.Getpid(), pid)
+	}
+
+	_, err = acquireLock(context.Background(), path, 0)
+	if !errors.Is(err, errLockHeld) || !strings.Contains(err.Error(), strconv.Itoa(os.Getpid())) {
+		t.Fatalf("expected errLockHeld naming the holder, got %v", err)
+	}
+}
+
+func TestAcquireLockKeepsHeldLockWithDeadPID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "btrfs-backup.lock")
+
+	held, err := acquireLock(context.Background(), path, 0)
+	if err != nil {
+		t.Fatalf("acquireLock: %v", err)
+	}
+	defer held.Close()
+
+	// A holder that hasn't written its pid yet still shows the last run's.
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("running true: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0o600); err != nil {
+		t.Fatalf("writing lock file: %v", err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat lock file: %v", err)
+	}
+
+	_, err = acquireLock(context.Background(), path, 0)
+	want := "held by an unknown process; recorded pid " + strconv.Itoa(cmd.Process.Pid) + " is not running"
+	if !errors.Is(err, errLockHeld) || !strings.Contains(err.Error(), want) {
+		t.Fatalf("expected errLockHeld saying the recorded pid is dead, got %v", err)
+	}
+
+	after, err := os.Stat(path)
+	if err != nil || !os.SameFile(before, after) {
+		t.Fatalf("expected the held lock file to be left alone, stat err: %v", err)
+	}
+}
+
+func TestAcquireRemoteLock(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	cfg := &Config{RemoteHost: "remote", RemoteDest: remoteDir, Backend: "ssh"}
+
+	held, err := acquireRemoteLock(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("acquireRemoteLock: %v", err)
+	}
+
+	if _, err := acquireRemoteLock(context.Background(), cfg); !errors.Is(err, errRemoteLockHeld) {
+		t.Fatalf("expected errRemoteLockHeld while held, got %v", err)
+	}
+
+	held.release()
+
+	again, err := acquireRemoteLock(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("expected the lock once released, got %v", err)
+	}
+	again.release()
+}
@@ -1,8 +1,126 @@
 package main
 
 import (
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/fatih/color"
 )
 
 var errLog = log.New(os.Stderr, "[btrfs-backup] ", 0)
+
+// closeLog flushes and closes the log file, if any. exit calls it because
+// os.Exit skips deferred calls.
+var closeLog = func() {}
+
+func exit(code int) {
+	closeLog()
+	os.Exit(code)
+}
+
+// logFile is an append-only log file that can be reopened after rotation.
+type logFile struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	l := &logFile{path: path}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(p)
+}
+
+// Reopen closes and reopens the file, picking up a new one after logrotate
+// has moved the old one away.
+func (l *logFile) Reopen() error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f = f
+	return nil
+}
+
+func (l *logFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+var (
+	ansiEscapeRegexp    = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+	partialEscapeRegexp = regexp.MustCompile(`\x1b(\[[0-9;]*)?$`)
+)
+
+// stripANSI drops terminal escape codes on the way to w, so colour meant for
+// the terminal doesn't end up in the log file. An escape split across writes
+// is held back until the rest of it arrives.
+type stripANSI struct {
+	w       io.Writer
+	pending []byte
+}
+
+func (s *stripANSI) Write(p []byte) (int, error) {
+	buf := append(s.pending, p...)
+	s.pending = nil
+	if loc := partialEscapeRegexp.FindIndex(buf); loc != nil {
+		s.pending = append([]byte(nil), buf[loc[0]:]...)
+		buf = buf[:loc[0]]
+	}
+	if _, err := s.w.Write(ansiEscapeRegexp.ReplaceAll(buf, nil)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// teeOutput copies everything written to stdout and errLog into l as well.
+// Progress output on stderr is left out of the file. The returned function
+// restores the original outputs once everything written has reached l.
+func teeOutput(l *logFile) (func(), error) {
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.MultiWriter(stdout, &stripANSI{w: l}), r)
+		close(done)
+	}()
+
+	os.Stdout = w
+	color.Output = w
+	errLog.SetOutput(io.MultiWriter(os.Stderr, l))
+
+	return func() {
+		os.Stdout = stdout
+		color.Output = stdout
+		errLog.SetOutput(os.Stderr)
+		w.Close()
+		<-done
+		l.Close()
+	}, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fatih/color"
+)
+
+func TestTeeOutputWritesLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "btrfs-backup.log")
+
+	l, err := openLogFile(path)
+	if err != nil {
+		t.Fatalf("openLogFile: %v", err)
+	}
+	closeTee, err := teeOutput(l)
+	if err != nil {
+		t.Fatalf("teeOutput: %v", err)
+	}
+
+	fmt.Println("→ informational")
+	errLog.Printf("something broke")
+	closeTee()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading log file: %v", err)
+	}
+	for _, want := range []string{"→ informational\n", "[btrfs-backup] something broke\n"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("expected log to contain %q, got %q", want, data)
+		}
+	}
+}
+
+func TestTeeOutputStripsColor(t *testing.T) {
+	orig := color.NoColor
+	color.NoColor = false
+	t.Cleanup(func() { color.NoColor = orig })
+
+	path := filepath.Join(t.TempDir(), "btrfs-backup.log")
+	l, err := openLogFile(path)
+	if err != nil {
+		t.Fatalf("openLogFile: %v", err)
+	}
+	closeTee, err := teeOutput(l)
+	if err != nil {
+		t.Fatalf("teeOutput: %v", err)
+	}
+
+	fmt.Println(color.GreenString("Finished processing: root"))
+	closeTee()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading log file: %v", err)
+	}
+	if string(data) != "Finished processing: root\n" {
+		t.Errorf("expected the log without escape codes, got %q", data)
+	}
+}
+
+func TestStripANSI(t *testing.T) {
+	var out strings.Builder
+	w := &stripANSI{w: &out}
+	for _, chunk := range []string{"\x1b[32mok\x1b[0m ", "split \x1b[3", "1mred\x1b", "[0m\n"} {
+		if n, err := w.Write([]byte(chunk)); err != nil || n != len(chunk) {
+			t.Fatalf("Write(%q) = %d, %v", chunk, n, err)
+		}
+	}
+	if got := out.String(); got != "ok split red\n" {
+		t.Errorf("expected escape codes removed, got %q", got)
+	}
+}
+
+func TestLogFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "btrfs-backup.log")
+
+	if err := os.WriteFile(path, []byte("earlier run\n"), 0o644); err != nil {
+		t.Fatalf("writing log: %v", err)
+	}
+
+	l, err := openLogFile(path)
+	if err != nil {
+		t.Fatalf("openLogFile: %v", err)
+	}
+	defer l.Close()
+
+	fmt.Fprintln(l, "before rotate")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("rotating log: %v", err)
+	}
+	if err := l.Reopen(); err != nil {
+		t.Fatalf("Reopen: %v", err)
+	}
+	fmt.Fprintln(l, "after rotate")
+
+	rotated, _ := os.ReadFile(path + ".1")
+	if string(rotated) != "earlier run\nbefore rotate\n" {
+		t.Errorf("unexpected rotated log: %q", rotated)
+	}
+	current, _ := os.ReadFile(path)
+	if string(current) != "after rotate\n" {
+		t.Errorf("unexpected current log: %q", current)
+	}
+}
@@ -2,37 +2,132 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/fatih/color"
+	"gopkg.in/yaml.v3"
 )
 
 var (
-	configPath  string
-	verbose     bool
-	veryVerbose bool
-	dryRun      bool
-	progress    bool
-	force       bool
+	configPath     string
+	verbose        bool
+	veryVerbose    bool
+	quiet          bool
+	snapshotOnly   bool
+	sendOnly       bool
+	dryRun         bool
+	progress       bool
+	progressFormat string
+	progressFD     int
+	force          bool
+	failFast       bool
+	strictEnv      bool
+	strictSnaps    bool
+	noColor        bool
+	showVersion    bool
+	showConfig     bool
+	configCheck    bool
+	printExample   bool
+	logFilePath    string
+	lockFilePath   string
+	remoteHostFlag string
+	remoteDestFlag string
+	lockWait       time.Duration
+	runTimeout     time.Duration
+	onlyVolumes    stringList
+	onlyTags       stringList
 )
 
+// Exit codes, so a wrapper can retry the transient failures and alert on the
+// rest. The flag package already exits 2 for a bad flag.
+const (
+	exitFailure     = 1 // anything not covered below
+	exitUsage       = 2
+	exitConfig      = 3
+	exitLocked      = 4
+	exitRemote      = 5
+	exitFailed      = 6
+	exitPartial     = 7
+	exitInterrupted = 130
+)
+
+const exitCodeHelp = `
+Exit codes:
+  0    success
+  1    other failure, such as a subcommand failing
+  2    bad flags, arguments or command
+  3    the config can't be loaded or is invalid
+  4    another run holds the lock or remote_lock
+  5    the remote can't be reached
+  6    every volume in the run failed
+  7    some volumes failed and the rest were backed up
+  130  interrupted twice, exiting without cleanup
+`
+
 func main() {
 	var vv bool
 	flag.StringVar(&configPath, "config", "/etc/btrfs-backup.yaml", "Path to config file")
 	flag.BoolVar(&verbose, "v", false, "Enable verbose logging")
 	flag.BoolVar(&vv, "vv", false, "Enable very verbose logging (includes dry-run commands)")
+	flag.BoolVar(&showVersion, "version", false, "Print version and build details, then exit")
+	flag.BoolVar(&noColor, "no-color", false, "Disable colored output (also set by NO_COLOR)")
+	flag.BoolVar(&quiet, "q", false, "Only print errors")
+	flag.BoolVar(&quiet, "quiet", false, "Only print errors")
 	flag.BoolVar(&dryRun, "n", false, "Dry run mode (no changes made)")
 	flag.BoolVar(&progress, "p", false, "Show transfer progress")
 	flag.BoolVar(&progress, "progress", false, "Show transfer progress")
+	flag.StringVar(&progressFormat, "progress-format", "human", "Progress format: human, or json for one object per line (implies -p)")
+	flag.IntVar(&progressFD, "progress-fd", 2, "File descriptor progress is written to")
 	flag.BoolVar(&force, "f", false, "Force full backup")
 	flag.BoolVar(&force, "force", false, "Force full backup")
+	flag.BoolVar(&failFast, "fail-fast", false, "Stop at the first volume that fails")
+	flag.BoolVar(&snapshotOnly, "snapshot-only", false, "Take local snapshots without sending anything")
+	flag.BoolVar(&sendOnly, "send-only", false, "Send each volume's latest snapshot without taking a new one")
+	flag.BoolVar(&showConfig, "show-config", false, "Print the config as resolved, with secrets redacted, then exit")
+	flag.BoolVar(&configCheck, "config-check", false, "Check the config loads and is valid, then exit; needs no root")
+	flag.BoolVar(&printExample, "print-example-config", false, "Print a commented example config with every option, then exit")
+	flag.BoolVar(&strictEnv, "strict-env", false, "Fail if the config references undefined environment variables")
+	flag.BoolVar(&strictSnaps, "strict-snapshots", false, "Fail a volume whose snapdir has snapshots sharing a timestamp instead of warning")
+	flag.StringVar(&logFilePath, "log-file", "", "Also append output to this file (overrides log_file)")
+	flag.StringVar(&lockFilePath, "lock-file", "", "Lock file preventing concurrent runs (overrides lock_file)")
+	flag.StringVar(&remoteHostFlag, "remote-host", "", "Send to this host instead (overrides remote_host, not mirrors)")
+	flag.StringVar(&remoteDestFlag, "remote-dest", "", "Send to this directory instead (overrides remote_dest, not mirrors)")
+	flag.Var(&onlyVolumes, "volume", "Only back up this volume (repeatable)")
+	flag.Var(&onlyTags, "tag", "Only back up volumes with this tag (repeatable, any tag matches)")
+	flag.DurationVar(&lockWait, "lock-wait", 0, "Wait up to this long for another run to release the lock")
+	flag.DurationVar(&runTimeout, "timeout", 0, "Give up on the whole run after this long (overrides run_timeout)")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [flags] [restore|download|migrate|list|prune|doctor|repair]\n\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(out, exitCodeHelp)
+	}
 	flag.Parse()
 
+	if showVersion {
+		fmt.Println(versionString())
+		return
+	}
+	if printExample {
+		fmt.Print(exampleConfig())
+		return
+	}
+
+	// The color package already turns itself off for NO_COLOR and when
+	// stdout isn't a terminal.
+	if noColor {
+		color.NoColor = true
+	}
+
 	if vv {
 		verbose = true
 		veryVerbose = true
@@ -42,6 +137,46 @@ func main() {
 		verbose = true
 	}
 
+	if snapshotOnly && sendOnly {
+		errLog.Println("-snapshot-only and -send-only can't be combined")
+		exit(exitUsage)
+	}
+
+	if quiet {
+		if verbose {
+			errLog.Println("-q can't be combined with -v, -vv or -n")
+			exit(exitUsage)
+		}
+		progress = false
+	}
+
+	if _, ok := progressFormats[progressFormat]; !ok {
+		errLog.Printf("-progress-format must be human or json, not %q", progressFormat)
+		exit(exitUsage)
+	}
+	if progressFormat == "json" {
+		// Events are for a program to read, so -q doesn't silence them.
+		progress = true
+	}
+	if progressFD != 2 {
+		f := os.NewFile(uintptr(progressFD), "progress")
+		if _, err := f.Stat(); err != nil {
+			errLog.Printf("-progress-fd %d isn't open: %v", progressFD, err)
+			exit(exitUsage)
+		}
+		progressOutput = f
+	}
+
+	// Only the file is checked: no lock, btrfs or remote.
+	if configCheck {
+		if err := checkConfig(configPath); err != nil {
+			errLog.Printf("%s: %v", configPath, err)
+			exit(exitConfig)
+		}
+		fmt.Printf("%s is valid\n", configPath)
+		return
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -51,134 +186,273 @@ func main() {
 		<-signalChannel
 		fmt.Fprintf(os.Stderr, "\n→ Interrupt received, cancelling operations...\n")
 		cancel()
+
+		// Cleanup can hang on a dead connection; a second signal gives up on it.
+		<-signalChannel
+		fmt.Fprintf(os.Stderr, "→ Interrupted again, exiting without cleanup\n")
+		exit(exitInterrupted)
 	}()
 
-	lockFile, err := os.OpenFile("/var/run/btrfs-backup.lock", os.O_CREATE|os.O_RDWR, 0600)
+	cfg, err := loadConfig(configPath)
 	if err != nil {
-		errLog.Printf("Error opening lock file: %v", err)
-		os.Exit(1)
+		errLog.Printf("Error loading config: %v", err)
+		exit(exitConfig)
 	}
-	defer lockFile.Close()
-
-	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
-		errLog.Printf("Another instance of btrfs-backup is already running")
-		os.Exit(1)
+	if err := cfg.overrideDestination(remoteHostFlag, remoteDestFlag); err != nil {
+		errLog.Printf("Error loading config: %v", err)
+		exit(exitConfig)
 	}
-	defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+	defer stopSSHMaster(cfg)
+	btrfsBin, sshBin, ageBin = cfg.BtrfsBin, cfg.SSHBin, cfg.AgeBin
+	snapshotLocation = cfg.location()
 
-	cfg, err := loadConfig(configPath)
-	if err != nil {
-		errLog.Printf("Error loading config: %v", err)
-		os.Exit(1)
+	if showConfig {
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(cfg.redacted()); err != nil {
+			errLog.Printf("Error encoding config: %v", err)
+			exit(exitFailure)
+		}
+		return
 	}
 
-	currentTime := time.Now()
+	if logFilePath == "" {
+		logFilePath = cfg.LogFile
+	}
+	if logFilePath != "" {
+		if err := setupLogFile(logFilePath); err != nil {
+			errLog.Printf("Error opening log file: %v", err)
+			exit(exitFailure)
+		}
+		defer closeLog()
+	}
 
-	for _, vol := range cfg.Volumes {
-		if !dryRun {
-			if err := checkBtrfsAccess(ctx, &vol); err != nil {
-				errLog.Printf("Error accessing btrfs subvolume: %v", err)
-				errLog.Println("Make sure the source path is a valid btrfs subvolume and that you have the necessary permissions.")
-				os.Exit(1)
+	if runTimeout == 0 {
+		runTimeout = cfg.RunTimeout
+	}
+	if runTimeout > 0 {
+		// Expiry cancels the run like an interrupt, so cleanup still happens.
+		var cancelRun context.CancelFunc
+		ctx, cancelRun = context.WithTimeout(ctx, runTimeout)
+		defer cancelRun()
+		context.AfterFunc(ctx, func() {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				errLog.Printf("Run timed out after %s, cancelling operations", runTimeout)
 			}
-		}
+		})
 	}
 
-	if !dryRun {
-		if err := checkRemoteAccess(ctx, cfg); err != nil {
-			errLog.Printf("Error accessing remote host: %v", err)
-			os.Exit(1)
+	if lockFilePath == "" {
+		lockFilePath = cfg.LockFile
+	}
+	if verbose && lockWait > 0 {
+		fmt.Printf("→ Waiting up to %s for lock %s\n", lockWait, lockFilePath)
+	}
+	lockFile, err := acquireLock(ctx, lockFilePath, lockWait)
+	if err != nil {
+		errLog.Printf("Error acquiring lock %s: %v", lockFilePath, err)
+		if errors.Is(err, errLockHeld) {
+			exit(exitLocked)
 		}
+		exit(exitFailure)
 	}
+	defer lockFile.Close()
 
-	for _, vol := range cfg.Volumes {
-		if verbose {
-			fmt.Printf(color.YellowString("Processing volume: %s (src: %s, snapdir: %s)\n"), vol.Name, vol.Src, vol.SnapDir)
-		}
+	if err := sdNotify("READY=1"); err != nil && verbose {
+		fmt.Printf("→ systemd notify failed: %v\n", err)
+	}
 
-		oldSnap, _ := latestSnapshot(vol.SnapDir)
+	// These work on stored files, which a standby doesn't have.
+	if cfg.Mode == "replicate" && slices.Contains([]string{"restore", "download", "migrate", "list", "prune", "repair"}, flag.Arg(0)) {
+		errLog.Printf("%s is not supported with mode replicate", flag.Arg(0))
+		exit(exitUsage)
+	}
+	// Nor does anything a command was handed.
+	if cfg.Backend == "command" && slices.Contains([]string{"restore", "download", "migrate", "list", "prune", "repair"}, flag.Arg(0)) {
+		errLog.Printf("%s is not supported with backend command", flag.Arg(0))
+		exit(exitUsage)
+	}
 
-		if oldSnap != "" && verbose {
-			fmt.Printf("→ Found previous snapshot: %s\n", oldSnap)
+	switch flag.Arg(0) {
+	case "":
+	case "restore":
+		if err := runRestore(ctx, cfg, flag.Args()[1:]); err != nil {
+			errLog.Printf("Error restoring backup: %v", err)
+			exit(exitFailure)
 		}
-
-		fullSnapshot := false
-		if force {
-			fullSnapshot = true
-			if verbose {
-				fmt.Printf("→ Forcing full backup for %s\n", vol.Name)
-			}
-		} else if needsFullBackup(ctx, cfg, &vol, oldSnap, currentTime) {
-			fullSnapshot = true
-			if verbose {
-				fmt.Printf("→ Doing full backup for %s\n", vol.Name)
-			}
-		} else if verbose {
-			fmt.Printf("→ Doing incremental backup for %s\n", vol.Name)
+		return
+	case "download":
+		if err := runDownload(ctx, cfg, flag.Args()[1:]); err != nil {
+			errLog.Printf("Error downloading backup: %v", err)
+			exit(exitFailure)
 		}
-
-		suffix := "inc"
-		if fullSnapshot {
-			suffix = "full"
+		return
+	case "migrate":
+		if err := runMigrate(ctx, cfg, flag.Args()[1:]); err != nil {
+			errLog.Printf("Error migrating backups: %v", err)
+			exit(exitFailure)
 		}
-		outfile := fmt.Sprintf("%s-%s.%s%s", vol.Name, currentTime.Format("2006-01-02_15-04-05"), suffix, remoteFileSuffix(cfg))
-
-		if remoteBackupExists(ctx, cfg, outfile) {
-			color.Red("⚠️ Backup file %s already exists on remote, skipping volume %s\n", outfile, vol.Name)
-
-			if verbose || dryRun {
-				fmt.Print("\n\n")
-			}
-			continue
+		return
+	case "list":
+		if err := runList(ctx, cfg, flag.Args()[1:]); err != nil {
+			errLog.Printf("Error listing backups: %v", err)
+			exit(exitFailure)
 		}
-
-		newSnap, err := createSnapshot(ctx, vol.Src, vol.SnapDir, currentTime)
-		if err != nil {
-			errLog.Printf("Error creating snapshot: %v", err)
-			os.Exit(1)
+		return
+	case "prune":
+		if err := runPrune(ctx, cfg, flag.Args()[1:]); err != nil {
+			errLog.Printf("Error pruning backups: %v", err)
+			exit(exitFailure)
 		}
-
-		checksum, err := sendSnapshot(ctx, cfg, newSnap, oldSnap, outfile, fullSnapshot)
-		if err != nil {
-			errLog.Printf("Error sending snapshot: %v", err)
-			os.Exit(1)
+		return
+	case "doctor":
+		if err := runDoctor(ctx, cfg, flag.Args()[1:]); err != nil {
+			errLog.Printf("Doctor found problems: %v", err)
+			exit(exitFailure)
+		}
+		return
+	case "repair":
+		if err := runRepair(ctx, cfg, flag.Args()[1:]); err != nil {
+			errLog.Printf("Error checking backups: %v", err)
+			exit(exitFailure)
 		}
+		return
+	default:
+		errLog.Printf("Unknown command: %s", flag.Arg(0))
+		exit(exitUsage)
+	}
 
-		if err := moveTmpFile(ctx, cfg, outfile, checksum); err != nil {
-			errLog.Printf("Error finalizing remote file: %v", err)
-			os.Exit(1)
+	if len(onlyVolumes) > 0 {
+		if err := cfg.selectVolumes(onlyVolumes); err != nil {
+			errLog.Printf("Error selecting volumes: %v", err)
+			exit(exitUsage)
+		}
+	}
+	if len(onlyTags) > 0 {
+		cfg.selectTags(onlyTags)
+		if len(cfg.Volumes) == 0 && verbose {
+			fmt.Printf("→ No volumes tagged %s\n", strings.Join(onlyTags, ", "))
 		}
+	}
+	cfg.skipDisabledVolumes()
+
+	currentTime := time.Now()
+	pingHealthcheck(cfg, "start", "")
 
-		if verbose && checksum != "" {
-			fmt.Printf("→ SHA256: %s\n", checksum)
+	if err := checkBinaries(cfg); err != nil {
+		errLog.Printf("Error finding commands: %v", err)
+		notifyFailure(cfg, "", "preflight", err)
+		pingHealthcheck(cfg, "fail", err.Error())
+		exit(exitFailure)
+	}
+
+	// Volumes failing here are reported alongside the rest of the run.
+	var results []volumeResult
+	if !dryRun {
+		// A volume that can't be read is left out; the others still run.
+		var usable []Volume
+		for _, vol := range cfg.Volumes {
+			if err := checkBtrfsAccess(ctx, &vol); err != nil {
+				errLog.Printf("Error accessing btrfs subvolume: %v", err)
+				errLog.Println("Make sure the source path is a valid btrfs subvolume and that you have the necessary permissions.")
+				notifyFailure(cfg, vol.Name, "preflight", err)
+				if failFast {
+					pingHealthcheck(cfg, "fail", fmt.Sprintf("%s: %v", vol.Name, err))
+					exit(exitFailed)
+				}
+				results = append(results, volumeResult{name: vol.Name, err: failedAt("preflight", err), finished: time.Now()})
+				continue
+			}
+			usable = append(usable, vol)
 		}
+		cfg.Volumes = usable
+	}
 
-		var newBackupForCleanup *remoteBackup
-		if dryRun {
-			kind := "inc"
-			if fullSnapshot {
-				kind = "full"
+	if !snapshotOnly {
+		if !dryRun {
+			if err := checkRemoteAccess(ctx, cfg); err != nil {
+				errLog.Printf("Error accessing remote host: %v", err)
+				notifyFailure(cfg, "", "preflight", err)
+				pingHealthcheck(cfg, "fail", err.Error())
+				exit(exitRemote)
 			}
-			newBackupForCleanup = &remoteBackup{
-				Name:      outfile,
-				Timestamp: currentTime,
-				Kind:      kind,
+			if cfg.RemoteLock {
+				lock, err := acquireRemoteLock(ctx, cfg)
+				if err != nil {
+					errLog.Printf("Error acquiring remote lock: %v", err)
+					notifyFailure(cfg, "", "preflight", err)
+					pingHealthcheck(cfg, "fail", err.Error())
+					if errors.Is(err, errRemoteLockHeld) {
+						exit(exitLocked)
+					}
+					exit(exitRemote)
+				}
+				defer lock.release()
 			}
 		}
-		if err := cleanupOldBackups(ctx, cfg, &vol, newBackupForCleanup); err != nil {
-			errLog.Printf("Error cleaning up old backups: %v", err)
-		}
 
-		if oldSnap != "" && oldSnap != newSnap {
-			deleteOldSnapshot(ctx, oldSnap)
+		// Holding the lock means no other run of this config is uploading,
+		// or of any config sharing remote_dest with remote_lock.
+		if err := removeStaleTmpFiles(ctx, cfg, cfg.StaleTmpAge); err != nil {
+			errLog.Printf("Error removing stale temp files: %v", err)
 		}
+	}
 
+	if cfg.Parallelism > 1 && progress && progressFormat == "human" {
+		// Concurrent progress bars would overwrite each other's line.
+		progress = false
 		if verbose {
-			fmt.Printf(color.GreenString("Finished processing: %s"), vol.Name)
+			fmt.Println("→ Progress display disabled with parallelism > 1")
 		}
+	}
 
-		if verbose || dryRun {
-			fmt.Print("\n\n")
+	results = append(results, runBackups(ctx, cfg, currentTime)...)
+	if progress {
+		runTotals.Finish(progressOutput, progressFormats[progressFormat])
+	}
+	printReport(results)
+	if failed := failedVolumes(results); len(failed) > 0 {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			errLog.Printf("Backup timed out after %s, not completed: %s", runTimeout, strings.Join(failed, ", "))
+		} else if ctx.Err() != nil {
+			errLog.Printf("Backup interrupted, not completed: %s", strings.Join(failed, ", "))
+		} else {
+			errLog.Printf("Backup failed for: %s", strings.Join(failed, ", "))
 		}
+		// Volumes were notified as they failed; the run pings fail once.
+		pingHealthcheck(cfg, "fail", "Backup failed for: "+strings.Join(failed, ", "))
+		stopSSHMaster(cfg)
+		exit(failureExitCode(results))
+	}
+
+	notifySuccess(cfg)
+	pingHealthcheck(cfg, "success", "")
+}
+
+// setupLogFile tees output into path and reopens it on SIGHUP so it plays
+// nicely with logrotate.
+func setupLogFile(path string) error {
+	l, err := openLogFile(path)
+	if err != nil {
+		return err
+	}
+
+	closeTee, err := teeOutput(l)
+	if err != nil {
+		l.Close()
+		return err
 	}
+	closeLog = sync.OnceFunc(closeTee)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := l.Reopen(); err != nil {
+				errLog.Printf("Error reopening log file: %v", err)
+			}
+		}
+	}()
+
+	return nil
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// backupManifest is the machine-readable record uploaded next to each backup
+// so tooling doesn't have to parse file names to follow a chain.
+type backupManifest struct {
+	Volume            string `json:"volume"`
+	Kind              string `json:"kind"`
+	Timestamp         string `json:"timestamp"`
+	Parent            string `json:"parent,omitempty"`
+	SinceParent       int64  `json:"since_parent_seconds,omitempty"`
+	Size              int64  `json:"size"`
+	Checksum          string `json:"checksum"`
+	ChecksumAlgorithm string `json:"checksum_algorithm"`
+	Version           string `json:"version"`
+	Suspect           string `json:"suspect,omitempty"`
+}
+
+func manifestName(outfile string) string {
+	return outfile + ".json"
+}
+
+func writeManifest(ctx context.Context, cfg *Config, outfile string, m backupManifest) error {
+	remote := cfg.remote()
+	name := manifestName(outfile)
+
+	if dryRun {
+		if veryVerbose {
+			fmt.Printf("[DRY-RUN] %s\n", remote.Describe("write", name))
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	err = withRetry(ctx, cfg.Retries, cfg.RetryBackoff, func() error {
+		_, err := remote.Write(ctx, name, bytes.NewReader(data))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+
+	if verbose {
+		fmt.Printf("→ Wrote manifest %s\n", name)
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// volumeResult is the outcome of backing up one volume in this run.
+type volumeResult struct {
+	name      string
+	err       error
+	kind      string
+	checksum  string
+	bytesSent int64
+	duration  time.Duration
+	finished  time.Time
+	// Time since the parent's snapshot, for an incremental.
+	sinceParent time.Duration
+}
+
+// status describes the outcome for the run report: ok, skipped when nothing
+// was sent, or failed along with the stage it failed at.
+func (r volumeResult) status() string {
+	var se *stageError
+	switch {
+	case errors.Is(r.err, errSkipped), r.err == nil && r.kind == "":
+		return "skipped"
+	case errors.As(r.err, &se):
+		return "failed at " + se.stage
+	case r.err != nil:
+		return "failed"
+	}
+	return "ok"
+}
+
+var metricLineRegexp = regexp.MustCompile(`^(btrfs_backup_\w+)\{volume="((?:[^"\\]|\\.)*)"\} (\S+)$`)
+
+// readMetrics parses a metrics file written by a previous run into
+// metric -> volume -> value. A missing or unreadable file yields no values.
+func readMetrics(path string) map[string]map[string]float64 {
+	values := map[string]map[string]float64{}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return values
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		match := metricLineRegexp.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		v, err := strconv.ParseFloat(match[3], 64)
+		if err != nil {
+			continue
+		}
+		volume, err := strconv.Unquote(`"` + match[2] + `"`)
+		if err != nil {
+			continue
+		}
+		if values[match[1]] == nil {
+			values[match[1]] = map[string]float64{}
+		}
+		values[match[1]][volume] = v
+	}
+
+	return values
+}
+
+// writeMetrics writes node_exporter textfile metrics for results to path.
+// The last success time and failure count carry over from the previous file
+// so they survive failed runs. The file is replaced atomically.
+func writeMetrics(path string, results []volumeResult) error {
+	if dryRun {
+		if veryVerbose {
+			fmt.Printf("[DRY-RUN] write metrics to %s\n", path)
+		}
+		return nil
+	}
+
+	previous := readMetrics(path)
+	lastSuccess := previous["btrfs_backup_last_success_timestamp"]
+	failures := previous["btrfs_backup_failures_total"]
+	if lastSuccess == nil {
+		lastSuccess = map[string]float64{}
+	}
+	if failures == nil {
+		failures = map[string]float64{}
+	}
+	// A full says nothing about churn, so the last incremental's figures stay.
+	changed := previous["btrfs_backup_changed_bytes"]
+	interval := previous["btrfs_backup_change_interval_seconds"]
+	if changed == nil {
+		changed = map[string]float64{}
+	}
+	if interval == nil {
+		interval = map[string]float64{}
+	}
+
+	bytesSent := map[string]float64{}
+	duration := map[string]float64{}
+	for _, r := range results {
+		// Every volume in the run gets a counter, even at zero.
+		count := failures[r.name]
+		if r.err != nil {
+			count++
+		} else {
+			lastSuccess[r.name] = float64(r.finished.Unix())
+		}
+		failures[r.name] = count
+		bytesSent[r.name] = float64(r.bytesSent)
+		duration[r.name] = r.duration.Seconds()
+		if r.err == nil && r.kind == "inc" {
+			changed[r.name] = float64(r.bytesSent)
+			interval[r.name] = r.sinceParent.Seconds()
+		}
+	}
+
+	var b strings.Builder
+	writeMetric(&b, "btrfs_backup_last_success_timestamp", "gauge", "Unix time of the last successful backup.", lastSuccess)
+	writeMetric(&b, "btrfs_backup_bytes_sent", "gauge", "Bytes sent by the last backup.", bytesSent)
+	writeMetric(&b, "btrfs_backup_duration_seconds", "gauge", "Duration of the last backup.", duration)
+	writeMetric(&b, "btrfs_backup_changed_bytes", "gauge", "Bytes sent by the last incremental.", changed)
+	writeMetric(&b, "btrfs_backup_change_interval_seconds", "gauge", "Time between the last incremental and its parent.", interval)
+	writeMetric(&b, "btrfs_backup_failures_total", "counter", "Failed backups.", failures)
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func writeMetric(b *strings.Builder, name, kind, help string, values map[string]float64) {
+	if len(values) == 0 {
+		return
+	}
+
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", name, kind)
+
+	for _, volume := range slices.Sorted(maps.Keys(values)) {
+		fmt.Fprintf(b, "%s{volume=%q} %s\n", name, volume, strconv.FormatFloat(values[volume], 'f', -1, 64))
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "btrfs-backup.prom")
+	finished := time.Unix(1704103200, 0)
+
+	results := []volumeResult{
+		{name: "root", bytesSent: 1024, duration: 90 * time.Second, finished: finished},
+		{name: "home", err: errors.New("boom"), duration: 5 * time.Second, finished: finished},
+	}
+	if err := writeMetrics(path, results); err != nil {
+		t.Fatalf("writeMetrics: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading metrics: %v", err)
+	}
+	for _, want := range []string{
+		"# TYPE btrfs_backup_failures_total counter",
+		`btrfs_backup_last_success_timestamp{volume="root"} 1704103200`,
+		`btrfs_backup_bytes_sent{volume="root"} 1024`,
+		`btrfs_backup_duration_seconds{volume="root"} 90`,
+		`btrfs_backup_failures_total{volume="home"} 1`,
+		`btrfs_backup_failures_total{volume="root"} 0`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("expected metrics to contain %q, got:\n%s", want, data)
+		}
+	}
+	if strings.Contains(string(data), `last_success_timestamp{volume="home"}`) {
+		t.Errorf("failed volume should have no success timestamp:\n%s", data)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("reading metrics dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the metrics file to remain, got %d entries", len(entries))
+	}
+}
+
+func TestWriteMetricsCarriesOverPreviousRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "btrfs-backup.prom")
+
+	first := []volumeResult{{name: "root", finished: time.Unix(1000, 0)}}
+	if err := writeMetrics(path, first); err != nil {
+		t.Fatalf("writeMetrics: %v", err)
+	}
+
+	second := []volumeResult{{name: "root", err: errors.New("boom"), finished: time.Unix(2000, 0)}}
+	if err := writeMetrics(path, second); err != nil {
+		t.Fatalf("writeMetrics: %v", err)
+	}
+	if err := writeMetrics(path, second); err != nil {
+		t.Fatalf("writeMetrics: %v", err)
+	}
+
+	values := readMetrics(path)
+	if got := values["btrfs_backup_last_success_timestamp"]["root"]; got != 1000 {
+		t.Errorf("expected last success to survive failures, got %v", got)
+	}
+	if got := values["btrfs_backup_failures_total"]["root"]; got != 2 {
+		t.Errorf("expected 2 failures, got %v", got)
+	}
+}
+
+func TestWriteMetricsChurn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "btrfs-backup.prom")
+
+	inc := []volumeResult{{name: "home", kind: "inc", bytesSent: 2048, sinceParent: 24 * time.Hour}}
+	if err := writeMetrics(path, inc); err != nil {
+		t.Fatalf("writeMetrics: %v", err)
+	}
+	// A full in between leaves the last incremental's churn in place.
+	full := []volumeResult{{name: "home", kind: "full", bytesSent: 1 << 20}}
+	if err := writeMetrics(path, full); err != nil {
+		t.Fatalf("writeMetrics: %v", err)
+	}
+
+	values := readMetrics(path)
+	if got := values["btrfs_backup_changed_bytes"]["home"]; got != 2048 {
+		t.Errorf("expected 2048 changed bytes, got %v", got)
+	}
+	if got := values["btrfs_backup_change_interval_seconds"]["home"]; got != 86400 {
+		t.Errorf("expected a day between the incremental and its parent, got %v", got)
+	}
+}
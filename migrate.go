@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// runMigrate copies a volume's backups from one remote to another as stored,
+// for moving to a new backup host without sending from the source again.
+// Backups already on the destination are skipped, so an interrupted migration
+// picks up where it stopped.
+func runMigrate(ctx context.Context, cfg *Config, args []string) error {
+	var volumeName, from, to string
+
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.StringVar(&volumeName, "volume", "", "Name of the volume to migrate")
+	fs.StringVar(&from, "from", "", "Remote to copy from, as [user@]host[:port]:/dest, or /dest for a local one")
+	fs.StringVar(&to, "to", "", "Remote to copy to, in the same form as --from")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if volumeName == "" || from == "" || to == "" {
+		return errors.New("migrate requires --volume, --from and --to")
+	}
+
+	if cfg.Backend == "s3" {
+		return errors.New("migrate is not supported with backend s3")
+	}
+
+	vol := findVolume(cfg, volumeName)
+	if vol == nil {
+		return fmt.Errorf("volume %q not found in config", volumeName)
+	}
+
+	src, err := cfg.endpointConfig(from)
+	if err != nil {
+		return fmt.Errorf("invalid --from: %w", err)
+	}
+	dst, err := cfg.endpointConfig(to)
+	if err != nil {
+		return fmt.Errorf("invalid --to: %w", err)
+	}
+
+	backups, err := listRemoteBackups(ctx, src, vol)
+	if err != nil {
+		return err
+	}
+	if len(backups) == 0 {
+		return errors.New("no remote backups found")
+	}
+
+	if !dryRun {
+		if err := dst.remote().Check(ctx); err != nil {
+			return fmt.Errorf("checking %s: %w", remoteTarget(dst, dst.RemoteDest), err)
+		}
+	}
+
+	copied := 0
+	for _, b := range backups {
+		if remoteBackupExists(ctx, dst, b.Name) {
+			if verbose {
+				fmt.Printf("→ %s is already on %s, skipping\n", b.Name, remoteTarget(dst, dst.RemoteDest))
+			}
+			continue
+		}
+		if err := migrateBackup(ctx, src, dst, b.Name); err != nil {
+			return fmt.Errorf("copying %s: %w", b.Name, err)
+		}
+		copied++
+	}
+
+	if copied > 0 && cfg.MaintainLatest && !dryRun {
+		if err := writeLatest(ctx, dst, vol, backups[len(backups)-1].Name); err != nil {
+			errLog.Printf("Error updating latest pointer for %s: %v", vol.Name, err)
+		}
+	}
+
+	if verbose {
+		fmt.Printf("→ Copied %d of %d backup(s) of %s to %s\n", copied, len(backups), vol.Name, remoteTarget(dst, dst.RemoteDest))
+	}
+
+	return nil
+}
+
+// endpointConfig returns cfg pointed at endpoint, given as [user@]host:/dest,
+// or just /dest for a directory on this machine.
+func (cfg *Config) endpointConfig(endpoint string) (*Config, error) {
+	host, dest := "", endpoint
+	if i := strings.Index(endpoint, ":/"); i >= 0 {
+		host, dest = endpoint[:i], endpoint[i+1:]
+	}
+	if !filepath.IsAbs(dest) {
+		return nil, fmt.Errorf("%q needs an absolute destination directory", endpoint)
+	}
+
+	c := *cfg
+	c.RemoteHost = host
+	c.RemotePort = 0
+	c.RemoteDest = dest
+	c.Mirrors = nil
+	c.backend = nil
+	return &c, nil
+}
+
+// migrateBackup streams name from src to dst, checking it against the
+// checksum sidecar on src before moving it into place with the sidecar and
+// any manifest.
+func migrateBackup(ctx context.Context, src, dst *Config, name string) error {
+	catRemoteCmd := fmt.Sprintf("cat %s", shellEscape(filepath.Join(src.RemoteDest, name)))
+	tmpFile := newTmpName(name)
+
+	if verbose {
+		fmt.Printf("→ Copying %s → %s\n", name, remoteTarget(dst, dst.RemoteDest))
+	}
+
+	if dryRun {
+		if veryVerbose {
+			fmt.Printf("[DRY-RUN] %s | %s\n", describeRemoteCommand(src, catRemoteCmd), dst.remote().Describe("write", tmpFile))
+			fmt.Printf("[DRY-RUN] %s\n", dst.remote().Describe("rename", tmpFile, name))
+		}
+		return nil
+	}
+
+	expected, algorithm, err := readRemoteChecksum(ctx, src, name)
+	if err != nil {
+		return err
+	}
+
+	// The destination hashes with the algorithm the sidecar was made with,
+	// so the two can be compared and the sidecar carried over as is.
+	c := *dst
+	c.ChecksumAlgorithm = algorithm.name
+	c.backend = nil
+	dst = &c
+
+	catCmd := remoteCommand(ctx, src, catRemoteCmd)
+	catCmd.Stderr = os.Stderr
+	stdout, err := catCmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := catCmd.Start(); err != nil {
+		return fmt.Errorf("ssh start failed: %w", err)
+	}
+
+	h := algorithm.newHash()
+	remoteChecksum, writeErr := dst.remote().Write(ctx, tmpFile, io.TeeReader(stdout, h))
+	if writeErr != nil {
+		// Nothing reads the rest of the stream now.
+		_ = catCmd.Process.Kill()
+	}
+	catErr := catCmd.Wait()
+
+	err = writeErr
+	if err == nil && catErr != nil {
+		err = fmt.Errorf("reading from %s: %w", remoteTarget(src, src.RemoteDest), catErr)
+	}
+	if err == nil {
+		actual := hex.EncodeToString(h.Sum(nil))
+		if !strings.EqualFold(actual, expected) {
+			err = fmt.Errorf("checksum mismatch: expected=%s read=%s", expected, actual)
+		} else if remoteChecksum != "" && !strings.EqualFold(remoteChecksum, expected) {
+			err = fmt.Errorf("checksum mismatch: expected=%s written=%s", expected, remoteChecksum)
+		}
+	}
+	if err != nil {
+		if rmErr := dst.remote().Remove(context.Background(), tmpFile); rmErr != nil {
+			errLog.Printf("Error during cleanup of temp file: %v", rmErr)
+		}
+		return err
+	}
+
+	if err := moveTmpFile(ctx, dst, tmpFile, name, expected); err != nil {
+		return fmt.Errorf("finalizing remote file: %w", err)
+	}
+
+	hasManifest, err := migrateManifest(ctx, src, dst, name)
+	if err != nil {
+		errLog.Printf("Error copying manifest for %s: %v", name, err)
+	}
+	if err := chmodRemoteFiles(ctx, dst, backupFiles(dst, name, true, hasManifest)...); err != nil {
+		errLog.Printf("Error setting permissions on %s: %v", name, err)
+	}
+
+	if verbose {
+		fmt.Printf("→ Verified %s\n", name)
+	}
+
+	return nil
+}
+
+// migrateManifest copies name's manifest from src to dst, reporting whether
+// there was one. Backups made before manifests were written have none.
+func migrateManifest(ctx context.Context, src, dst *Config, name string) (bool, error) {
+	manifest := manifestName(name)
+	remoteCmd := fmt.Sprintf("if test -e %[1]s; then cat %[1]s; fi", shellEscape(filepath.Join(src.RemoteDest, manifest)))
+
+	var data []byte
+	err := withRetry(ctx, src.Retries, src.RetryBackoff, func() error {
+		return runRemoteOp(ctx, src, remoteCmd, func(cmd *exec.Cmd) (err error) {
+			data, err = cmd.Output()
+			return err
+		})
+	})
+	if err != nil || len(data) == 0 {
+		return false, err
+	}
+
+	err = withRetry(ctx, dst.Retries, dst.RetryBackoff, func() error {
+		_, err := dst.remote().Write(ctx, manifest, bytes.NewReader(data))
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("writing %s: %w", manifest, err)
+	}
+	return true, nil
+}
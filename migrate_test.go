@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunMigrate(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+	newDir := t.TempDir()
+
+	writeRemoteBackup(t, remoteDir, "home-2024-05-10_10-00-00.full.btrfs", "full;", true)
+	writeRemoteBackup(t, remoteDir, "home-2024-05-11_10-00-00.inc.btrfs", "inc1;", true)
+	if err := os.WriteFile(filepath.Join(remoteDir, "home-2024-05-11_10-00-00.inc.btrfs.json"), []byte("{}\n"), 0o644); err != nil {
+		t.Fatalf("writing manifest: %v", err)
+	}
+	// Left by an earlier, interrupted migration.
+	writeRemoteBackup(t, newDir, "home-2024-05-10_10-00-00.full.btrfs", "full;", true)
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Volumes:    []Volume{{Name: "home"}},
+	}
+
+	sshLog := filepath.Join(t.TempDir(), "ssh.log")
+	t.Setenv("SSH_LOG", sshLog)
+
+	args := []string{"--volume", "home", "--from", "old:" + remoteDir, "--to", "new:" + newDir}
+	if err := runMigrate(context.Background(), cfg, args); err != nil {
+		t.Fatalf("runMigrate: %v", err)
+	}
+
+	assertDir(t, newDir, []string{
+		"home-2024-05-10_10-00-00.full.btrfs",
+		"home-2024-05-10_10-00-00.full.btrfs.sha256",
+		"home-2024-05-11_10-00-00.inc.btrfs",
+		"home-2024-05-11_10-00-00.inc.btrfs.json",
+		"home-2024-05-11_10-00-00.inc.btrfs.sha256",
+	})
+	data, err := os.ReadFile(filepath.Join(newDir, "home-2024-05-11_10-00-00.inc.btrfs"))
+	if err != nil {
+		t.Fatalf("reading copied backup: %v", err)
+	}
+	if string(data) != "inc1;" {
+		t.Fatalf("expected the backup as stored, got %q", string(data))
+	}
+
+	logData, err := os.ReadFile(sshLog)
+	if err != nil {
+		t.Fatalf("reading ssh log: %v", err)
+	}
+	catCmd := func(name string) string {
+		return "cat " + shellEscape(filepath.Join(remoteDir, name)) + "\n"
+	}
+	if !strings.Contains(string(logData), catCmd("home-2024-05-11_10-00-00.inc.btrfs")) {
+		t.Fatalf("expected the missing backup to be read, got:\n%s", logData)
+	}
+	if strings.Contains(string(logData), catCmd("home-2024-05-10_10-00-00.full.btrfs")) {
+		t.Fatalf("expected the backup already on the destination not to be read, got:\n%s", logData)
+	}
+}
+
+func TestRunMigrateChecksumMismatch(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+	newDir := t.TempDir()
+
+	name := "home-2024-05-10_10-00-00.full.btrfs"
+	writeRemoteBackup(t, remoteDir, name, "full;", true)
+	if err := os.WriteFile(filepath.Join(remoteDir, name), []byte("corrupt"), 0o644); err != nil {
+		t.Fatalf("corrupting backup: %v", err)
+	}
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Volumes:    []Volume{{Name: "home"}},
+	}
+
+	args := []string{"--volume", "home", "--from", "old:" + remoteDir, "--to", "new:" + newDir}
+	err := runMigrate(context.Background(), cfg, args)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch error, got %v", err)
+	}
+	assertDir(t, newDir, nil)
+}
+
+func TestEndpointConfig(t *testing.T) {
+	cfg := &Config{RemoteHost: "backup@old", RemotePort: 2222, RemoteDest: "/srv/old"}
+
+	tests := []struct {
+		endpoint, host, dest string
+	}{
+		{"backup@new:/srv/new", "backup@new", "/srv/new"},
+		{"backup@new:2200:/srv/new", "backup@new:2200", "/srv/new"},
+		{"/mnt/backups", "", "/mnt/backups"},
+	}
+	for _, tt := range tests {
+		c, err := cfg.endpointConfig(tt.endpoint)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.endpoint, err)
+		}
+		if c.RemoteHost != tt.host || c.RemoteDest != tt.dest || c.RemotePort != 0 {
+			t.Errorf("%s: expected %q %q, got %q %q port %d", tt.endpoint, tt.host, tt.dest, c.RemoteHost, c.RemoteDest, c.RemotePort)
+		}
+	}
+
+	if _, err := cfg.endpointConfig("backup@new:srv"); err == nil {
+		t.Error("expected an error for a relative destination")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// mirrorConfigs returns a config for each mirror, the primary's with the
+// destination swapped out.
+func (cfg *Config) mirrorConfigs() []*Config {
+	var configs []*Config
+	for _, m := range cfg.Mirrors {
+		c := *cfg
+		c.RemoteHost = m.RemoteHost
+		c.RemotePort = m.RemotePort
+		c.RemoteDest = m.RemoteDest
+		c.SSHKey = m.SSHKey
+		c.Mirrors = nil
+		c.backend = nil
+		configs = append(configs, &c)
+	}
+	return configs
+}
+
+// mirrorUpload tracks one mirror's copy of a backup. Once err is set the
+// mirror is left out of the rest of the backup.
+type mirrorUpload struct {
+	cfg      *Config
+	backups  []remoteBackup
+	checksum string
+	err      error
+}
+
+func (m *mirrorUpload) String() string {
+	return remoteTarget(m.cfg, m.cfg.RemoteDest)
+}
+
+// newMirrorUploads lists each mirror's backups of vol, which the rest of the
+// backup works from as it does the primary's listing.
+func newMirrorUploads(ctx context.Context, cfg *Config, vol *Volume) []*mirrorUpload {
+	var mirrors []*mirrorUpload
+	for _, c := range cfg.mirrorConfigs() {
+		m := &mirrorUpload{cfg: c}
+		backups, err := listRemoteBackups(ctx, c, vol)
+		if err != nil {
+			m.err = fmt.Errorf("listing backups: %w", err)
+		}
+		m.backups = backups
+		mirrors = append(mirrors, m)
+	}
+	return mirrors
+}
+
+// skipMirrorsWithoutParent leaves out mirrors that missed the backup an
+// incremental is diffed against; the stream would be no use to them. They
+// catch up at the next full.
+func skipMirrorsWithoutParent(mirrors []*mirrorUpload, parent string) {
+	ts, err := extractSnapshotTimestamp(parent)
+	if err != nil {
+		return
+	}
+	for _, m := range mirrors {
+		if m.err == nil && !remoteBackupForTimestamp(m.backups, ts) {
+			m.err = fmt.Errorf("missing the parent backup for %s, skipped until the next full", filepath.Base(parent))
+		}
+	}
+}
+
+// mirrorCloneSources drops the clone sources whose backups some active mirror
+// lacks, since a mirror's copy of the stream has to restore there too.
+func mirrorCloneSources(mirrors []*mirrorUpload, clones []string) []string {
+	var kept []string
+	for _, clone := range clones {
+		ts, err := extractSnapshotTimestamp(clone)
+		if err != nil {
+			continue
+		}
+		present := true
+		for _, m := range activeMirrors(mirrors) {
+			if !remoteBackupForTimestamp(m.backups, ts) {
+				present = false
+				break
+			}
+		}
+		if present {
+			kept = append(kept, clone)
+		}
+	}
+	return kept
+}
+
+// activeMirrors returns the mirrors still taking part in the backup.
+func activeMirrors(mirrors []*mirrorUpload) []*mirrorUpload {
+	var active []*mirrorUpload
+	for _, m := range mirrors {
+		if m.err == nil {
+			active = append(active, m)
+		}
+	}
+	return active
+}
+
+// mirrorErrors combines the failures of mirrors into one error naming each.
+func mirrorErrors(mirrors []*mirrorUpload) error {
+	var errs []error
+	for _, m := range mirrors {
+		if m.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", m, m.err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// mirrorWriter feeds a mirror's upload. A failed mirror stops being written
+// to rather than failing the stream for every destination.
+type mirrorWriter struct {
+	w   *io.PipeWriter
+	err error
+}
+
+func (mw *mirrorWriter) Write(p []byte) (int, error) {
+	if mw.err == nil {
+		_, mw.err = mw.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// startMirrorWrites starts uploading tmpFile to each mirror, returning the
+// writer to tee the stream into and a function that ends the uploads once
+// the stream is done, or with err if it failed, and waits for them.
+func startMirrorWrites(ctx context.Context, mirrors []*mirrorUpload, tmpFile string) (io.Writer, func(err error)) {
+	var writers []io.Writer
+	var mws []*mirrorWriter
+	done := make(chan struct{}, len(mirrors))
+	for _, m := range mirrors {
+		m.checksum = ""
+		pr, pw := io.Pipe()
+		mw := &mirrorWriter{w: pw}
+		writers = append(writers, mw)
+		mws = append(mws, mw)
+
+		go func() {
+			checksum, err := m.cfg.remote().Write(ctx, tmpFile, pr)
+			// Unblock the stream if the upload stopped reading early.
+			pr.CloseWithError(errors.New("mirror upload finished"))
+			m.checksum, m.err = checksum, err
+			done <- struct{}{}
+		}()
+	}
+
+	finish := func(err error) {
+		for _, mw := range mws {
+			mw.w.CloseWithError(err)
+		}
+		for range mirrors {
+			<-done
+		}
+		for i, m := range mirrors {
+			if m.err == nil && mws[i].err != nil {
+				m.err = mws[i].err
+			}
+		}
+	}
+	return io.MultiWriter(writers...), finish
+}
+
+// removeMirrorTmpFiles deletes tmpFile from each mirror, after the upload
+// failed or turned out not to be needed.
+func removeMirrorTmpFiles(mirrors []*mirrorUpload, tmpFile string) {
+	for _, m := range mirrors {
+		if err := m.cfg.remote().Remove(context.Background(), tmpFile); err != nil {
+			errLog.Printf("Error during cleanup of temp file on %s: %v", m, err)
+		}
+	}
+}
+
+// finishMirrors puts the upload in place on each mirror that received it,
+// with its manifest, and applies retention there. It returns the failures of
+// every mirror, including those that dropped out earlier.
+func finishMirrors(ctx context.Context, vol *Volume, mirrors []*mirrorUpload, tmpFile, outfile, checksum string, manifest backupManifest, newBackup *remoteBackup) error {
+	for _, m := range activeMirrors(mirrors) {
+		if err := moveTmpFile(ctx, m.cfg, tmpFile, outfile, checksum); err != nil {
+			m.err = fmt.Errorf("finalizing remote file: %w", err)
+			continue
+		}
+		manifestErr := writeManifest(ctx, m.cfg, outfile, manifest)
+		if manifestErr != nil {
+			errLog.Printf("Error writing manifest for %s on %s: %v", outfile, m, manifestErr)
+		}
+		if err := chmodRemoteFiles(ctx, m.cfg, backupFiles(m.cfg, outfile, checksum != "", manifestErr == nil)...); err != nil {
+			errLog.Printf("Error setting permissions on %s on %s: %v", outfile, m, err)
+		}
+		if m.cfg.MaintainLatest {
+			if err := writeLatest(ctx, m.cfg, vol, outfile); err != nil {
+				errLog.Printf("Error updating latest pointer for %s on %s: %v", vol.Name, m, err)
+			}
+		}
+		if err := cleanupOldBackups(ctx, m.cfg, vol, m.backups, newBackup); err != nil {
+			errLog.Printf("Error cleaning up old backups on %s: %v", m, err)
+		}
+		if verbose {
+			fmt.Printf("→ Mirrored %s to %s\n", outfile, m)
+		}
+	}
+
+	if err := mirrorErrors(mirrors); err != nil {
+		return fmt.Errorf("mirroring failed: %s", strings.ReplaceAll(err.Error(), "\n", "; "))
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupVolumeMirrors(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+	mirrorDir := t.TempDir()
+
+	snapDir := t.TempDir()
+	vol := &Volume{Name: "root", Src: "/@", SnapDir: snapDir}
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Backend:    "ssh",
+		Mirrors:    []Mirror{{RemoteHost: "mirror", RemoteDest: mirrorDir}},
+		Volumes:    []Volume{*vol},
+	}
+
+	day1 := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+	for _, currentTime := range []time.Time{day1, day2} {
+		if _, err := backupVolume(context.Background(), cfg, vol, currentTime); err != nil {
+			t.Fatalf("backupVolume: %v", err)
+		}
+	}
+
+	for _, name := range []string{"root-2024-01-01_10-00-00.full.btrfs", "root-2024-01-02_10-00-00.inc.btrfs"} {
+		primary, err := os.ReadFile(filepath.Join(remoteDir, name))
+		if err != nil {
+			t.Fatalf("reading primary %s: %v", name, err)
+		}
+		mirrored, err := os.ReadFile(filepath.Join(mirrorDir, name))
+		if err != nil {
+			t.Fatalf("reading mirrored %s: %v", name, err)
+		}
+		if !bytes.Equal(primary, mirrored) {
+			t.Errorf("mirrored %s differs from the primary", name)
+		}
+		for _, sidecar := range []string{name + ".sha256", name + ".json"} {
+			if _, err := os.Stat(filepath.Join(mirrorDir, sidecar)); err != nil {
+				t.Errorf("expected %s on the mirror: %v", sidecar, err)
+			}
+		}
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(mirrorDir, "*.tmp")); len(tmp) > 0 {
+		t.Errorf("expected no temp files left on the mirror, got %v", tmp)
+	}
+}
+
+func TestBackupVolumeMirrorFailureKeepsPrimary(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	snapDir := t.TempDir()
+	vol := &Volume{Name: "root", Src: "/@", SnapDir: snapDir}
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Backend:    "ssh",
+		Mirrors:    []Mirror{{RemoteHost: "mirror", RemoteDest: missing}},
+		Volumes:    []Volume{*vol},
+	}
+
+	currentTime := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	_, err := backupVolume(context.Background(), cfg, vol, currentTime)
+
+	var se *stageError
+	if !errors.As(err, &se) || se.stage != "mirror" {
+		t.Fatalf("expected a mirror failure, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "mirror:"+missing) {
+		t.Errorf("expected the error to name the mirror, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, "root-2024-01-01_10-00-00.full.btrfs")); err != nil {
+		t.Fatalf("expected the primary backup despite the mirror failure: %v", err)
+	}
+}
+
+func TestBackupVolumeSkipsMirrorWithoutParent(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+	mirrorDir := t.TempDir()
+
+	snapDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(snapDir, "btrfs-backup-2024-01-01_10-00-00"), 0o755); err != nil {
+		t.Fatalf("creating snapshot: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(remoteDir, "root-2024-01-01_10-00-00.full.btrfs"), []byte("full"), 0o644); err != nil {
+		t.Fatalf("creating remote full: %v", err)
+	}
+
+	vol := &Volume{Name: "root", Src: "/@", SnapDir: snapDir}
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Backend:    "ssh",
+		Mirrors:    []Mirror{{RemoteHost: "mirror", RemoteDest: mirrorDir}},
+		Volumes:    []Volume{*vol},
+	}
+
+	currentTime := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	_, err := backupVolume(context.Background(), cfg, vol, currentTime)
+	if err == nil || !strings.Contains(err.Error(), "missing the parent backup") {
+		t.Fatalf("expected the mirror to be skipped for its missing parent, got %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(remoteDir, "root-2024-01-02_10-00-00.inc.btrfs")); err != nil {
+		t.Fatalf("expected the primary incremental: %v", err)
+	}
+	if entries, _ := os.ReadDir(mirrorDir); len(entries) > 0 {
+		t.Errorf("expected nothing written to the skipped mirror, got %d entries", len(entries))
+	}
+}
+
+func TestMirrorCloneSources(t *testing.T) {
+	at := func(day int) time.Time { return time.Date(2024, 1, day, 10, 0, 0, 0, time.UTC) }
+	clones := []string{"/snaps/btrfs-backup-2024-01-01_10-00-00", "/snaps/btrfs-backup-2024-01-02_10-00-00"}
+	mirrors := []*mirrorUpload{
+		{backups: []remoteBackup{{Timestamp: at(1)}, {Timestamp: at(2)}}},
+		{backups: []remoteBackup{{Timestamp: at(2)}}},
+		// Already failed, so it doesn't hold the others back.
+		{err: errors.New("unreachable")},
+	}
+
+	got := mirrorCloneSources(mirrors, clones)
+	if len(got) != 1 || got[0] != clones[1] {
+		t.Fatalf("expected only the clone source every mirror has, got %v", got)
+	}
+}
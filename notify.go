@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+const notifyTimeout = 10 * time.Second
+
+// notification is the JSON body POSTed to notify.webhook_url.
+type notification struct {
+	Status  string    `json:"status"`
+	Host    string    `json:"host"`
+	Volume  string    `json:"volume,omitempty"`
+	Stage   string    `json:"stage,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Volumes []string  `json:"volumes,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// stageError records which step of a backup failed so notifications can say
+// more than the error text.
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string { return e.err.Error() }
+func (e *stageError) Unwrap() error { return e.err }
+
+func failedAt(stage string, err error) error {
+	return &stageError{stage: stage, err: err}
+}
+
+// notifyFailure reports a failed volume, or the whole run when volume is empty.
+func notifyFailure(cfg *Config, volume, stage string, err error) {
+	var se *stageError
+	if errors.As(err, &se) {
+		stage = se.stage
+	}
+	sendNotification(cfg, notification{
+		Status: "failure",
+		Volume: volume,
+		Stage:  stage,
+		Error:  err.Error(),
+	})
+}
+
+func notifySuccess(cfg *Config) {
+	if cfg.Notify == nil || !cfg.Notify.NotifyOnSuccess {
+		return
+	}
+	var volumes []string
+	for _, vol := range cfg.Volumes {
+		volumes = append(volumes, vol.Name)
+	}
+	sendNotification(cfg, notification{Status: "success", Volumes: volumes})
+}
+
+// sendNotification POSTs n to the webhook. It is best-effort: problems are
+// logged and never replace the error being reported.
+func sendNotification(cfg *Config, n notification) {
+	if cfg.Notify == nil || cfg.Notify.WebhookURL == "" {
+		return
+	}
+
+	if dryRun {
+		if veryVerbose {
+			fmt.Printf("[DRY-RUN] POST %s (%s)\n", cfg.Notify.WebhookURL, n.Status)
+		}
+		return
+	}
+
+	n.Host, _ = os.Hostname()
+	n.Time = time.Now()
+	body, err := json.Marshal(n)
+	if err != nil {
+		errLog.Printf("Error encoding notification: %v", err)
+		return
+	}
+
+	// Not tied to the run's context: an interrupted run should still report.
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.Notify.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		errLog.Printf("Error sending notification: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		errLog.Printf("Error sending notification: %v", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		errLog.Printf("Error sending notification: webhook returned %s", resp.Status)
+		return
+	}
+
+	if verbose {
+		fmt.Printf("→ Sent %s notification\n", n.Status)
+	}
+}
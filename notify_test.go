@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRecorder is a test server collecting the notifications it receives.
+type webhookRecorder struct {
+	mu       sync.Mutex
+	received []notification
+}
+
+func newWebhookRecorder(t *testing.T, status int) (*webhookRecorder, string) {
+	rec := &webhookRecorder{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("decoding notification: %v", err)
+		}
+		rec.mu.Lock()
+		rec.received = append(rec.received, n)
+		rec.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return rec, srv.URL
+}
+
+func TestNotifyFailureReportsStage(t *testing.T) {
+	rec, url := newWebhookRecorder(t, http.StatusOK)
+	cfg := &Config{Notify: &NotifyConfig{WebhookURL: url}}
+
+	err := fmt.Errorf("wrapped: %w", failedAt("send", errors.New("broken pipe")))
+	notifyFailure(cfg, "home", "backup", err)
+
+	if len(rec.received) != 1 {
+		t.Fatalf("expected 1 notification, got %d", len(rec.received))
+	}
+	n := rec.received[0]
+	if n.Status != "failure" || n.Volume != "home" || n.Stage != "send" || n.Error != "wrapped: broken pipe" {
+		t.Fatalf("unexpected notification: %+v", n)
+	}
+}
+
+func TestNotifySuccessIsOptIn(t *testing.T) {
+	rec, url := newWebhookRecorder(t, http.StatusOK)
+	cfg := &Config{
+		Notify:  &NotifyConfig{WebhookURL: url},
+		Volumes: []Volume{{Name: "root"}, {Name: "home"}},
+	}
+
+	notifySuccess(cfg)
+	if len(rec.received) != 0 {
+		t.Fatalf("expected no notification without notify_on_success, got %d", len(rec.received))
+	}
+
+	cfg.Notify.NotifyOnSuccess = true
+	notifySuccess(cfg)
+	if len(rec.received) != 1 {
+		t.Fatalf("expected 1 notification, got %d", len(rec.received))
+	}
+	if n := rec.received[0]; n.Status != "success" || len(n.Volumes) != 2 {
+		t.Fatalf("unexpected notification: %+v", n)
+	}
+}
+
+func TestSendNotificationIsBestEffort(t *testing.T) {
+	_, url := newWebhookRecorder(t, http.StatusInternalServerError)
+
+	// Neither an error status nor an unreachable server may panic or block.
+	for _, u := range []string{url, "http://127.0.0.1:1"} {
+		cfg := &Config{Notify: &NotifyConfig{WebhookURL: u}}
+		notifyFailure(cfg, "", "preflight", errors.New("boom"))
+	}
+}
+
+func TestRunBackupsNotifiesFailedVolume(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+	t.Setenv("BTRFS_FAIL_SNAPSHOT_SRC", "/@broken")
+	rec, url := newWebhookRecorder(t, http.StatusOK)
+
+	snapRoot := t.TempDir()
+	cfg := &Config{
+		RemoteHost:  "remote",
+		RemoteDest:  remoteDir,
+		Backend:     "ssh",
+		Parallelism: 1,
+		Notify:      &NotifyConfig{WebhookURL: url},
+		Volumes: []Volume{
+			{Name: "root", Src: "/@", SnapDir: filepath.Join(snapRoot, "root")},
+			{Name: "broken", Src: "/@broken", SnapDir: filepath.Join(snapRoot, "broken")},
+		},
+	}
+
+	runBackups(context.Background(), cfg, time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC))
+
+	if len(rec.received) != 1 {
+		t.Fatalf("expected 1 notification, got %d", len(rec.received))
+	}
+	if n := rec.received[0]; n.Volume != "broken" || n.Stage != "snapshot" {
+		t.Fatalf("unexpected notification: %+v", n)
+	}
+}
@@ -1,34 +1,121 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// progressOutput is where transfer progress goes, stderr unless -progress-fd
+// names another descriptor.
+var progressOutput io.Writer = os.Stderr
+
+// progressStatus is the state of a transfer handed to a progressFormatter on
+// each tick, and once more with Done set when it finishes.
+type progressStatus struct {
+	Label    string
+	Bytes    int64
+	Total    int64
+	Rate     float64 // bytes/sec over the last tick, or the average once done
+	Elapsed  time.Duration
+	Done     bool
+	RunBytes int64 // sent by every volume in the run so far
+	Volumes  int   // set only on the run's total, to the volumes it covers
+}
+
+// progressFormatter writes one progress update to w.
+type progressFormatter func(w io.Writer, s progressStatus)
+
+// progressFormats are the formatters selectable with -progress-format.
+var progressFormats = map[string]progressFormatter{
+	"human": humanProgress,
+	"json":  jsonProgress,
+}
+
+// progressTotals sums the transfers of every volume in a run, for a total
+// alongside each volume's own progress.
+type progressTotals struct {
+	bytes   atomic.Int64
+	mu      sync.Mutex
+	volumes map[string]bool
+	start   time.Time
+}
+
+// runTotals is what the transfers of this run report into.
+var runTotals = &progressTotals{}
+
+// add counts volume's transfer, from when the first one started.
+func (t *progressTotals) add(volume string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.volumes == nil {
+		t.volumes = map[string]bool{}
+		t.start = time.Now()
+	}
+	t.volumes[volume] = true
+}
+
+// Finish writes the total sent across all volumes, when there was more than
+// one to add up.
+func (t *progressTotals) Finish(output io.Writer, format progressFormatter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.volumes) < 2 {
+		return
+	}
+
+	elapsed := time.Since(t.start)
+	bytes := t.bytes.Load()
+	format(output, progressStatus{
+		Label:    "total",
+		Bytes:    bytes,
+		Rate:     float64(bytes) / elapsed.Seconds(),
+		Elapsed:  elapsed,
+		Done:     true,
+		RunBytes: bytes,
+		Volumes:  len(t.volumes),
+	})
+}
+
 type ProgressWriter struct {
 	output       io.Writer
+	format       progressFormatter
+	run          *progressTotals
 	bytesWritten int64
 	lastBytes    int64
 	startTime    time.Time
 	lastUpdate   time.Time
 	mu           sync.Mutex
 	label        string
+	total        int64
 	updateTicker *time.Ticker
-	done         chan bool
+	done         chan struct{}
+	finishOnce   sync.Once
 	wg           sync.WaitGroup
 }
 
-func NewProgressWriter(output io.Writer, label string) *ProgressWriter {
+// NewProgressWriter displays the progress of sending volume's backup of the
+// given kind, labelled like "home (full)" so concurrent transfers can be told
+// apart. Bytes are also counted in run, when it isn't nil.
+func NewProgressWriter(output io.Writer, format progressFormatter, run *progressTotals, volume, kind string) *ProgressWriter {
+	if run != nil {
+		run.add(volume)
+	}
+
 	now := time.Now()
 	pw := &ProgressWriter{
 		output:       output,
+		format:       format,
+		run:          run,
 		startTime:    now,
 		lastUpdate:   now,
-		label:        label,
+		label:        fmt.Sprintf("%s (%s)", volume, kind),
 		updateTicker: time.NewTicker(time.Second),
-		done:         make(chan bool),
+		done:         make(chan struct{}),
 	}
 
 	pw.wg.Add(1)
@@ -37,6 +124,37 @@ func NewProgressWriter(output io.Writer, label string) *ProgressWriter {
 	return pw
 }
 
+// newTransferProgress displays volume's transfer on progressOutput in the
+// format chosen with -progress-format.
+func newTransferProgress(volume, kind string) *ProgressWriter {
+	format, ok := progressFormats[progressFormat]
+	if !ok {
+		format = humanProgress
+	}
+	return NewProgressWriter(progressOutput, format, runTotals, volume, kind)
+}
+
+// SetTotal sets the expected number of bytes, adding a percentage and ETA to
+// the display. Zero means unknown.
+func (pw *ProgressWriter) SetTotal(total int64) {
+	pw.mu.Lock()
+	pw.total = total
+	pw.mu.Unlock()
+}
+
+// estimateCompletion returns how far through total the transfer is and the time
+// left at the average rate so far. ok is false when there's nothing to base an
+// estimate on, or the transfer has outgrown the estimate.
+func estimateCompletion(written, total int64, elapsed time.Duration) (percent float64, eta time.Duration, ok bool) {
+	if total <= 0 || written <= 0 || written > total || elapsed <= 0 {
+		return 0, 0, false
+	}
+	percent = float64(written) * 100 / float64(total)
+	rate := float64(written) / elapsed.Seconds()
+	eta = time.Duration(float64(total-written) / rate * float64(time.Second))
+	return percent, eta, true
+}
+
 func (pw *ProgressWriter) displayLoop() {
 	defer pw.wg.Done()
 	for {
@@ -44,64 +162,219 @@ func (pw *ProgressWriter) displayLoop() {
 		case <-pw.done:
 			return
 		case now := <-pw.updateTicker.C:
-			pw.mu.Lock()
-			elapsed := now.Sub(pw.startTime)
-
-			bytesSinceLastUpdate := pw.bytesWritten - pw.lastBytes
-			instantRate := float64(bytesSinceLastUpdate)
-			pw.lastBytes = pw.bytesWritten
-
-			var status string
-			if instantRate > 0 {
-				status = fmt.Sprintf("%s/s", formatBytes(int64(instantRate)))
-			} else if pw.bytesWritten > 0 {
-				status = "0.0 B/s"
-			} else {
-				status = "waiting..."
-			}
-
-			_, _ = fmt.Fprintf(
-				pw.output,
-				"\r\033[K→ %s: %s transferred, %s, %s elapsed",
-				pw.label,
-				formatBytes(pw.bytesWritten),
-				status,
-				formatDuration(elapsed),
-			)
-			pw.mu.Unlock()
+			pw.tick(now)
 		}
 	}
 }
 
+// tick reports progress as of now. The rate is over the time since the last
+// tick rather than assumed to be a second, as the ticker drifts and drops ticks
+// when the display falls behind.
+func (pw *ProgressWriter) tick(now time.Time) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	var rate float64
+	if interval := now.Sub(pw.lastUpdate); interval > 0 {
+		rate = float64(pw.bytesWritten-pw.lastBytes) / interval.Seconds()
+	}
+	pw.lastBytes = pw.bytesWritten
+	pw.lastUpdate = now
+
+	pw.format(pw.output, progressStatus{
+		Label:    pw.label,
+		Bytes:    pw.bytesWritten,
+		Total:    pw.total,
+		Rate:     rate,
+		Elapsed:  now.Sub(pw.startTime),
+		RunBytes: pw.runBytes(),
+	})
+}
+
 func (pw *ProgressWriter) Write(p []byte) (int, error) {
 	n := len(p)
 
 	pw.mu.Lock()
 	pw.bytesWritten += int64(n)
 	pw.mu.Unlock()
+	if pw.run != nil {
+		pw.run.bytes.Add(int64(n))
+	}
 
 	return n, nil
 }
 
+// Finish stops the display and writes the summary. It doesn't depend on the
+// display loop still running, and only the first call does anything.
 func (pw *ProgressWriter) Finish() {
-	pw.updateTicker.Stop()
-	close(pw.done)
-	pw.wg.Wait()
+	pw.finishOnce.Do(func() {
+		pw.updateTicker.Stop()
+		close(pw.done)
+		pw.wg.Wait()
+
+		pw.mu.Lock()
+		defer pw.mu.Unlock()
+
+		elapsed := time.Since(pw.startTime)
+		pw.format(pw.output, progressStatus{
+			Label:    pw.label,
+			Bytes:    pw.bytesWritten,
+			Total:    pw.total,
+			Rate:     float64(pw.bytesWritten) / elapsed.Seconds(),
+			Elapsed:  elapsed,
+			Done:     true,
+			RunBytes: pw.runBytes(),
+		})
+	})
+}
+
+// Abandon finishes a transfer that failed and takes its bytes back out of the
+// run's total, so a retry isn't counted twice. It may follow Finish.
+func (pw *ProgressWriter) Abandon() {
+	pw.Finish()
 
 	pw.mu.Lock()
 	defer pw.mu.Unlock()
+	if pw.run != nil {
+		pw.run.bytes.Add(-pw.bytesWritten)
+	}
+	pw.bytesWritten = 0
+}
+
+// runBytes is what every transfer in the run has sent so far, or zero when
+// the run isn't being totalled.
+func (pw *ProgressWriter) runBytes() int64 {
+	if pw.run == nil {
+		return 0
+	}
+	return pw.run.bytes.Load()
+}
+
+// humanProgress rewrites a single terminal line on each tick, ending it with a
+// summary once the transfer is done.
+func humanProgress(w io.Writer, s progressStatus) {
+	if s.Volumes > 0 {
+		_, _ = fmt.Fprintf(
+			w,
+			"\r\033[K→ Total: %s transferred across %d volumes, %s/s average, %s total\n",
+			formatBytes(s.Bytes),
+			s.Volumes,
+			formatBytes(int64(s.Rate)),
+			formatDuration(s.Elapsed),
+		)
+		return
+	}
+
+	// Once an earlier volume has sent something, the run's total is shown too.
+	var run string
+	if s.RunBytes > s.Bytes {
+		run = fmt.Sprintf(", %s this run", formatBytes(s.RunBytes))
+	}
+
+	if s.Done {
+		_, _ = fmt.Fprintf(
+			w,
+			"\r\033[K→ %s: %s transferred, %s/s average, %s total%s\n",
+			s.Label,
+			formatBytes(s.Bytes),
+			formatBytes(int64(s.Rate)),
+			formatDuration(s.Elapsed),
+			run,
+		)
+		return
+	}
+
+	var status string
+	if s.Rate > 0 {
+		status = fmt.Sprintf("%s/s", formatBytes(int64(s.Rate)))
+	} else if s.Bytes > 0 {
+		status = "0.0 B/s"
+	} else {
+		status = "waiting..."
+	}
+
+	if percent, eta, ok := estimateCompletion(s.Bytes, s.Total, s.Elapsed); ok {
+		_, _ = fmt.Fprintf(
+			w,
+			"\r\033[K→ %s: %s of ~%s (%.0f%%), %s, %s elapsed, ETA %s%s",
+			s.Label,
+			formatBytes(s.Bytes),
+			formatBytes(s.Total),
+			percent,
+			status,
+			formatDuration(s.Elapsed),
+			formatDuration(eta),
+			run,
+		)
+	} else {
+		_, _ = fmt.Fprintf(
+			w,
+			"\r\033[K→ %s: %s transferred, %s, %s elapsed%s",
+			s.Label,
+			formatBytes(s.Bytes),
+			status,
+			formatDuration(s.Elapsed),
+			run,
+		)
+	}
+}
+
+// jsonProgress writes each update as a JSON object on a line of its own, for
+// wrappers that parse progress rather than show it.
+func jsonProgress(w io.Writer, s progressStatus) {
+	_ = json.NewEncoder(w).Encode(struct {
+		Label    string  `json:"label"`
+		Bytes    int64   `json:"bytes"`
+		Total    int64   `json:"total,omitempty"`
+		Rate     float64 `json:"rate"`
+		Elapsed  float64 `json:"elapsed"`
+		Done     bool    `json:"done,omitempty"`
+		RunBytes int64   `json:"run_bytes,omitempty"`
+		Volumes  int     `json:"volumes,omitempty"`
+	}{s.Label, s.Bytes, s.Total, s.Rate, s.Elapsed.Seconds(), s.Done, s.RunBytes, s.Volumes})
+}
+
+// rateLimitedReader holds reads from r to an average of rate bytes/sec using a
+// token bucket that refills continuously and holds at most a tenth of a second
+// of burst.
+type rateLimitedReader struct {
+	r      io.Reader
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimitedReader wraps r, or returns it unchanged when rate is zero.
+func newRateLimitedReader(r io.Reader, rate int64) io.Reader {
+	if rate <= 0 {
+		return r
+	}
+	return &rateLimitedReader{
+		r:     r,
+		rate:  float64(rate),
+		burst: max(float64(rate)/10, 1),
+		last:  time.Now(),
+	}
+}
 
-	elapsed := time.Since(pw.startTime)
-	avgBytesPerSec := float64(pw.bytesWritten) / elapsed.Seconds()
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > int(l.burst) {
+		p = p[:int(l.burst)]
+	}
+
+	n, err := l.r.Read(p)
 
-	_, _ = fmt.Fprintf(
-		pw.output,
-		"\r\033[K→ %s: %s transferred, %s/s average, %s total\n",
-		pw.label,
-		formatBytes(pw.bytesWritten),
-		formatBytes(int64(avgBytesPerSec)),
-		formatDuration(elapsed),
-	)
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.burst)
+	l.last = now
+	l.tokens -= float64(n)
+
+	if l.tokens < 0 {
+		time.Sleep(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+	}
+
+	return n, err
 }
 
 func formatBytes(bytes int64) string {
@@ -132,3 +405,11 @@ func formatDuration(d time.Duration) string {
 	}
 	return fmt.Sprintf("%ds", s)
 }
+
+// byteCounter counts the bytes written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
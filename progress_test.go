@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedReader(t *testing.T) {
+	const rate = 200 * 1024
+	payload := bytes.Repeat([]byte("x"), rate/4)
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, newRateLimitedReader(bytes.NewReader(payload), rate))
+	elapsed := time.Since(start)
+
+	if err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if n != int64(len(payload)) {
+		t.Fatalf("expected %d bytes, got %d", len(payload), n)
+	}
+
+	want := 250 * time.Millisecond
+	if elapsed < want*8/10 || elapsed > want*2 {
+		t.Fatalf("expected ~%s at %d B/s, took %s", want, rate, elapsed)
+	}
+}
+
+func TestRateLimitedReaderDisabled(t *testing.T) {
+	r := bytes.NewReader(nil)
+	if got := newRateLimitedReader(r, 0); got != io.Reader(r) {
+		t.Fatal("expected zero rate to return the reader unchanged")
+	}
+}
+
+func TestEstimateCompletion(t *testing.T) {
+	tests := []struct {
+		name    string
+		written int64
+		total   int64
+		elapsed time.Duration
+		percent float64
+		eta     time.Duration
+		ok      bool
+	}{
+		{"quarter done", 250, 1000, 10 * time.Second, 25, 30 * time.Second, true},
+		{"nearly done", 990, 1000, 99 * time.Second, 99, time.Second, true},
+		{"complete", 1000, 1000, 10 * time.Second, 100, 0, true},
+		{"unknown total", 250, 0, 10 * time.Second, 0, 0, false},
+		{"nothing written", 0, 1000, 10 * time.Second, 0, 0, false},
+		{"beyond estimate", 1200, 1000, 10 * time.Second, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		percent, eta, ok := estimateCompletion(tt.written, tt.total, tt.elapsed)
+		if ok != tt.ok || percent != tt.percent || eta != tt.eta {
+			t.Errorf("%s: expected %.0f%%, ETA %s, ok=%v; got %.0f%%, ETA %s, ok=%v",
+				tt.name, tt.percent, tt.eta, tt.ok, percent, eta, ok)
+		}
+	}
+}
+
+func TestProgressWriterLabel(t *testing.T) {
+	var out bytes.Buffer
+	pw := NewProgressWriter(&out, humanProgress, nil, "home", "full")
+	if _, err := pw.Write([]byte("data")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	pw.Finish()
+
+	if !strings.HasPrefix(out.String(), "\r\033[K→ home (full): 4 B transferred") {
+		t.Fatalf("expected the volume and kind in the label, got %q", out.String())
+	}
+}
+
+func TestJSONProgress(t *testing.T) {
+	var out bytes.Buffer
+	jsonProgress(&out, progressStatus{Label: "home (inc)", Bytes: 2048, Total: 4096, Rate: 1024, Elapsed: 2 * time.Second})
+	jsonProgress(&out, progressStatus{Label: "home (inc)", Bytes: 4096, Rate: 2048, Elapsed: 2 * time.Second, Done: true})
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	expected := []string{
+		`{"label":"home (inc)","bytes":2048,"total":4096,"rate":1024,"elapsed":2}`,
+		`{"label":"home (inc)","bytes":4096,"rate":2048,"elapsed":2,"done":true}`,
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected one object per update:\n%s\ngot:\n%s", strings.Join(expected, "\n"), out.String())
+	}
+}
+
+func TestProgressWriterTickRate(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var rates []float64
+	pw := &ProgressWriter{
+		output:     io.Discard,
+		format:     func(_ io.Writer, s progressStatus) { rates = append(rates, s.Rate) },
+		startTime:  start,
+		lastUpdate: start,
+	}
+
+	// Ticks late, early and after a dropped tick.
+	steps := []struct {
+		bytes int64
+		after time.Duration
+	}{
+		{3000, 1500 * time.Millisecond},
+		{500, 500 * time.Millisecond},
+		{4000, 2 * time.Second},
+	}
+	now := start
+	for _, s := range steps {
+		if _, err := pw.Write(make([]byte, s.bytes)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		now = now.Add(s.after)
+		pw.tick(now)
+	}
+
+	expected := []float64{2000, 1000, 2000}
+	if !slices.Equal(rates, expected) {
+		t.Fatalf("expected rates %v, got %v", expected, rates)
+	}
+}
+
+func TestProgressWriterFinishAfterLoopExit(t *testing.T) {
+	var summaries int
+	pw := &ProgressWriter{
+		output:       io.Discard,
+		format:       func(io.Writer, progressStatus) { summaries++ },
+		startTime:    time.Now(),
+		lastUpdate:   time.Now(),
+		updateTicker: time.NewTicker(time.Second),
+		done:         make(chan struct{}),
+	}
+	// The loop is started and has already returned, as it would after an
+	// aborted transfer.
+	pw.wg.Add(1)
+	pw.wg.Done()
+
+	finished := make(chan struct{})
+	go func() {
+		pw.Finish()
+		pw.Finish()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Finish blocked")
+	}
+	if summaries != 1 {
+		t.Fatalf("expected one summary, got %d", summaries)
+	}
+}
+
+func TestProgressTotals(t *testing.T) {
+	var out bytes.Buffer
+	run := &progressTotals{}
+
+	// A failed attempt is taken back out of the total before its retry.
+	failed := NewProgressWriter(io.Discard, jsonProgress, run, "home", "full")
+	if _, err := failed.Write([]byte("partial")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	failed.Abandon()
+
+	for _, volume := range []string{"root", "home"} {
+		pw := NewProgressWriter(io.Discard, jsonProgress, run, volume, "full")
+		if _, err := pw.Write([]byte("data")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		pw.Finish()
+	}
+	// A retried transfer doesn't count as another volume.
+	pw := NewProgressWriter(io.Discard, jsonProgress, run, "home", "full")
+	pw.Finish()
+
+	run.Finish(&out, humanProgress)
+	if !strings.HasPrefix(out.String(), "\r\033[K→ Total: 8 B transferred across 2 volumes") {
+		t.Fatalf("expected the total across both volumes, got %q", out.String())
+	}
+}
+
+func TestProgressTotalsSingleVolume(t *testing.T) {
+	var out bytes.Buffer
+	run := &progressTotals{}
+	pw := NewProgressWriter(io.Discard, jsonProgress, run, "root", "full")
+	pw.Finish()
+
+	run.Finish(&out, humanProgress)
+	if out.Len() != 0 {
+		t.Fatalf("expected no total for one volume, got %q", out.String())
+	}
+}
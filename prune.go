@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+)
+
+// runPrune applies retention to the remote backups without taking a new one,
+// optionally only to those inside a time window.
+func runPrune(ctx context.Context, cfg *Config, args []string) error {
+	var volumeName, since, until string
+
+	fs := flag.NewFlagSet("prune", flag.ContinueOnError)
+	fs.StringVar(&volumeName, "volume", "", "Only prune this volume (default: all)")
+	fs.StringVar(&since, "since", "", "Only delete backups taken at or after this time (RFC3339 or "+snapshotTimestampFormat+")")
+	fs.StringVar(&until, "until", "", "Only delete backups taken before this time (RFC3339 or "+snapshotTimestampFormat+")")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	window, err := parseTimeWindow(since, until)
+	if err != nil {
+		return err
+	}
+
+	if cfg.RemoteLock && !dryRun {
+		lock, err := acquireRemoteLock(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+	}
+
+	volumes := cfg.Volumes
+	if volumeName != "" {
+		vol := findVolume(cfg, volumeName)
+		if vol == nil {
+			return fmt.Errorf("volume %q not found in config", volumeName)
+		}
+		volumes = []Volume{*vol}
+	}
+
+	for i := range volumes {
+		vol := &volumes[i]
+		backups, err := listRemoteBackups(ctx, cfg, vol)
+		if err != nil {
+			return fmt.Errorf("listing %s: %w", vol.Name, err)
+		}
+
+		toDelete := backupsToDelete(backups, cfg.Retention, cfg.KeepFulls)
+		toDelete = windowDeletions(backups, toDelete, window)
+		if len(toDelete) == 0 {
+			fmt.Printf("%s: nothing to prune\n", vol.Name)
+			continue
+		}
+
+		for _, b := range toDelete {
+			fmt.Printf("%s: deleting %s\n", vol.Name, b.Name)
+		}
+		if err := removeRemoteBackups(ctx, cfg, toDelete); err != nil {
+			return fmt.Errorf("pruning %s: %w", vol.Name, err)
+		}
+
+		if cfg.MaintainLatest {
+			if err := repointLatest(ctx, cfg, vol, backups, toDelete); err != nil {
+				return fmt.Errorf("failed to repoint %s: %w", latestName(vol), err)
+			}
+		}
+	}
+
+	return nil
+}
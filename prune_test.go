@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRunPruneWindow(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	names := []string{
+		"root-2024-05-01_10-00-00.full.btrfs",
+		"root-2024-05-02_10-00-00.inc.btrfs",
+		"root-2024-05-03_10-00-00.full.btrfs",
+		"root-2024-05-04_10-00-00.full.btrfs",
+	}
+	for _, name := range names {
+		writeRemoteBackup(t, remoteDir, name, "data", true)
+	}
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Backend:    "ssh",
+		Volumes:    []Volume{{Name: "root"}},
+	}
+
+	var runErr error
+	captureStdout(t, func() {
+		runErr = runPrune(context.Background(), cfg, []string{"--until", "2024-05-02_10-00-00"})
+	})
+	if runErr != nil {
+		t.Fatalf("runPrune: %v", runErr)
+	}
+
+	// The first full is in the window, but its incremental isn't.
+	assertNames(t, remoteListing(t, cfg, &cfg.Volumes[0]), names)
+
+	captureStdout(t, func() {
+		runErr = runPrune(context.Background(), cfg, []string{"--until", "2024-05-03_10-00-00"})
+	})
+	if runErr != nil {
+		t.Fatalf("runPrune: %v", runErr)
+	}
+
+	assertNames(t, remoteListing(t, cfg, &cfg.Volumes[0]), names[2:])
+}
+
+func TestRunPruneRemoteLockHeld(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	cfg := &Config{RemoteHost: "remote", RemoteDest: remoteDir, Backend: "ssh", RemoteLock: true}
+
+	held, err := acquireRemoteLock(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("acquireRemoteLock: %v", err)
+	}
+	defer held.release()
+
+	if err := runPrune(context.Background(), cfg, nil); !errors.Is(err, errRemoteLockHeld) {
+		t.Fatalf("expected prune to refuse while another run holds the lock, got %v", err)
+	}
+}
@@ -2,289 +2,867 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/fatih/color"
 )
 
 type remoteBackup struct {
-	Name      string
-	Timestamp time.Time
-	Kind      string
+	Name      string    `json:"name"`
+	Timestamp time.Time `json:"timestamp"`
+	Kind      string    `json:"kind"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mtime,omitzero"`
 }
 
 func remoteFileSuffix(cfg *Config) string {
-	if cfg.EncryptionKey != "" {
-		return ".btrfs.age"
-	}
-	return ".btrfs"
+	return ".btrfs" + compressionSuffix(cfg.Compression) + encryptionSuffix(cfg)
 }
 
-func checkRemoteAccess(ctx context.Context, cfg *Config) error {
-	remoteCmd := fmt.Sprintf("test -d %s || mkdir -p %s",
-		shellEscape(cfg.RemoteDest),
-		shellEscape(cfg.RemoteDest))
-
-	cmd := exec.CommandContext(ctx, "ssh", buildSSHArgs(cfg, remoteCmd)...)
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to access remote host %s: %w (check SSH connectivity and permissions)", cfg.RemoteHost, err)
+// sendArgs builds the btrfs send arguments for newSnap. A full is sent on its
+// own; an incremental names parent with -p and each of clones with -c.
+func sendArgs(newSnap, parent string, clones []string, full bool) []string {
+	if full {
+		return []string{"send", newSnap}
 	}
-
-	if verbose {
-		fmt.Printf("→ Remote host %s is accessible\n", cfg.RemoteHost)
+	args := []string{"send", "-p", parent}
+	for _, clone := range clones {
+		args = append(args, "-c", clone)
 	}
+	return append(args, newSnap)
+}
 
-	return nil
+func checkRemoteAccess(ctx context.Context, cfg *Config) error {
+	return withRetry(ctx, cfg.Retries, cfg.RetryBackoff, func() error {
+		return cfg.remote().Check(ctx)
+	})
 }
 
-func sendSnapshot(ctx context.Context, cfg *Config, newSnap, oldSnap, outfile string, full bool) (checksum string, err error) {
+// sendSnapshot streams the snapshot to tmpFile on the remote and on each
+// active mirror, ready to be moved to outfile. A mirror failing is recorded on
+// it rather than failing the send. Incrementals are diffed against oldSnap and
+// may clone extents from the snapshots in clones.
+func sendSnapshot(ctx context.Context, cfg *Config, volume, newSnap, oldSnap string, clones []string, outfile, tmpFile string, full bool, mirrors []*mirrorUpload) (checksum string, size int64, err error) {
 	ok := false
 
-	tmpFile := outfile + ".tmp"
-
-	// Use tee to write file and compute checksum in parallel during transfer
-	remoteWriteCommandSshArgs := buildSSHArgs(cfg, fmt.Sprintf("tee %s | sha256sum", shellEscape(filepath.Join(cfg.RemoteDest, tmpFile))))
+	remote := cfg.remote()
+	mirrors = activeMirrors(mirrors)
 
 	defer func(success *bool) {
 		if *success || dryRun {
 			return
 		}
 
-		cleanupCmd := exec.Command(
-			"ssh",
-			buildSSHArgs(cfg, fmt.Sprintf("rm -f %s", shellEscape(filepath.Join(cfg.RemoteDest, tmpFile))))...,
-		)
-
-		if err := cleanupCmd.Run(); err != nil {
+		if err := remote.Remove(context.Background(), tmpFile); err != nil {
 			errLog.Printf("Error during cleanup of remote temp file: %v", err)
 		} else if verbose {
 			fmt.Printf("→ Cleaned up remote temp file: %s\n", tmpFile)
 		}
 
+		// The attempt is discarded, so mirrors get another go with it.
+		removeMirrorTmpFiles(mirrors, tmpFile)
+		for _, m := range mirrors {
+			m.err = nil
+		}
 	}(&ok)
 
-	var sendArgs []string
-	if full {
-		sendArgs = []string{"send", newSnap}
-	} else {
-		sendArgs = []string{"send", "-p", oldSnap, newSnap}
-	}
+	sendArgs := sendArgs(newSnap, oldSnap, clones, full)
+	compress := compressArgs(cfg)
+	encrypt := encryptArgs(cfg)
 
 	if verbose {
-		fmt.Printf(
-			"→ [%s] Sending snapshot %s → %s:%s\n",
-			map[bool]string{true: "age encrypt", false: "plain"}[cfg.EncryptionKey != ""],
-			newSnap,
-			cfg.RemoteHost,
-			filepath.Join(cfg.RemoteDest, outfile),
-		)
+		target := remoteTarget(cfg, filepath.Join(cfg.RemoteDest, outfile))
+		var stages []string
+		if compress != nil {
+			stages = append(stages, cfg.Compression)
+		}
+		if encrypt != nil {
+			stages = append(stages, encrypt[0]+" encrypt")
+		}
+		if len(stages) == 0 {
+			stages = append(stages, "plain")
+		}
+		fmt.Printf("→ [%s] Sending snapshot %s → %s\n", strings.Join(stages, " + "), newSnap, target)
 	}
 
 	if dryRun {
 		if veryVerbose {
 			var builder strings.Builder
-			builder.WriteString(fmt.Sprintf("btrfs %s", strings.Join(sendArgs, " ")))
-			if cfg.EncryptionKey != "" {
-				builder.WriteString(fmt.Sprintf(" | age -r %s", cfg.EncryptionKey))
+			builder.WriteString(fmt.Sprintf("%s %s", btrfsBin, strings.Join(sendArgs, " ")))
+			if compress != nil {
+				builder.WriteString(fmt.Sprintf(" | %s", strings.Join(compress, " ")))
+			}
+			if encrypt != nil {
+				builder.WriteString(fmt.Sprintf(" | %s", strings.Join(encrypt, " ")))
+			}
+			if cfg.Transport == "rsync" {
+				builder.WriteString(" > <local-tmp>")
+				fmt.Printf("[DRY-RUN] %s\n", builder.String())
+				fmt.Printf("[DRY-RUN] %s\n", strings.Join(rsyncArgs(cfg, "<local-tmp>", tmpFile), " "))
+			} else {
+				builder.WriteString(fmt.Sprintf(" | %s", remote.Describe("write", tmpFile)))
+				fmt.Printf("[DRY-RUN] %s\n", builder.String())
+				for _, m := range mirrors {
+					fmt.Printf("[DRY-RUN]   also | %s\n", m.cfg.remote().Describe("write", tmpFile))
+				}
 			}
-			builder.WriteString(fmt.Sprintf(" | ssh %s", strings.Join(remoteWriteCommandSshArgs, " ")))
-			fmt.Printf("[DRY-RUN] %s\n", builder.String())
 		}
-		return "", nil
+		return "", 0, nil
 	}
 
-	sendCmd := exec.CommandContext(ctx, "btrfs", sendArgs...)
+	sendCmd := exec.CommandContext(ctx, btrfsBin, sendArgs...)
 	sendCmd.Stderr = io.Discard
 	stdout, err := sendCmd.StdoutPipe()
 	if err != nil {
-		return "", err
+		return "", 0, err
+	}
+
+	var inspector sendStreamInspector
+	var stream io.Reader = io.TeeReader(stdout, &inspector)
+
+	// Compress before encrypting; ciphertext doesn't compress.
+	var compressCmd *exec.Cmd
+	if compress != nil {
+		compressCmd = exec.CommandContext(ctx, compress[0], compress[1:]...)
+		compressCmd.Stdin = stream
+		compressCmd.Stderr = os.Stderr
+		outPipe, err := compressCmd.StdoutPipe()
+		if err != nil {
+			return "", 0, err
+		}
+		stream = outPipe
 	}
 
-	var stream io.Reader = stdout
 	var encryptCmd *exec.Cmd
-	if cfg.EncryptionKey != "" {
-		encryptCmd = exec.CommandContext(ctx, "age", "-r", cfg.EncryptionKey)
+	if encrypt != nil {
+		encryptCmd = exec.CommandContext(ctx, encrypt[0], encrypt[1:]...)
 		encryptCmd.Stdin = stream
 		encryptCmd.Stderr = os.Stderr
 		outPipe, err := encryptCmd.StdoutPipe()
 		if err != nil {
-			return "", err
+			return "", 0, err
 		}
 		stream = outPipe
 	}
 
-	hasher := sha256.New()
-	sshCmd := exec.CommandContext(ctx, "ssh", remoteWriteCommandSshArgs...)
-	sshCmd.Stderr = os.Stderr
-
-	sshStdout, err := sshCmd.StdoutPipe()
-	if err != nil {
-		return "", err
+	// verify_mode remote leaves hashing to the remote, which does it as it
+	// writes, or after an rsync.
+	var hasher hash.Hash
+	var counter byteCounter
+	tees := []io.Writer{&counter}
+	if cfg.verifyMode() != "remote" {
+		hasher = cfg.checksum().newHash()
+		tees = append(tees, hasher)
 	}
 
 	var reader io.Reader
 	var progressWriter *ProgressWriter
 	if progress {
-		progressWriter = NewProgressWriter(os.Stderr, "Transfer")
-		reader = io.TeeReader(stream, io.MultiWriter(hasher, progressWriter))
-	} else {
-		reader = io.TeeReader(stream, hasher)
+		// Compressed sizes can't be predicted, so only plain and encrypted
+		// streams get an ETA.
+		var total int64
+		if compress == nil {
+			parent := ""
+			if !full {
+				parent = oldSnap
+			}
+			estimate, err := estimateSendSize(ctx, newSnap, parent)
+			if err != nil && verbose {
+				fmt.Printf("→ Unable to estimate transfer size: %v\n", err)
+			}
+			total = estimate
+		}
+		kind := "inc"
+		if full {
+			kind = "full"
+		}
+		progressWriter = newTransferProgress(volume, kind)
+		// Stops the ticker on every error path, and keeps a failed attempt
+		// out of the run's total.
+		defer func() {
+			if !ok {
+				progressWriter.Abandon()
+			}
+		}()
+		progressWriter.SetTotal(total)
+		tees = append(tees, progressWriter)
 	}
-
-	sshCmd.Stdin = reader
+	reader = io.TeeReader(stream, io.MultiWriter(tees...))
 
 	if err := sendCmd.Start(); err != nil {
-		return "", fmt.Errorf("btrfs send start failed: %w", err)
+		return "", 0, fmt.Errorf("btrfs send start failed: %w", err)
+	}
+	if compressCmd != nil {
+		if err := compressCmd.Start(); err != nil {
+			return "", 0, fmt.Errorf("%s start failed: %w", compress[0], err)
+		}
 	}
 	if encryptCmd != nil {
 		if err := encryptCmd.Start(); err != nil {
-			return "", fmt.Errorf("age start failed: %w", err)
+			return "", 0, fmt.Errorf("%s start failed: %w", encrypt[0], err)
 		}
 	}
 
-	if err := sshCmd.Start(); err != nil {
-		_ = sendCmd.Wait()
-		if encryptCmd != nil {
-			_ = encryptCmd.Wait()
+	var stagedFile string
+	var remoteChecksum string
+	if cfg.Transport == "rsync" {
+		stagedFile, err = stageStream(reader)
+		if stagedFile != "" {
+			defer os.Remove(stagedFile)
 		}
-		return "", fmt.Errorf("ssh start failed: %w", err)
+	} else {
+		// Mirrors are fed the same bytes as the primary reads them.
+		mirrorStream, finishMirrorWrites := startMirrorWrites(ctx, mirrors, tmpFile)
+		// Progress advances as the limiter reads, so it shows the throttled rate.
+		remoteChecksum, err = remote.Write(ctx, tmpFile, newRateLimitedReader(io.TeeReader(reader, mirrorStream), int64(cfg.BWLimit)))
+		finishMirrorWrites(err)
 	}
-
-	remoteChecksumOutput, err := io.ReadAll(sshStdout)
 	if err != nil {
-		return "", fmt.Errorf("failed to read remote checksum: %w", err)
-	}
-
-	if err := sshCmd.Wait(); err != nil {
 		_ = sendCmd.Wait()
+		if compressCmd != nil {
+			_ = compressCmd.Wait()
+		}
 		if encryptCmd != nil {
 			_ = encryptCmd.Wait()
 		}
-		return "", fmt.Errorf("ssh failed: %w", err)
+		return "", 0, err
 	}
 
 	sendErr := sendCmd.Wait()
-	var encryptErr error
+	var compressErr, encryptErr error
+	if compressCmd != nil {
+		compressErr = compressCmd.Wait()
+	}
 	if encryptCmd != nil {
 		encryptErr = encryptCmd.Wait()
 	}
 
 	if encryptErr != nil {
-		return "", fmt.Errorf("age failed: %w", encryptErr)
+		return "", 0, fmt.Errorf("%s failed: %w", encrypt[0], encryptErr)
+	}
+	if compressErr != nil {
+		return "", 0, fmt.Errorf("%s failed: %w", compress[0], compressErr)
 	}
 	if sendErr != nil {
-		return "", fmt.Errorf("btrfs send failed: %w", sendErr)
+		return "", 0, fmt.Errorf("btrfs send failed: %w", sendErr)
 	}
 
 	if progressWriter != nil {
 		progressWriter.Finish()
 	}
 
-	localChecksum := fmt.Sprintf("%x", hasher.Sum(nil))
+	if !full && inspector.unchanged(int64(cfg.MinChangeBytes)) {
+		return "", 0, errNoChanges
+	}
 
-	remoteChecksumFields := strings.Fields(strings.TrimSpace(string(remoteChecksumOutput)))
-	if len(remoteChecksumFields) == 0 {
-		return "", fmt.Errorf("unable to parse remote checksum output: %q", string(remoteChecksumOutput))
+	if cfg.Transport == "rsync" {
+		if err := rsyncFile(ctx, cfg, stagedFile, tmpFile); err != nil {
+			return "", 0, err
+		}
 	}
 
-	remoteChecksum := remoteChecksumFields[0]
-	if !strings.EqualFold(remoteChecksum, localChecksum) {
-		return "", fmt.Errorf("checksum mismatch: local=%s remote=%s", localChecksum, remoteChecksum)
+	checksum, err = verifyUpload(ctx, cfg, tmpFile, hasher, remoteChecksum)
+	if err != nil {
+		return "", 0, err
 	}
 
 	if verbose {
 		fmt.Printf("→ Checksum validation passed\n")
 	}
 
+	var failedMirrors []*mirrorUpload
+	for _, m := range mirrors {
+		if m.err == nil {
+			var mirrorChecksum string
+			mirrorChecksum, m.err = verifyUpload(ctx, m.cfg, tmpFile, hasher, m.checksum)
+			if m.err == nil && !strings.EqualFold(mirrorChecksum, checksum) {
+				m.err = fmt.Errorf("checksum mismatch: primary=%s mirror=%s", checksum, mirrorChecksum)
+			}
+		}
+		if m.err != nil {
+			failedMirrors = append(failedMirrors, m)
+		}
+	}
+	removeMirrorTmpFiles(failedMirrors, tmpFile)
+
 	ok = true
+	return checksum, int64(counter), nil
+}
+
+// verifyUpload checks tmpFile as stored against the stream that was sent,
+// according to verify_mode, and returns its checksum. hasher holds the local
+// hash unless verify_mode is remote, and remoteChecksum is what the backend's
+// Write returned, if anything.
+func verifyUpload(ctx context.Context, cfg *Config, tmpFile string, hasher hash.Hash, remoteChecksum string) (string, error) {
+	algorithm := cfg.checksum()
+
+	if hasher == nil {
+		// Nothing to compare against, so the remote's word is taken.
+		if remoteChecksum != "" {
+			return remoteChecksum, nil
+		}
+		return remoteFileChecksum(ctx, cfg, tmpFile, algorithm)
+	}
+
+	localChecksum := fmt.Sprintf("%x", hasher.Sum(nil))
+	if remoteChecksum == "" {
+		// rsync, or verify_mode local: hash the file now it is stored.
+		if err := validateRemoteChecksum(ctx, cfg, tmpFile, localChecksum, algorithm); err != nil {
+			return "", err
+		}
+		return localChecksum, nil
+	}
+	if !strings.EqualFold(remoteChecksum, localChecksum) {
+		return "", fmt.Errorf("checksum mismatch: local=%s remote=%s", localChecksum, remoteChecksum)
+	}
 	return localChecksum, nil
 }
 
-func moveTmpFile(ctx context.Context, cfg *Config, outfile, checksum string) error {
-	tmpFile := outfile + ".tmp"
+// remoteFreeBytes returns the space available in remote_dest.
+func remoteFreeBytes(ctx context.Context, cfg *Config) (int64, error) {
+	var output []byte
+	err := withRetry(ctx, cfg.Retries, cfg.RetryBackoff, func() (err error) {
+		return runRemoteOp(ctx, cfg, fmt.Sprintf("df -Pk %s", shellEscape(cfg.RemoteDest)), func(cmd *exec.Cmd) (err error) {
+			output, err = cmd.Output()
+			return err
+		})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("df of remote destination failed: %w", err)
+	}
+
+	// POSIX output is a header line then: filesystem, size, used, available, ...
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(lines) < 2 || len(fields) < 4 {
+		return 0, fmt.Errorf("unable to parse df output: %q", string(output))
+	}
+
+	availableKB, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse df output: %q", string(output))
+	}
+
+	return availableKB * 1024, nil
+}
+
+// removeStaleTmpFiles deletes .tmp uploads in remote_dest left behind by runs
+// that were killed before they could clean up. Only this tool's uploads of a
+// configured volume untouched for olderThan are considered, so other files in
+// remote_dest and a transfer still in progress are left alone, as is a
+// completed upload waiting for finishPendingBackup.
+func removeStaleTmpFiles(ctx context.Context, cfg *Config, olderThan time.Duration) error {
+	// File ages come from find on the remote.
+	if cfg.Backend != "ssh" || olderThan <= 0 {
+		return nil
+	}
+
 	remoteCmd := fmt.Sprintf(
-		"mv %s %s",
-		shellEscape(filepath.Join(cfg.RemoteDest, tmpFile)),
-		shellEscape(filepath.Join(cfg.RemoteDest, outfile)),
+		"cd %s && find . -maxdepth 1 -type f -name '*.tmp' -mmin +%d",
+		shellEscape(cfg.RemoteDest), int(olderThan.Minutes()),
 	)
+	var output []byte
+	err := withRetry(ctx, cfg.Retries, cfg.RetryBackoff, func() (err error) {
+		return runRemoteOp(ctx, cfg, remoteCmd, func(cmd *exec.Cmd) (err error) {
+			output, err = cmd.Output()
+			return err
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("finding stale temp files failed: %w", err)
+	}
+
+	var stale []string
+	for _, line := range strings.Split(string(output), "\n") {
+		name := strings.TrimPrefix(strings.TrimSpace(line), "./")
+		if !ownTmpFile(cfg, name) {
+			continue
+		}
+		// A sidecar marks a verified upload that only missed its rename.
+		outfile := tmpTarget(name)
+		exists, err := cfg.remote().Exists(ctx, cfg.checksum().sidecar(outfile))
+		if err != nil || exists {
+			continue
+		}
+		stale = append(stale, name)
+	}
+	if len(stale) == 0 {
+		return nil
+	}
 
+	remote := cfg.remote()
+	if verbose {
+		for _, name := range stale {
+			fmt.Printf("→ Removing stale temp file: %s\n", name)
+		}
+	}
 	if dryRun {
 		if veryVerbose {
-			fmt.Printf("[DRY-RUN] ssh %s\n", strings.Join(buildSSHArgs(cfg, remoteCmd), " "))
+			fmt.Printf("[DRY-RUN] %s\n", remote.Describe("remove", stale...))
 		}
-	} else {
-		sshCmd := exec.CommandContext(ctx, "ssh", buildSSHArgs(cfg, remoteCmd)...)
-		sshCmd.Stdout = os.Stdout
-		sshCmd.Stderr = os.Stderr
+		return nil
+	}
+
+	return withRetry(ctx, cfg.Retries, cfg.RetryBackoff, func() error {
+		return remote.Remove(ctx, stale...)
+	})
+}
+
+// ownTmpFile reports whether name is an upload of one of cfg's volumes, as
+// named by newTmpName or, before that, with a bare .tmp suffix.
+func ownTmpFile(cfg *Config, name string) bool {
+	if !strings.HasSuffix(name, ".tmp") {
+		return false
+	}
+	match := backupNameRegexp.FindStringSubmatch(tmpTarget(name))
+	return match != nil && findVolume(cfg, match[1]) != nil
+}
+
+// checkRemoteSpace fails if a full send of subvol might not fit in
+// remote_dest while leaving min_free_bytes spare. The check is skipped when
+// the size can't be estimated.
+func checkRemoteSpace(ctx context.Context, cfg *Config, subvol string) error {
+	if cfg.Backend != "ssh" {
+		return nil
+	}
+
+	estimate, err := estimateSubvolumeSize(ctx, subvol)
+	if err != nil {
+		if verbose {
+			fmt.Printf("→ Skipping free space check, unable to estimate size: %v\n", err)
+		}
+		return nil
+	}
+
+	free, err := remoteFreeBytes(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	needed := estimate + int64(cfg.MinFreeBytes)
+	if free < needed {
+		return fmt.Errorf(
+			"not enough space in %s: %s free, need %s (%s estimated + %s min_free_bytes)",
+			cfg.RemoteDest, formatBytes(free), formatBytes(needed), formatBytes(estimate), formatBytes(int64(cfg.MinFreeBytes)),
+		)
+	}
+
+	if verbose {
+		fmt.Printf("→ Remote has %s free for an estimated %s\n", formatBytes(free), formatBytes(estimate))
+	}
+
+	return nil
+}
+
+const rsyncAttempts = 3
 
-		if err := sshCmd.Run(); err != nil {
+// stageStream writes the stream to a local temp file so rsync can transfer it
+// and resume if the connection drops.
+func stageStream(r io.Reader) (string, error) {
+	f, err := os.CreateTemp("", "btrfs-backup-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("creating local temp file: %w", err)
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return f.Name(), fmt.Errorf("writing local temp file: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return f.Name(), fmt.Errorf("closing local temp file: %w", err)
+	}
+
+	return f.Name(), nil
+}
+
+func rsyncArgs(cfg *Config, src, tmpFile string) []string {
+	dest := filepath.Join(cfg.RemoteDest, tmpFile)
+	args := []string{"rsync", "--partial", "--append-verify"}
+	if cfg.BWLimit > 0 {
+		// rsync takes KiB/s.
+		args = append(args, fmt.Sprintf("--bwlimit=%d", max(int64(cfg.BWLimit)/1024, 1)))
+	}
+	if cfg.RemoteHost != "" {
+		sshCmd := append([]string{sshBin}, sshOptions(cfg)...)
+		for i, arg := range sshCmd {
+			sshCmd[i] = shellEscape(arg)
+		}
+		args = append(args, "-e", strings.Join(sshCmd, " "))
+		dest = remoteTarget(cfg, dest)
+	}
+	return append(args, src, dest)
+}
+
+// rsyncFile copies src to tmpFile in remote_dest, retrying so that an
+// interrupted transfer resumes from the partial file rather than from zero.
+func rsyncFile(ctx context.Context, cfg *Config, src, tmpFile string) error {
+	args := rsyncArgs(cfg, src, tmpFile)
+
+	var err error
+	for attempt := 1; attempt <= rsyncAttempts; attempt++ {
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdout = io.Discard
+		cmd.Stderr = os.Stderr
+
+		if err = cmd.Run(); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if verbose && attempt < rsyncAttempts {
+			fmt.Printf("→ rsync attempt %d failed, resuming: %v\n", attempt, err)
+		}
+	}
+
+	return fmt.Errorf("rsync failed: %w", err)
+}
+
+// readRemoteChecksum returns the checksum recorded in the sidecar for name and
+// the algorithm it was made with. The configured algorithm's sidecar is tried
+// first, then the others for backups made before it was changed.
+func readRemoteChecksum(ctx context.Context, cfg *Config, name string) (string, checksumAlgorithm, error) {
+	algorithms := []checksumAlgorithm{cfg.checksum()}
+	for _, a := range checksumAlgorithms {
+		if a.name != algorithms[0].name {
+			algorithms = append(algorithms, a)
+		}
+	}
+
+	var err error
+	for _, algorithm := range algorithms {
+		sidecar := shellEscape(filepath.Join(cfg.RemoteDest, algorithm.sidecar(name)))
+
+		var output []byte
+		err = runRemoteOp(ctx, cfg, fmt.Sprintf("cat %s", sidecar), func(cmd *exec.Cmd) (err error) {
+			output, err = cmd.Output()
 			return err
+		})
+		if err != nil {
+			continue
+		}
+
+		fields := strings.Fields(string(output))
+		if len(fields) == 0 {
+			return "", algorithm, fmt.Errorf("empty checksum file for %s", name)
 		}
+
+		return fields[0], algorithm, nil
+	}
+
+	return "", checksumAlgorithm{}, fmt.Errorf("reading checksum for %s: %w", name, err)
+}
+
+// sameAsRemoteBackup reports whether name's checksum sidecar records
+// checksum. A sidecar from another algorithm can't be compared, so doesn't
+// match.
+func sameAsRemoteBackup(ctx context.Context, cfg *Config, name, checksum string) bool {
+	recorded, algorithm, err := readRemoteChecksum(ctx, cfg, name)
+	if err != nil {
+		if verbose {
+			fmt.Printf("→ Unable to compare with %s: %v\n", name, err)
+		}
+		return false
+	}
+	return algorithm.name == cfg.checksum().name && strings.EqualFold(recorded, checksum)
+}
+
+// discardUpload removes a finished upload that turned out not to be needed,
+// from the remote and every mirror that took it.
+func discardUpload(ctx context.Context, cfg *Config, mirrors []*mirrorUpload, tmpFile string) {
+	if err := cfg.remote().Remove(ctx, tmpFile); err != nil {
+		errLog.Printf("Error during cleanup of remote temp file: %v", err)
+	}
+	removeMirrorTmpFiles(activeMirrors(mirrors), tmpFile)
+}
+
+// remoteFileChecksum hashes a file in remote_dest on the remote.
+func remoteFileChecksum(ctx context.Context, cfg *Config, name string, algorithm checksumAlgorithm) (string, error) {
+	remotePath := shellEscape(filepath.Join(cfg.RemoteDest, name))
+	cmd := remoteCommand(ctx, cfg, fmt.Sprintf("%s %s", algorithm.command, remotePath))
+
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("computing remote checksum for %s: %w", name, err)
+	}
+
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("unable to parse remote checksum output: %q", string(output))
+	}
+	return fields[0], nil
+}
+
+// validateRemoteChecksum hashes the remote file and compares it to expected.
+func validateRemoteChecksum(ctx context.Context, cfg *Config, name, expected string, algorithm checksumAlgorithm) error {
+	actual, err := remoteFileChecksum(ctx, cfg, name, algorithm)
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("checksum mismatch for %s: expected=%s remote=%s", name, expected, actual)
+	}
+
+	return nil
+}
+
+// newTmpName returns a name to upload outfile under until it is complete.
+// The random part, like mktemp's, stops overlapping attempts at the same
+// backup, such as a retry racing an upload that hasn't died yet, from writing
+// to the same file.
+func newTmpName(outfile string) string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s.%s.tmp", outfile, hex.EncodeToString(b))
+}
+
+// tmpTarget returns the outfile that tmpFile was uploaded for. Older releases
+// used a fixed outfile.tmp, which is understood too.
+func tmpTarget(tmpFile string) string {
+	name := strings.TrimSuffix(tmpFile, ".tmp")
+	ext := filepath.Ext(name)
+	if _, err := hex.DecodeString(strings.TrimPrefix(ext, ".")); err == nil && len(ext) == 9 {
+		return strings.TrimSuffix(name, ext)
 	}
+	return name
+}
+
+// writeChecksumSidecar records checksum for outfile in the sidecar of the
+// configured algorithm, in the format sha256sum -c reads.
+func writeChecksumSidecar(ctx context.Context, cfg *Config, outfile, checksum string) error {
+	sidecar := fmt.Sprintf("%s  %s\n", checksum, outfile)
+	return withRetry(ctx, cfg.Retries, cfg.RetryBackoff, func() error {
+		_, err := cfg.remote().Write(ctx, cfg.checksum().sidecar(outfile), strings.NewReader(sidecar))
+		return err
+	})
+}
 
-	if checksum == "" && !dryRun {
+// chmodRemoteFiles applies remote_file_mode to names in remote_dest. Without it
+// the files keep whatever the remote shell's umask gave them.
+func chmodRemoteFiles(ctx context.Context, cfg *Config, names ...string) error {
+	if cfg.RemoteFileMode == 0 || len(names) == 0 {
 		return nil
 	}
 
-	checksumValue := checksum
-	if checksumValue == "" {
-		checksumValue = "<calculated-sha256>"
+	var paths []string
+	for _, name := range names {
+		paths = append(paths, shellEscape(filepath.Join(cfg.RemoteDest, name)))
 	}
+	remoteCmd := fmt.Sprintf("chmod %s %s", cfg.RemoteFileMode, strings.Join(paths, " "))
 
-	checksumFinal := filepath.Join(cfg.RemoteDest, outfile+".sha256")
+	if dryRun {
+		if veryVerbose {
+			fmt.Printf("[DRY-RUN] %s\n", describeRemoteCommand(cfg, remoteCmd))
+		}
+		return nil
+	}
 
-	checksumCmd := fmt.Sprintf(
-		"printf '%%s  %%s\\n' %s %s > %s",
-		shellEscape(checksumValue),
-		shellEscape(outfile),
-		shellEscape(checksumFinal),
-	)
+	return withRetry(ctx, cfg.Retries, cfg.RetryBackoff, func() error {
+		return runRemoteOp(ctx, cfg, remoteCmd, func(cmd *exec.Cmd) error {
+			return cmd.Run()
+		})
+	})
+}
+
+// backupFiles lists outfile and the sidecars written alongside it.
+func backupFiles(cfg *Config, outfile string, checksum, manifest bool) []string {
+	names := []string{outfile}
+	if checksum {
+		names = append(names, cfg.checksum().sidecar(outfile))
+	}
+	if manifest {
+		names = append(names, manifestName(outfile))
+	}
+	return names
+}
+
+// moveTmpFile renames the verified upload tmpFile to outfile, writing its
+// checksum sidecar first when checksum is set.
+func moveTmpFile(ctx context.Context, cfg *Config, tmpFile, outfile, checksum string) error {
+	remote := cfg.remote()
 
 	if dryRun {
+		if veryVerbose {
+			fmt.Printf("[DRY-RUN] %s\n", remote.Describe("rename", tmpFile, outfile))
+		}
 		return nil
 	}
 
-	sshChecksumCmd := exec.CommandContext(ctx, "ssh", buildSSHArgs(cfg, checksumCmd)...)
-	sshChecksumCmd.Stdout = os.Stdout
-	sshChecksumCmd.Stderr = os.Stderr
+	// The sidecar goes first: a tmp file with a sidecar is a completed,
+	// verified upload that finishPendingBackup can rename on the next run.
+	if checksum != "" {
+		if err := writeChecksumSidecar(ctx, cfg, outfile, checksum); err != nil {
+			return err
+		}
+	}
+
+	attempts := 0
+	return withRetry(ctx, cfg.Retries, cfg.RetryBackoff, func() error {
+		attempts++
+		// A previous attempt may have renamed before the connection dropped.
+		if attempts > 1 {
+			if exists, err := remote.Exists(ctx, outfile); err == nil && exists {
+				return nil
+			}
+		}
+		return remote.Rename(ctx, tmpFile, outfile)
+	})
+}
+
+// finishPendingBackup looks for an upload of snap left behind by a run that
+// died after the stream completed but before the rename. If its checksum still
+// matches the sidecar it is moved into place instead of being sent again.
+func finishPendingBackup(ctx context.Context, cfg *Config, vol *Volume, snap string) (bool, error) {
+	// Checksums are verified with remote shell commands.
+	if snap == "" || cfg.Backend != "ssh" {
+		return false, nil
+	}
+
+	ts, err := extractSnapshotTimestamp(snap)
+	if err != nil {
+		return false, nil
+	}
+	cfg = cfg.forVolume(vol)
+
+	var names []string
+	prefix := fmt.Sprintf("%s-%s.", vol.Name, ts.Format(snapshotTimestampFormat))
+	err = withRetry(ctx, cfg.Retries, cfg.RetryBackoff, func() (err error) {
+		names, err = cfg.remote().List(ctx, prefix)
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("listing pending uploads failed: %w", err)
+	}
+
+	present := map[string]bool{}
+	for _, name := range names {
+		present[name] = true
+	}
+
+	for _, kind := range []string{"full", "inc"} {
+		outfile := prefix + kind + remoteFileSuffix(cfg)
+		if present[outfile] || !present[cfg.checksum().sidecar(outfile)] {
+			continue
+		}
+		var tmpFiles []string
+		for _, name := range names {
+			if strings.HasSuffix(name, ".tmp") && tmpTarget(name) == outfile {
+				tmpFiles = append(tmpFiles, name)
+			}
+		}
+		if len(tmpFiles) == 0 {
+			continue
+		}
 
-	return sshChecksumCmd.Run()
+		checksum, algorithm, err := readRemoteChecksum(ctx, cfg, outfile)
+		if err != nil {
+			return false, err
+		}
+		// Only the attempt that wrote the sidecar can match it.
+		tmpFile := ""
+		for _, name := range tmpFiles {
+			err := validateRemoteChecksum(ctx, cfg, name, checksum, algorithm)
+			if err == nil {
+				tmpFile = name
+				break
+			}
+			if verbose {
+				fmt.Printf("→ Pending upload %s doesn't match its checksum: %v\n", name, err)
+			}
+		}
+		if tmpFile == "" {
+			if verbose {
+				fmt.Printf("→ Pending upload %s is incomplete, sending again\n", outfile)
+			}
+			return false, nil
+		}
+
+		if verbose {
+			fmt.Printf("→ Finishing pending upload %s from a previous run\n", outfile)
+		}
+		if err := moveTmpFile(ctx, cfg, tmpFile, outfile, ""); err != nil {
+			return false, err
+		}
+		if err := chmodRemoteFiles(ctx, cfg, backupFiles(cfg, outfile, true, false)...); err != nil {
+			errLog.Printf("Error setting permissions on %s: %v", outfile, err)
+		}
+		if cfg.MaintainLatest {
+			if err := writeLatest(ctx, cfg, vol, outfile); err != nil {
+				errLog.Printf("Error updating latest pointer for %s: %v", vol.Name, err)
+			}
+		}
+		return true, nil
+	}
+
+	return false, nil
 }
 
 func remoteBackupExists(ctx context.Context, cfg *Config, outfile string) bool {
-	remotePath := shellEscape(filepath.Join(cfg.RemoteDest, outfile))
-	lsCmd := exec.CommandContext(ctx, "ssh", buildSSHArgs(cfg, fmt.Sprintf("test -f %s && echo exists", remotePath))...)
+	var exists bool
+	err := withRetry(ctx, cfg.Retries, cfg.RetryBackoff, func() (err error) {
+		exists, err = cfg.remote().Exists(ctx, outfile)
+		return err
+	})
+	return err == nil && exists
+}
+
+// backupNameRegexp matches the name of a stored backup, capturing the volume,
+// timestamp, kind and the compression and encryption suffixes.
+var backupNameRegexp = regexp.MustCompile(`^(.+)-(\d{4}-\d{2}-\d{2}_\d{2}-\d{2}-\d{2})\.(full|inc)\.btrfs(\.zst|\.gz)?(\.age|\.gpg)?$`)
 
-	output, err := lsCmd.Output()
-	return err == nil && strings.TrimSpace(string(output)) == "exists"
+// backupEncoding is what was done to a send stream on its way to the remote,
+// as recorded in the backup's name.
+type backupEncoding struct {
+	Compression string // none, zstd or gzip
+	Encryption  string // empty, age or gpg
+}
+
+// parseBackupEncoding reads the encoding from a backup's name, reporting
+// false for a name that isn't a backup.
+func parseBackupEncoding(name string) (backupEncoding, bool) {
+	match := backupNameRegexp.FindStringSubmatch(name)
+	if match == nil {
+		return backupEncoding{}, false
+	}
+
+	enc := backupEncoding{Compression: "none", Encryption: strings.TrimPrefix(match[5], ".")}
+	switch match[4] {
+	case ".zst":
+		enc.Compression = "zstd"
+	case ".gz":
+		enc.Compression = "gzip"
+	}
+	return enc, true
 }
 
 func listRemoteBackups(ctx context.Context, cfg *Config, vol *Volume) ([]remoteBackup, error) {
-	remoteCmd := fmt.Sprintf("cd %s && ls -1", shellEscape(cfg.RemoteDest))
-	cmd := exec.CommandContext(ctx, "ssh", buildSSHArgs(cfg, remoteCmd)...)
+	cfg = cfg.forVolume(vol)
 
-	output, err := cmd.Output()
+	var lines []string
+	err := withRetry(ctx, cfg.Retries, cfg.RetryBackoff, func() (err error) {
+		lines, err = cfg.remote().List(ctx, vol.Name+"-")
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("listing remote backups failed: %w", err)
 	}
 
-	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-	if len(lines) == 1 && strings.TrimSpace(lines[0]) == "" {
-		lines = nil
-	}
-
-	suffix := regexp.QuoteMeta(remoteFileSuffix(cfg))
-	namePattern := fmt.Sprintf(`^%s-(\d{4}-\d{2}-\d{2}_\d{2}-\d{2}-\d{2})\.(full|inc)%s$`, regexp.QuoteMeta(vol.Name), suffix)
-	re := regexp.MustCompile(namePattern)
-
 	var backups []remoteBackup
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
@@ -292,12 +870,14 @@ func listRemoteBackups(ctx context.Context, cfg *Config, vol *Volume) ([]remoteB
 			continue
 		}
 
-		match := re.FindStringSubmatch(line)
-		if len(match) != 3 {
+		// Any compression is accepted so a chain survives changing the
+		// setting, but only the volume's own encryption.
+		match := backupNameRegexp.FindStringSubmatch(line)
+		if match == nil || match[1] != vol.Name || match[5] != encryptionSuffix(cfg) {
 			continue
 		}
 
-		ts, err := time.Parse(snapshotTimestampFormat, match[1])
+		ts, err := time.ParseInLocation(snapshotTimestampFormat, match[2], snapshotLocation)
 		if err != nil {
 			continue
 		}
@@ -305,7 +885,7 @@ func listRemoteBackups(ctx context.Context, cfg *Config, vol *Volume) ([]remoteB
 		backups = append(backups, remoteBackup{
 			Name:      line,
 			Timestamp: ts,
-			Kind:      match[2],
+			Kind:      match[3],
 		})
 	}
 
@@ -325,6 +905,54 @@ func remoteBackupForTimestamp(backups []remoteBackup, ts time.Time) bool {
 	return false
 }
 
+// selectParent returns the local snapshot taken at the time of the latest
+// remote backup, the only valid parent for the next incremental, or an empty
+// string if that snapshot is gone.
+func selectParent(backups []remoteBackup, snaps []string) string {
+	if len(backups) == 0 {
+		return ""
+	}
+
+	latest := backups[len(backups)-1].Timestamp
+	for _, snap := range snaps {
+		if ts, err := extractSnapshotTimestamp(snap); err == nil && ts.Equal(latest) {
+			return snap
+		}
+	}
+	return ""
+}
+
+// incrementalParent finds the local snapshot of vol that the next incremental
+// should be sent against.
+func incrementalParent(cfg *Config, vol *Volume, backups []remoteBackup) string {
+	return selectParent(backups, listSnapshots(vol.SnapDir, cfg.snapshotPrefix()))
+}
+
+// cloneSources picks the local snapshots an incremental against parent can
+// also clone from: those behind the backups between the latest full and the
+// parent. Restoring the new backup replays that whole chain first, so each one
+// is present wherever the stream is received.
+func cloneSources(backups []remoteBackup, snaps []string, parent string) []string {
+	full := latestRemoteFull(backups)
+	if full == nil || parent == "" {
+		return nil
+	}
+
+	var clones []string
+	for _, b := range backups {
+		if b.Timestamp.Before(full.Timestamp) {
+			continue
+		}
+		for _, snap := range snaps {
+			ts, err := extractSnapshotTimestamp(snap)
+			if err == nil && ts.Equal(b.Timestamp) && snap != parent {
+				clones = append(clones, snap)
+			}
+		}
+	}
+	return clones
+}
+
 func latestRemoteFull(backups []remoteBackup) *remoteBackup {
 	for i := len(backups) - 1; i >= 0; i-- {
 		if backups[i].Kind == "full" {
@@ -345,17 +973,13 @@ func countIncrementalsSince(backups []remoteBackup, since time.Time) int {
 	return count
 }
 
-func needsFullBackup(ctx context.Context, cfg *Config, vol *Volume, oldSnap string, currentTime time.Time) bool {
+// needsFullBackup decides whether vol's next backup must be a full, given the
+// backups already on the remote.
+func needsFullBackup(cfg *Config, vol *Volume, remoteBackups []remoteBackup, oldSnap string, currentTime time.Time) bool {
 	if oldSnap == "" {
 		return true
 	}
 
-	remoteBackups, err := listRemoteBackups(ctx, cfg, vol)
-	if err != nil {
-		errLog.Printf("Error retrieving remote backups: %v", err)
-		return true
-	}
-
 	if len(remoteBackups) == 0 {
 		if verbose {
 			errLog.Println("Remote target has no backups")
@@ -383,20 +1007,29 @@ func needsFullBackup(ctx context.Context, cfg *Config, vol *Volume, oldSnap stri
 		return true
 	}
 
-	if cfg.MaxAgeDays > 0 {
-		if currentTime.Sub(lastFull.Timestamp) >= time.Duration(cfg.MaxAgeDays)*24*time.Hour {
+	if vol.MaxAgeDays > 0 {
+		if currentTime.Sub(lastFull.Timestamp) >= time.Duration(vol.MaxAgeDays)*24*time.Hour {
+			if verbose {
+				errLog.Printf("→ Last remote full backup is older than %d days", vol.MaxAgeDays)
+			}
+			return true
+		}
+	}
+
+	if weekday, ok := parseWeekday(cfg.FullOnWeekday); ok {
+		if since := lastWeekday(currentTime.In(cfg.location()), weekday); lastFull.Timestamp.Before(since) {
 			if verbose {
-				errLog.Printf("→ Last remote full backup is older than %d days", cfg.MaxAgeDays)
+				errLog.Printf("→ No remote full backup since %s", since.Format("Monday 2006-01-02"))
 			}
 			return true
 		}
 	}
 
-	if cfg.MaxIncrementals > 0 {
+	if vol.MaxIncrementals > 0 {
 		incCount := countIncrementalsSince(remoteBackups, lastFull.Timestamp)
-		if incCount >= cfg.MaxIncrementals {
+		if incCount >= vol.MaxIncrementals {
 			if verbose {
-				errLog.Printf("→ Remote has %d incrementals since last full (limit %d)", incCount, cfg.MaxIncrementals)
+				errLog.Printf("→ Remote has %d incrementals since last full (limit %d)", incCount, vol.MaxIncrementals)
 			}
 			return true
 		}
@@ -404,14 +1037,19 @@ func needsFullBackup(ctx context.Context, cfg *Config, vol *Volume, oldSnap stri
 
 	return false
 }
-func cleanupOldBackups(ctx context.Context, cfg *Config, vol *Volume, newBackup *remoteBackup) error {
-	backups, err := listRemoteBackups(ctx, cfg, vol)
-	if err != nil {
-		return fmt.Errorf("failed to list remote backups: %w", err)
-	}
 
-	if dryRun && newBackup != nil {
-		backups = append(backups, *newBackup)
+// lastWeekday returns the start of the most recent weekday on or before t, in
+// t's location.
+func lastWeekday(t time.Time, weekday time.Weekday) time.Time {
+	days := (int(t.Weekday()) - int(weekday) + 7) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-days, 0, 0, 0, 0, t.Location())
+}
+
+// cleanupOldBackups applies retention to backups, the remote listing taken
+// before newBackup was uploaded.
+func cleanupOldBackups(ctx context.Context, cfg *Config, vol *Volume, backups []remoteBackup, newBackup *remoteBackup) error {
+	if newBackup != nil {
+		backups = append(slices.Clone(backups), *newBackup)
 		sort.Slice(backups, func(i, j int) bool {
 			return backups[i].Timestamp.Before(backups[j].Timestamp)
 		})
@@ -421,57 +1059,164 @@ func cleanupOldBackups(ctx context.Context, cfg *Config, vol *Volume, newBackup
 		return nil
 	}
 
-	fullBackups := []remoteBackup{}
-	for _, b := range backups {
-		if b.Kind == "full" {
-			fullBackups = append(fullBackups, b)
+	toDelete := backupsToDelete(backups, cfg.Retention, cfg.KeepFulls)
+
+	var evict []remoteBackup
+	if cfg.MaxTotalBytes > 0 {
+		var err error
+		evict, err = budgetEvictionsFor(ctx, cfg, vol, backups, toDelete, newBackup)
+		if err != nil {
+			return err
 		}
 	}
 
-	if len(fullBackups) < 1 {
+	if len(toDelete) == 0 && len(evict) == 0 {
 		return nil
 	}
 
-	lastFull := fullBackups[len(fullBackups)-1]
+	if verbose {
+		policy := "keeping latest full chain"
+		if cfg.KeepFulls > 1 {
+			policy = fmt.Sprintf("keeping latest %d full chains", cfg.KeepFulls)
+		}
+		if cfg.Retention != nil {
+			policy = "applying retention policy"
+		}
+		if len(toDelete) > 0 {
+			fmt.Printf("→ Cleaning up %d old backup(s) for %s (%s)\n", len(toDelete), vol.Name, policy)
+		}
+		if len(evict) > 0 {
+			fmt.Printf("→ Evicting %d old backup(s) for %s to stay under max_total_bytes\n", len(evict), vol.Name)
+		}
+	}
+	// removeRemoteBackups needs one list in order to keep broken chains whole.
+	toDelete = append(toDelete, evict...)
+	sort.SliceStable(toDelete, func(i, j int) bool {
+		return toDelete[i].Timestamp.Before(toDelete[j].Timestamp)
+	})
+	toDelete = slices.CompactFunc(toDelete, func(a, b remoteBackup) bool { return a.Name == b.Name })
 
-	var toDelete []remoteBackup
-	for _, b := range backups {
-		if b.Timestamp.Before(lastFull.Timestamp) {
-			toDelete = append(toDelete, b)
+	if err := removeRemoteBackups(ctx, cfg, toDelete); err != nil {
+		return fmt.Errorf("failed to delete old backups: %w", err)
+	}
+
+	if cfg.MaintainLatest {
+		if err := repointLatest(ctx, cfg, vol, backups, toDelete); err != nil {
+			return fmt.Errorf("failed to repoint %s: %w", latestName(vol), err)
 		}
 	}
 
-	if len(toDelete) == 0 {
-		return nil
+	return nil
+}
+
+// verifyReceive has the remote parse outfile with btrfs receive --dump, which
+// reads the whole stream without applying it, to show it's a send stream btrfs
+// could receive. Compressed backups are decompressed on the way in; encrypted
+// ones can't be, as the remote has no key.
+func verifyReceive(ctx context.Context, cfg *Config, outfile string) error {
+	remoteCmd := fmt.Sprintf("btrfs receive --dump < %s >/dev/null", shellEscape(filepath.Join(cfg.RemoteDest, outfile)))
+	if decompress := decompressArgs(outfile); decompress != nil {
+		remoteCmd = fmt.Sprintf("%s < %s | btrfs receive --dump >/dev/null", strings.Join(decompress, " "), shellEscape(filepath.Join(cfg.RemoteDest, outfile)))
 	}
 
 	if verbose {
-		fmt.Printf("→ Cleaning up %d old backup(s) for %s (keeping latest full chain)\n", len(toDelete), vol.Name)
+		fmt.Printf("→ Checking %s parses as a send stream\n", outfile)
+	}
+	if dryRun {
+		if veryVerbose {
+			fmt.Printf("[DRY-RUN] %s\n", describeRemoteCommand(cfg, remoteCmd))
+		}
+		return nil
 	}
 
-	var rmArgs []string
-	for _, b := range toDelete {
-		backupPath := shellEscape(filepath.Join(cfg.RemoteDest, b.Name))
-		checksumPath := shellEscape(filepath.Join(cfg.RemoteDest, b.Name+".sha256"))
-		rmArgs = append(rmArgs, backupPath, checksumPath)
-		if verbose {
-			fmt.Printf("→ Deleting: %s\n", b.Name)
+	var stderr strings.Builder
+	cmd := remoteCommand(ctx, cfg, remoteCmd)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
 		}
+		return err
 	}
+	return nil
+}
 
-	remoteCmd := fmt.Sprintf("rm -f %s", strings.Join(rmArgs, " "))
+// budgetEvictionsFor picks the backups to evict on top of toDelete to keep
+// vol's backups under max_total_bytes, sizing them on the remote. newBackup was
+// just written and its size is already known.
+func budgetEvictionsFor(ctx context.Context, cfg *Config, vol *Volume, backups, toDelete []remoteBackup, newBackup *remoteBackup) ([]remoteBackup, error) {
+	var kept, listed []remoteBackup
+	for _, b := range backups {
+		if slices.ContainsFunc(toDelete, func(d remoteBackup) bool { return d.Name == b.Name }) {
+			continue
+		}
+		kept = append(kept, b)
+		if newBackup == nil || b.Name != newBackup.Name {
+			listed = append(listed, b)
+		}
+	}
 
-	if dryRun {
-		if veryVerbose {
-			fmt.Printf("[DRY-RUN] ssh %s\n", strings.Join(buildSSHArgs(cfg, remoteCmd), " "))
+	if err := fillRemoteBackupStats(ctx, cfg, listed); err != nil {
+		return nil, err
+	}
+	for i := range kept {
+		if j := slices.IndexFunc(listed, func(b remoteBackup) bool { return b.Name == kept[i].Name }); j >= 0 {
+			kept[i].Size = listed[j].Size
 		}
-		return nil
 	}
 
-	sshCmd := exec.CommandContext(ctx, "ssh", buildSSHArgs(cfg, remoteCmd)...)
-	if err := sshCmd.Run(); err != nil {
-		return fmt.Errorf("failed to delete old backups: %w", err)
+	evict, fits := budgetEvictions(kept, int64(cfg.MaxTotalBytes))
+	if !fits && !quiet {
+		fmt.Println(color.YellowString("⚠️ The newest chain of %s alone exceeds max_total_bytes (%s)", vol.Name, formatBytes(int64(cfg.MaxTotalBytes))))
 	}
+	return evict, nil
+}
 
-	return nil
+// removeRemoteBackups deletes backups along with their sidecar files, one
+// backup at a time so the log shows exactly what went. Backups must be sorted
+// oldest first. It works newest first and carries on past a failure, except
+// that once a backup couldn't be deleted, everything older in its chain is
+// kept so it can still be restored. Cancelling ctx stops it between backups.
+// The failures are returned together.
+func removeRemoteBackups(ctx context.Context, cfg *Config, backups []remoteBackup) error {
+	remote := cfg.remote()
+	var errs []error
+	chainFailed := false
+	for i := len(backups) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, fmt.Errorf("stopped before deleting %s: %w", backups[i].Name, err))
+			break
+		}
+
+		b := backups[i]
+		if chainFailed {
+			errs = append(errs, fmt.Errorf("kept %s, a newer backup in its chain couldn't be deleted", b.Name))
+			// The full is the oldest of its chain; what's before it isn't
+			// part of the one that failed.
+			chainFailed = b.Kind != "full"
+			continue
+		}
+
+		names := append([]string{b.Name, manifestName(b.Name)}, sidecars(b.Name)...)
+		if dryRun {
+			if veryVerbose {
+				fmt.Printf("[DRY-RUN] %s\n", remote.Describe("remove", names...))
+			}
+			continue
+		}
+
+		err := withRetry(ctx, cfg.Retries, cfg.RetryBackoff, func() error {
+			return remote.Remove(ctx, names...)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("deleting %s: %w", b.Name, err))
+			chainFailed = b.Kind != "full"
+			continue
+		}
+		if verbose {
+			fmt.Printf("→ Deleted: %s\n", b.Name)
+		}
+	}
+
+	return errors.Join(errs...)
 }
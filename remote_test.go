@@ -1,13 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestMoveTmpFileRenamesWithoutChecksum(t *testing.T) {
@@ -25,7 +28,7 @@ func TestMoveTmpFileRenamesWithoutChecksum(t *testing.T) {
 		t.Fatalf("writing tmp file: %v", err)
 	}
 
-	if err := moveTmpFile(context.Background(), cfg, outfile, ""); err != nil {
+	if err := moveTmpFile(context.Background(), cfg, outfile+".tmp", outfile, ""); err != nil {
 		t.Fatalf("moveTmpFile: %v", err)
 	}
 
@@ -62,7 +65,7 @@ func TestMoveTmpFileWithChecksum(t *testing.T) {
 
 	checksum := fmt.Sprintf("%x", sha256.Sum256([]byte("content")))
 
-	if err := moveTmpFile(context.Background(), cfg, outfile, checksum); err != nil {
+	if err := moveTmpFile(context.Background(), cfg, outfile+".tmp", outfile, checksum); err != nil {
 		t.Fatalf("moveTmpFile: %v", err)
 	}
 
@@ -132,7 +135,7 @@ func TestSendSnapshotFull(t *testing.T) {
 	}
 
 	outfile := "volume-full.btrfs"
-	checksum, err := sendSnapshot(context.Background(), cfg, newSnap, "", outfile, true)
+	checksum, _, err := sendSnapshot(context.Background(), cfg, "root", newSnap, "", nil, outfile, outfile+".tmp", true, nil)
 	if err != nil {
 		t.Fatalf("sendSnapshot full: %v", err)
 	}
@@ -183,13 +186,14 @@ func TestSendSnapshotIncrementalWithEncryption(t *testing.T) {
 	}
 
 	cfg := &Config{
-		RemoteHost:    "remote",
-		RemoteDest:    remoteDir,
-		EncryptionKey: "age-recipient",
+		RemoteHost:     "remote",
+		RemoteDest:     remoteDir,
+		EncryptionKey:  "age-recipient",
+		EncryptionKeys: []string{"age-recovery"},
 	}
 
 	outfile := "volume-inc.btrfs.age"
-	checksum, err := sendSnapshot(context.Background(), cfg, newSnap, oldSnap, outfile, false)
+	checksum, _, err := sendSnapshot(context.Background(), cfg, "root", newSnap, oldSnap, nil, outfile, outfile+".tmp", false, nil)
 	if err != nil {
 		t.Fatalf("sendSnapshot incremental: %v", err)
 	}
@@ -222,8 +226,135 @@ func TestSendSnapshotIncrementalWithEncryption(t *testing.T) {
 	if err != nil {
 		t.Fatalf("reading age log: %v", err)
 	}
-	if !strings.Contains(string(ageLogData), "-r age-recipient") {
-		t.Fatalf("expected age command to include recipient, got %q", string(ageLogData))
+	if !strings.Contains(string(ageLogData), "-r age-recipient -r age-recovery") {
+		t.Fatalf("expected age command to include both recipients, got %q", string(ageLogData))
+	}
+}
+
+func TestSendSnapshotCompressedWithEncryption(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	tempDir := t.TempDir()
+	compressLog := filepath.Join(tempDir, "compress.log")
+	t.Setenv("COMPRESS_LOG", compressLog)
+	t.Setenv("AGE_PREFIX", "age-prefix:")
+
+	newSnap := filepath.Join(tempDir, "snap-new")
+	payload := []byte("compressible snapshot data")
+	if err := os.WriteFile(newSnap, payload, 0o644); err != nil {
+		t.Fatalf("writing new snapshot: %v", err)
+	}
+
+	cfg := &Config{
+		RemoteHost:       "remote",
+		RemoteDest:       remoteDir,
+		EncryptionKey:    "age-recipient",
+		Compression:      "zstd",
+		CompressionLevel: 9,
+	}
+
+	outfile := "volume-full" + remoteFileSuffix(cfg)
+	if outfile != "volume-full.btrfs.zst.age" {
+		t.Fatalf("unexpected outfile %q", outfile)
+	}
+
+	checksum, _, err := sendSnapshot(context.Background(), cfg, "root", newSnap, "", nil, outfile, outfile+".tmp", true, nil)
+	if err != nil {
+		t.Fatalf("sendSnapshot: %v", err)
+	}
+
+	// Compression runs before encryption, so age wraps the zstd output.
+	expectedPayload := append([]byte("age-prefix:zstd:"), payload...)
+	wantHash := fmt.Sprintf("%x", sha256.Sum256(expectedPayload))
+	if checksum != wantHash {
+		t.Fatalf("unexpected checksum: want %s, got %s", wantHash, checksum)
+	}
+
+	data, err := os.ReadFile(filepath.Join(remoteDir, outfile+".tmp"))
+	if err != nil {
+		t.Fatalf("reading remote tmp file: %v", err)
+	}
+	if string(data) != string(expectedPayload) {
+		t.Fatalf("remote tmp file mismatch: want %q, got %q", string(expectedPayload), string(data))
+	}
+
+	logData, err := os.ReadFile(compressLog)
+	if err != nil {
+		t.Fatalf("reading compress log: %v", err)
+	}
+	if !strings.Contains(string(logData), "zstd -q -c -9") {
+		t.Fatalf("expected zstd with level, got %q", string(logData))
+	}
+}
+
+func TestSendSnapshotGPGEncryption(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	gpgLog := filepath.Join(t.TempDir(), "gpg.log")
+	t.Setenv("GPG_LOG", gpgLog)
+
+	newSnap := filepath.Join(t.TempDir(), "snap-new")
+	payload := []byte("gpg snapshot data")
+	if err := os.WriteFile(newSnap, payload, 0o644); err != nil {
+		t.Fatalf("writing new snapshot: %v", err)
+	}
+
+	cfg := &Config{
+		RemoteHost:        "remote",
+		RemoteDest:        remoteDir,
+		EncryptionKey:     "ops@example.com",
+		EncryptionKeys:    []string{"recovery@example.com"},
+		EncryptionBackend: "gpg",
+	}
+
+	outfile := "volume-full" + remoteFileSuffix(cfg)
+	if outfile != "volume-full.btrfs.gpg" {
+		t.Fatalf("unexpected outfile %q", outfile)
+	}
+
+	if _, _, err := sendSnapshot(context.Background(), cfg, "root", newSnap, "", nil, outfile, outfile+".tmp", true, nil); err != nil {
+		t.Fatalf("sendSnapshot: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(remoteDir, outfile+".tmp"))
+	if err != nil {
+		t.Fatalf("reading remote tmp file: %v", err)
+	}
+	if want := "gpg:" + string(payload); string(data) != want {
+		t.Fatalf("remote tmp file mismatch: want %q, got %q", want, string(data))
+	}
+
+	logData, err := os.ReadFile(gpgLog)
+	if err != nil {
+		t.Fatalf("reading gpg log: %v", err)
+	}
+	if !strings.Contains(string(logData), "--encrypt --recipient ops@example.com --recipient recovery@example.com") {
+		t.Fatalf("expected gpg to encrypt to both recipients, got %q", string(logData))
+	}
+}
+
+func TestListRemoteBackupsMixedCompression(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	for _, name := range []string{
+		"root-2024-01-01_10-00-00.full.btrfs",
+		"root-2024-01-02_10-00-00.inc.btrfs.zst",
+		"root-2024-01-03_10-00-00.inc.btrfs.gz",
+		"root-2024-01-04_10-00-00.inc.btrfs.xz",
+	} {
+		if err := os.WriteFile(filepath.Join(remoteDir, name), nil, 0o644); err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+	}
+
+	cfg := &Config{RemoteHost: "remote", RemoteDest: remoteDir, Compression: "zstd"}
+	backups, err := listRemoteBackups(context.Background(), cfg, &Volume{Name: "root"})
+	if err != nil {
+		t.Fatalf("listRemoteBackups: %v", err)
+	}
+
+	if len(backups) != 3 {
+		t.Fatalf("expected 3 backups, got %+v", backups)
 	}
 }
 
@@ -250,7 +381,7 @@ func TestSendSnapshotFailureCleansUpTempFile(t *testing.T) {
 	}
 
 	outfile := "volume-fail.btrfs"
-	_, err := sendSnapshot(context.Background(), cfg, newSnap, "", outfile, true)
+	_, _, err := sendSnapshot(context.Background(), cfg, "root", newSnap, "", nil, outfile, outfile+".tmp", true, nil)
 	if err == nil {
 		t.Fatal("expected sendSnapshot to fail, got nil error")
 	}
@@ -272,6 +403,34 @@ func TestSendSnapshotFailureCleansUpTempFile(t *testing.T) {
 	}
 }
 
+func TestSendSnapshotFailureFinishesProgress(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+	t.Setenv("SSH_FAIL_CAT", "1")
+
+	var out bytes.Buffer
+	progress, progressOutput, progressFormat = true, &out, "json"
+	t.Cleanup(func() { progress, progressOutput, progressFormat = false, os.Stderr, "" })
+
+	newSnap := filepath.Join(t.TempDir(), "snap-fail")
+	if err := os.WriteFile(newSnap, []byte("data"), 0o644); err != nil {
+		t.Fatalf("writing new snapshot: %v", err)
+	}
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+	}
+	outfile := "volume-fail.btrfs"
+	if _, _, err := sendSnapshot(context.Background(), cfg, "root", newSnap, "", nil, outfile, outfile+".tmp", true, nil); err == nil {
+		t.Fatal("expected sendSnapshot to fail, got nil error")
+	}
+
+	// The summary is only written once the ticker has stopped.
+	if !strings.Contains(out.String(), `"done":true`) {
+		t.Fatalf("expected a failed transfer to finish its progress, got %q", out.String())
+	}
+}
+
 func TestSendSnapshotBtrfsSendStartFailure(t *testing.T) {
 	setupTestEnv(t)
 
@@ -289,7 +448,7 @@ func TestSendSnapshotBtrfsSendStartFailure(t *testing.T) {
 	newSnap := "/nonexistent/snapshot"
 	outfile := "volume-fail.btrfs"
 
-	_, err := sendSnapshot(context.Background(), cfg, newSnap, "", outfile, true)
+	_, _, err := sendSnapshot(context.Background(), cfg, "root", newSnap, "", nil, outfile, outfile+".tmp", true, nil)
 	if err == nil {
 		t.Fatal("expected sendSnapshot to fail due to btrfs send start failure")
 	}
@@ -312,7 +471,7 @@ func TestSendSnapshotBtrfsSendWaitFailure(t *testing.T) {
 	}
 
 	outfile := "volume-fail.btrfs"
-	_, err := sendSnapshot(context.Background(), cfg, newSnap, "", outfile, true)
+	_, _, err := sendSnapshot(context.Background(), cfg, "root", newSnap, "", nil, outfile, outfile+".tmp", true, nil)
 	if err == nil {
 		t.Fatal("expected sendSnapshot to fail due to btrfs send wait failure")
 	}
@@ -349,7 +508,7 @@ func TestSendSnapshotAgeStartFailure(t *testing.T) {
 	errLog.SetOutput(os.NewFile(0, os.DevNull))
 
 	outfile := "volume-fail.btrfs.age"
-	_, err := sendSnapshot(context.Background(), cfg, newSnap, "", outfile, true)
+	_, _, err := sendSnapshot(context.Background(), cfg, "root", newSnap, "", nil, outfile, outfile+".tmp", true, nil)
 	if err == nil {
 		t.Fatal("expected sendSnapshot to fail due to age start failure")
 	}
@@ -373,7 +532,7 @@ func TestSendSnapshotAgeWaitFailure(t *testing.T) {
 	}
 
 	outfile := "volume-fail.btrfs.age"
-	_, err := sendSnapshot(context.Background(), cfg, newSnap, "", outfile, true)
+	_, _, err := sendSnapshot(context.Background(), cfg, "root", newSnap, "", nil, outfile, outfile+".tmp", true, nil)
 	if err == nil {
 		t.Fatal("expected sendSnapshot to fail due to age wait failure")
 	}
@@ -400,6 +559,9 @@ func TestCleanupOldBackups(t *testing.T) {
 		if err := os.WriteFile(checksumPath, []byte("abc123  "+name), 0o644); err != nil {
 			t.Fatalf("creating test checksum: %v", err)
 		}
+		if err := os.WriteFile(path+".json", []byte("{}"), 0o644); err != nil {
+			t.Fatalf("creating test manifest: %v", err)
+		}
 	}
 
 	createTestBackup("root-2024-01-01_10-00-00.full.btrfs")
@@ -409,7 +571,7 @@ func TestCleanupOldBackups(t *testing.T) {
 	createTestBackup("root-2024-01-05_10-00-00.inc.btrfs")
 	createTestBackup("root-2024-01-06_10-00-00.full.btrfs")
 
-	if err := cleanupOldBackups(context.Background(), cfg, vol, nil); err != nil {
+	if err := cleanupOldBackups(context.Background(), cfg, vol, remoteListing(t, cfg, vol), nil); err != nil {
 		t.Fatalf("cleanupOldBackups: %v", err)
 	}
 
@@ -427,6 +589,7 @@ func TestCleanupOldBackups(t *testing.T) {
 
 	expected := []string{
 		"root-2024-01-06_10-00-00.full.btrfs",
+		"root-2024-01-06_10-00-00.full.btrfs.json",
 	}
 
 	if len(remaining) != len(expected) {
@@ -440,6 +603,53 @@ func TestCleanupOldBackups(t *testing.T) {
 	}
 }
 
+func TestCleanupOldBackupsKeepFulls(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		KeepFulls:  2,
+	}
+	vol := &Volume{Name: "root"}
+
+	for _, name := range []string{
+		"root-2024-01-01_10-00-00.full.btrfs",
+		"root-2024-01-02_10-00-00.inc.btrfs",
+		"root-2024-01-03_10-00-00.full.btrfs",
+		"root-2024-01-04_10-00-00.inc.btrfs",
+		"root-2024-01-05_10-00-00.full.btrfs",
+		"root-2024-01-06_10-00-00.inc.btrfs",
+	} {
+		if err := os.WriteFile(filepath.Join(remoteDir, name), []byte("test"), 0o644); err != nil {
+			t.Fatalf("creating test backup: %v", err)
+		}
+	}
+
+	if err := cleanupOldBackups(context.Background(), cfg, vol, remoteListing(t, cfg, vol), nil); err != nil {
+		t.Fatalf("cleanupOldBackups: %v", err)
+	}
+
+	var remaining []string
+	entries, err := os.ReadDir(remoteDir)
+	if err != nil {
+		t.Fatalf("reading remote dir: %v", err)
+	}
+	for _, e := range entries {
+		remaining = append(remaining, e.Name())
+	}
+
+	expected := []string{
+		"root-2024-01-03_10-00-00.full.btrfs",
+		"root-2024-01-04_10-00-00.inc.btrfs",
+		"root-2024-01-05_10-00-00.full.btrfs",
+		"root-2024-01-06_10-00-00.inc.btrfs",
+	}
+	if !slices.Equal(remaining, expected) {
+		t.Fatalf("expected %v to remain, got %v", expected, remaining)
+	}
+}
+
 func TestCleanupOldBackupsNoFullBackups(t *testing.T) {
 	_, remoteDir := setupTestEnv(t)
 
@@ -449,7 +659,7 @@ func TestCleanupOldBackupsNoFullBackups(t *testing.T) {
 	}
 	vol := &Volume{Name: "root"}
 
-	if err := cleanupOldBackups(context.Background(), cfg, vol, nil); err != nil {
+	if err := cleanupOldBackups(context.Background(), cfg, vol, remoteListing(t, cfg, vol), nil); err != nil {
 		t.Fatalf("cleanupOldBackups on empty dir: %v", err)
 	}
 }
@@ -473,7 +683,7 @@ func TestCleanupOldBackupsOnlyOneFull(t *testing.T) {
 	createTestBackup("root-2024-01-01_10-00-00.full.btrfs")
 	createTestBackup("root-2024-01-02_10-00-00.inc.btrfs")
 
-	if err := cleanupOldBackups(context.Background(), cfg, vol, nil); err != nil {
+	if err := cleanupOldBackups(context.Background(), cfg, vol, remoteListing(t, cfg, vol), nil); err != nil {
 		t.Fatalf("cleanupOldBackups: %v", err)
 	}
 
@@ -486,3 +696,637 @@ func TestCleanupOldBackupsOnlyOneFull(t *testing.T) {
 		t.Fatalf("expected 2 backups to remain (only 1 full), got %d", len(entries))
 	}
 }
+
+func TestCleanupOldBackupsCountsNewBackup(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+	}
+	vol := &Volume{Name: "root"}
+
+	for _, name := range []string{"root-2024-01-01_10-00-00.full.btrfs", "root-2024-01-02_10-00-00.inc.btrfs"} {
+		if err := os.WriteFile(filepath.Join(remoteDir, name), []byte("test"), 0o644); err != nil {
+			t.Fatalf("creating test backup: %v", err)
+		}
+	}
+
+	// Listed before the new full was uploaded, as backupVolume does.
+	backups := remoteListing(t, cfg, vol)
+	newFull := "root-2024-01-03_10-00-00.full.btrfs"
+	if err := os.WriteFile(filepath.Join(remoteDir, newFull), []byte("test"), 0o644); err != nil {
+		t.Fatalf("creating new backup: %v", err)
+	}
+
+	newBackup := &remoteBackup{
+		Name:      newFull,
+		Timestamp: time.Date(2024, 1, 3, 10, 0, 0, 0, time.UTC),
+		Kind:      "full",
+	}
+	if err := cleanupOldBackups(context.Background(), cfg, vol, backups, newBackup); err != nil {
+		t.Fatalf("cleanupOldBackups: %v", err)
+	}
+
+	entries, err := os.ReadDir(remoteDir)
+	if err != nil {
+		t.Fatalf("reading remote dir: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != newFull {
+		t.Fatalf("expected only the new full to remain, got %v", entries)
+	}
+}
+
+func TestCleanupOldBackupsMaxTotalBytes(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	cfg := &Config{
+		RemoteHost:    "remote",
+		RemoteDest:    remoteDir,
+		KeepFulls:     5,
+		MaxTotalBytes: 300,
+	}
+	vol := &Volume{Name: "root"}
+
+	sized := map[string]int{
+		"root-2024-01-01_10-00-00.full.btrfs": 100,
+		"root-2024-01-02_10-00-00.inc.btrfs":  50,
+		"root-2024-01-03_10-00-00.full.btrfs": 100,
+		"root-2024-01-04_10-00-00.inc.btrfs":  50,
+	}
+	for name, size := range sized {
+		if err := os.WriteFile(filepath.Join(remoteDir, name), make([]byte, size), 0o644); err != nil {
+			t.Fatalf("creating test backup: %v", err)
+		}
+	}
+
+	backups := remoteListing(t, cfg, vol)
+	newFull := "root-2024-01-05_10-00-00.full.btrfs"
+	if err := os.WriteFile(filepath.Join(remoteDir, newFull), make([]byte, 100), 0o644); err != nil {
+		t.Fatalf("creating new backup: %v", err)
+	}
+	newBackup := &remoteBackup{
+		Name:      newFull,
+		Timestamp: time.Date(2024, 1, 5, 10, 0, 0, 0, time.UTC),
+		Kind:      "full",
+		Size:      100,
+	}
+
+	// 400 bytes in all: the oldest chain goes, the middle one fits.
+	if err := cleanupOldBackups(context.Background(), cfg, vol, backups, newBackup); err != nil {
+		t.Fatalf("cleanupOldBackups: %v", err)
+	}
+	assertNames(t, remoteListing(t, cfg, vol), []string{
+		"root-2024-01-03_10-00-00.full.btrfs",
+		"root-2024-01-04_10-00-00.inc.btrfs",
+		newFull,
+	})
+
+	// Even the newest chain alone is over budget, so it is kept with a warning.
+	cfg.MaxTotalBytes = 50
+	out := captureStdout(t, func() {
+		if err := cleanupOldBackups(context.Background(), cfg, vol, remoteListing(t, cfg, vol), nil); err != nil {
+			t.Fatalf("cleanupOldBackups: %v", err)
+		}
+	})
+	assertNames(t, remoteListing(t, cfg, vol), []string{newFull})
+	if !strings.Contains(out, "newest chain of root alone exceeds max_total_bytes") {
+		t.Errorf("expected a warning about the budget, got %q", out)
+	}
+}
+
+func TestCleanupOldBackupsEvictionsOlderThanRetention(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	cfg := &Config{
+		RemoteHost:    "remote",
+		RemoteDest:    remoteDir,
+		KeepFulls:     1,
+		Retention:     &Retention{KeepMonthly: 2},
+		MaxTotalBytes: 200,
+	}
+	vol := &Volume{Name: "root"}
+
+	// Retention drops the first January chain; the budget then evicts the
+	// orphaned incremental before it, which is older.
+	orphan := "root-2023-12-31_10-00-00.inc.btrfs"
+	names := []string{
+		orphan,
+		"root-2024-01-02_10-00-00.full.btrfs",
+		"root-2024-01-03_10-00-00.inc.btrfs",
+		"root-2024-01-20_10-00-00.full.btrfs",
+		"root-2024-02-01_10-00-00.full.btrfs",
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(remoteDir, name), make([]byte, 100), 0o644); err != nil {
+			t.Fatalf("creating test backup: %v", err)
+		}
+	}
+	// rm -f can't remove a directory, so deleting the orphan fails.
+	if err := os.MkdirAll(filepath.Join(remoteDir, orphan+".sha256", "x"), 0o755); err != nil {
+		t.Fatalf("creating stuck sidecar: %v", err)
+	}
+
+	err := cleanupOldBackups(context.Background(), cfg, vol, remoteListing(t, cfg, vol), nil)
+	if err == nil || !strings.Contains(err.Error(), "deleting "+orphan) {
+		t.Fatalf("expected the failed deletion to be reported, got %v", err)
+	}
+	// The orphan's failure says nothing about the January chain.
+	if strings.Contains(err.Error(), "kept ") {
+		t.Errorf("expected no full to be kept back, got %v", err)
+	}
+	// rm -f still takes the orphan itself, just not its sidecar.
+	assertNames(t, remoteListing(t, cfg, vol), []string{names[3], names[4]})
+}
+
+func TestCleanupOldBackupsKeepsChainBehindFailure(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	cfg := &Config{RemoteHost: "remote", RemoteDest: remoteDir, KeepFulls: 1}
+	vol := &Volume{Name: "root"}
+
+	names := []string{
+		"root-2024-01-01_10-00-00.full.btrfs",
+		"root-2024-01-02_10-00-00.inc.btrfs",
+		"root-2024-01-03_10-00-00.inc.btrfs",
+		"root-2024-01-04_10-00-00.inc.btrfs",
+		"root-2024-01-05_10-00-00.full.btrfs",
+		"root-2024-01-06_10-00-00.inc.btrfs",
+		"root-2024-01-07_10-00-00.full.btrfs",
+	}
+	for _, name := range names {
+		if name == names[2] {
+			// rm -f can't remove a directory, so deleting this one fails.
+			if err := os.MkdirAll(filepath.Join(remoteDir, name, "x"), 0o755); err != nil {
+				t.Fatalf("creating stuck backup: %v", err)
+			}
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(remoteDir, name), []byte("test"), 0o644); err != nil {
+			t.Fatalf("creating test backup: %v", err)
+		}
+	}
+
+	err := cleanupOldBackups(context.Background(), cfg, vol, remoteListing(t, cfg, vol), nil)
+	if err == nil || !strings.Contains(err.Error(), "deleting "+names[2]) {
+		t.Fatalf("expected the failed deletion to be reported, got %v", err)
+	}
+	for _, kept := range names[:2] {
+		if !strings.Contains(err.Error(), "kept "+kept) {
+			t.Errorf("expected %s to be reported as kept, got %v", kept, err)
+		}
+	}
+
+	// The newer incremental and the whole second chain still go.
+	assertNames(t, remoteListing(t, cfg, vol), []string{names[0], names[1], names[2], names[6]})
+}
+
+func TestRemoveRemoteBackupsContinuesPastFailure(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	cfg := &Config{RemoteHost: "remote", RemoteDest: remoteDir}
+	names := []string{
+		"root-2024-01-01_10-00-00.full.btrfs",
+		"root-2024-01-02_10-00-00.inc.btrfs",
+		"root-2024-01-03_10-00-00.inc.btrfs",
+		"root-2024-01-04_10-00-00.full.btrfs",
+		"root-2024-01-05_10-00-00.inc.btrfs",
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(remoteDir, name), []byte("test"), 0o644); err != nil {
+			t.Fatalf("creating test backup: %v", err)
+		}
+	}
+	// rm -f can't remove a directory, so deleting this one fails.
+	stuck := filepath.Join(remoteDir, names[1]+".sha256")
+	if err := os.MkdirAll(filepath.Join(stuck, "x"), 0o755); err != nil {
+		t.Fatalf("creating stuck sidecar: %v", err)
+	}
+
+	err := removeRemoteBackups(context.Background(), cfg, makeBackups(t, names...))
+	if err == nil || !strings.Contains(err.Error(), "deleting "+names[1]) {
+		t.Fatalf("expected the failed deletion to be reported, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "kept "+names[0]) {
+		t.Errorf("expected the full of the broken chain to be kept, got %v", err)
+	}
+
+	entries, err := os.ReadDir(remoteDir)
+	if err != nil {
+		t.Fatalf("reading remote dir: %v", err)
+	}
+	var remaining []string
+	for _, e := range entries {
+		remaining = append(remaining, e.Name())
+	}
+	expected := []string{names[0], names[1] + ".sha256"}
+	if !slices.Equal(remaining, expected) {
+		t.Fatalf("expected the rest to be deleted, leaving %v, got %v", expected, remaining)
+	}
+}
+
+func TestLocalDestinationSkipsSSH(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	sshLog := filepath.Join(t.TempDir(), "ssh.log")
+	t.Setenv("SSH_LOG", sshLog)
+
+	cfg := &Config{
+		RemoteDest: remoteDir,
+	}
+	vol := &Volume{Name: "root"}
+	ctx := context.Background()
+
+	if err := checkRemoteAccess(ctx, cfg); err != nil {
+		t.Fatalf("checkRemoteAccess: %v", err)
+	}
+
+	newSnap := filepath.Join(t.TempDir(), "snap")
+	payload := []byte("local snapshot data")
+	if err := os.WriteFile(newSnap, payload, 0o644); err != nil {
+		t.Fatalf("writing new snapshot: %v", err)
+	}
+
+	outfile := "root-2024-01-02_10-00-00.full.btrfs"
+	checksum, _, err := sendSnapshot(ctx, cfg, "root", newSnap, "", nil, outfile, outfile+".tmp", true, nil)
+	if err != nil {
+		t.Fatalf("sendSnapshot: %v", err)
+	}
+	if want := fmt.Sprintf("%x", sha256.Sum256(payload)); checksum != want {
+		t.Fatalf("unexpected checksum: want %s, got %s", want, checksum)
+	}
+
+	if err := moveTmpFile(ctx, cfg, outfile+".tmp", outfile, checksum); err != nil {
+		t.Fatalf("moveTmpFile: %v", err)
+	}
+
+	if !remoteBackupExists(ctx, cfg, outfile) {
+		t.Fatal("expected local backup to exist")
+	}
+
+	if err := os.WriteFile(filepath.Join(remoteDir, "root-2024-01-01_10-00-00.full.btrfs"), []byte("old"), 0o644); err != nil {
+		t.Fatalf("writing old backup: %v", err)
+	}
+
+	backups, err := listRemoteBackups(ctx, cfg, vol)
+	if err != nil {
+		t.Fatalf("listRemoteBackups: %v", err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups, got %d", len(backups))
+	}
+
+	if err := cleanupOldBackups(ctx, cfg, vol, backups, nil); err != nil {
+		t.Fatalf("cleanupOldBackups: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, "root-2024-01-01_10-00-00.full.btrfs")); !os.IsNotExist(err) {
+		t.Fatalf("expected old backup to be removed, stat err: %v", err)
+	}
+
+	if _, err := os.Stat(sshLog); !os.IsNotExist(err) {
+		t.Fatalf("expected ssh not to be invoked, stat err: %v", err)
+	}
+}
+
+func TestSendSnapshotRsyncTransport(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	tempDir := t.TempDir()
+	rsyncLog := filepath.Join(tempDir, "rsync.log")
+	t.Setenv("RSYNC_LOG", rsyncLog)
+	t.Setenv("RSYNC_FAIL_ONCE", filepath.Join(tempDir, "rsync-failed"))
+
+	newSnap := filepath.Join(tempDir, "snap")
+	payload := []byte("rsync snapshot data")
+	if err := os.WriteFile(newSnap, payload, 0o644); err != nil {
+		t.Fatalf("writing new snapshot: %v", err)
+	}
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		SSHKey:     "/path/to/key",
+		Transport:  "rsync",
+	}
+
+	outfile := "volume-full.btrfs"
+	checksum, _, err := sendSnapshot(context.Background(), cfg, "root", newSnap, "", nil, outfile, outfile+".tmp", true, nil)
+	if err != nil {
+		t.Fatalf("sendSnapshot rsync: %v", err)
+	}
+
+	if want := fmt.Sprintf("%x", sha256.Sum256(payload)); checksum != want {
+		t.Fatalf("unexpected checksum: want %s, got %s", want, checksum)
+	}
+
+	data, err := os.ReadFile(filepath.Join(remoteDir, outfile+".tmp"))
+	if err != nil {
+		t.Fatalf("reading remote tmp file: %v", err)
+	}
+	if string(data) != string(payload) {
+		t.Fatalf("remote tmp file mismatch: want %q, got %q", string(payload), string(data))
+	}
+
+	logData, err := os.ReadFile(rsyncLog)
+	if err != nil {
+		t.Fatalf("reading rsync log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(logData)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected rsync to be retried once, got %q", string(logData))
+	}
+	if !strings.Contains(lines[1], "--partial --append-verify -e 'ssh' '-i' '/path/to/key'") {
+		t.Fatalf("unexpected rsync arguments: %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[1], "remote:"+filepath.Join(remoteDir, outfile+".tmp")) {
+		t.Fatalf("expected rsync destination on remote host, got %q", lines[1])
+	}
+}
+
+func TestFinishPendingBackup(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	cfg := &Config{RemoteHost: "remote", RemoteDest: remoteDir, Backend: "ssh"}
+	vol := &Volume{Name: "root"}
+	snap := "/snaps/btrfs-backup-2024-01-02_10-00-00"
+	outfile := "root-2024-01-02_10-00-00.inc.btrfs"
+
+	payload := []byte("uploaded stream")
+	checksum := fmt.Sprintf("%x", sha256.Sum256(payload))
+	if err := os.WriteFile(filepath.Join(remoteDir, outfile+".tmp"), payload, 0o644); err != nil {
+		t.Fatalf("writing tmp file: %v", err)
+	}
+
+	// Without a sidecar the upload may be truncated, so it is left alone.
+	finished, err := finishPendingBackup(context.Background(), cfg, vol, snap)
+	if err != nil || finished {
+		t.Fatalf("expected no resume without sidecar, got %v, %v", finished, err)
+	}
+
+	sidecar := fmt.Sprintf("%s  %s\n", checksum, outfile)
+	if err := os.WriteFile(filepath.Join(remoteDir, outfile+".sha256"), []byte(sidecar), 0o644); err != nil {
+		t.Fatalf("writing sidecar: %v", err)
+	}
+
+	finished, err = finishPendingBackup(context.Background(), cfg, vol, snap)
+	if err != nil || !finished {
+		t.Fatalf("expected pending upload to be finished, got %v, %v", finished, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(remoteDir, outfile+".tmp")); !os.IsNotExist(err) {
+		t.Fatalf("expected tmp file to be renamed, stat err: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(remoteDir, outfile))
+	if err != nil || string(data) != string(payload) {
+		t.Fatalf("unexpected final file: %q, %v", string(data), err)
+	}
+}
+
+func TestFinishPendingBackupChecksumMismatch(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	cfg := &Config{RemoteHost: "remote", RemoteDest: remoteDir, Backend: "ssh"}
+	outfile := "root-2024-01-02_10-00-00.full.btrfs"
+
+	if err := os.WriteFile(filepath.Join(remoteDir, outfile+".tmp"), []byte("partial"), 0o644); err != nil {
+		t.Fatalf("writing tmp file: %v", err)
+	}
+	sidecar := fmt.Sprintf("%s  %s\n", strings.Repeat("0", 64), outfile)
+	if err := os.WriteFile(filepath.Join(remoteDir, outfile+".sha256"), []byte(sidecar), 0o644); err != nil {
+		t.Fatalf("writing sidecar: %v", err)
+	}
+
+	finished, err := finishPendingBackup(context.Background(), cfg, &Volume{Name: "root"}, "/snaps/btrfs-backup-2024-01-02_10-00-00")
+	if err != nil || finished {
+		t.Fatalf("expected mismatched upload to be sent again, got %v, %v", finished, err)
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, outfile+".tmp")); err != nil {
+		t.Fatalf("expected tmp file to be left in place: %v", err)
+	}
+}
+
+func TestFinishPendingBackupPicksMatchingAttempt(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	cfg := &Config{RemoteHost: "remote", RemoteDest: remoteDir, Backend: "ssh"}
+	outfile := "root-2024-01-02_10-00-00.full.btrfs"
+
+	payload := []byte("uploaded stream")
+	attempts := map[string][]byte{
+		outfile + ".0a1b2c3d.tmp": []byte("partial"),
+		outfile + ".deadbeef.tmp": payload,
+	}
+	for name, data := range attempts {
+		if err := os.WriteFile(filepath.Join(remoteDir, name), data, 0o644); err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+	}
+	sidecar := fmt.Sprintf("%x  %s\n", sha256.Sum256(payload), outfile)
+	if err := os.WriteFile(filepath.Join(remoteDir, outfile+".sha256"), []byte(sidecar), 0o644); err != nil {
+		t.Fatalf("writing sidecar: %v", err)
+	}
+
+	finished, err := finishPendingBackup(context.Background(), cfg, &Volume{Name: "root"}, "/snaps/btrfs-backup-2024-01-02_10-00-00")
+	if err != nil || !finished {
+		t.Fatalf("expected pending upload to be finished, got %v, %v", finished, err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(remoteDir, outfile))
+	if err != nil || string(data) != string(payload) {
+		t.Fatalf("expected the matching attempt to be moved into place, got %q, %v", string(data), err)
+	}
+}
+
+func TestTmpTarget(t *testing.T) {
+	t.Parallel()
+
+	outfile := "root-2024-01-02_10-00-00.full.btrfs.zst.age"
+	tests := map[string]string{
+		newTmpName(outfile):                "root-2024-01-02_10-00-00.full.btrfs.zst.age",
+		outfile + ".tmp":                   "root-2024-01-02_10-00-00.full.btrfs.zst.age",
+		"root-latest.0a1b2c3d.tmp":         "root-latest",
+		"root-2024-01-02_10-00-00.inc.tmp": "root-2024-01-02_10-00-00.inc",
+	}
+	for tmpFile, want := range tests {
+		if got := tmpTarget(tmpFile); got != want {
+			t.Errorf("tmpTarget(%q) = %q, want %q", tmpFile, got, want)
+		}
+	}
+
+	if a, b := newTmpName(outfile), newTmpName(outfile); a == b {
+		t.Errorf("expected distinct temp names, got %q twice", a)
+	}
+}
+
+func TestCheckRemoteSpace(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "data"), make([]byte, 4096), 0o644); err != nil {
+		t.Fatalf("writing source data: %v", err)
+	}
+
+	cfg := &Config{RemoteHost: "remote", RemoteDest: remoteDir, Backend: "ssh"}
+	if err := checkRemoteSpace(context.Background(), cfg, src); err != nil {
+		t.Fatalf("expected enough space, got %v", err)
+	}
+
+	cfg.MinFreeBytes = 1 << 60
+	err := checkRemoteSpace(context.Background(), cfg, src)
+	if err == nil || !strings.Contains(err.Error(), "not enough space") {
+		t.Fatalf("expected not enough space error, got %v", err)
+	}
+
+	// An unmeasurable source skips the check rather than failing.
+	if err := checkRemoteSpace(context.Background(), cfg, filepath.Join(src, "missing")); err != nil {
+		t.Fatalf("expected check to be skipped, got %v", err)
+	}
+}
+
+func TestRemoveStaleTmpFiles(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	cfg := &Config{RemoteHost: "remote", RemoteDest: remoteDir, Backend: "ssh", Volumes: []Volume{{Name: "root"}}}
+	old := time.Now().Add(-48 * time.Hour)
+
+	files := map[string]bool{
+		// Abandoned uploads, named before and after newTmpName.
+		"root-2024-01-01_10-00-00.full.btrfs.tmp":              true,
+		"root-2024-01-04_10-00-00.full.btrfs.zst.89abcdef.tmp": true,
+		// Not ours: another tool's file, and a volume this host doesn't have.
+		"export.tmp": false,
+		"home-2024-01-01_10-00-00.full.btrfs.0a1b2c3d.tmp": false,
+		// Still being written.
+		"root-2024-01-02_10-00-00.inc.btrfs.tmp": false,
+		// Verified upload waiting to be resumed.
+		"root-2024-01-03_10-00-00.inc.btrfs.0a1b2c3d.tmp": false,
+	}
+	for name := range files {
+		path := filepath.Join(remoteDir, name)
+		if err := os.WriteFile(path, []byte("partial"), 0o644); err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+		if name != "root-2024-01-02_10-00-00.inc.btrfs.tmp" {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatalf("setting mtime: %v", err)
+			}
+		}
+	}
+	if err := os.WriteFile(filepath.Join(remoteDir, "root-2024-01-03_10-00-00.inc.btrfs.sha256"), []byte("abc  x\n"), 0o644); err != nil {
+		t.Fatalf("writing sidecar: %v", err)
+	}
+
+	if err := removeStaleTmpFiles(context.Background(), cfg, time.Hour); err != nil {
+		t.Fatalf("removeStaleTmpFiles: %v", err)
+	}
+
+	for name, removed := range files {
+		_, err := os.Stat(filepath.Join(remoteDir, name))
+		if removed && !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, stat err: %v", name, err)
+		}
+		if !removed && err != nil {
+			t.Errorf("expected %s to be kept: %v", name, err)
+		}
+	}
+}
+
+func TestSendSnapshotVerifyModes(t *testing.T) {
+	payload := []byte("full snapshot data")
+	wantHash := fmt.Sprintf("%x", sha256.Sum256(payload))
+	bogus := strings.Repeat("0", 64)
+
+	tests := []struct {
+		mode    string
+		lying   bool
+		want    string
+		wantErr bool
+	}{
+		{mode: "both", want: wantHash},
+		{mode: "remote", want: wantHash},
+		{mode: "local", want: wantHash},
+		{mode: "both", lying: true, wantErr: true},
+		// Nothing local to compare with, so the remote is believed.
+		{mode: "remote", lying: true, want: bogus},
+		{mode: "local", lying: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s lying=%v", tt.mode, tt.lying), func(t *testing.T) {
+			binDir, remoteDir := setupTestEnv(t)
+			if tt.lying {
+				writeExecutable(t, binDir, "sha256sum", fmt.Sprintf("#!/bin/sh\ncat >/dev/null\necho '%s  -'\n", bogus))
+			}
+
+			newSnap := filepath.Join(t.TempDir(), "snap-full")
+			if err := os.WriteFile(newSnap, payload, 0o644); err != nil {
+				t.Fatalf("writing new snapshot: %v", err)
+			}
+
+			cfg := &Config{RemoteHost: "remote", RemoteDest: remoteDir, VerifyMode: tt.mode}
+			outfile := "volume-full.btrfs"
+			checksum, _, err := sendSnapshot(context.Background(), cfg, "root", newSnap, "", nil, outfile, outfile+".tmp", true, nil)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+					t.Fatalf("expected a checksum mismatch, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sendSnapshot: %v", err)
+			}
+			if checksum != tt.want {
+				t.Errorf("expected checksum %s, got %s", tt.want, checksum)
+			}
+
+			data, err := os.ReadFile(filepath.Join(remoteDir, outfile+".tmp"))
+			if err != nil || string(data) != string(payload) {
+				t.Fatalf("remote tmp file mismatch: %q, %v", string(data), err)
+			}
+		})
+	}
+}
+
+func TestParseBackupEncoding(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		want backupEncoding
+		ok   bool
+	}{
+		{"root-2024-05-10_10-00-00.full.btrfs", backupEncoding{Compression: "none"}, true},
+		{"root-2024-05-10_10-00-00.inc.btrfs.zst", backupEncoding{Compression: "zstd"}, true},
+		{"root-2024-05-10_10-00-00.full.btrfs.age", backupEncoding{Compression: "none", Encryption: "age"}, true},
+		{"root-2024-05-10_10-00-00.inc.btrfs.gz.age", backupEncoding{Compression: "gzip", Encryption: "age"}, true},
+		{"my-vol-2024-05-10_10-00-00.full.btrfs.zst.gpg", backupEncoding{Compression: "zstd", Encryption: "gpg"}, true},
+		{"root-2024-05-10_10-00-00.full.btrfs.age.sha256", backupEncoding{}, false},
+		{"root-2024-05-10_10-00-00.full.btrfs.1a2b3c4d.tmp", backupEncoding{}, false},
+		{"root-2024-05-10_10-00-00.full.btrfs.age.zst", backupEncoding{}, false},
+		{"root-latest", backupEncoding{}, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseBackupEncoding(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: expected %+v, %v; got %+v, %v", tt.name, tt.want, tt.ok, got, ok)
+		}
+	}
+}
+
+func TestPipelineFromBackupName(t *testing.T) {
+	t.Parallel()
+
+	name := "root-2024-05-10_10-00-00.inc.btrfs.gz.age"
+	if got := decryptArgs(name, "key.txt"); len(got) == 0 || got[len(got)-2] != "-i" {
+		t.Errorf("expected age to decrypt %s, got %v", name, got)
+	}
+	if got := decompressArgs(name); strings.Join(got, " ") != "gzip -d -c" {
+		t.Errorf("expected gzip to decompress %s, got %v", name, got)
+	}
+
+	plain := "root-2024-05-10_10-00-00.inc.btrfs"
+	if decryptArgs(plain, "") != nil || decompressArgs(plain) != nil {
+		t.Errorf("expected nothing to undo for %s", plain)
+	}
+}
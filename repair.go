@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"slices"
+)
+
+// chainReport lists what's wrong with a volume's remote backups.
+type chainReport struct {
+	// orphans are incrementals with no full at or before them to restore from.
+	orphans []remoteBackup
+	// missingChecksums are backups without a checksum sidecar, which restore
+	// can't verify.
+	missingChecksums []remoteBackup
+}
+
+func runRepair(ctx context.Context, cfg *Config, args []string) error {
+	var volumeName string
+	var repair bool
+
+	fs := flag.NewFlagSet("repair", flag.ContinueOnError)
+	fs.StringVar(&volumeName, "volume", "", "Only check this volume (default: all)")
+	fs.BoolVar(&repair, "repair", false, "Delete orphaned incrementals and write missing checksums instead of only reporting them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if repair && cfg.RemoteLock && !dryRun {
+		lock, err := acquireRemoteLock(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+	}
+
+	volumes := cfg.Volumes
+	if volumeName != "" {
+		vol := findVolume(cfg, volumeName)
+		if vol == nil {
+			return fmt.Errorf("volume %q not found in config", volumeName)
+		}
+		volumes = []Volume{*vol}
+	}
+
+	unrepairedOrphans, unrepairedChecksums := 0, 0
+	for i := range volumes {
+		vol := &volumes[i]
+		report, err := checkRemoteChain(ctx, cfg, vol)
+		if err != nil {
+			return fmt.Errorf("checking %s: %w", vol.Name, err)
+		}
+
+		if len(report.orphans) == 0 && len(report.missingChecksums) == 0 {
+			fmt.Printf("%s: OK\n", vol.Name)
+			continue
+		}
+
+		for _, b := range report.orphans {
+			fmt.Printf("%s: orphaned incremental %s (no full backup before it)\n", vol.Name, b.Name)
+		}
+		for _, b := range report.missingChecksums {
+			fmt.Printf("%s: %s backup %s has no checksum file\n", vol.Name, b.Kind, b.Name)
+		}
+
+		if !repair {
+			unrepairedOrphans += len(report.orphans)
+			unrepairedChecksums += len(report.missingChecksums)
+			continue
+		}
+		if len(report.orphans) > 0 {
+			if err := removeRemoteBackups(ctx, cfg, report.orphans); err != nil {
+				return fmt.Errorf("removing orphans of %s: %w", vol.Name, err)
+			}
+		}
+		if err := writeMissingChecksums(ctx, cfg.forVolume(vol), vol, report.missingChecksums); err != nil {
+			return err
+		}
+	}
+
+	if unrepairedOrphans > 0 {
+		fmt.Printf("Run with --repair to delete %d orphaned incremental(s)\n", unrepairedOrphans)
+	}
+	if unrepairedChecksums > 0 {
+		fmt.Printf("Run with --repair to write %d missing checksum(s)\n", unrepairedChecksums)
+	}
+
+	return nil
+}
+
+// writeMissingChecksums hashes each of backups on the remote and writes the
+// sidecar it lacks. This trusts the stored file, so it can only stop
+// a later corruption going unnoticed, not find an earlier one.
+func writeMissingChecksums(ctx context.Context, cfg *Config, vol *Volume, backups []remoteBackup) error {
+	if len(backups) == 0 {
+		return nil
+	}
+	// Hashing in place needs a shell on the remote.
+	if cfg.Backend == "s3" {
+		fmt.Printf("%s: missing checksums can't be recomputed with backend s3\n", vol.Name)
+		return nil
+	}
+
+	algorithm := cfg.checksum()
+	for _, b := range backups {
+		if dryRun {
+			if veryVerbose {
+				fmt.Printf("[DRY-RUN] %s\n", describeRemoteCommand(cfg, fmt.Sprintf("%s %s > %s", algorithm.command, b.Name, algorithm.sidecar(b.Name))))
+			}
+			continue
+		}
+
+		checksum, err := remoteFileChecksum(ctx, cfg, b.Name, algorithm)
+		if err != nil {
+			return err
+		}
+		if err := writeChecksumSidecar(ctx, cfg, b.Name, checksum); err != nil {
+			return fmt.Errorf("writing checksum for %s: %w", b.Name, err)
+		}
+		fmt.Printf("%s: wrote %s for %s\n", vol.Name, algorithm.sidecar(b.Name), b.Name)
+	}
+	return nil
+}
+
+// checkRemoteChain inspects the remote backups of vol for broken chains.
+func checkRemoteChain(ctx context.Context, cfg *Config, vol *Volume) (chainReport, error) {
+	backups, err := listRemoteBackups(ctx, cfg, vol)
+	if err != nil {
+		return chainReport{}, err
+	}
+
+	var names []string
+	err = withRetry(ctx, cfg.Retries, cfg.RetryBackoff, func() (err error) {
+		names, err = cfg.remote().List(ctx, vol.Name+"-")
+		return err
+	})
+	if err != nil {
+		return chainReport{}, fmt.Errorf("listing remote files failed: %w", err)
+	}
+
+	return findChainProblems(backups, names), nil
+}
+
+// findChainProblems checks backups, sorted oldest first, against names, every
+// file present on the remote.
+func findChainProblems(backups []remoteBackup, names []string) chainReport {
+	var report chainReport
+	sawFull := false
+	for _, b := range backups {
+		if b.Kind == "full" {
+			sawFull = true
+		} else if !sawFull {
+			// Deleted by a repair, so not worth a checksum.
+			report.orphans = append(report.orphans, b)
+			continue
+		}
+
+		hasSidecar := slices.ContainsFunc(sidecars(b.Name), func(s string) bool {
+			return slices.Contains(names, s)
+		})
+		if !hasSidecar {
+			report.missingChecksums = append(report.missingChecksums, b)
+		}
+	}
+	return report
+}
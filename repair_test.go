@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFindChainProblems(t *testing.T) {
+	t.Parallel()
+
+	day := func(d int) time.Time { return time.Date(2024, 5, d, 10, 0, 0, 0, time.UTC) }
+	backups := []remoteBackup{
+		{Name: "root-2024-05-01_10-00-00.inc.btrfs", Timestamp: day(1), Kind: "inc"},
+		{Name: "root-2024-05-02_10-00-00.inc.btrfs", Timestamp: day(2), Kind: "inc"},
+		{Name: "root-2024-05-03_10-00-00.full.btrfs", Timestamp: day(3), Kind: "full"},
+		{Name: "root-2024-05-04_10-00-00.inc.btrfs", Timestamp: day(4), Kind: "inc"},
+		{Name: "root-2024-05-05_10-00-00.full.btrfs", Timestamp: day(5), Kind: "full"},
+	}
+	names := []string{
+		"root-2024-05-03_10-00-00.full.btrfs.sha256",
+		"root-2024-05-04_10-00-00.inc.btrfs.sha256",
+		"root-2024-05-05_10-00-00.full.btrfs.blake3",
+	}
+
+	report := findChainProblems(backups, names)
+	if len(report.orphans) != 2 || report.orphans[0].Name != backups[0].Name || report.orphans[1].Name != backups[1].Name {
+		t.Errorf("unexpected orphans: %+v", report.orphans)
+	}
+	if len(report.missingChecksums) != 0 {
+		t.Errorf("unexpected missing checksums: %+v", report.missingChecksums)
+	}
+
+	report = findChainProblems(backups, names[:1])
+	if len(report.missingChecksums) != 2 || report.missingChecksums[0].Name != backups[3].Name || report.missingChecksums[1].Name != backups[4].Name {
+		t.Errorf("expected the incremental and last full to be missing checksums, got %+v", report.missingChecksums)
+	}
+}
+
+func TestRunRepair(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Volumes:    []Volume{{Name: "root"}},
+	}
+
+	orphan := "root-2024-05-01_10-00-00.inc.btrfs"
+	full := "root-2024-05-02_10-00-00.full.btrfs"
+	for _, name := range []string{orphan, orphan + ".sha256", full, full + ".sha256"} {
+		if err := os.WriteFile(filepath.Join(remoteDir, name), []byte("data"), 0o644); err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+	}
+
+	if err := runRepair(context.Background(), cfg, nil); err != nil {
+		t.Fatalf("runRepair report: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, orphan)); err != nil {
+		t.Fatalf("expected report mode to leave the orphan alone: %v", err)
+	}
+
+	if err := runRepair(context.Background(), cfg, []string{"--repair"}); err != nil {
+		t.Fatalf("runRepair: %v", err)
+	}
+	for _, name := range []string{orphan, orphan + ".sha256"} {
+		if _, err := os.Stat(filepath.Join(remoteDir, name)); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be deleted, stat err: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, full)); err != nil {
+		t.Fatalf("expected the full backup to remain: %v", err)
+	}
+}
+
+func TestRunRepairWritesMissingChecksum(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Backend:    "ssh",
+		Volumes:    []Volume{{Name: "root"}},
+	}
+
+	full := "root-2024-05-02_10-00-00.full.btrfs"
+	if err := os.WriteFile(filepath.Join(remoteDir, full), []byte("data"), 0o644); err != nil {
+		t.Fatalf("writing %s: %v", full, err)
+	}
+	sidecar := filepath.Join(remoteDir, full+".sha256")
+
+	captureStdout(t, func() {
+		if err := runRepair(context.Background(), cfg, nil); err != nil {
+			t.Errorf("runRepair report: %v", err)
+		}
+	})
+	if _, err := os.Stat(sidecar); !os.IsNotExist(err) {
+		t.Fatalf("expected report mode not to write a checksum, stat err: %v", err)
+	}
+
+	captureStdout(t, func() {
+		if err := runRepair(context.Background(), cfg, []string{"--repair"}); err != nil {
+			t.Errorf("runRepair: %v", err)
+		}
+	})
+	data, err := os.ReadFile(sidecar)
+	if err != nil {
+		t.Fatalf("expected the checksum to be written: %v", err)
+	}
+	want := fmt.Sprintf("%x  %s\n", sha256.Sum256([]byte("data")), full)
+	if string(data) != want {
+		t.Errorf("expected sidecar %q, got %q", want, data)
+	}
+
+	// Once consistent there is nothing left to do.
+	out := captureStdout(t, func() {
+		if err := runRepair(context.Background(), cfg, []string{"--repair"}); err != nil {
+			t.Errorf("runRepair: %v", err)
+		}
+	})
+	if out != "root: OK\n" {
+		t.Errorf("expected a clean report, got %q", out)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// With mode replicate each snapshot is received into a subvolume on the
+// remote rather than stored as a file, keeping a standby that can be mounted
+// straight away. Every replica is complete on its own, so each counts as a
+// full for retention, and the newest is what the next send diffs against.
+
+// replicaIncomingDir holds a receive in progress. Only once it completes is
+// the subvolume moved alongside the others, so a killed run never leaves
+// something that looks like a replica.
+const replicaIncomingDir = ".incoming"
+
+// replicaDir is where vol's snapshots are received, each named like the local
+// snapshot it came from.
+func replicaDir(cfg *Config, vol *Volume) string {
+	return filepath.Join(cfg.RemoteDest, vol.Name)
+}
+
+// listReplicas returns the snapshots of vol received on the remote, oldest
+// first.
+func listReplicas(ctx context.Context, cfg *Config, vol *Volume) ([]remoteBackup, error) {
+	dir := shellEscape(replicaDir(cfg, vol))
+	remoteCmd := fmt.Sprintf("if test -d %[1]s; then ls -1 %[1]s; fi", dir)
+
+	var output []byte
+	err := withRetry(ctx, cfg.Retries, cfg.RetryBackoff, func() error {
+		return runRemoteOp(ctx, cfg, remoteCmd, func(cmd *exec.Cmd) (err error) {
+			output, err = cmd.Output()
+			return err
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing replicas failed: %w", err)
+	}
+
+	var replicas []remoteBackup
+	for _, line := range strings.Split(string(output), "\n") {
+		name := strings.TrimSpace(line)
+		if !strings.HasPrefix(name, cfg.snapshotPrefix()) {
+			continue
+		}
+		ts, err := extractSnapshotTimestamp(name)
+		if err != nil {
+			continue
+		}
+		replicas = append(replicas, remoteBackup{Name: name, Timestamp: ts, Kind: "full"})
+	}
+
+	sort.Slice(replicas, func(i, j int) bool {
+		return replicas[i].Timestamp.Before(replicas[j].Timestamp)
+	})
+	return replicas, nil
+}
+
+// replicateVolume sends vol's next snapshot into btrfs receive on the remote.
+// It takes over from backupVolume once the snapshot time is settled.
+func replicateVolume(ctx context.Context, cfg *Config, vol *Volume, oldSnap string, currentTime time.Time, reuseSnap bool) (res volumeResult, err error) {
+	// Without knowing what the standby has there's no valid parent, and a
+	// full would collide with a replica of the same name.
+	replicas, err := listReplicas(ctx, cfg, vol)
+	if err != nil {
+		return res, failedAt("list", err)
+	}
+
+	parent := incrementalParent(cfg, vol, replicas)
+	if reuseSnap && parent != "" && parent == oldSnap {
+		if verbose {
+			fmt.Printf("→ %s is already on the standby, nothing to send\n", filepath.Base(oldSnap))
+		}
+		clearFailedSend(vol.SnapDir)
+		return res, nil
+	}
+
+	full := force || parent == ""
+	if verbose {
+		if full {
+			fmt.Printf("→ Doing full replication for %s\n", vol.Name)
+		} else {
+			fmt.Printf("→ Doing incremental replication for %s against %s\n", vol.Name, filepath.Base(parent))
+		}
+	}
+
+	if full && !dryRun {
+		if err := checkRemoteSpace(ctx, cfg, vol.Src); err != nil {
+			return res, failedAt("space", err)
+		}
+	}
+
+	newSnap := oldSnap
+	if !reuseSnap {
+		newSnap, err = takeSnapshot(ctx, cfg, vol, currentTime)
+		if err != nil {
+			return res, failedAt("snapshot", err)
+		}
+	}
+	name := filepath.Base(newSnap)
+
+	if slices.ContainsFunc(replicas, func(r remoteBackup) bool { return r.Name == name }) {
+		if !quiet {
+			color.Red("⚠️ Replica %s already exists on remote, skipping volume %s\n", name, vol.Name)
+		}
+		return res, nil
+	}
+
+	if dryRun {
+		reportTransferEstimate(ctx, vol, newSnap, parent, full)
+	}
+
+	var size int64
+	err = withRetry(ctx, cfg.Retries, cfg.RetryBackoff, func() (err error) {
+		size, err = receiveSnapshot(ctx, cfg, vol, newSnap, parent, full)
+		return err
+	})
+	if err != nil {
+		discardFailedSnapshot(cfg, vol, newSnap)
+		return res, failedAt("send", fmt.Errorf("replicating snapshot: %w", err))
+	}
+
+	clearFailedSend(vol.SnapDir)
+	res.kind, res.bytesSent = "inc", size
+	if full {
+		res.kind = "full"
+	}
+
+	replicas = append(replicas, remoteBackup{Name: name, Timestamp: currentTime, Kind: "full"})
+	sort.Slice(replicas, func(i, j int) bool {
+		return replicas[i].Timestamp.Before(replicas[j].Timestamp)
+	})
+	if err := removeReplicas(ctx, cfg, vol, backupsToDelete(replicas, cfg.Retention, cfg.KeepFulls)); err != nil {
+		errLog.Printf("Error cleaning up old replicas: %v", err)
+	}
+
+	// The standby only needs the newest snapshot to diff the next one against.
+	pruneLocalSnapshots(ctx, vol.SnapDir, cfg.snapshotPrefix(), cfg.LocalRetention, newSnap)
+
+	if verbose {
+		fmt.Printf(color.GreenString("Finished processing: %s"), vol.Name)
+	}
+	if verbose || dryRun {
+		fmt.Print("\n\n")
+	}
+	return res, nil
+}
+
+// receiveSnapshot pipes btrfs send into btrfs receive on the remote and moves
+// the result into place, returning the size of the stream.
+func receiveSnapshot(ctx context.Context, cfg *Config, vol *Volume, newSnap, parent string, full bool) (int64, error) {
+	dir := replicaDir(cfg, vol)
+	incoming := filepath.Join(dir, replicaIncomingDir)
+	name := filepath.Base(newSnap)
+
+	sendArgs := []string{"send", newSnap}
+	if !full {
+		sendArgs = []string{"send", "-p", parent, newSnap}
+	}
+
+	// Whatever an earlier attempt left half received is cleared first, so a
+	// failed attempt needs no cleanup of its own.
+	receiveCmd := fmt.Sprintf(
+		`mkdir -p %[1]s && for s in %[1]s/*; do if test -e "$s"; then btrfs subvolume delete "$s" >/dev/null || exit 1; fi; done && btrfs receive %[1]s`,
+		shellEscape(incoming),
+	)
+	moveCmd := fmt.Sprintf("mv %s %s", shellEscape(filepath.Join(incoming, name)), shellEscape(filepath.Join(dir, name)))
+
+	if verbose {
+		fmt.Printf("→ [receive] Sending snapshot %s → %s\n", newSnap, remoteTarget(cfg, dir))
+	}
+
+	if dryRun {
+		if veryVerbose {
+			fmt.Printf("[DRY-RUN] %s %s | %s\n", btrfsBin, strings.Join(sendArgs, " "), describeRemoteCommand(cfg, receiveCmd))
+			fmt.Printf("[DRY-RUN] %s\n", describeRemoteCommand(cfg, moveCmd))
+		}
+		return 0, nil
+	}
+
+	sendCmd := exec.CommandContext(ctx, btrfsBin, sendArgs...)
+	sendCmd.Stderr = io.Discard
+	stdout, err := sendCmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+
+	ok := false
+	var counter byteCounter
+	tees := []io.Writer{&counter}
+	var progressWriter *ProgressWriter
+	if progress {
+		estimate, err := estimateSendSize(ctx, newSnap, parent)
+		if err != nil && verbose {
+			fmt.Printf("→ Unable to estimate transfer size: %v\n", err)
+		}
+		kind := "inc"
+		if full {
+			kind = "full"
+		}
+		progressWriter = newTransferProgress(vol.Name, kind)
+		defer func() {
+			if !ok {
+				progressWriter.Abandon()
+			}
+		}()
+		progressWriter.SetTotal(estimate)
+		tees = append(tees, progressWriter)
+	}
+
+	recvCmd := remoteCommand(ctx, cfg, receiveCmd)
+	recvCmd.Stdin = newRateLimitedReader(io.TeeReader(stdout, io.MultiWriter(tees...)), int64(cfg.BWLimit))
+	var stderr bytes.Buffer
+	recvCmd.Stderr = &stderr
+
+	if err := sendCmd.Start(); err != nil {
+		return 0, fmt.Errorf("btrfs send start failed: %w", err)
+	}
+	if err := recvCmd.Run(); err != nil {
+		// Nothing reads the rest of the stream now.
+		_ = sendCmd.Process.Kill()
+		_ = sendCmd.Wait()
+		return 0, fmt.Errorf("btrfs receive failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if err := sendCmd.Wait(); err != nil {
+		return 0, fmt.Errorf("btrfs send failed: %w", err)
+	}
+
+	if progressWriter != nil {
+		progressWriter.Finish()
+	}
+
+	err = runRemoteOp(ctx, cfg, moveCmd, func(cmd *exec.Cmd) error {
+		return cmd.Run()
+	})
+	if err != nil {
+		return 0, fmt.Errorf("moving received snapshot into place: %w", err)
+	}
+	ok = true
+	return int64(counter), nil
+}
+
+// removeReplicas deletes received snapshots of vol from the remote.
+func removeReplicas(ctx context.Context, cfg *Config, vol *Volume, replicas []remoteBackup) error {
+	if len(replicas) == 0 {
+		return nil
+	}
+
+	var paths []string
+	for _, r := range replicas {
+		paths = append(paths, shellEscape(filepath.Join(replicaDir(cfg, vol), r.Name)))
+		if verbose {
+			fmt.Printf("→ Deleting: %s\n", r.Name)
+		}
+	}
+	remoteCmd := "btrfs subvolume delete " + strings.Join(paths, " ")
+
+	if dryRun {
+		if veryVerbose {
+			fmt.Printf("[DRY-RUN] %s\n", describeRemoteCommand(cfg, remoteCmd))
+		}
+		return nil
+	}
+
+	return withRetry(ctx, cfg.Retries, cfg.RetryBackoff, func() error {
+		return runRemoteOp(ctx, cfg, remoteCmd, func(cmd *exec.Cmd) error {
+			return cmd.Run()
+		})
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplicateVolume(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+	logPath := filepath.Join(t.TempDir(), "btrfs.log")
+	t.Setenv("BTRFS_LOG", logPath)
+
+	snapDir := t.TempDir()
+	vol := &Volume{Name: "root", Src: "/@", SnapDir: snapDir}
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Backend:    "ssh",
+		Mode:       "replicate",
+		KeepFulls:  2,
+		Volumes:    []Volume{*vol},
+	}
+
+	var kinds []string
+	for _, hour := range []int{10, 11, 12} {
+		res, err := backupVolume(context.Background(), cfg, vol, time.Date(2024, 1, 1, hour, 0, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatalf("backupVolume at %d:00: %v", hour, err)
+		}
+		kinds = append(kinds, res.kind)
+	}
+	if strings.Join(kinds, " ") != "full inc inc" {
+		t.Errorf("expected a full then incrementals, got %v", kinds)
+	}
+
+	snap := func(hour string) string {
+		return filepath.Join(snapDir, "btrfs-backup-2024-01-01_"+hour+"-00-00")
+	}
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("reading btrfs log: %v", err)
+	}
+	log := string(data)
+	incoming := filepath.Join(remoteDir, "root", replicaIncomingDir)
+	for _, want := range []string{
+		"send " + snap("10") + "\n",
+		"send -p " + snap("10") + " " + snap("11") + "\n",
+		"send -p " + snap("11") + " " + snap("12") + "\n",
+		"receive " + incoming + "\n",
+		"delete " + filepath.Join(remoteDir, "root", "btrfs-backup-2024-01-01_10-00-00") + "\n",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("expected %q in btrfs log:\n%s", want, log)
+		}
+	}
+
+	replicas, err := listReplicas(context.Background(), cfg, vol)
+	if err != nil {
+		t.Fatalf("listReplicas: %v", err)
+	}
+	assertNames(t, replicas, []string{"btrfs-backup-2024-01-01_11-00-00", "btrfs-backup-2024-01-01_12-00-00"})
+	if entries, _ := os.ReadDir(incoming); len(entries) != 1 || entries[0].Name() != "received" {
+		t.Errorf("expected nothing left in %s, got %v", incoming, entries)
+	}
+	if snaps := listSnapshots(snapDir, cfg.snapshotPrefix()); len(snaps) != 1 || snaps[0] != snap("12") {
+		t.Errorf("expected only the newest snapshot kept locally, got %v", snaps)
+	}
+}
+
+func TestReplicateVolumeReceiveFails(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+	t.Setenv("BTRFS_FAIL_RECEIVE", "1")
+
+	vol := &Volume{Name: "root", Src: "/@", SnapDir: t.TempDir()}
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Backend:    "ssh",
+		Mode:       "replicate",
+		Volumes:    []Volume{*vol},
+	}
+
+	_, err := backupVolume(context.Background(), cfg, vol, time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC))
+	var se *stageError
+	if !errors.As(err, &se) || se.stage != "send" {
+		t.Fatalf("expected a send stage error, got %v", err)
+	}
+
+	replicas, err := listReplicas(context.Background(), cfg, vol)
+	if err != nil {
+		t.Fatalf("listReplicas: %v", err)
+	}
+	if len(replicas) != 0 {
+		t.Fatalf("expected no replicas after a failed receive, got %v", replicas)
+	}
+}
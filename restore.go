@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func runRestore(ctx context.Context, cfg *Config, args []string) error {
+	var volumeName, at, dest, identity string
+
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fs.StringVar(&volumeName, "volume", "", "Name of the volume to restore")
+	fs.StringVar(&at, "at", "", "Restore the backup taken at this timestamp (default: latest)")
+	fs.StringVar(&dest, "dest", "", "Directory to receive the restored subvolume into")
+	fs.StringVar(&identity, "identity", "", "age identity file used to decrypt encrypted backups (gpg uses its keyring)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if volumeName == "" || dest == "" {
+		return errors.New("restore requires --volume and --dest")
+	}
+
+	if cfg.Backend == "s3" {
+		return errors.New("restore is not supported with backend s3")
+	}
+
+	vol := findVolume(cfg, volumeName)
+	if vol == nil {
+		return fmt.Errorf("volume %q not found in config", volumeName)
+	}
+
+	target, err := parseAt(at)
+	if err != nil {
+		return err
+	}
+
+	backups, err := listRemoteBackups(ctx, cfg, vol)
+	if err != nil {
+		return err
+	}
+
+	chain, err := restoreChain(backups, target)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(chain[0].Name, ".age") && identity == "" {
+		return errors.New("backups are encrypted, --identity is required")
+	}
+
+	if verbose {
+		fmt.Printf("→ Restoring %s from %d backup(s) into %s\n", vol.Name, len(chain), dest)
+	}
+
+	for _, b := range chain {
+		if err := restoreBackup(ctx, cfg, b, dest, identity); err != nil {
+			return err
+		}
+	}
+
+	if verbose {
+		fmt.Printf("→ Restore of %s complete\n", vol.Name)
+	}
+
+	return nil
+}
+
+// parseAt parses an --at timestamp, returning the zero time for the latest
+// backup when it's empty.
+func parseAt(at string) (time.Time, error) {
+	if at == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.ParseInLocation(snapshotTimestampFormat, at, snapshotLocation)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --at timestamp %q (expected %s): %w", at, snapshotTimestampFormat, err)
+	}
+	return t, nil
+}
+
+func findVolume(cfg *Config, name string) *Volume {
+	for i := range cfg.Volumes {
+		if cfg.Volumes[i].Name == name {
+			return &cfg.Volumes[i]
+		}
+	}
+	return nil
+}
+
+// restoreChain returns the full backup and every incremental after it, up to
+// and including the backup at target. A zero target selects the latest backup.
+func restoreChain(backups []remoteBackup, target time.Time) ([]remoteBackup, error) {
+	if len(backups) == 0 {
+		return nil, errors.New("no remote backups found")
+	}
+
+	end := len(backups) - 1
+	if !target.IsZero() {
+		end = -1
+		for i, b := range backups {
+			if b.Timestamp.Equal(target) {
+				end = i
+				break
+			}
+		}
+		if end == -1 {
+			return nil, fmt.Errorf("no remote backup at %s", target.Format(snapshotTimestampFormat))
+		}
+	}
+
+	start := -1
+	for i := end; i >= 0; i-- {
+		if backups[i].Kind == "full" {
+			start = i
+			break
+		}
+	}
+	if start == -1 {
+		return nil, fmt.Errorf("chain incomplete: no full backup at or before %s", backups[end].Timestamp.Format(snapshotTimestampFormat))
+	}
+
+	return backups[start : end+1], nil
+}
+
+// restoreBackup receives b into dest, checking the stream against its
+// checksum sidecar as it goes rather than reading the backup twice. A received
+// subvolume that turns out not to match is deleted again.
+func restoreBackup(ctx context.Context, cfg *Config, b remoteBackup, dest, identity string) error {
+	if dryRun {
+		return receiveBackup(ctx, cfg, b.Name, dest, identity, nil)
+	}
+
+	expected, algorithm, err := readRemoteChecksum(ctx, cfg, b.Name)
+	if err != nil {
+		return err
+	}
+
+	h := algorithm.newHash()
+	if err := receiveBackup(ctx, cfg, b.Name, dest, identity, h); err != nil {
+		return fmt.Errorf("receiving %s: %w", b.Name, err)
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(actual, expected) {
+		// The subvolume is named after the snapshot that was sent.
+		received := filepath.Join(dest, cfg.snapshotPrefix()+b.Timestamp.Format(snapshotTimestampFormat))
+		mismatch := fmt.Errorf("checksum mismatch for %s: expected=%s received=%s", b.Name, expected, actual)
+		if err := exec.CommandContext(ctx, btrfsBin, "subvolume", "delete", received).Run(); err != nil {
+			return fmt.Errorf("%w; deleting %s failed: %v", mismatch, received, err)
+		}
+		return mismatch
+	}
+
+	if verbose {
+		fmt.Printf("→ Verified %s\n", b.Name)
+	}
+
+	return nil
+}
+
+// receiveBackup streams name from the remote into btrfs receive, decrypting
+// and decompressing on the way. The stream as stored is also written to h
+// when it is set.
+func receiveBackup(ctx context.Context, cfg *Config, name, dest, identity string, h hash.Hash) error {
+	remotePath := shellEscape(filepath.Join(cfg.RemoteDest, name))
+	catRemoteCmd := fmt.Sprintf("cat %s", remotePath)
+	decrypt := decryptArgs(name, identity)
+	decompress := decompressArgs(name)
+
+	if verbose {
+		fmt.Printf("→ Receiving %s into %s\n", name, dest)
+	}
+
+	if dryRun {
+		if veryVerbose {
+			var builder strings.Builder
+			builder.WriteString(describeRemoteCommand(cfg, catRemoteCmd))
+			if decrypt != nil {
+				builder.WriteString(fmt.Sprintf(" | %s", strings.Join(decrypt, " ")))
+			}
+			if decompress != nil {
+				builder.WriteString(fmt.Sprintf(" | %s", strings.Join(decompress, " ")))
+			}
+			builder.WriteString(fmt.Sprintf(" | btrfs receive %s", dest))
+			fmt.Printf("[DRY-RUN] %s\n", builder.String())
+		}
+		return nil
+	}
+
+	catCmd := remoteCommand(ctx, cfg, catRemoteCmd)
+	catCmd.Stderr = os.Stderr
+	stdout, err := catCmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	var stream io.Reader = stdout
+	if h != nil {
+		stream = io.TeeReader(stream, h)
+	}
+	var decryptCmd *exec.Cmd
+	if decrypt != nil {
+		decryptCmd = exec.CommandContext(ctx, decrypt[0], decrypt[1:]...)
+		decryptCmd.Stdin = stream
+		decryptCmd.Stderr = os.Stderr
+		outPipe, err := decryptCmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		stream = outPipe
+	}
+
+	var decompressCmd *exec.Cmd
+	if decompress != nil {
+		decompressCmd = exec.CommandContext(ctx, decompress[0], decompress[1:]...)
+		decompressCmd.Stdin = stream
+		decompressCmd.Stderr = os.Stderr
+		outPipe, err := decompressCmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		stream = outPipe
+	}
+
+	receiveCmd := exec.CommandContext(ctx, btrfsBin, "receive", dest)
+	receiveCmd.Stdin = stream
+	receiveCmd.Stdout = io.Discard
+	receiveCmd.Stderr = os.Stderr
+
+	if err := catCmd.Start(); err != nil {
+		return fmt.Errorf("ssh start failed: %w", err)
+	}
+	if decryptCmd != nil {
+		if err := decryptCmd.Start(); err != nil {
+			_ = catCmd.Process.Kill()
+			_ = catCmd.Wait()
+			return fmt.Errorf("%s start failed: %w", decrypt[0], err)
+		}
+	}
+	if decompressCmd != nil {
+		if err := decompressCmd.Start(); err != nil {
+			_ = catCmd.Process.Kill()
+			_ = catCmd.Wait()
+			if decryptCmd != nil {
+				_ = decryptCmd.Wait()
+			}
+			return fmt.Errorf("%s start failed: %w", decompress[0], err)
+		}
+	}
+	if err := receiveCmd.Start(); err != nil {
+		_ = catCmd.Wait()
+		if decryptCmd != nil {
+			_ = decryptCmd.Wait()
+		}
+		if decompressCmd != nil {
+			_ = decompressCmd.Wait()
+		}
+		return fmt.Errorf("btrfs receive start failed: %w", err)
+	}
+
+	receiveErr := receiveCmd.Wait()
+	if receiveErr != nil {
+		// Nothing is reading the stream any more, so stop the producers
+		// rather than leaving them blocked on a full pipe.
+		_ = catCmd.Process.Kill()
+		if decryptCmd != nil {
+			_ = decryptCmd.Process.Kill()
+		}
+		if decompressCmd != nil {
+			_ = decompressCmd.Process.Kill()
+		}
+		if decompressCmd != nil {
+			_ = decompressCmd.Wait()
+		}
+		if decryptCmd != nil {
+			_ = decryptCmd.Wait()
+		}
+		_ = catCmd.Wait()
+		return fmt.Errorf("btrfs receive failed: %w", receiveErr)
+	}
+
+	// Downstream first: with h set, the next command reads ssh's output
+	// through a copy that must finish before catCmd.Wait closes the pipe.
+	var decryptErr, decompressErr error
+	if decompressCmd != nil {
+		decompressErr = decompressCmd.Wait()
+	}
+	if decryptCmd != nil {
+		decryptErr = decryptCmd.Wait()
+	}
+	catErr := catCmd.Wait()
+
+	if catErr != nil {
+		return fmt.Errorf("ssh failed: %w", catErr)
+	}
+	if decryptErr != nil {
+		return fmt.Errorf("%s failed: %w", decrypt[0], decryptErr)
+	}
+	if decompressErr != nil {
+		return fmt.Errorf("%s failed: %w", decompress[0], decompressErr)
+	}
+
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeRemoteBackup(t *testing.T, remoteDir, name, payload string, withChecksum bool) {
+	t.Helper()
+
+	path := filepath.Join(remoteDir, name)
+	if err := os.WriteFile(path, []byte(payload), 0o644); err != nil {
+		t.Fatalf("writing remote backup: %v", err)
+	}
+
+	if !withChecksum {
+		return
+	}
+
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(payload)))
+	if err := os.WriteFile(path+".sha256", []byte(fmt.Sprintf("%s  %s\n", sum, name)), 0o644); err != nil {
+		t.Fatalf("writing remote checksum: %v", err)
+	}
+}
+
+func TestRestoreChain(t *testing.T) {
+	t.Parallel()
+
+	backups := makeBackups(t,
+		"vol-2024-05-10_10-00-00.full.btrfs",
+		"vol-2024-05-11_10-00-00.inc.btrfs",
+		"vol-2024-05-12_10-00-00.inc.btrfs",
+		"vol-2024-05-13_10-00-00.full.btrfs",
+		"vol-2024-05-14_10-00-00.inc.btrfs",
+	)
+
+	t.Run("latest", func(t *testing.T) {
+		chain, err := restoreChain(backups, time.Time{})
+		if err != nil {
+			t.Fatalf("restoreChain: %v", err)
+		}
+		assertNames(t, chain, []string{
+			"vol-2024-05-13_10-00-00.full.btrfs",
+			"vol-2024-05-14_10-00-00.inc.btrfs",
+		})
+	})
+
+	t.Run("at incremental", func(t *testing.T) {
+		chain, err := restoreChain(backups, time.Date(2024, 5, 12, 10, 0, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatalf("restoreChain: %v", err)
+		}
+		assertNames(t, chain, []string{
+			"vol-2024-05-10_10-00-00.full.btrfs",
+			"vol-2024-05-11_10-00-00.inc.btrfs",
+			"vol-2024-05-12_10-00-00.inc.btrfs",
+		})
+	})
+
+	t.Run("unknown timestamp", func(t *testing.T) {
+		if _, err := restoreChain(backups, time.Date(2024, 5, 12, 11, 0, 0, 0, time.UTC)); err == nil {
+			t.Fatal("expected error for unknown timestamp")
+		}
+	})
+
+	t.Run("no full", func(t *testing.T) {
+		orphans := makeBackups(t, "vol-2024-05-11_10-00-00.inc.btrfs")
+		if _, err := restoreChain(orphans, time.Time{}); err == nil {
+			t.Fatal("expected error for chain without full")
+		}
+	})
+}
+
+func TestRunRestore(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	btrfsLog := filepath.Join(t.TempDir(), "btrfs.log")
+	t.Setenv("BTRFS_LOG", btrfsLog)
+
+	writeRemoteBackup(t, remoteDir, "home-2024-05-10_10-00-00.full.btrfs", "full;", true)
+	writeRemoteBackup(t, remoteDir, "home-2024-05-11_10-00-00.inc.btrfs", "inc1;", true)
+	writeRemoteBackup(t, remoteDir, "home-2024-05-12_10-00-00.inc.btrfs", "inc2;", true)
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Volumes:    []Volume{{Name: "home"}},
+	}
+
+	dest := t.TempDir()
+	args := []string{"--volume", "home", "--at", "2024-05-11_10-00-00", "--dest", dest}
+	if err := runRestore(context.Background(), cfg, args); err != nil {
+		t.Fatalf("runRestore: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dest, "received"))
+	if err != nil {
+		t.Fatalf("reading received stream: %v", err)
+	}
+	if string(data) != "full;inc1;" {
+		t.Fatalf("unexpected received stream: %q", string(data))
+	}
+
+	logData, err := os.ReadFile(btrfsLog)
+	if err != nil {
+		t.Fatalf("reading btrfs log: %v", err)
+	}
+	if strings.Count(string(logData), fmt.Sprintf("receive %s\n", dest)) != 2 {
+		t.Fatalf("expected two receive invocations, got %q", string(logData))
+	}
+}
+
+func TestRunRestoreEncrypted(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	ageLog := filepath.Join(t.TempDir(), "age.log")
+	t.Setenv("AGE_LOG", ageLog)
+
+	writeRemoteBackup(t, remoteDir, "home-2024-05-10_10-00-00.full.btrfs.age", "full;", true)
+
+	cfg := &Config{
+		RemoteHost:    "remote",
+		RemoteDest:    remoteDir,
+		EncryptionKey: "age-recipient",
+		Volumes:       []Volume{{Name: "home"}},
+	}
+
+	dest := t.TempDir()
+	if err := runRestore(context.Background(), cfg, []string{"--volume", "home", "--dest", dest}); err == nil {
+		t.Fatal("expected error without --identity")
+	}
+
+	args := []string{"--volume", "home", "--dest", dest, "--identity", "/keys/backup.txt"}
+	if err := runRestore(context.Background(), cfg, args); err != nil {
+		t.Fatalf("runRestore: %v", err)
+	}
+
+	logData, err := os.ReadFile(ageLog)
+	if err != nil {
+		t.Fatalf("reading age log: %v", err)
+	}
+	if !strings.Contains(string(logData), "-d -i /keys/backup.txt") {
+		t.Fatalf("expected age decrypt with identity, got %q", string(logData))
+	}
+}
+
+func TestRunRestoreCompressed(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	compressLog := filepath.Join(t.TempDir(), "compress.log")
+	t.Setenv("COMPRESS_LOG", compressLog)
+
+	writeRemoteBackup(t, remoteDir, "home-2024-05-10_10-00-00.full.btrfs.zst", "zstd:full;", true)
+	writeRemoteBackup(t, remoteDir, "home-2024-05-11_10-00-00.inc.btrfs.gz", "gzip:inc;", true)
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Volumes:    []Volume{{Name: "home"}},
+	}
+
+	dest := t.TempDir()
+	if err := runRestore(context.Background(), cfg, []string{"--volume", "home", "--dest", dest}); err != nil {
+		t.Fatalf("runRestore: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dest, "received"))
+	if err != nil {
+		t.Fatalf("reading received stream: %v", err)
+	}
+	if string(data) != "full;inc;" {
+		t.Fatalf("unexpected received stream: %q", string(data))
+	}
+
+	logData, err := os.ReadFile(compressLog)
+	if err != nil {
+		t.Fatalf("reading compress log: %v", err)
+	}
+	if !strings.Contains(string(logData), "zstd -d") || !strings.Contains(string(logData), "gzip -d") {
+		t.Fatalf("expected both decompressors to run, got %q", string(logData))
+	}
+}
+
+func TestRunRestoreGPG(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	gpgLog := filepath.Join(t.TempDir(), "gpg.log")
+	t.Setenv("GPG_LOG", gpgLog)
+
+	writeRemoteBackup(t, remoteDir, "home-2024-05-10_10-00-00.full.btrfs.gz.gpg", "gpg:gzip:full;", true)
+
+	cfg := &Config{
+		RemoteHost:        "remote",
+		RemoteDest:        remoteDir,
+		EncryptionKey:     "ops@example.com",
+		EncryptionBackend: "gpg",
+		Volumes:           []Volume{{Name: "home"}},
+	}
+
+	dest := t.TempDir()
+	if err := runRestore(context.Background(), cfg, []string{"--volume", "home", "--dest", dest}); err != nil {
+		t.Fatalf("runRestore: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dest, "received"))
+	if err != nil {
+		t.Fatalf("reading received stream: %v", err)
+	}
+	if string(data) != "full;" {
+		t.Fatalf("unexpected received stream: %q", string(data))
+	}
+
+	logData, err := os.ReadFile(gpgLog)
+	if err != nil {
+		t.Fatalf("reading gpg log: %v", err)
+	}
+	if !strings.Contains(string(logData), "--decrypt") {
+		t.Fatalf("expected gpg decrypt, got %q", string(logData))
+	}
+}
+
+func TestRunRestoreChecksumMismatch(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	btrfsLog := filepath.Join(t.TempDir(), "btrfs.log")
+	t.Setenv("BTRFS_LOG", btrfsLog)
+
+	name := "home-2024-05-10_10-00-00.full.btrfs"
+	writeRemoteBackup(t, remoteDir, name, "full;", true)
+	if err := os.WriteFile(filepath.Join(remoteDir, name), []byte("corrupt"), 0o644); err != nil {
+		t.Fatalf("corrupting backup: %v", err)
+	}
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+		Volumes:    []Volume{{Name: "home"}},
+	}
+
+	dest := t.TempDir()
+	err := runRestore(context.Background(), cfg, []string{"--volume", "home", "--dest", dest})
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch error, got %v", err)
+	}
+
+	// The stream is checked as it is received, so the bad subvolume has to
+	// be deleted again.
+	logData, err := os.ReadFile(btrfsLog)
+	if err != nil {
+		t.Fatalf("reading btrfs log: %v", err)
+	}
+	want := fmt.Sprintf("receive %s\ndelete %s\n", dest, filepath.Join(dest, "btrfs-backup-2024-05-10_10-00-00"))
+	if string(logData) != want {
+		t.Fatalf("expected the received subvolume to be deleted, got %q", string(logData))
+	}
+}
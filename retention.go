@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// backupsToDelete returns the backups that fall outside the retention policy.
+// Backups must be sorted oldest first. The newest keepFulls full chains are
+// always kept, and with no retention configured nothing else is.
+func backupsToDelete(backups []remoteBackup, retention *Retention, keepFulls int) []remoteBackup {
+	var fulls []remoteBackup
+	for _, b := range backups {
+		if b.Kind == "full" {
+			fulls = append(fulls, b)
+		}
+	}
+
+	if len(fulls) == 0 {
+		return nil
+	}
+	keepFulls = max(keepFulls, 1)
+
+	if retention == nil {
+		// Asking for more fulls than exist keeps everything from the oldest.
+		oldestKept := fulls[max(len(fulls)-keepFulls, 0)]
+
+		var toDelete []remoteBackup
+		for _, b := range backups {
+			if b.Timestamp.Before(oldestKept.Timestamp) {
+				toDelete = append(toDelete, b)
+			}
+		}
+		return toDelete
+	}
+
+	keep := retainedFulls(fulls, retention, keepFulls)
+
+	// Walk the backups in order, tracking which full each incremental
+	// belongs to, so a chain is only ever removed as a whole.
+	var toDelete []remoteBackup
+	var parent *remoteBackup
+	for i, b := range backups {
+		if b.Kind == "full" {
+			parent = &backups[i]
+		}
+		if parent == nil {
+			continue
+		}
+		if !keep[parent.Name] {
+			toDelete = append(toDelete, b)
+		}
+	}
+
+	return toDelete
+}
+
+// budgetEvictions picks the oldest chains of backups to delete until the rest
+// add up to no more than budget bytes. Incrementals left over from a deleted
+// full go first, and the newest chain is never evicted; fits reports whether
+// what's left is within budget.
+func budgetEvictions(backups []remoteBackup, budget int64) (evict []remoteBackup, fits bool) {
+	var chains [][]remoteBackup
+	var total int64
+	for _, b := range backups {
+		if b.Kind == "full" || len(chains) == 0 {
+			chains = append(chains, nil)
+		}
+		chains[len(chains)-1] = append(chains[len(chains)-1], b)
+		total += b.Size
+	}
+
+	for _, chain := range chains[:max(len(chains)-1, 0)] {
+		if total <= budget {
+			break
+		}
+		for _, b := range chain {
+			total -= b.Size
+		}
+		evict = append(evict, chain...)
+	}
+
+	return evict, total <= budget
+}
+
+// retainedFulls buckets fulls by day, ISO week and month and keeps the newest
+// full in each of the most recent buckets. The latest keepFulls fulls are
+// always kept.
+func retainedFulls(fulls []remoteBackup, retention *Retention, keepFulls int) map[string]bool {
+	keep := map[string]bool{}
+	for _, b := range fulls[max(len(fulls)-keepFulls, 0):] {
+		keep[b.Name] = true
+	}
+
+	buckets := []struct {
+		limit int
+		key   func(time.Time) string
+	}{
+		{retention.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{retention.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{retention.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+
+	for _, bucket := range buckets {
+		if bucket.limit <= 0 {
+			continue
+		}
+
+		seen := map[string]bool{}
+		for i := len(fulls) - 1; i >= 0 && len(seen) < bucket.limit; i-- {
+			key := bucket.key(fulls[i].Timestamp)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			keep[fulls[i].Name] = true
+		}
+	}
+
+	return keep
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeBackups(t *testing.T, names ...string) []remoteBackup {
+	t.Helper()
+
+	var backups []remoteBackup
+	for _, name := range names {
+		match := snapshotTimestampRegexp.FindStringSubmatch(name)
+		if len(match) < 2 {
+			t.Fatalf("no timestamp in %q", name)
+		}
+		ts, err := time.Parse(snapshotTimestampFormat, match[1])
+		if err != nil {
+			t.Fatalf("parsing timestamp in %q: %v", name, err)
+		}
+		kind := "inc"
+		if strings.Contains(name, ".full.") {
+			kind = "full"
+		}
+		backups = append(backups, remoteBackup{Name: name, Timestamp: ts, Kind: kind})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Timestamp.Before(backups[j].Timestamp)
+	})
+
+	return backups
+}
+
+func backupNames(backups []remoteBackup) []string {
+	names := []string{}
+	for _, b := range backups {
+		names = append(names, b.Name)
+	}
+	return names
+}
+
+func assertNames(t *testing.T, got []remoteBackup, want []string) {
+	t.Helper()
+
+	names := backupNames(got)
+	if len(names) != len(want) {
+		t.Fatalf("expected %d backups %v, got %d: %v", len(want), want, len(names), names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("backup[%d] = %q, want %q", i, names[i], want[i])
+		}
+	}
+}
+
+func TestBackupsToDeleteWithoutRetention(t *testing.T) {
+	t.Parallel()
+
+	backups := makeBackups(t,
+		"vol-2024-01-01_10-00-00.full.btrfs",
+		"vol-2024-01-02_10-00-00.inc.btrfs",
+		"vol-2024-01-03_10-00-00.full.btrfs",
+		"vol-2024-01-04_10-00-00.inc.btrfs",
+	)
+
+	assertNames(t, backupsToDelete(backups, nil, 1), []string{
+		"vol-2024-01-01_10-00-00.full.btrfs",
+		"vol-2024-01-02_10-00-00.inc.btrfs",
+	})
+}
+
+func TestBackupsToDeleteKeepFulls(t *testing.T) {
+	t.Parallel()
+
+	backups := makeBackups(t,
+		"vol-2024-01-01_10-00-00.full.btrfs",
+		"vol-2024-01-02_10-00-00.inc.btrfs",
+		"vol-2024-01-03_10-00-00.full.btrfs",
+		"vol-2024-01-04_10-00-00.inc.btrfs",
+		"vol-2024-01-05_10-00-00.inc.btrfs",
+		"vol-2024-01-06_10-00-00.full.btrfs",
+		"vol-2024-01-07_10-00-00.inc.btrfs",
+	)
+
+	t.Run("two of three", func(t *testing.T) {
+		assertNames(t, backupsToDelete(backups, nil, 2), []string{
+			"vol-2024-01-01_10-00-00.full.btrfs",
+			"vol-2024-01-02_10-00-00.inc.btrfs",
+		})
+	})
+
+	t.Run("more than exist", func(t *testing.T) {
+		assertNames(t, backupsToDelete(backups, nil, 5), nil)
+	})
+
+	t.Run("zero behaves like one", func(t *testing.T) {
+		assertNames(t, backupsToDelete(backups, nil, 0), []string{
+			"vol-2024-01-01_10-00-00.full.btrfs",
+			"vol-2024-01-02_10-00-00.inc.btrfs",
+			"vol-2024-01-03_10-00-00.full.btrfs",
+			"vol-2024-01-04_10-00-00.inc.btrfs",
+			"vol-2024-01-05_10-00-00.inc.btrfs",
+		})
+	})
+
+	t.Run("floor under retention policy", func(t *testing.T) {
+		// KeepMonthly alone would keep just the latest full.
+		assertNames(t, backupsToDelete(backups, &Retention{KeepMonthly: 1}, 2), []string{
+			"vol-2024-01-01_10-00-00.full.btrfs",
+			"vol-2024-01-02_10-00-00.inc.btrfs",
+		})
+	})
+}
+
+func TestBackupsToDeleteGFS(t *testing.T) {
+	t.Parallel()
+
+	backups := makeBackups(t,
+		"vol-2024-01-15_10-00-00.full.btrfs",
+		"vol-2024-01-16_10-00-00.inc.btrfs",
+		"vol-2024-02-05_10-00-00.full.btrfs",
+		"vol-2024-02-06_10-00-00.inc.btrfs",
+		"vol-2024-02-20_10-00-00.full.btrfs",
+		"vol-2024-02-26_10-00-00.full.btrfs",
+		"vol-2024-02-27_10-00-00.full.btrfs",
+		"vol-2024-02-27_11-00-00.inc.btrfs",
+		"vol-2024-02-28_10-00-00.full.btrfs",
+		"vol-2024-02-28_11-00-00.inc.btrfs",
+	)
+
+	t.Run("daily only", func(t *testing.T) {
+		got := backupsToDelete(backups, &Retention{KeepDaily: 2}, 1)
+		assertNames(t, got, []string{
+			"vol-2024-01-15_10-00-00.full.btrfs",
+			"vol-2024-01-16_10-00-00.inc.btrfs",
+			"vol-2024-02-05_10-00-00.full.btrfs",
+			"vol-2024-02-06_10-00-00.inc.btrfs",
+			"vol-2024-02-20_10-00-00.full.btrfs",
+			"vol-2024-02-26_10-00-00.full.btrfs",
+		})
+	})
+
+	t.Run("daily weekly monthly", func(t *testing.T) {
+		got := backupsToDelete(backups, &Retention{KeepDaily: 1, KeepWeekly: 2, KeepMonthly: 2}, 1)
+		// Weekly keeps 02-28 (W09) and 02-20 (W08); monthly keeps 02-28
+		// and 01-15 (January). Only the 02-05 chain and 02-26/02-27
+		// fulls (and 02-27's incremental) fall outside every bucket.
+		assertNames(t, got, []string{
+			"vol-2024-02-05_10-00-00.full.btrfs",
+			"vol-2024-02-06_10-00-00.inc.btrfs",
+			"vol-2024-02-26_10-00-00.full.btrfs",
+			"vol-2024-02-27_10-00-00.full.btrfs",
+			"vol-2024-02-27_11-00-00.inc.btrfs",
+		})
+	})
+
+	t.Run("zero limits keep only latest chain", func(t *testing.T) {
+		got := backupsToDelete(backups, &Retention{}, 1)
+		if len(got) != len(backups)-2 {
+			t.Fatalf("expected all but the latest chain deleted, got %v", backupNames(got))
+		}
+	})
+}
+
+func TestBackupsToDeleteNeverSplitsChains(t *testing.T) {
+	t.Parallel()
+
+	backups := makeBackups(t,
+		"vol-2024-01-01_09-00-00.inc.btrfs",
+		"vol-2024-01-01_10-00-00.full.btrfs",
+		"vol-2024-01-01_11-00-00.inc.btrfs",
+		"vol-2024-01-01_12-00-00.inc.btrfs",
+		"vol-2024-01-02_10-00-00.full.btrfs",
+		"vol-2024-01-02_11-00-00.inc.btrfs",
+	)
+
+	got := backupsToDelete(backups, &Retention{KeepDaily: 2}, 1)
+	if len(got) != 0 {
+		t.Fatalf("expected nothing deleted, got %v", backupNames(got))
+	}
+
+	got = backupsToDelete(backups, &Retention{KeepDaily: 1}, 1)
+	// The orphaned incremental before the first full has no parent to
+	// remove it with, so it is left in place.
+	assertNames(t, got, []string{
+		"vol-2024-01-01_10-00-00.full.btrfs",
+		"vol-2024-01-01_11-00-00.inc.btrfs",
+		"vol-2024-01-01_12-00-00.inc.btrfs",
+	})
+}
+
+func TestBudgetEvictions(t *testing.T) {
+	t.Parallel()
+
+	at := func(day int) time.Time { return time.Date(2024, 1, day, 10, 0, 0, 0, time.UTC) }
+	backups := []remoteBackup{
+		// Left over from a full that is already gone.
+		{Name: "orphan", Timestamp: at(1), Kind: "inc", Size: 10},
+		{Name: "full1", Timestamp: at(2), Kind: "full", Size: 100},
+		{Name: "inc1", Timestamp: at(3), Kind: "inc", Size: 20},
+		{Name: "full2", Timestamp: at(4), Kind: "full", Size: 100},
+		{Name: "inc2", Timestamp: at(5), Kind: "inc", Size: 20},
+	}
+
+	tests := []struct {
+		name   string
+		budget int64
+		evict  []string
+		fits   bool
+	}{
+		{"within budget", 250, nil, true},
+		{"orphans go first", 240, []string{"orphan"}, true},
+		{"whole chains", 200, []string{"orphan", "full1", "inc1"}, true},
+		{"newest chain kept", 100, []string{"orphan", "full1", "inc1"}, false},
+	}
+
+	for _, tt := range tests {
+		evict, fits := budgetEvictions(backups, tt.budget)
+		if !slices.Equal(backupNames(evict), tt.evict) || fits != tt.fits {
+			t.Errorf("%s: expected %v (fits=%v), got %v (fits=%v)", tt.name, tt.evict, tt.fits, backupNames(evict), fits)
+		}
+	}
+}
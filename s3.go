@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	s3DefaultPartSize = 64 << 20
+	s3MinPartSize     = 5 << 20
+	// Objects larger than this can't be copied in a single request.
+	s3MaxCopySize = 5 << 30
+)
+
+// s3Backend stores backups in an S3-compatible bucket using path-style
+// requests signed with AWS Signature Version 4.
+type s3Backend struct {
+	client    *http.Client
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	prefix    string
+	accessKey string
+	secretKey string
+	partSize  int64
+	checksum  checksumAlgorithm
+
+	mu sync.Mutex
+	// checksums remembers what Write computed so Rename can store it as
+	// object metadata on the final object.
+	checksums map[string]string
+}
+
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3 request failed with status %d", e.Status)
+	}
+	return fmt.Sprintf("s3 request failed with status %d: %s: %s", e.Status, e.Code, e.Message)
+}
+
+func newS3Backend(c *S3Config) (*s3Backend, error) {
+	if c.Bucket == "" {
+		return nil, errors.New("s3 bucket is required")
+	}
+
+	region := c.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", endpoint)
+	}
+
+	accessKey := c.AccessKey
+	if accessKey == "" {
+		accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	secretKey := c.SecretKey
+	if secretKey == "" {
+		secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("s3 credentials missing (set access_key/secret_key or AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY)")
+	}
+
+	partSize := int64(c.PartSizeMB) << 20
+	if partSize == 0 {
+		partSize = s3DefaultPartSize
+	}
+	if partSize < s3MinPartSize {
+		return nil, fmt.Errorf("s3 part_size_mb must be at least %d", s3MinPartSize>>20)
+	}
+
+	return &s3Backend{
+		client:    &http.Client{},
+		endpoint:  u,
+		bucket:    c.Bucket,
+		region:    region,
+		prefix:    strings.Trim(c.Prefix, "/"),
+		accessKey: accessKey,
+		secretKey: secretKey,
+		partSize:  partSize,
+		checksum:  checksumAlgorithms[0],
+		checksums: map[string]string{},
+	}, nil
+}
+
+func (b *s3Backend) key(name string) string {
+	if b.prefix == "" {
+		return name
+	}
+	return b.prefix + "/" + name
+}
+
+func (b *s3Backend) objectURL(key string) string {
+	return fmt.Sprintf("s3://%s/%s", b.bucket, key)
+}
+
+func (b *s3Backend) Describe(op string, names ...string) string {
+	switch op {
+	case "write":
+		return fmt.Sprintf("s3 put %s", b.objectURL(b.key(names[0])))
+	case "rename":
+		return fmt.Sprintf("s3 copy %s %s && s3 delete %s", b.objectURL(b.key(names[0])), b.objectURL(b.key(names[1])), b.objectURL(b.key(names[0])))
+	case "remove":
+		var urls []string
+		for _, name := range names {
+			urls = append(urls, b.objectURL(b.key(name)))
+		}
+		return fmt.Sprintf("s3 delete %s", strings.Join(urls, " "))
+	}
+	return fmt.Sprintf("s3 %s %s", op, strings.Join(names, " "))
+}
+
+// do sends a signed request for key (the bucket itself when key is empty) and
+// returns an *s3Error for non-2xx responses.
+func (b *s3Backend) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *b.endpoint
+	u.Path = "/" + b.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	sum := sha256.Sum256(body)
+	signS3Request(req, hex.EncodeToString(sum[:]), b.accessKey, b.secretKey, b.region, time.Now())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		s3err := &s3Error{Status: resp.StatusCode}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		_ = xml.Unmarshal(data, s3err)
+		return nil, s3err
+	}
+
+	return resp, nil
+}
+
+func (b *s3Backend) doXML(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte, out any) error {
+	resp, err := b.do(ctx, method, key, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return xml.NewDecoder(resp.Body).Decode(out)
+}
+
+func (b *s3Backend) Check(ctx context.Context) error {
+	if err := b.doXML(ctx, http.MethodHead, "", nil, nil, nil, nil); err != nil {
+		return fmt.Errorf("failed to access s3 bucket %s: %w (check endpoint and credentials)", b.bucket, err)
+	}
+
+	if verbose {
+		fmt.Printf("→ S3 bucket %s is accessible\n", b.bucket)
+	}
+
+	return nil
+}
+
+func (b *s3Backend) Write(ctx context.Context, name string, r io.Reader) (string, error) {
+	hasher := b.checksum.newHash()
+	r = io.TeeReader(r, hasher)
+	key := b.key(name)
+
+	buf := make([]byte, b.partSize)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("reading stream: %w", err)
+	}
+
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		// Everything fits in one part, so skip the multipart dance.
+		if err := b.doXML(ctx, http.MethodPut, key, nil, nil, buf[:n], nil); err != nil {
+			return "", fmt.Errorf("s3 upload failed: %w", err)
+		}
+	} else if err := b.multipartUpload(ctx, key, r, buf, n); err != nil {
+		return "", fmt.Errorf("s3 upload failed: %w", err)
+	}
+
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+
+	b.mu.Lock()
+	b.checksums[name] = checksum
+	b.mu.Unlock()
+
+	return checksum, nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+func (b *s3Backend) createMultipartUpload(ctx context.Context, key string, header http.Header) (string, error) {
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := b.doXML(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil, &result); err != nil {
+		return "", err
+	}
+	return result.UploadID, nil
+}
+
+func (b *s3Backend) completeMultipartUpload(ctx context.Context, key, uploadID string, parts []s3CompletedPart) error {
+	body, err := xml.Marshal(s3CompleteMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Content-Type": {"application/xml"}}
+	return b.doXML(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, header, body, nil)
+}
+
+func (b *s3Backend) abortMultipartUpload(key, uploadID string) {
+	// Use a fresh context so an interrupted run still cleans up.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := b.doXML(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil, nil); err != nil {
+		errLog.Printf("Error aborting s3 multipart upload: %v", err)
+	}
+}
+
+// multipartUpload uploads buf[:n] as the first part, then the rest of r.
+func (b *s3Backend) multipartUpload(ctx context.Context, key string, r io.Reader, buf []byte, n int) (err error) {
+	uploadID, err := b.createMultipartUpload(ctx, key, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			b.abortMultipartUpload(key, uploadID)
+		}
+	}()
+
+	var parts []s3CompletedPart
+	for partNumber := 1; n > 0; partNumber++ {
+		query := url.Values{
+			"partNumber": {strconv.Itoa(partNumber)},
+			"uploadId":   {uploadID},
+		}
+		resp, err := b.do(ctx, http.MethodPut, key, query, nil, buf[:n])
+		if err != nil {
+			return fmt.Errorf("uploading part %d: %w", partNumber, err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		parts = append(parts, s3CompletedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return fmt.Errorf("reading stream: %w", err)
+		}
+	}
+
+	return b.completeMultipartUpload(ctx, key, uploadID, parts)
+}
+
+func (b *s3Backend) Exists(ctx context.Context, name string) (bool, error) {
+	err := b.doXML(ctx, http.MethodHead, b.key(name), nil, nil, nil, nil)
+	var s3err *s3Error
+	if errors.As(err, &s3err) && s3err.Status == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *s3Backend) List(ctx context.Context, prefix string) ([]string, error) {
+	keyPrefix := b.key(prefix)
+
+	var names []string
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {keyPrefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := b.doXML(ctx, http.MethodGet, "", query, nil, nil, &result); err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			name := c.Key
+			if b.prefix != "" {
+				name = strings.TrimPrefix(name, b.prefix+"/")
+			}
+			names = append(names, name)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	return names, nil
+}
+
+func (b *s3Backend) Remove(ctx context.Context, names ...string) error {
+	var errs []error
+	for _, name := range names {
+		err := b.doXML(ctx, http.MethodDelete, b.key(name), nil, nil, nil, nil)
+		var s3err *s3Error
+		if err != nil && !(errors.As(err, &s3err) && s3err.Status == http.StatusNotFound) {
+			errs = append(errs, fmt.Errorf("deleting %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Rename copies tmp to final, storing the checksum from Write as metadata, and
+// deletes tmp. S3 has no rename, and copies above 5GiB need a multipart copy.
+func (b *s3Backend) Rename(ctx context.Context, tmp, final string) error {
+	srcKey := b.key(tmp)
+	dstKey := b.key(final)
+
+	resp, err := b.do(ctx, http.MethodHead, srcKey, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("stat of %s failed: %w", tmp, err)
+	}
+	resp.Body.Close()
+	size := resp.ContentLength
+
+	header := http.Header{}
+	b.mu.Lock()
+	if checksum, ok := b.checksums[tmp]; ok {
+		header.Set("X-Amz-Meta-"+b.checksum.name, checksum)
+		delete(b.checksums, tmp)
+	}
+	b.mu.Unlock()
+
+	copySource := s3EscapePath("/" + b.bucket + "/" + srcKey)
+
+	if size <= s3MaxCopySize {
+		header.Set("X-Amz-Copy-Source", copySource)
+		header.Set("X-Amz-Metadata-Directive", "REPLACE")
+		if err := b.doXML(ctx, http.MethodPut, dstKey, nil, header, nil, nil); err != nil {
+			return fmt.Errorf("copying %s to %s: %w", tmp, final, err)
+		}
+	} else if err := b.multipartCopy(ctx, copySource, dstKey, size, header); err != nil {
+		return fmt.Errorf("copying %s to %s: %w", tmp, final, err)
+	}
+
+	return b.Remove(ctx, tmp)
+}
+
+func (b *s3Backend) multipartCopy(ctx context.Context, copySource, dstKey string, size int64, header http.Header) (err error) {
+	uploadID, err := b.createMultipartUpload(ctx, dstKey, header)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			b.abortMultipartUpload(dstKey, uploadID)
+		}
+	}()
+
+	var parts []s3CompletedPart
+	for offset, partNumber := int64(0), 1; offset < size; offset, partNumber = offset+s3MaxCopySize, partNumber+1 {
+		end := min(offset+s3MaxCopySize, size) - 1
+		query := url.Values{
+			"partNumber": {strconv.Itoa(partNumber)},
+			"uploadId":   {uploadID},
+		}
+		partHeader := http.Header{
+			"X-Amz-Copy-Source":       {copySource},
+			"X-Amz-Copy-Source-Range": {fmt.Sprintf("bytes=%d-%d", offset, end)},
+		}
+
+		var result struct {
+			ETag string `xml:"ETag"`
+		}
+		if err := b.doXML(ctx, http.MethodPut, dstKey, query, partHeader, nil, &result); err != nil {
+			return fmt.Errorf("copying part %d: %w", partNumber, err)
+		}
+		parts = append(parts, s3CompletedPart{PartNumber: partNumber, ETag: result.ETag})
+	}
+
+	return b.completeMultipartUpload(ctx, dstKey, uploadID, parts)
+}
+
+// s3EscapePath percent-encodes each segment of p as SigV4 expects.
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = s3Escape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signS3Request adds AWS Signature Version 4 headers to req, signing every
+// header already set on it plus host.
+func signS3Request(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalURI := req.URL.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, region)
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(hashedRequest[:]),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+secretKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature,
+	))
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// sdNotify sends state to systemd's notification socket, e.g. "READY=1" or
+// "STATUS=...". It does nothing when not started by systemd with Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// A leading @ names a socket in the abstract namespace.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdStatus updates the status line shown by systemctl status. Failures are
+// ignored; the backup shouldn't care whether anyone is listening.
+func sdStatus(status string) {
+	_ = sdNotify("STATUS=" + status)
+}
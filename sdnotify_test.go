@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func listenNotifySocket(t *testing.T) *net.UnixConn {
+	// t.TempDir can exceed the sun_path limit, so use a short directory.
+	dir, err := os.MkdirTemp("", "sd")
+	if err != nil {
+		t.Fatalf("creating socket dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("listening on notify socket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", socket)
+
+	return conn
+}
+
+func TestSdNotify(t *testing.T) {
+	conn := listenNotifySocket(t)
+
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("sdNotify: %v", err)
+	}
+	sdStatus("Processing volume root (0/1 done, 0%)")
+
+	buf := make([]byte, 256)
+	for _, want := range []string{"READY=1", "STATUS=Processing volume root (0/1 done, 0%)"} {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("reading notification: %v", err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+	}
+}
+
+func TestSdNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("expected no error outside systemd, got %v", err)
+	}
+}
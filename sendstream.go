@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// errNoChanges is returned by sendSnapshot when an incremental has nothing in
+// it worth uploading.
+var errNoChanges = errors.New("no changes since the parent snapshot")
+
+const (
+	sendStreamMagic     = "btrfs-stream\x00"
+	sendStreamHeaderLen = len(sendStreamMagic) + 4 // magic, u32 version
+	sendCmdHeaderLen    = 10                       // u32 length, u16 command, u32 crc
+
+	sendAttrHeaderLen = 4 // u16 type, u16 length
+
+	sendCmdSubvol       = 1
+	sendCmdSnapshot     = 2
+	sendCmdEnd          = 21
+	sendCmdUpdateExtent = 22
+
+	sendAttrSize = 4
+)
+
+// sendStreamInspector watches a btrfs send stream go by, counting its bytes
+// and the commands that change something beyond creating the snapshot.
+// extentBytes totals the file data a --no-data stream leaves out.
+type sendStreamInspector struct {
+	bytes       int64
+	changes     int
+	extentBytes int64
+	sawHeader   bool
+	invalid     bool
+	buf         []byte
+	skip        int64
+	payload     []byte
+	collect     int
+}
+
+func (s *sendStreamInspector) Write(p []byte) (int, error) {
+	n := len(p)
+	s.bytes += int64(n)
+
+	for len(p) > 0 && !s.invalid {
+		if s.skip > 0 {
+			k := min(int64(len(p)), s.skip)
+			s.skip -= k
+			p = p[k:]
+			continue
+		}
+		if s.collect > 0 {
+			k := min(len(p), s.collect)
+			s.payload = append(s.payload, p[:k]...)
+			s.collect -= k
+			p = p[k:]
+			if s.collect == 0 {
+				s.extentBytes += extentSize(s.payload)
+				s.payload = s.payload[:0]
+			}
+			continue
+		}
+
+		want := sendCmdHeaderLen
+		if !s.sawHeader {
+			want = sendStreamHeaderLen
+		}
+		k := min(want-len(s.buf), len(p))
+		s.buf = append(s.buf, p[:k]...)
+		p = p[k:]
+		if len(s.buf) < want {
+			break
+		}
+
+		if !s.sawHeader {
+			if !bytes.HasPrefix(s.buf, []byte(sendStreamMagic)) {
+				s.invalid = true
+				break
+			}
+			s.sawHeader = true
+		} else {
+			length := binary.LittleEndian.Uint32(s.buf[0:4])
+			switch binary.LittleEndian.Uint16(s.buf[4:6]) {
+			case sendCmdSubvol, sendCmdSnapshot, sendCmdEnd:
+			case sendCmdUpdateExtent:
+				// Extent attributes are tiny, so these are read rather than skipped.
+				s.changes++
+				s.collect = int(length)
+			default:
+				s.changes++
+			}
+			if s.collect == 0 {
+				s.skip = int64(length)
+			}
+		}
+		s.buf = s.buf[:0]
+	}
+
+	return n, nil
+}
+
+// empty reports whether the whole stream was understood and changes nothing.
+func (s *sendStreamInspector) empty() bool {
+	return s.sawHeader && !s.invalid && s.changes == 0 && len(s.buf) == 0 && s.skip == 0 && s.collect == 0
+}
+
+// unchanged reports whether an incremental stream should be dropped: it is
+// empty, or smaller than minBytes when that is set.
+func (s *sendStreamInspector) unchanged(minBytes int64) bool {
+	return s.empty() || s.bytes < minBytes
+}
+
+// extentSize returns the size attribute of an update_extent command payload.
+func extentSize(payload []byte) int64 {
+	for len(payload) >= sendAttrHeaderLen {
+		attr := binary.LittleEndian.Uint16(payload[0:2])
+		length := int(binary.LittleEndian.Uint16(payload[2:4]))
+		payload = payload[sendAttrHeaderLen:]
+		if length > len(payload) {
+			break
+		}
+		if attr == sendAttrSize && length == 8 {
+			return int64(binary.LittleEndian.Uint64(payload))
+		}
+		payload = payload[length:]
+	}
+	return 0
+}
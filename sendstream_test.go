@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// buildSendStream returns a btrfs send stream made of the given commands,
+// each carrying payload bytes of data.
+func buildSendStream(payload int, cmds ...uint16) []byte {
+	var b bytes.Buffer
+	b.WriteString(sendStreamMagic)
+	_ = binary.Write(&b, binary.LittleEndian, uint32(1))
+	for _, cmd := range cmds {
+		_ = binary.Write(&b, binary.LittleEndian, uint32(payload))
+		_ = binary.Write(&b, binary.LittleEndian, cmd)
+		_ = binary.Write(&b, binary.LittleEndian, uint32(0))
+		b.Write(make([]byte, payload))
+	}
+	return b.Bytes()
+}
+
+// buildUpdateExtent returns an update_extent command as btrfs send --no-data
+// writes it: path, file offset and size attributes.
+func buildUpdateExtent(size uint64) []byte {
+	var attrs bytes.Buffer
+	for _, a := range []struct {
+		typ  uint16
+		data []byte
+	}{
+		{15, []byte("file")},
+		{18, binary.LittleEndian.AppendUint64(nil, 0)},
+		{sendAttrSize, binary.LittleEndian.AppendUint64(nil, size)},
+	} {
+		_ = binary.Write(&attrs, binary.LittleEndian, a.typ)
+		_ = binary.Write(&attrs, binary.LittleEndian, uint16(len(a.data)))
+		attrs.Write(a.data)
+	}
+
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.LittleEndian, uint32(attrs.Len()))
+	_ = binary.Write(&b, binary.LittleEndian, uint16(sendCmdUpdateExtent))
+	_ = binary.Write(&b, binary.LittleEndian, uint32(0))
+	b.Write(attrs.Bytes())
+	return b.Bytes()
+}
+
+func TestSendStreamInspector(t *testing.T) {
+	t.Parallel()
+
+	const sendCmdWrite = 15
+
+	tests := []struct {
+		name      string
+		stream    []byte
+		minBytes  int64
+		unchanged bool
+	}{
+		{"empty incremental", buildSendStream(8, sendCmdSnapshot, sendCmdEnd), 0, true},
+		{"with a write", buildSendStream(8, sendCmdSnapshot, sendCmdWrite, sendCmdEnd), 0, false},
+		{"below min_change_bytes", buildSendStream(8, sendCmdSnapshot, sendCmdWrite, sendCmdEnd), 1024, true},
+		{"not a send stream", []byte("some other data"), 0, false},
+		{"truncated", buildSendStream(8, sendCmdSnapshot)[:20], 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Feed a byte at a time to exercise headers split across writes.
+			var inspector sendStreamInspector
+			for i := range tt.stream {
+				_, _ = inspector.Write(tt.stream[i : i+1])
+			}
+			if got := inspector.unchanged(tt.minBytes); got != tt.unchanged {
+				t.Errorf("expected unchanged=%v, got %v", tt.unchanged, got)
+			}
+			if inspector.bytes != int64(len(tt.stream)) {
+				t.Errorf("expected %d bytes counted, got %d", len(tt.stream), inspector.bytes)
+			}
+		})
+	}
+}
+
+func TestSendStreamInspectorExtentBytes(t *testing.T) {
+	t.Parallel()
+
+	stream := buildSendStream(8, sendCmdSnapshot)
+	stream = append(stream, buildUpdateExtent(4096)...)
+	stream = append(stream, buildUpdateExtent(1<<20)...)
+	stream = append(stream, buildSendStream(8, sendCmdEnd)[sendStreamHeaderLen:]...)
+
+	var inspector sendStreamInspector
+	for i := range stream {
+		_, _ = inspector.Write(stream[i : i+1])
+	}
+	if inspector.extentBytes != 4096+1<<20 {
+		t.Fatalf("expected %d extent bytes, got %d", 4096+1<<20, inspector.extentBytes)
+	}
+	if inspector.empty() {
+		t.Fatal("expected extents to count as changes")
+	}
+}
+
+func TestSendSnapshotSkipsEmptyIncremental(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	tempDir := t.TempDir()
+	oldSnap := filepath.Join(tempDir, "snap-old")
+	newSnap := filepath.Join(tempDir, "snap-new")
+	if err := os.WriteFile(oldSnap, []byte("old"), 0o644); err != nil {
+		t.Fatalf("writing old snapshot: %v", err)
+	}
+	if err := os.WriteFile(newSnap, buildSendStream(16, sendCmdSnapshot, sendCmdEnd), 0o644); err != nil {
+		t.Fatalf("writing new snapshot: %v", err)
+	}
+
+	cfg := &Config{
+		RemoteHost: "remote",
+		RemoteDest: remoteDir,
+	}
+
+	outfile := "volume-inc.btrfs"
+	_, _, err := sendSnapshot(context.Background(), cfg, "root", newSnap, oldSnap, nil, outfile, outfile+".tmp", false, nil)
+	if !errors.Is(err, errNoChanges) {
+		t.Fatalf("expected errNoChanges, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, outfile+".tmp")); !os.IsNotExist(err) {
+		t.Fatalf("expected the upload to be removed, stat err: %v", err)
+	}
+
+	// A full backup is never skipped, however empty.
+	if _, _, err := sendSnapshot(context.Background(), cfg, "volume", newSnap, "", nil, "volume-full.btrfs", "volume-full.btrfs.tmp", true, nil); err != nil {
+		t.Fatalf("sendSnapshot full: %v", err)
+	}
+}
@@ -2,42 +2,128 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"sort"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// latestSnapshot returns the path to the most recent snapshot in snapDir, or an empty string if none exist.
-func latestSnapshot(snapDir string) (string, error) {
-	entries, err := os.ReadDir(snapDir)
-	if err != nil || len(entries) == 0 {
+const defaultSnapshotPrefix = "btrfs-backup-"
+
+// latestSnapshot returns the path to the most recent snapshot in snapDir named
+// with prefix, or an empty string if none exist. It also reports snapshots
+// whose names share a timestamp, which the path is still returned alongside.
+func latestSnapshot(snapDir, prefix string) (string, error) {
+	snaps := listSnapshots(snapDir, prefix)
+	if len(snaps) == 0 {
 		return "", nil
 	}
+	return snaps[len(snaps)-1], duplicateSnapshots(snaps)
+}
 
-	var names []string
+// duplicateSnapshots reports each group of snaps, sorted as listSnapshots
+// returns them, that parse to the same timestamp. Any one of them could be
+// taken as the parent of an incremental, so the wrong one might be.
+func duplicateSnapshots(snaps []string) error {
+	var errs []error
+	for i := 0; i < len(snaps); {
+		ts, _ := extractSnapshotTimestamp(snaps[i])
+		j := i + 1
+		for j < len(snaps) {
+			if next, _ := extractSnapshotTimestamp(snaps[j]); !next.Equal(ts) {
+				break
+			}
+			j++
+		}
+		if j-i > 1 {
+			var names []string
+			for _, snap := range snaps[i:j] {
+				names = append(names, filepath.Base(snap))
+			}
+			errs = append(errs, fmt.Errorf("snapshots %s share timestamp %s", strings.Join(names, ", "), ts.Format(snapshotTimestampFormat)))
+		}
+		i = j
+	}
+	return errors.Join(errs...)
+}
+
+// listSnapshots returns the paths of the snapshots in snapDir named with
+// prefix, oldest first. Names without a timestamp are skipped.
+func listSnapshots(snapDir, prefix string) []string {
+	entries, err := os.ReadDir(snapDir)
+	if err != nil {
+		return nil
+	}
+
+	var paths []string
 	for _, e := range entries {
-		if e.IsDir() {
-			names = append(names, e.Name())
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		if _, err := extractSnapshotTimestamp(e.Name()); err != nil {
+			continue
 		}
+		paths = append(paths, filepath.Join(snapDir, e.Name()))
 	}
-	if len(names) == 0 {
-		return "", nil
+	sortSnapshots(paths)
+
+	return paths
+}
+
+// sortSnapshots orders snapshot paths by the timestamp in their names rather
+// than lexically, which breaks as soon as prefixes differ in length.
+func sortSnapshots(paths []string) {
+	slices.SortStableFunc(paths, func(a, b string) int {
+		ta, _ := extractSnapshotTimestamp(a)
+		tb, _ := extractSnapshotTimestamp(b)
+		return ta.Compare(tb)
+	})
+}
+
+// pruneLocalSnapshots deletes all but the newest keep snapshots in snapDir.
+// Snapshots in needed, such as the parent for the next incremental, are
+// always kept, so keep of zero leaves just those.
+func pruneLocalSnapshots(ctx context.Context, snapDir, prefix string, keep int, needed ...string) {
+	snaps := listSnapshots(snapDir, prefix)
+	// In a dry run the new snapshot was never created.
+	for _, snap := range needed {
+		if !slices.Contains(snaps, snap) {
+			snaps = append(snaps, snap)
+		}
 	}
+	sortSnapshots(snaps)
 
-	sort.Sort(sort.Reverse(sort.StringSlice(names)))
-	return filepath.Join(snapDir, names[0]), nil
+	for i, snap := range snaps {
+		if slices.Contains(needed, snap) || i >= len(snaps)-keep {
+			continue
+		}
+		deleteOldSnapshot(ctx, snap)
+	}
+}
+
+// nextSnapshotTime returns currentTime, or one second after the latest
+// snapshot when that isn't newer. Names have one-second resolution, so this
+// keeps a run straight after another, or after the clock went back, from
+// colliding with or sorting before the latest snapshot.
+func nextSnapshotTime(latest string, currentTime time.Time) time.Time {
+	ts, err := extractSnapshotTimestamp(latest)
+	if err != nil || currentTime.Truncate(time.Second).After(ts) {
+		return currentTime
+	}
+	return ts.Add(time.Second).In(currentTime.Location())
 }
 
-func createSnapshot(ctx context.Context, src, snapDir string, currentTime time.Time) (string, error) {
-	name := fmt.Sprintf("btrfs-backup-%s", currentTime.Format("2006-01-02_15-04-05"))
+func createSnapshot(ctx context.Context, src, snapDir, prefix string, currentTime time.Time) (string, error) {
+	name := prefix + currentTime.Format(snapshotTimestampFormat)
 	path := filepath.Join(snapDir, name)
 
-	createCmd := exec.CommandContext(ctx, "btrfs", "subvolume", "snapshot", "-r", src, path)
+	createCmd := exec.CommandContext(ctx, btrfsBin, "subvolume", "snapshot", "-r", src, path)
 	createCmd.Stdout = io.Discard
 	createCmd.Stderr = os.Stderr
 
@@ -51,8 +137,49 @@ func createSnapshot(ctx context.Context, src, snapDir string, currentTime time.T
 	return path, createCmd.Run()
 }
 
+// estimateSubvolumeSize returns the apparent size of the files in subvol,
+// roughly the uncompressed size of a full send. Nested subvolumes aren't
+// sent, so du stays on one filesystem.
+func estimateSubvolumeSize(ctx context.Context, subvol string) (int64, error) {
+	output, err := exec.CommandContext(ctx, "du", "-sbx", subvol).Output()
+	if err != nil {
+		return 0, fmt.Errorf("du of %s failed: %w", subvol, err)
+	}
+
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unable to parse du output: %q", string(output))
+	}
+
+	return strconv.ParseInt(fields[0], 10, 64)
+}
+
+// estimateSendSize returns roughly how many bytes btrfs send will produce for
+// snapshot, diffed against parent when set. A --no-data send walks the same
+// metadata without reading file contents, reporting each extent's size
+// instead.
+func estimateSendSize(ctx context.Context, snapshot, parent string) (int64, error) {
+	args := []string{"send", "--no-data"}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	args = append(args, snapshot)
+
+	cmd := exec.CommandContext(ctx, btrfsBin, args...)
+	var inspector sendStreamInspector
+	cmd.Stdout = &inspector
+	if err := cmd.Run(); err != nil {
+		return 0, fmt.Errorf("btrfs send --no-data failed: %w", err)
+	}
+	if inspector.invalid {
+		return 0, fmt.Errorf("unrecognised send stream from %s", snapshot)
+	}
+
+	return inspector.bytes + inspector.extentBytes, nil
+}
+
 func checkBtrfsAccess(ctx context.Context, vol *Volume) error {
-	cmd := exec.CommandContext(ctx, "btrfs", "subvolume", "list", vol.Src)
+	cmd := exec.CommandContext(ctx, btrfsBin, "subvolume", "list", vol.Src)
 
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("error accessing btrfs subvolume at %s: %v", vol.Src, err)
@@ -60,8 +187,34 @@ func checkBtrfsAccess(ctx context.Context, vol *Volume) error {
 	return nil
 }
 
+// failedSendFile in snapdir names a snapshot whose send failed with
+// retry_from_snapshot, for the next run to send again.
+const failedSendFile = ".failed-send"
+
+func recordFailedSend(snapDir, snap string) error {
+	return os.WriteFile(filepath.Join(snapDir, failedSendFile), []byte(filepath.Base(snap)+"\n"), 0o644)
+}
+
+// failedSend returns the snapshot recorded by recordFailedSend, if any.
+func failedSend(snapDir string) string {
+	data, err := os.ReadFile(filepath.Join(snapDir, failedSendFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func clearFailedSend(snapDir string) {
+	if dryRun {
+		return
+	}
+	if err := os.Remove(filepath.Join(snapDir, failedSendFile)); err != nil && !os.IsNotExist(err) {
+		errLog.Printf("Error clearing failed send record: %v", err)
+	}
+}
+
 func deleteOldSnapshot(ctx context.Context, snapshot string) {
-	delCmd := exec.CommandContext(ctx, "btrfs", "subvolume", "delete", snapshot)
+	delCmd := exec.CommandContext(ctx, btrfsBin, "subvolume", "delete", snapshot)
 
 	if verbose {
 		fmt.Printf("→ Deleting old local snapshot: %s\n", snapshot)
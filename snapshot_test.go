@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -14,7 +15,7 @@ func TestLatestSnapshot(t *testing.T) {
 	t.Parallel()
 	t.Run("missing or empty returns empty", func(t *testing.T) {
 		missing := filepath.Join(t.TempDir(), "missing")
-		got, err := latestSnapshot(missing)
+		got, err := latestSnapshot(missing, defaultSnapshotPrefix)
 		if err != nil {
 			t.Fatalf("latestSnapshot missing: %v", err)
 		}
@@ -23,7 +24,7 @@ func TestLatestSnapshot(t *testing.T) {
 		}
 
 		empty := t.TempDir()
-		got, err = latestSnapshot(empty)
+		got, err = latestSnapshot(empty, defaultSnapshotPrefix)
 		if err != nil {
 			t.Fatalf("latestSnapshot empty: %v", err)
 		}
@@ -50,7 +51,7 @@ func TestLatestSnapshot(t *testing.T) {
 			t.Fatalf("writing file: %v", err)
 		}
 
-		got, err := latestSnapshot(snapDir)
+		got, err := latestSnapshot(snapDir, defaultSnapshotPrefix)
 		if err != nil {
 			t.Fatalf("latestSnapshot: %v", err)
 		}
@@ -62,6 +63,144 @@ func TestLatestSnapshot(t *testing.T) {
 	})
 }
 
+func TestSnapshotsIgnoreOtherPrefixes(t *testing.T) {
+	t.Parallel()
+
+	snapDir := t.TempDir()
+	for _, name := range []string{
+		"btrfs-backup-2024-05-09_10-10-10",
+		"btrfs-backup-2024-05-10_10-10-10",
+		"snapper-2024-05-12_10-10-10",
+		"home-2024-05-09_12-00-00",
+		"home-2024-05-11_12-00-00",
+	} {
+		if err := os.Mkdir(filepath.Join(snapDir, name), 0o755); err != nil {
+			t.Fatalf("creating snapshot dir: %v", err)
+		}
+	}
+
+	got, err := latestSnapshot(snapDir, defaultSnapshotPrefix)
+	if err != nil {
+		t.Fatalf("latestSnapshot: %v", err)
+	}
+	if want := filepath.Join(snapDir, "btrfs-backup-2024-05-10_10-10-10"); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	got, err = latestSnapshot(snapDir, "home-")
+	if err != nil {
+		t.Fatalf("latestSnapshot: %v", err)
+	}
+	if want := filepath.Join(snapDir, "home-2024-05-11_12-00-00"); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	want := []string{
+		filepath.Join(snapDir, "home-2024-05-09_12-00-00"),
+		filepath.Join(snapDir, "home-2024-05-11_12-00-00"),
+	}
+	if got := listSnapshots(snapDir, "home-"); !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestLatestSnapshotUsesTimestampOrder(t *testing.T) {
+	t.Parallel()
+
+	// Lexically "btrfs-backup-2024..." sorts after "b-2025...", but the
+	// latter is newer.
+	snapDir := t.TempDir()
+	for _, name := range []string{
+		"b-2025-01-01_00-00-00",
+		"btrfs-backup-2024-12-31_23-59-59",
+		"b-not-a-snapshot",
+	} {
+		if err := os.Mkdir(filepath.Join(snapDir, name), 0o755); err != nil {
+			t.Fatalf("creating snapshot dir: %v", err)
+		}
+	}
+
+	got, err := latestSnapshot(snapDir, "b")
+	if err != nil {
+		t.Fatalf("latestSnapshot: %v", err)
+	}
+	if want := filepath.Join(snapDir, "b-2025-01-01_00-00-00"); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestNextSnapshotTime(t *testing.T) {
+	latest := "/snaps/btrfs-backup-2024-01-01_10-00-00"
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		latest  string
+		current time.Time
+		want    time.Time
+	}{
+		{"no previous snapshot", "", base, base},
+		{"later second", latest, base.Add(time.Second), base.Add(time.Second)},
+		{"same second", latest, base.Add(400 * time.Millisecond), base.Add(time.Second)},
+		{"clock went back", latest, base.Add(-time.Hour), base.Add(time.Second)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextSnapshotTime(tt.latest, tt.current); !got.Equal(tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPruneLocalSnapshots(t *testing.T) {
+	setupTestEnv(t)
+
+	names := []string{
+		"btrfs-backup-2024-05-08_10-10-10",
+		"btrfs-backup-2024-05-09_10-10-10",
+		"btrfs-backup-2024-05-10_10-10-10",
+		"btrfs-backup-2024-05-11_10-10-10",
+		"snapper-2024-05-01_10-10-10",
+	}
+
+	tests := []struct {
+		name string
+		keep int
+		want []string
+	}{
+		{"zero keeps only the parent", 0, []string{"btrfs-backup-2024-05-11_10-10-10"}},
+		{"keeps newest", 2, []string{"btrfs-backup-2024-05-10_10-10-10", "btrfs-backup-2024-05-11_10-10-10"}},
+		{"more than exist", 10, names[:4]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapDir := t.TempDir()
+			for _, name := range names {
+				if err := os.Mkdir(filepath.Join(snapDir, name), 0o755); err != nil {
+					t.Fatalf("creating snapshot dir: %v", err)
+				}
+			}
+
+			parent := filepath.Join(snapDir, "btrfs-backup-2024-05-11_10-10-10")
+			pruneLocalSnapshots(context.Background(), snapDir, defaultSnapshotPrefix, tt.keep, parent)
+
+			var want []string
+			for _, name := range tt.want {
+				want = append(want, filepath.Join(snapDir, name))
+			}
+			if got := listSnapshots(snapDir, defaultSnapshotPrefix); !slices.Equal(got, want) {
+				t.Fatalf("expected %v, got %v", want, got)
+			}
+			if _, err := os.Stat(filepath.Join(snapDir, "snapper-2024-05-01_10-10-10")); err != nil {
+				t.Fatalf("expected unrelated snapshot to survive: %v", err)
+			}
+		})
+	}
+}
+
 func TestCreateSnapshot(t *testing.T) {
 	setupTestEnv(t)
 
@@ -79,7 +218,7 @@ func TestCreateSnapshot(t *testing.T) {
 	}
 
 	now := time.Date(2024, 5, 12, 11, 30, 45, 0, time.UTC)
-	got, err := createSnapshot(context.Background(), srcDir, snapDir, now)
+	got, err := createSnapshot(context.Background(), srcDir, snapDir, defaultSnapshotPrefix, now)
 	if err != nil {
 		t.Fatalf("createSnapshot: %v", err)
 	}
@@ -89,6 +228,14 @@ func TestCreateSnapshot(t *testing.T) {
 		t.Fatalf("expected snapshot path %q, got %q", want, got)
 	}
 
+	custom, err := createSnapshot(context.Background(), srcDir, snapDir, "root-", now)
+	if err != nil {
+		t.Fatalf("createSnapshot with prefix: %v", err)
+	}
+	if want := filepath.Join(snapDir, "root-2024-05-12_11-30-45"); custom != want {
+		t.Fatalf("expected snapshot path %q, got %q", want, custom)
+	}
+
 	if _, err := os.Stat(got); err != nil {
 		t.Fatalf("expected snapshot directory to exist: %v", err)
 	}
@@ -118,7 +265,7 @@ func TestCreateSnapshotError(t *testing.T) {
 		t.Fatalf("creating snapshot dir: %v", err)
 	}
 
-	_, err := createSnapshot(context.Background(), srcDir, snapDir, time.Now())
+	_, err := createSnapshot(context.Background(), srcDir, snapDir, defaultSnapshotPrefix, time.Now())
 	if err == nil {
 		t.Fatal("expected createSnapshot to fail")
 	}
@@ -149,3 +296,44 @@ func TestDeleteOldSnapshot(t *testing.T) {
 		t.Fatalf("expected delete log entry, got %q", string(logData))
 	}
 }
+
+func TestEstimateSubvolumeSize(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "data"), make([]byte, 10000), 0o644); err != nil {
+		t.Fatalf("writing data: %v", err)
+	}
+
+	size, err := estimateSubvolumeSize(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("estimateSubvolumeSize: %v", err)
+	}
+	if size < 10000 {
+		t.Fatalf("expected at least 10000 bytes, got %d", size)
+	}
+}
+
+func TestLatestSnapshotDuplicateTimestamps(t *testing.T) {
+	t.Parallel()
+
+	snapDir := t.TempDir()
+	for _, name := range []string{
+		"btrfs-backup-2024-05-09_10-10-10",
+		"btrfs-backup-2024-05-09_10-10-10.copy",
+		"btrfs-backup-2024-05-10_10-10-10",
+	} {
+		if err := os.Mkdir(filepath.Join(snapDir, name), 0o755); err != nil {
+			t.Fatalf("creating snapshot dir: %v", err)
+		}
+	}
+
+	got, err := latestSnapshot(snapDir, defaultSnapshotPrefix)
+	if want := filepath.Join(snapDir, "btrfs-backup-2024-05-10_10-10-10"); got != want {
+		t.Fatalf("expected %q despite the duplicates, got %q", want, got)
+	}
+	want := "snapshots btrfs-backup-2024-05-09_10-10-10, btrfs-backup-2024-05-09_10-10-10.copy share timestamp 2024-05-09_10-10-10"
+	if err == nil || err.Error() != want {
+		t.Fatalf("expected %q, got %v", want, err)
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
@@ -32,10 +34,51 @@ func setupTestBins(t *testing.T) (binDir, remoteDir string) {
 	writeExecutable(t, binDir, "btrfs", btrfsStubScript)
 	writeExecutable(t, binDir, "ssh", sshStubScript)
 	writeExecutable(t, binDir, "age", ageStubScript)
+	writeExecutable(t, binDir, "rsync", rsyncStubScript)
+	writeExecutable(t, binDir, "gpg", gpgStubScript)
+	writeExecutable(t, binDir, "zstd", compressStubScript)
+	writeExecutable(t, binDir, "gzip", compressStubScript)
 
 	return binDir, remoteDir
 }
 
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("creating pipe: %v", err)
+	}
+
+	orig := os.Stdout
+	os.Stdout = w
+	defer func() {
+		os.Stdout = orig
+	}()
+
+	done := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- data
+	}()
+
+	fn()
+
+	w.Close()
+	return string(<-done)
+}
+
+// remoteListing returns the backups of vol currently on the remote.
+func remoteListing(t *testing.T, cfg *Config, vol *Volume) []remoteBackup {
+	t.Helper()
+
+	backups, err := listRemoteBackups(context.Background(), cfg, vol)
+	if err != nil {
+		t.Fatalf("listRemoteBackups: %v", err)
+	}
+	return backups
+}
+
 func writeExecutable(t *testing.T, dir, name, script string) {
 	t.Helper()
 
@@ -49,19 +92,39 @@ const btrfsStubScript = `#!/bin/sh
 set -e
 log="${BTRFS_LOG:-}"
 
+# Snapshots made by the stub are directories; send their path as the stream.
+stream() {
+	if [ -d "$1" ]; then
+		printf "%s" "$1"
+	else
+		cat "$1"
+	fi
+}
+
 case "$1" in
+--version)
+	echo "btrfs-progs ${BTRFS_VERSION:-v6.6.3}"
+	exit 0
+	;;
 send)
 	shift
 	if [ "${BTRFS_FAIL_SEND:-0}" -ne 0 ]; then
 		exit 1
 	fi
+	if [ "${1:-}" = "--no-data" ]; then
+		if [ "${BTRFS_FAIL_NO_DATA:-0}" -ne 0 ]; then
+			echo "send: unrecognized option '--no-data'" >&2
+			exit 1
+		fi
+		shift
+	fi
 	if [ "${1:-}" = "-p" ]; then
 		old="$2"
 		new="$3"
 		if [ -n "$log" ]; then
 			printf "send -p %s %s\n" "$old" "$new" >> "$log"
 		fi
-		cat "$new"
+		stream "$new"
 		exit 0
 	fi
 
@@ -69,7 +132,36 @@ send)
 	if [ -n "$log" ]; then
 		printf "send %s\n" "$new" >> "$log"
 	fi
-	cat "$new"
+	stream "$new"
+	exit 0
+	;;
+receive)
+	if [ "${2:-}" = "--dump" ]; then
+		if [ -n "$log" ]; then
+			printf "receive --dump\n" >> "$log"
+		fi
+		cat > /dev/null
+		if [ "${BTRFS_FAIL_DUMP:-0}" -ne 0 ]; then
+			echo "ERROR: unexpected command 0" >&2
+			exit 1
+		fi
+		exit 0
+	fi
+	dest="$2"
+	if [ -n "$log" ]; then
+		printf "receive %s\n" "$dest" >> "$log"
+	fi
+	if [ "${BTRFS_FAIL_RECEIVE:-0}" -ne 0 ]; then
+		exit 1
+	fi
+	stream="$dest/.stream.$$"
+	cat > "$stream"
+	cat "$stream" >> "$dest/received"
+	# A stub snapshot's stream is its path; receive it under its name.
+	case "$(head -c 1 "$stream")" in
+	/) mkdir -p "$dest/$(basename "$(cat "$stream")")" ;;
+	esac
+	rm -f "$stream"
 	exit 0
 	;;
 subvolume)
@@ -85,7 +177,7 @@ subvolume)
 		if [ -n "$log" ]; then
 			printf "snapshot %s%s %s\n" "$readonly" "$src" "$dest" >> "$log"
 		fi
-		if [ "${BTRFS_FAIL_SNAPSHOT:-0}" -ne 0 ]; then
+		if [ "${BTRFS_FAIL_SNAPSHOT:-0}" -ne 0 ] || [ "$src" = "${BTRFS_FAIL_SNAPSHOT_SRC:-}" ]; then
 			exit 1
 		fi
 		rm -rf "$dest"
@@ -94,14 +186,16 @@ subvolume)
 	fi
 
 	if [ "$2" = "delete" ]; then
-		target="$3"
-		if [ -n "$log" ]; then
-			printf "delete %s\n" "$target" >> "$log"
-		fi
-		if [ "${BTRFS_FAIL_DELETE:-0}" -ne 0 ]; then
-			exit 1
-		fi
-		rm -rf "$target"
+		shift 2
+		for target; do
+			if [ -n "$log" ]; then
+				printf "delete %s\n" "$target" >> "$log"
+			fi
+			if [ "${BTRFS_FAIL_DELETE:-0}" -ne 0 ]; then
+				exit 1
+			fi
+			rm -rf "$target"
+		done
 		exit 0
 	fi
 
@@ -121,12 +215,22 @@ exit 1
 const sshStubScript = `#!/bin/sh
 set -e
 log="${SSH_LOG:-}"
-cmd="${@: -1}"
+for cmd; do :; done
 
 if [ -n "$log" ]; then
 	printf "%s\n" "$cmd" >> "$log"
 fi
 
+# Fail the first SSH_FAIL_FIRST invocations, counting them in SSH_FAIL_COUNTER.
+if [ -n "${SSH_FAIL_FIRST:-}" ]; then
+	count=$(cat "$SSH_FAIL_COUNTER" 2>/dev/null || echo 0)
+	count=$((count + 1))
+	echo "$count" > "$SSH_FAIL_COUNTER"
+	if [ "$count" -le "$SSH_FAIL_FIRST" ]; then
+		exit 255
+	fi
+fi
+
 if printf "%s" "$cmd" | grep -q "^tee .* | sha256sum"; then
 	if [ "${SSH_FAIL_CAT:-0}" -ne 0 ]; then
 		exit 1
@@ -143,9 +247,7 @@ if printf "%s" "$cmd" | grep -q "^cat > "; then
 	exit 0
 fi
 
-if ! sh -c "$cmd"; then
-	exit $?
-fi
+sh -c "$cmd" || exit $?
 
 exit 0
 `
@@ -167,3 +269,69 @@ fi
 
 cat
 `
+
+const gpgStubScript = `#!/bin/sh
+set -e
+log="${GPG_LOG:-}"
+if [ -n "$log" ]; then
+	printf "gpg %s\n" "$*" >> "$log"
+fi
+
+if [ "${GPG_FAIL:-0}" -ne 0 ]; then
+	exit 1
+fi
+
+for arg; do
+	if [ "$arg" = "--decrypt" ]; then
+		sed "1s/^gpg://"
+		exit 0
+	fi
+done
+
+printf "gpg:"
+cat
+`
+
+const rsyncStubScript = `#!/bin/sh
+set -e
+log="${RSYNC_LOG:-}"
+if [ -n "$log" ]; then
+	printf "rsync %s\n" "$*" >> "$log"
+fi
+
+# Fail the first invocation only, to exercise resume-by-retry.
+if [ -n "${RSYNC_FAIL_ONCE:-}" ] && [ ! -e "$RSYNC_FAIL_ONCE" ]; then
+	touch "$RSYNC_FAIL_ONCE"
+	exit 1
+fi
+
+prev=""
+for arg; do
+	src="$prev"
+	prev="$arg"
+done
+dest="${prev#*:}"
+
+cp "$src" "$dest"
+`
+
+// compressStubScript stands in for zstd and gzip: it tags the stream with the
+// tool's name when compressing and strips the tag when decompressing.
+const compressStubScript = `#!/bin/sh
+set -e
+name="$(basename "$0")"
+log="${COMPRESS_LOG:-}"
+if [ -n "$log" ]; then
+	printf "%s %s\n" "$name" "$*" >> "$log"
+fi
+
+for arg; do
+	if [ "$arg" = "-d" ]; then
+		sed "1s/^$name://"
+		exit 0
+	fi
+done
+
+printf "%s:" "$name"
+cat
+`
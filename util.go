@@ -1,17 +1,37 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"math"
+	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 )
 
 const snapshotTimestampFormat = "2006-01-02_15-04-05"
 
 var snapshotTimestampRegexp = regexp.MustCompile(`(\d{4}-\d{2}-\d{2}_\d{2}-\d{2}-\d{2})`)
 
+// snapshotLocation is the zone snapshot and backup names are written and read
+// in, set from timezone.
+var snapshotLocation = time.UTC
+
+// Commands spawned by the tool, overridden by btrfs_bin, ssh_bin and age_bin.
+var (
+	btrfsBin = "btrfs"
+	sshBin   = "ssh"
+	ageBin   = "age"
+)
+
 func extractSnapshotTimestamp(path string) (time.Time, error) {
 	base := filepath.Base(path)
 	match := snapshotTimestampRegexp.FindStringSubmatch(base)
@@ -19,7 +39,7 @@ func extractSnapshotTimestamp(path string) (time.Time, error) {
 		return time.Time{}, fmt.Errorf("unable to extract timestamp from %s", base)
 	}
 
-	t, err := time.Parse(snapshotTimestampFormat, match[1])
+	t, err := time.ParseInLocation(snapshotTimestampFormat, match[1], snapshotLocation)
 	if err != nil {
 		return time.Time{}, fmt.Errorf("unable to parse timestamp %s: %w", match[1], err)
 	}
@@ -27,17 +47,257 @@ func extractSnapshotTimestamp(path string) (time.Time, error) {
 	return t, nil
 }
 
-func buildSSHArgs(cfg *Config, remoteCmd string, extraOpts ...string) []string {
-	sshArgs := []string{}
+// splitRemoteHost splits remote_host into its user, host and any port given
+// with it. An IPv6 literal may be bare, or bracketed to carry a port as in
+// user@[fd00::1]:2222.
+func splitRemoteHost(remoteHost string) (user, host string, port int, err error) {
+	host = remoteHost
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		user, host = host[:i], host[i+1:]
+	}
+
+	var portStr string
+	if rest, ok := strings.CutPrefix(host, "["); ok {
+		addr, after, ok := strings.Cut(rest, "]")
+		if !ok {
+			return "", "", 0, fmt.Errorf("missing ] in %q", remoteHost)
+		}
+		host = addr
+		if after != "" {
+			if portStr, ok = strings.CutPrefix(after, ":"); !ok {
+				return "", "", 0, fmt.Errorf("unexpected %q after ] in %q", after, remoteHost)
+			}
+		}
+	} else if strings.Count(host, ":") == 1 {
+		// More than one colon is a bare IPv6 literal, which can't have a port.
+		host, portStr, _ = strings.Cut(host, ":")
+	}
+
+	if portStr != "" {
+		if port, err = strconv.Atoi(portStr); err != nil || port <= 0 || port > 65535 {
+			return "", "", 0, fmt.Errorf("invalid port %q in %q", portStr, remoteHost)
+		}
+	}
+	if host == "" {
+		return "", "", 0, fmt.Errorf("missing host in %q", remoteHost)
+	}
+	return user, host, port, nil
+}
+
+// sshDestination returns remote_host as ssh takes it: any port removed and
+// IPv6 literals unbracketed.
+func sshDestination(cfg *Config) string {
+	user, host, _, err := splitRemoteHost(cfg.RemoteHost)
+	if err != nil {
+		// validate rejects these, so only hand-built configs get here.
+		return cfg.RemoteHost
+	}
+	if user != "" {
+		return user + "@" + host
+	}
+	return host
+}
+
+// remoteTarget returns path on the remote in the host:path form rsync and
+// scp use, bracketing IPv6 literals. Local destinations are returned as is.
+func remoteTarget(cfg *Config, path string) string {
+	if cfg.RemoteHost == "" {
+		return path
+	}
+	user, host, _, err := splitRemoteHost(cfg.RemoteHost)
+	if err != nil {
+		return cfg.RemoteHost + ":" + path
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if user != "" {
+		host = user + "@" + host
+	}
+	return host + ":" + path
+}
+
+// sshPort returns remote_port, or else the port given in remote_host.
+func sshPort(cfg *Config) int {
+	if cfg.RemotePort != 0 {
+		return cfg.RemotePort
+	}
+	_, _, port, _ := splitRemoteHost(cfg.RemoteHost)
+	return port
+}
+
+// sshOptions returns the ssh flags derived from the config, without the host.
+func sshOptions(cfg *Config) []string {
+	opts := []string{}
 	if cfg.SSHKey != "" {
-		sshArgs = append(sshArgs, "-i", cfg.SSHKey)
+		opts = append(opts, "-i", cfg.SSHKey)
+	}
+	if port := sshPort(cfg); port != 0 {
+		opts = append(opts, "-p", strconv.Itoa(port))
+	}
+	for _, opt := range cfg.SSHOptions {
+		// Entries starting with a dash are raw flags, anything else is an
+		// ssh_config option such as "ServerAliveInterval=30".
+		if strings.HasPrefix(opt, "-") {
+			opts = append(opts, strings.Fields(opt)...)
+		} else {
+			opts = append(opts, "-o", opt)
+		}
+	}
+	if cfg.SSHMultiplex {
+		// The first ssh of the run becomes the master and later ones reuse its
+		// connection. It lingers briefly in case the run exits without
+		// stopSSHMaster.
+		opts = append(opts,
+			"-o", "ControlMaster=auto",
+			"-o", "ControlPath="+sshControlPath(cfg),
+			"-o", "ControlPersist=60",
+		)
+	}
+	return opts
+}
+
+func sshControlPath(cfg *Config) string {
+	dir := cfg.SSHControlDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	// %C is a hash of the connection details, keeping the path short enough
+	// for a unix socket.
+	return filepath.Join(dir, "btrfs-backup-%C")
+}
+
+// checkBinaries reports commands the run will spawn that can't be found, so
+// a missing one fails up front rather than part way through a volume.
+// Configurable commands are named by their config field.
+func checkBinaries(cfg *Config) error {
+	needed := map[string]string{"btrfs_bin": btrfsBin}
+	if !snapshotOnly {
+		if cfg.Backend == "ssh" && (cfg.RemoteHost != "" || len(cfg.Mirrors) > 0) {
+			needed["ssh_bin"] = sshBin
+		}
+		if cfg.Transport == "rsync" {
+			needed["rsync"] = "rsync"
+		}
+		if args := compressArgs(cfg); args != nil {
+			needed[args[0]] = args[0]
+		}
+		for i := range cfg.Volumes {
+			if len(cfg.forVolume(&cfg.Volumes[i]).recipients()) == 0 {
+				continue
+			}
+			if cfg.EncryptionBackend == "gpg" {
+				needed["gpg"] = "gpg"
+			} else {
+				needed["age_bin"] = ageBin
+			}
+			break
+		}
+	}
+
+	var problems []string
+	for _, name := range slices.Sorted(maps.Keys(needed)) {
+		bin := needed[name]
+		if _, err := exec.LookPath(bin); err != nil {
+			problem := fmt.Sprintf("%q not found in $PATH", bin)
+			if strings.Contains(bin, "/") {
+				problem = fmt.Sprintf("%q not found or not executable", bin)
+			}
+			if name != bin {
+				problem = name + ": " + problem
+			}
+			problems = append(problems, problem)
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
 	}
+	return nil
+}
+
+// stopSSHMaster closes the multiplexed connections opened during the run, to
+// the remote host and to each mirror.
+func stopSSHMaster(cfg *Config) {
+	for _, c := range cfg.mirrorConfigs() {
+		stopSSHMaster(c)
+	}
+	if !cfg.SSHMultiplex || cfg.RemoteHost == "" {
+		return
+	}
+
+	args := append(sshOptions(cfg), "-O", "exit", sshDestination(cfg))
+	cmd := exec.Command(sshBin, args...)
+	if err := cmd.Run(); err != nil && veryVerbose {
+		fmt.Printf("→ Closing ssh master connection: %v\n", err)
+	}
+}
+
+func buildSSHArgs(cfg *Config, remoteCmd string, extraOpts ...string) []string {
+	sshArgs := sshOptions(cfg)
 	sshArgs = append(sshArgs, extraOpts...)
-	sshArgs = append(sshArgs, cfg.RemoteHost, remoteCmd)
+	sshArgs = append(sshArgs, sshDestination(cfg), remoteCmd)
 
 	return sshArgs
 }
 
+// remoteCommand runs remoteCmd on the remote host over ssh, or through the local
+// shell when no remote host is configured and remote_dest is a local path.
+func remoteCommand(ctx context.Context, cfg *Config, remoteCmd string) *exec.Cmd {
+	if cfg.RemoteHost == "" {
+		return exec.CommandContext(ctx, "sh", "-c", remoteCmd)
+	}
+	return exec.CommandContext(ctx, sshBin, buildSSHArgs(cfg, remoteCmd)...)
+}
+
+// runRemoteOp runs a short remote command through run, killing it after
+// op_timeout. Uploads, hashing and restores aren't ops: they take as long as
+// the data does.
+func runRemoteOp(ctx context.Context, cfg *Config, remoteCmd string, run func(cmd *exec.Cmd) error) error {
+	if cfg.OpTimeout <= 0 {
+		return run(remoteCommand(ctx, cfg, remoteCmd))
+	}
+
+	opCtx, cancel := context.WithTimeout(ctx, cfg.OpTimeout)
+	defer cancel()
+	err := run(remoteCommand(opCtx, cfg, remoteCmd))
+	if err != nil && ctx.Err() == nil && errors.Is(opCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s (op_timeout): %w", cfg.OpTimeout, err)
+	}
+	return err
+}
+
+// describeRemoteCommand renders the command remoteCommand would run, for dry-run output.
+func describeRemoteCommand(cfg *Config, remoteCmd string) string {
+	if cfg.RemoteHost == "" {
+		return fmt.Sprintf("sh -c %s", shellEscape(remoteCmd))
+	}
+	return fmt.Sprintf("%s %s", sshBin, strings.Join(buildSSHArgs(cfg, remoteCmd), " "))
+}
+
+// withRetry calls fn until it succeeds, retrying up to retries times and
+// doubling backoff after each failure.
+func withRetry(ctx context.Context, retries int, backoff time.Duration, fn func() error) error {
+	err := fn()
+	for attempt := 1; err != nil && attempt <= retries; attempt++ {
+		if ctx.Err() != nil {
+			return err
+		}
+		if verbose {
+			fmt.Printf("→ Attempt %d failed, retrying in %s: %v\n", attempt, backoff, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		err = fn()
+	}
+	return err
+}
+
 func shellEscape(s string) string {
 	if s == "" {
 		return "''"
@@ -45,3 +305,100 @@ func shellEscape(s string) string {
 
 	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
 }
+
+// ByteSize is a number of bytes that may be written in config with a K, M, G
+// or T suffix, optionally followed by B or iB, e.g. "10M" or "10MiB". All of
+// them are powers of 1024.
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalYAML(unmarshal func(any) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	n, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+
+	*b = ByteSize(n)
+	return nil
+}
+
+// byteSizeUnits maps each suffix parseByteSize accepts to its multiplier.
+var byteSizeUnits = func() map[string]int64 {
+	units := map[string]int64{"": 1, "B": 1}
+	for i, prefix := range "KMGT" {
+		multiplier := int64(1) << (10 * (i + 1))
+		units[string(prefix)] = multiplier
+		units[string(prefix)+"B"] = multiplier
+		units[string(prefix)+"IB"] = multiplier
+	}
+	return units
+}()
+
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	number, unit := s, ""
+	if i := strings.IndexFunc(s, unicode.IsLetter); i >= 0 {
+		number, unit = s[:i], strings.ToUpper(s[i:])
+	}
+	multiplier, ok := byteSizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q (expected a K, M, G or T suffix)", s)
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+	if errors.Is(err, strconv.ErrRange) || n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	return n * multiplier, nil
+}
+
+// FileMode is a permission mode written in config as octal, e.g. "0600". Zero
+// leaves permissions to the remote's umask.
+type FileMode uint32
+
+func (m *FileMode) UnmarshalYAML(unmarshal func(any) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	n, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(s), "0o"), 8, 32)
+	if err != nil || n > 0o7777 {
+		return fmt.Errorf("invalid file mode %q (expected octal, e.g. 0600)", s)
+	}
+
+	*m = FileMode(n)
+	return nil
+}
+
+func (m FileMode) MarshalYAML() (any, error) {
+	return m.String(), nil
+}
+
+func (m FileMode) String() string {
+	return fmt.Sprintf("%04o", uint32(m))
+}
+
+// stringList is a flag.Value collecting every use of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
@@ -2,11 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
+	_ "time/tzdata"
 )
 
 func TestShellEscape(t *testing.T) {
@@ -87,6 +92,112 @@ func TestBuildSSHArgs(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("with port", func(t *testing.T) {
+		cfg := &Config{
+			RemoteHost: "user@host",
+			RemotePort: 2222,
+		}
+		args := buildSSHArgs(cfg, "ls -la")
+		want := []string{"-p", "2222", "user@host", "ls -la"}
+		if len(args) != len(want) {
+			t.Fatalf("got %d args, want %d", len(args), len(want))
+		}
+		for i := range args {
+			if args[i] != want[i] {
+				t.Errorf("arg[%d] = %q, want %q", i, args[i], want[i])
+			}
+		}
+	})
+
+	t.Run("with IPv6 hosts", func(t *testing.T) {
+		tests := []struct {
+			host string
+			port int
+			want []string
+		}{
+			{"user@[fd00::1]", 0, []string{"user@fd00::1", "ls -la"}},
+			{"fd00::1", 2222, []string{"-p", "2222", "fd00::1", "ls -la"}},
+			{"user@[fd00::1]:2222", 0, []string{"-p", "2222", "user@fd00::1", "ls -la"}},
+			{"user@host:2222", 0, []string{"-p", "2222", "user@host", "ls -la"}},
+		}
+		for _, tt := range tests {
+			args := buildSSHArgs(&Config{RemoteHost: tt.host, RemotePort: tt.port}, "ls -la")
+			if !slices.Equal(args, tt.want) {
+				t.Errorf("%s: got %q, want %q", tt.host, args, tt.want)
+			}
+		}
+	})
+
+	t.Run("with ssh options", func(t *testing.T) {
+		cfg := &Config{
+			RemoteHost: "user@host",
+			SSHKey:     "/path/to/key",
+			RemotePort: 2222,
+			SSHOptions: []string{"ServerAliveInterval=30", "-C", "-J jump@bastion"},
+		}
+		args := buildSSHArgs(cfg, "ls -la", "-T")
+		want := []string{
+			"-i", "/path/to/key",
+			"-p", "2222",
+			"-o", "ServerAliveInterval=30",
+			"-C",
+			"-J", "jump@bastion",
+			"-T",
+			"user@host", "ls -la",
+		}
+		if len(args) != len(want) {
+			t.Fatalf("got %d args, want %d", len(args), len(want))
+		}
+		for i := range args {
+			if args[i] != want[i] {
+				t.Errorf("arg[%d] = %q, want %q", i, args[i], want[i])
+			}
+		}
+	})
+
+	t.Run("with multiplexing", func(t *testing.T) {
+		cfg := &Config{
+			RemoteHost:    "user@host",
+			SSHKey:        "/path/to/key",
+			SSHMultiplex:  true,
+			SSHControlDir: "/run/btrfs-backup",
+		}
+		args := buildSSHArgs(cfg, "ls -la")
+		want := []string{
+			"-i", "/path/to/key",
+			"-o", "ControlMaster=auto",
+			"-o", "ControlPath=/run/btrfs-backup/btrfs-backup-%C",
+			"-o", "ControlPersist=60",
+			"user@host", "ls -la",
+		}
+		if len(args) != len(want) {
+			t.Fatalf("got %d args, want %d", len(args), len(want))
+		}
+		for i := range args {
+			if args[i] != want[i] {
+				t.Errorf("arg[%d] = %q, want %q", i, args[i], want[i])
+			}
+		}
+	})
+
+	t.Run("with port, key and extra options", func(t *testing.T) {
+		cfg := &Config{
+			RemoteHost: "user@host",
+			SSHKey:     "/path/to/key",
+			RemotePort: 2222,
+		}
+		args := buildSSHArgs(cfg, "ls -la", "-T")
+		want := []string{"-i", "/path/to/key", "-p", "2222", "-T", "user@host", "ls -la"}
+		if len(args) != len(want) {
+			t.Fatalf("got %d args, want %d", len(args), len(want))
+		}
+		for i := range args {
+			if args[i] != want[i] {
+				t.Errorf("arg[%d] = %q, want %q", i, args[i], want[i])
+			}
+		}
+	})
 }
 
 func TestRemoteFileSuffix(t *testing.T) {
@@ -109,6 +220,68 @@ func TestRemoteFileSuffix(t *testing.T) {
 			t.Errorf("got %q, want .btrfs.age", got)
 		}
 	})
+
+	t.Run("with per-volume encryption", func(t *testing.T) {
+		cfg := &Config{}
+		got := remoteFileSuffix(cfg.forVolume(&Volume{EncryptionKey: "age-tenant"}))
+		if got != ".btrfs.age" {
+			t.Errorf("got %q, want .btrfs.age", got)
+		}
+		if got := remoteFileSuffix(cfg.forVolume(&Volume{})); got != ".btrfs" {
+			t.Errorf("got %q, want .btrfs for a volume without a key", got)
+		}
+	})
+}
+
+func TestConfigForVolume(t *testing.T) {
+	t.Parallel()
+
+	cfg := &Config{EncryptionKey: "age-global"}
+
+	if got := cfg.forVolume(&Volume{Name: "root"}); got != cfg || got.EncryptionKey != "age-global" {
+		t.Errorf("expected volume without key to use the global config, got key %q", got.EncryptionKey)
+	}
+
+	got := cfg.forVolume(&Volume{Name: "tenant", EncryptionKey: "age-tenant"})
+	if got.EncryptionKey != "age-tenant" {
+		t.Errorf("expected per-volume key, got %q", got.EncryptionKey)
+	}
+	if cfg.EncryptionKey != "age-global" {
+		t.Errorf("expected global config to be unchanged, got %q", cfg.EncryptionKey)
+	}
+}
+
+func TestListRemoteBackupsPerVolumeEncryption(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	for _, name := range []string{
+		"tenant-2024-01-01_10-00-00.full.btrfs.age",
+		"tenant-2024-01-02_10-00-00.inc.btrfs",
+		"shared-2024-01-01_10-00-00.full.btrfs",
+		"shared-2024-01-02_10-00-00.inc.btrfs.age",
+	} {
+		if err := os.WriteFile(filepath.Join(remoteDir, name), nil, 0o644); err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+	}
+
+	cfg := &Config{RemoteHost: "remote", RemoteDest: remoteDir}
+
+	tenant, err := listRemoteBackups(context.Background(), cfg, &Volume{Name: "tenant", EncryptionKey: "age-tenant"})
+	if err != nil {
+		t.Fatalf("listRemoteBackups tenant: %v", err)
+	}
+	if len(tenant) != 1 || tenant[0].Name != "tenant-2024-01-01_10-00-00.full.btrfs.age" {
+		t.Fatalf("unexpected tenant backups: %+v", tenant)
+	}
+
+	shared, err := listRemoteBackups(context.Background(), cfg, &Volume{Name: "shared"})
+	if err != nil {
+		t.Fatalf("listRemoteBackups shared: %v", err)
+	}
+	if len(shared) != 1 || shared[0].Name != "shared-2024-01-01_10-00-00.full.btrfs" {
+		t.Fatalf("unexpected shared backups: %+v", shared)
+	}
 }
 
 func TestExtractSnapshotTimestamp(t *testing.T) {
@@ -158,6 +331,50 @@ func TestExtractSnapshotTimestamp(t *testing.T) {
 	}
 }
 
+func TestSnapshotTimestampAcrossDST(t *testing.T) {
+	setupTestEnv(t)
+
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatalf("loading zone: %v", err)
+	}
+	snapshotLocation = london
+	t.Cleanup(func() { snapshotLocation = time.UTC })
+
+	// Clocks went forward from 01:00 GMT to 02:00 BST on 2024-03-31.
+	before := time.Date(2024, 3, 31, 0, 30, 0, 0, time.UTC)
+	after := before.Add(time.Hour)
+
+	snapDir := t.TempDir()
+	var names []string
+	for _, currentTime := range []time.Time{before, after} {
+		snap, err := createSnapshot(context.Background(), "/@", snapDir, "btrfs-backup-", currentTime.In(snapshotLocation))
+		if err != nil {
+			t.Fatalf("createSnapshot: %v", err)
+		}
+		names = append(names, filepath.Base(snap))
+	}
+	want := []string{"btrfs-backup-2024-03-31_00-30-00", "btrfs-backup-2024-03-31_02-30-00"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("expected names %v, got %v", want, names)
+	}
+
+	var parsed []time.Time
+	for _, name := range names {
+		ts, err := extractSnapshotTimestamp(name)
+		if err != nil {
+			t.Fatalf("extractSnapshotTimestamp(%s): %v", name, err)
+		}
+		parsed = append(parsed, ts)
+	}
+	if !parsed[0].Equal(before) || !parsed[1].Equal(after) {
+		t.Errorf("expected %v and %v, got %v and %v", before, after, parsed[0], parsed[1])
+	}
+	if gap := parsed[1].Sub(parsed[0]); gap != time.Hour {
+		t.Errorf("expected the snapshots an hour apart, got %s", gap)
+	}
+}
+
 func TestRemoteBackupForTimestamp(t *testing.T) {
 	t.Parallel()
 
@@ -181,6 +398,107 @@ func TestRemoteBackupForTimestamp(t *testing.T) {
 	}
 }
 
+func TestSelectParent(t *testing.T) {
+	t.Parallel()
+
+	backups := []remoteBackup{
+		{Name: "vol-2024-05-10_10-00-00.full.btrfs", Timestamp: time.Date(2024, 5, 10, 10, 0, 0, 0, time.UTC), Kind: "full"},
+		{Name: "vol-2024-05-11_10-00-00.inc.btrfs", Timestamp: time.Date(2024, 5, 11, 10, 0, 0, 0, time.UTC), Kind: "inc"},
+	}
+
+	tests := []struct {
+		name    string
+		backups []remoteBackup
+		snaps   []string
+		want    string
+	}{
+		{
+			name:    "matches latest remote",
+			backups: backups,
+			snaps:   []string{"/snaps/btrfs-backup-2024-05-10_10-00-00", "/snaps/btrfs-backup-2024-05-11_10-00-00"},
+			want:    "/snaps/btrfs-backup-2024-05-11_10-00-00",
+		},
+		{
+			// The newest local snapshot never made it to the remote.
+			name:    "ignores newer local snapshot",
+			backups: backups,
+			snaps:   []string{"/snaps/btrfs-backup-2024-05-11_10-00-00", "/snaps/btrfs-backup-2024-05-12_10-00-00"},
+			want:    "/snaps/btrfs-backup-2024-05-11_10-00-00",
+		},
+		{
+			name:    "latest remote has no local snapshot",
+			backups: backups,
+			snaps:   []string{"/snaps/btrfs-backup-2024-05-10_10-00-00"},
+			want:    "",
+		},
+		{
+			name:  "no remote backups",
+			snaps: []string{"/snaps/btrfs-backup-2024-05-11_10-00-00"},
+			want:  "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := selectParent(tt.backups, tt.snaps); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloneSources(t *testing.T) {
+	t.Parallel()
+
+	at := func(day int) time.Time { return time.Date(2024, 5, day, 10, 0, 0, 0, time.UTC) }
+	snap := func(day int) string { return "/snaps/btrfs-backup-" + at(day).Format(snapshotTimestampFormat) }
+	backups := []remoteBackup{
+		{Name: "vol-2024-05-09_10-00-00.full.btrfs", Timestamp: at(9), Kind: "full"},
+		{Name: "vol-2024-05-10_10-00-00.full.btrfs", Timestamp: at(10), Kind: "full"},
+		{Name: "vol-2024-05-11_10-00-00.inc.btrfs", Timestamp: at(11), Kind: "inc"},
+		{Name: "vol-2024-05-13_10-00-00.inc.btrfs", Timestamp: at(13), Kind: "inc"},
+	}
+	// The 9th is from an older chain and the 12th never reached the remote.
+	snaps := []string{snap(9), snap(10), snap(11), snap(12), snap(13)}
+
+	expected := []string{snap(10), snap(11)}
+	if got := cloneSources(backups, snaps, snap(13)); !slices.Equal(got, expected) {
+		t.Errorf("expected clone sources %v, got %v", expected, got)
+	}
+	if got := cloneSources(backups, snaps, ""); got != nil {
+		t.Errorf("expected no clone sources without a parent, got %v", got)
+	}
+	if got := cloneSources(backups[2:], snaps, snap(13)); got != nil {
+		t.Errorf("expected no clone sources without a full, got %v", got)
+	}
+}
+
+func TestSendArgs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		parent string
+		clones []string
+		full   bool
+		want   []string
+	}{
+		{"full", "", nil, true, []string{"send", "/snaps/new"}},
+		{"full ignores clones", "/snaps/old", []string{"/snaps/older"}, true, []string{"send", "/snaps/new"}},
+		{"incremental", "/snaps/old", nil, false, []string{"send", "-p", "/snaps/old", "/snaps/new"}},
+		{
+			"incremental with clones", "/snaps/old", []string{"/snaps/a", "/snaps/b"}, false,
+			[]string{"send", "-p", "/snaps/old", "-c", "/snaps/a", "-c", "/snaps/b", "/snaps/new"},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := sendArgs("/snaps/new", tt.parent, tt.clones, tt.full); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
 func TestLatestRemoteFull(t *testing.T) {
 	t.Parallel()
 
@@ -309,7 +627,7 @@ func TestNeedsFullBackup(t *testing.T) {
 	t.Run("no old snapshot", func(t *testing.T) {
 		cfg := &Config{}
 		vol := &Volume{Name: "vol"}
-		if !needsFullBackup(context.Background(), cfg, vol, "", time.Now()) {
+		if !needsFullBackup(cfg, vol, nil, "", time.Now()) {
 			t.Error("expected full backup when no old snapshot")
 		}
 	})
@@ -323,7 +641,7 @@ func TestNeedsFullBackup(t *testing.T) {
 		vol := &Volume{Name: "vol"}
 		oldSnap := "/snapshots/btrfs-backup-2024-05-10_10-00-00"
 
-		if !needsFullBackup(context.Background(), cfg, vol, oldSnap, time.Now()) {
+		if !needsFullBackup(cfg, vol, remoteListing(t, cfg, vol), oldSnap, time.Now()) {
 			t.Error("expected full backup when no remote backups")
 		}
 	})
@@ -342,7 +660,7 @@ func TestNeedsFullBackup(t *testing.T) {
 
 		oldSnap := "/snapshots/btrfs-backup-2024-05-10_10-00-00"
 
-		if !needsFullBackup(context.Background(), cfg, vol, oldSnap, time.Now()) {
+		if !needsFullBackup(cfg, vol, remoteListing(t, cfg, vol), oldSnap, time.Now()) {
 			t.Error("expected full backup when remote missing backup matching old snapshot timestamp")
 		}
 	})
@@ -361,7 +679,7 @@ func TestNeedsFullBackup(t *testing.T) {
 
 		oldSnap := "/snapshots/btrfs-backup-2024-05-10_10-00-00"
 
-		if !needsFullBackup(context.Background(), cfg, vol, oldSnap, time.Now()) {
+		if !needsFullBackup(cfg, vol, remoteListing(t, cfg, vol), oldSnap, time.Now()) {
 			t.Error("expected full backup when remote has only incrementals, no full backup")
 		}
 	})
@@ -371,9 +689,8 @@ func TestNeedsFullBackup(t *testing.T) {
 		cfg := &Config{
 			RemoteHost: "remote",
 			RemoteDest: remoteDir,
-			MaxAgeDays: 7,
 		}
-		vol := &Volume{Name: "vol"}
+		vol := &Volume{Name: "vol", MaxAgeDays: 7}
 
 		oldTime := time.Now().Add(-8 * 24 * time.Hour)
 		oldFileName := fmt.Sprintf("vol-%s.full.btrfs", oldTime.Format("2006-01-02_15-04-05"))
@@ -383,7 +700,7 @@ func TestNeedsFullBackup(t *testing.T) {
 
 		oldSnap := fmt.Sprintf("/snapshots/btrfs-backup-%s", oldTime.Format("2006-01-02_15-04-05"))
 
-		if !needsFullBackup(context.Background(), cfg, vol, oldSnap, time.Now()) {
+		if !needsFullBackup(cfg, vol, remoteListing(t, cfg, vol), oldSnap, time.Now()) {
 			t.Error("expected full backup when last full too old")
 		}
 	})
@@ -391,11 +708,10 @@ func TestNeedsFullBackup(t *testing.T) {
 	t.Run("too many incrementals", func(t *testing.T) {
 		_, remoteDir := setupTestEnv(t)
 		cfg := &Config{
-			RemoteHost:      "remote",
-			RemoteDest:      remoteDir,
-			MaxIncrementals: 2,
+			RemoteHost: "remote",
+			RemoteDest: remoteDir,
 		}
-		vol := &Volume{Name: "vol"}
+		vol := &Volume{Name: "vol", MaxIncrementals: 2}
 
 		baseTime := time.Now().Add(-24 * time.Hour)
 		fullName := fmt.Sprintf("vol-%s.full.btrfs", baseTime.Format("2006-01-02_15-04-05"))
@@ -414,7 +730,7 @@ func TestNeedsFullBackup(t *testing.T) {
 		lastIncTime := baseTime.Add(3 * time.Hour)
 		oldSnap := fmt.Sprintf("/snapshots/btrfs-backup-%s", lastIncTime.Format("2006-01-02_15-04-05"))
 
-		if !needsFullBackup(context.Background(), cfg, vol, oldSnap, time.Now()) {
+		if !needsFullBackup(cfg, vol, remoteListing(t, cfg, vol), oldSnap, time.Now()) {
 			t.Error("expected full backup when too many incrementals")
 		}
 	})
@@ -422,12 +738,10 @@ func TestNeedsFullBackup(t *testing.T) {
 	t.Run("incremental is ok", func(t *testing.T) {
 		_, remoteDir := setupTestEnv(t)
 		cfg := &Config{
-			RemoteHost:      "remote",
-			RemoteDest:      remoteDir,
-			MaxAgeDays:      7,
-			MaxIncrementals: 5,
+			RemoteHost: "remote",
+			RemoteDest: remoteDir,
 		}
-		vol := &Volume{Name: "vol"}
+		vol := &Volume{Name: "vol", MaxAgeDays: 7, MaxIncrementals: 5}
 
 		baseTime := time.Now().Add(-2 * 24 * time.Hour)
 		fullName := fmt.Sprintf("vol-%s.full.btrfs", baseTime.Format("2006-01-02_15-04-05"))
@@ -443,12 +757,153 @@ func TestNeedsFullBackup(t *testing.T) {
 
 		oldSnap := fmt.Sprintf("/snapshots/btrfs-backup-%s", incTime.Format("2006-01-02_15-04-05"))
 
-		if needsFullBackup(context.Background(), cfg, vol, oldSnap, time.Now()) {
+		if needsFullBackup(cfg, vol, remoteListing(t, cfg, vol), oldSnap, time.Now()) {
 			t.Error("expected incremental backup to be ok")
 		}
 	})
 }
 
+func TestNeedsFullBackupWeekday(t *testing.T) {
+	tests := []struct {
+		name     string
+		timezone string
+		full     string
+		inc      string
+		now      time.Time
+		want     bool
+	}{
+		{
+			name: "full before this Sunday",
+			full: "2024-05-11_10-00-00", inc: "2024-05-11_22-00-00",
+			now:  time.Date(2024, 5, 12, 10, 0, 0, 0, time.UTC),
+			want: true,
+		},
+		{
+			name: "full already taken today",
+			full: "2024-05-12_02-00-00", inc: "2024-05-12_06-00-00",
+			now:  time.Date(2024, 5, 12, 10, 0, 0, 0, time.UTC),
+			want: false,
+		},
+		{
+			name: "full since last Sunday",
+			full: "2024-05-12_02-00-00", inc: "2024-05-17_02-00-00",
+			now:  time.Date(2024, 5, 18, 23, 59, 59, 0, time.UTC),
+			want: false,
+		},
+		{
+			name: "Sunday's run was missed",
+			full: "2024-05-11_10-00-00", inc: "2024-05-11_22-00-00",
+			now:  time.Date(2024, 5, 13, 1, 0, 0, 0, time.UTC),
+			want: true,
+		},
+		{
+			name:     "still Saturday in the configured timezone",
+			timezone: "America/New_York",
+			full:     "2024-05-11_10-00-00", inc: "2024-05-11_22-00-00",
+			now:  time.Date(2024, 5, 12, 3, 0, 0, 0, time.UTC),
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{FullOnWeekday: "Sunday", Timezone: tt.timezone}
+			vol := &Volume{Name: "vol"}
+			backups := makeBackups(t, "vol-"+tt.full+".full.btrfs", "vol-"+tt.inc+".inc.btrfs")
+			oldSnap := "/snapshots/btrfs-backup-" + tt.inc
+
+			if got := needsFullBackup(cfg, vol, backups, oldSnap, tt.now); got != tt.want {
+				t.Errorf("expected needsFullBackup=%v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNeedsFullBackupPerVolumeRetention(t *testing.T) {
+	writeChain := func(t *testing.T, remoteDir string, fullTime time.Time, incs int) string {
+		t.Helper()
+		fullName := fmt.Sprintf("vol-%s.full.btrfs", fullTime.Format("2006-01-02_15-04-05"))
+		if err := os.WriteFile(filepath.Join(remoteDir, fullName), []byte("data"), 0o644); err != nil {
+			t.Fatalf("creating test file: %v", err)
+		}
+
+		last := fullTime
+		for i := 1; i <= incs; i++ {
+			last = fullTime.Add(time.Duration(i) * time.Hour)
+			incName := fmt.Sprintf("vol-%s.inc.btrfs", last.Format("2006-01-02_15-04-05"))
+			if err := os.WriteFile(filepath.Join(remoteDir, incName), []byte("data"), 0o644); err != nil {
+				t.Fatalf("creating test file: %v", err)
+			}
+		}
+
+		return fmt.Sprintf("/snapshots/btrfs-backup-%s", last.Format("2006-01-02_15-04-05"))
+	}
+
+	t.Run("volume max age overrides global", func(t *testing.T) {
+		_, remoteDir := setupTestEnv(t)
+		cfg := &Config{
+			RemoteHost: "remote",
+			RemoteDest: remoteDir,
+			MaxAgeDays: 30,
+		}
+		vol := &Volume{Name: "vol", MaxAgeDays: 7}
+		oldSnap := writeChain(t, remoteDir, time.Now().Add(-10*24*time.Hour), 1)
+
+		if !needsFullBackup(cfg, vol, remoteListing(t, cfg, vol), oldSnap, time.Now()) {
+			t.Error("expected full backup when volume max age exceeded")
+		}
+	})
+
+	t.Run("volume max incrementals overrides global", func(t *testing.T) {
+		_, remoteDir := setupTestEnv(t)
+		cfg := &Config{
+			RemoteHost:      "remote",
+			RemoteDest:      remoteDir,
+			MaxIncrementals: 2,
+		}
+		vol := &Volume{Name: "vol", MaxIncrementals: 10}
+		oldSnap := writeChain(t, remoteDir, time.Now().Add(-24*time.Hour), 3)
+
+		if needsFullBackup(cfg, vol, remoteListing(t, cfg, vol), oldSnap, time.Now()) {
+			t.Error("expected incremental when volume allows more incrementals than global")
+		}
+	})
+
+	t.Run("falls back to global when volume unset", func(t *testing.T) {
+		_, remoteDir := setupTestEnv(t)
+		configPath := filepath.Join(t.TempDir(), "config.yaml")
+		configContent := fmt.Sprintf("remote_host: remote\nremote_dest: %s\nmax_age_days: 7\nvolumes:\n  - name: vol\n    src: /@\n    snapdir: /snapshots\n", remoteDir)
+		if err := os.WriteFile(configPath, []byte(configContent), 0o644); err != nil {
+			t.Fatalf("failed to write config file: %v", err)
+		}
+		// loadConfig fills the volume's unset limits from the global ones.
+		cfg, err := loadConfig(configPath)
+		if err != nil {
+			t.Fatalf("loadConfig: %v", err)
+		}
+		vol := &cfg.Volumes[0]
+		oldSnap := writeChain(t, remoteDir, time.Now().Add(-10*24*time.Hour), 1)
+
+		if !needsFullBackup(cfg, vol, remoteListing(t, cfg, vol), oldSnap, time.Now()) {
+			t.Error("expected full backup from global max age")
+		}
+	})
+
+	t.Run("both unset disables limits", func(t *testing.T) {
+		_, remoteDir := setupTestEnv(t)
+		cfg := &Config{
+			RemoteHost: "remote",
+			RemoteDest: remoteDir,
+		}
+		vol := &Volume{Name: "vol"}
+		oldSnap := writeChain(t, remoteDir, time.Now().Add(-100*24*time.Hour), 20)
+
+		if needsFullBackup(cfg, vol, remoteListing(t, cfg, vol), oldSnap, time.Now()) {
+			t.Error("expected incremental when no limits configured")
+		}
+	})
+}
+
 func TestSnapshotTimestampRegexp(t *testing.T) {
 	t.Parallel()
 
@@ -522,3 +977,236 @@ func TestCheckBtrfsAccessError(t *testing.T) {
 		t.Fatal("expected error from checkBtrfsAccess")
 	}
 }
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"1500", 1500, false},
+		{"512K", 512 * 1024, false},
+		{"10M", 10 * 1024 * 1024, false},
+		{"2g", 2 * 1024 * 1024 * 1024, false},
+		{"100B", 100, false},
+		{"1KB", 1024, false},
+		{"10MB", 10 * 1024 * 1024, false},
+		{"10 MiB", 10 * 1024 * 1024, false},
+		{"2gb", 2 * 1024 * 1024 * 1024, false},
+		{"3TiB", 3 << 40, false},
+		{"8T", 8 << 40, false},
+		{"fast", 0, true},
+		{"-5M", 0, true},
+		{"10i", 0, true},
+		{"10XB", 0, true},
+		{"10MBB", 0, true},
+		{"9223372036854775807K", 0, true},
+		{"8388608T", 0, true},
+		{"99999999999999999999", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseByteSize(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error for %q", tt.input)
+				}
+				if !strings.Contains(err.Error(), fmt.Sprintf("%q", tt.input)) {
+					t.Fatalf("expected the error to name %q, got %v", tt.input, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	calls := 0
+	err := withRetry(context.Background(), 3, time.Millisecond, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected success after retries, got %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+
+	calls = 0
+	err = withRetry(context.Background(), 2, time.Millisecond, func() error {
+		calls++
+		return errors.New("permanent")
+	})
+	if err == nil {
+		t.Fatal("expected error once retries are exhausted")
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestWithRetryStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := 0
+	err := withRetry(ctx, 5, time.Hour, func() error {
+		calls++
+		return errors.New("transient")
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("expected a single failed call after cancel, got %d calls, err %v", calls, err)
+	}
+}
+
+func TestRemoteOperationsRetrySSHFailures(t *testing.T) {
+	_, remoteDir := setupTestEnv(t)
+
+	if err := os.WriteFile(filepath.Join(remoteDir, "root-2024-01-01_10-00-00.full.btrfs"), nil, 0o644); err != nil {
+		t.Fatalf("writing backup: %v", err)
+	}
+
+	t.Setenv("SSH_FAIL_FIRST", "2")
+	t.Setenv("SSH_FAIL_COUNTER", filepath.Join(t.TempDir(), "ssh.count"))
+
+	cfg := &Config{RemoteHost: "remote", RemoteDest: remoteDir, Retries: 2, RetryBackoff: time.Millisecond}
+	backups, err := listRemoteBackups(context.Background(), cfg, &Volume{Name: "root"})
+	if err != nil {
+		t.Fatalf("listRemoteBackups: %v", err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("expected 1 backup, got %d", len(backups))
+	}
+
+	t.Setenv("SSH_FAIL_COUNTER", filepath.Join(t.TempDir(), "ssh.count"))
+	cfg.Retries = 1
+	if err := checkRemoteAccess(context.Background(), cfg); err == nil {
+		t.Fatal("expected checkRemoteAccess to fail with too few retries")
+	}
+}
+
+func TestRunRemoteOpTimeout(t *testing.T) {
+	cfg := &Config{OpTimeout: 50 * time.Millisecond}
+
+	start := time.Now()
+	err := runRemoteOp(context.Background(), cfg, "sleep 5", func(cmd *exec.Cmd) error {
+		return cmd.Run()
+	})
+	if err == nil || !strings.Contains(err.Error(), "op_timeout") {
+		t.Fatalf("expected an op_timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Fatalf("expected the command to be killed, took %s", elapsed)
+	}
+
+	// A run that is cancelled itself isn't reported as an op timing out.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	cfg.OpTimeout = time.Hour
+	err = runRemoteOp(ctx, cfg, "sleep 5", func(cmd *exec.Cmd) error {
+		return cmd.Run()
+	})
+	if err == nil || strings.Contains(err.Error(), "op_timeout") {
+		t.Fatalf("expected the run's cancellation, got %v", err)
+	}
+}
+
+func TestCheckBinaries(t *testing.T) {
+	binDir, _ := setupTestEnv(t)
+	t.Cleanup(func() { btrfsBin, sshBin, ageBin = "btrfs", "ssh", "age" })
+
+	cfg := &Config{
+		RemoteHost:        "remote",
+		Backend:           "ssh",
+		EncryptionBackend: "age",
+		Volumes:           []Volume{{Name: "root"}, {Name: "home", EncryptionKey: "age1..."}},
+	}
+
+	btrfsBin = filepath.Join(binDir, "btrfs")
+	sshBin = "ssh"
+	ageBin = "/nonexistent/age"
+
+	err := checkBinaries(cfg)
+	if err == nil || !strings.Contains(err.Error(), "age_bin") {
+		t.Fatalf("expected a missing age_bin error, got %v", err)
+	}
+	if strings.Contains(err.Error(), "btrfs_bin") || strings.Contains(err.Error(), "ssh_bin") {
+		t.Fatalf("expected btrfs and ssh to be found, got %v", err)
+	}
+
+	if !strings.Contains(err.Error(), `age_bin: "/nonexistent/age" not found`) {
+		t.Fatalf("expected the missing command to be named, got %v", err)
+	}
+
+	// Without encryption age is never run, so its absence doesn't matter.
+	cfg.Volumes[1].EncryptionKey = ""
+	if err := checkBinaries(cfg); err != nil {
+		t.Fatalf("expected no error without encryption, got %v", err)
+	}
+
+	// Commands that aren't configurable are looked up on $PATH too.
+	t.Setenv("PATH", t.TempDir())
+	cfg.Compression = "zstd"
+	cfg.Transport = "rsync"
+	cfg.EncryptionBackend = "gpg"
+	cfg.Volumes[1].EncryptionKey = "ABCDEF"
+	err = checkBinaries(cfg)
+	for _, want := range []string{`"gpg" not found in $PATH`, `"rsync" not found in $PATH`, `"zstd" not found in $PATH`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %s, got %v", want, err)
+		}
+	}
+}
+
+func TestSplitRemoteHost(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input  string
+		user   string
+		host   string
+		port   int
+		target string
+		err    bool
+	}{
+		{"host", "", "host", 0, "host:/data", false},
+		{"user@host", "user", "host", 0, "user@host:/data", false},
+		{"user@host:2222", "user", "host", 2222, "user@host:/data", false},
+		{"fd00::1", "", "fd00::1", 0, "[fd00::1]:/data", false},
+		{"user@fd00::1", "user", "fd00::1", 0, "user@[fd00::1]:/data", false},
+		{"user@[fd00::1]", "user", "fd00::1", 0, "user@[fd00::1]:/data", false},
+		{"[fd00::1]:2222", "", "fd00::1", 2222, "[fd00::1]:/data", false},
+		{"user@[fd00::1", "", "", 0, "", true},
+		{"user@[fd00::1]2222", "", "", 0, "", true},
+		{"host:ssh", "", "", 0, "", true},
+		{"user@", "", "", 0, "", true},
+	}
+
+	for _, tt := range tests {
+		user, host, port, err := splitRemoteHost(tt.input)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.input)
+			}
+			continue
+		}
+		if err != nil || user != tt.user || host != tt.host || port != tt.port {
+			t.Errorf("%s: got %q %q %d %v", tt.input, user, host, port, err)
+		}
+		if got := remoteTarget(&Config{RemoteHost: tt.input}, "/data"); got != tt.target {
+			t.Errorf("%s: expected target %s, got %s", tt.input, tt.target, got)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Build details, recorded in backup manifests and printed by -version.
+// Release builds set them with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...".
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// versionString describes the build. Without -ldflags the commit comes from
+// the VCS details go build records when run in a checkout.
+func versionString() string {
+	rev := commit
+	if rev == "" {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, s := range info.Settings {
+				if s.Key == "vcs.revision" {
+					rev = s.Value
+				}
+			}
+		}
+	}
+	if len(rev) > 12 {
+		rev = rev[:12]
+	}
+	if rev == "" {
+		rev = "unknown"
+	}
+
+	date := buildDate
+	if date == "" {
+		date = "unknown"
+	}
+
+	return fmt.Sprintf("btrfs-backup %s (commit %s, built %s)", version, rev, date)
+}
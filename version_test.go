@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestVersionString(t *testing.T) {
+	t.Cleanup(func() { version, commit, buildDate = "dev", "", "" })
+
+	version, commit, buildDate = "1.4.0", "0123456789abcdef0123", "2024-05-12T11:30:45Z"
+	if got, want := versionString(), "btrfs-backup 1.4.0 (commit 0123456789ab, built 2024-05-12T11:30:45Z)"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	// Test binaries carry no VCS details to fall back on.
+	version, commit, buildDate = "dev", "", ""
+	if got, want := versionString(), "btrfs-backup dev (commit unknown, built unknown)"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
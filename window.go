@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// timeWindow limits list and prune to the backups taken in [since, until).
+// Either end may be zero to leave that side open. The end is exclusive so
+// consecutive windows don't overlap.
+type timeWindow struct {
+	since time.Time
+	until time.Time
+}
+
+// parseTimeWindow parses the --since and --until flags, either of which may
+// be empty.
+func parseTimeWindow(since, until string) (timeWindow, error) {
+	var w timeWindow
+	var err error
+	if since != "" {
+		if w.since, err = parseWindowTime(since); err != nil {
+			return timeWindow{}, fmt.Errorf("invalid --since: %w", err)
+		}
+	}
+	if until != "" {
+		if w.until, err = parseWindowTime(until); err != nil {
+			return timeWindow{}, fmt.Errorf("invalid --until: %w", err)
+		}
+	}
+	if !w.since.IsZero() && !w.until.IsZero() && !w.until.After(w.since) {
+		return timeWindow{}, fmt.Errorf("--until %s is not after --since %s", until, since)
+	}
+	return w, nil
+}
+
+// parseWindowTime accepts RFC3339 or a snapshot timestamp, the latter read in
+// the configured timezone like the names it is copied from.
+func parseWindowTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(snapshotTimestampFormat, s, snapshotLocation)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither RFC3339 nor %s", s, snapshotTimestampFormat)
+	}
+	return t, nil
+}
+
+func (w timeWindow) contains(t time.Time) bool {
+	if !w.since.IsZero() && t.Before(w.since) {
+		return false
+	}
+	if !w.until.IsZero() && !t.Before(w.until) {
+		return false
+	}
+	return true
+}
+
+func (w timeWindow) isZero() bool {
+	return w.since.IsZero() && w.until.IsZero()
+}
+
+// filterBackups returns the backups taken inside w.
+func filterBackups(backups []remoteBackup, w timeWindow) []remoteBackup {
+	if w.isZero() {
+		return backups
+	}
+
+	var filtered []remoteBackup
+	for _, b := range backups {
+		if w.contains(b.Timestamp) {
+			filtered = append(filtered, b)
+		}
+	}
+	return filtered
+}
+
+// windowDeletions narrows toDelete, chosen from backups sorted oldest first,
+// to the backups inside w. A backup is still kept when a later one in its
+// chain is, since that one needs it to restore; a chain may only lose its
+// tail.
+func windowDeletions(backups, toDelete []remoteBackup, w timeWindow) []remoteBackup {
+	candidate := map[string]bool{}
+	for _, b := range toDelete {
+		if w.contains(b.Timestamp) {
+			candidate[b.Name] = true
+		}
+	}
+
+	deleted := map[string]bool{}
+	chainKept := false
+	for i := len(backups) - 1; i >= 0; i-- {
+		b := backups[i]
+		if candidate[b.Name] && !chainKept {
+			deleted[b.Name] = true
+		} else {
+			chainKept = true
+		}
+		// Walking newest first, a full is where its chain starts.
+		if b.Kind == "full" {
+			chainKept = false
+		}
+	}
+
+	var narrowed []remoteBackup
+	for _, b := range toDelete {
+		if deleted[b.Name] {
+			narrowed = append(narrowed, b)
+		}
+	}
+	return narrowed
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeWindow(t *testing.T) {
+	tests := []struct {
+		name         string
+		since, until string
+		want         timeWindow
+		wantErr      bool
+	}{
+		{name: "open", want: timeWindow{}},
+		{
+			name:  "snapshot format",
+			since: "2024-05-01_00-00-00",
+			want:  timeWindow{since: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:  "rfc3339 with offset",
+			until: "2024-05-01T02:00:00+02:00",
+			want:  timeWindow{until: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{name: "garbage", since: "yesterday", wantErr: true},
+		{name: "until before since", since: "2024-05-02_00-00-00", until: "2024-05-01_00-00-00", wantErr: true},
+		{name: "empty window", since: "2024-05-01_00-00-00", until: "2024-05-01_00-00-00", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTimeWindow(tt.since, tt.until)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTimeWindow: %v", err)
+			}
+			if !got.since.Equal(tt.want.since) || !got.until.Equal(tt.want.until) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFilterBackupsBoundaries(t *testing.T) {
+	t.Parallel()
+
+	backups := makeBackups(t,
+		"root-2024-05-01_00-00-00.full.btrfs",
+		"root-2024-05-02_00-00-00.inc.btrfs",
+		"root-2024-05-03_00-00-00.inc.btrfs",
+	)
+	day := func(d int) time.Time { return time.Date(2024, 5, d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name   string
+		window timeWindow
+		want   []string
+	}{
+		{"open", timeWindow{}, backupNames(backups)},
+		{"since is inclusive", timeWindow{since: day(2)}, backupNames(backups[1:])},
+		{"until is exclusive", timeWindow{until: day(2)}, backupNames(backups[:1])},
+		{"both", timeWindow{since: day(2), until: day(3)}, backupNames(backups[1:2])},
+		{"nothing inside", timeWindow{since: day(4)}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertNames(t, filterBackups(backups, tt.window), tt.want)
+		})
+	}
+}
+
+func TestWindowDeletionsKeepsChainsWhole(t *testing.T) {
+	t.Parallel()
+
+	backups := makeBackups(t,
+		"root-2024-05-01_00-00-00.full.btrfs",
+		"root-2024-05-02_00-00-00.inc.btrfs",
+		"root-2024-05-03_00-00-00.inc.btrfs",
+		"root-2024-05-04_00-00-00.full.btrfs",
+		"root-2024-05-05_00-00-00.inc.btrfs",
+		"root-2024-05-06_00-00-00.full.btrfs",
+	)
+	// Retention would drop the first two chains.
+	toDelete := backups[:5]
+	day := func(d int) time.Time { return time.Date(2024, 5, d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name   string
+		window timeWindow
+		want   []string
+	}{
+		{"open", timeWindow{}, backupNames(toDelete)},
+		{
+			// The full and first incremental are needed by the one left.
+			"window misses the end of a chain",
+			timeWindow{until: day(3)},
+			nil,
+		},
+		{
+			"window covers the end of a chain",
+			timeWindow{since: day(2), until: day(4)},
+			backupNames(backups[1:3]),
+		},
+		{
+			"window covers a whole chain",
+			timeWindow{since: day(4)},
+			backupNames(backups[3:5]),
+		},
+		{
+			"window misses the start of a chain",
+			timeWindow{since: day(5)},
+			backupNames(backups[4:5]),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertNames(t, windowDeletions(backups, toDelete, tt.window), tt.want)
+		})
+	}
+}